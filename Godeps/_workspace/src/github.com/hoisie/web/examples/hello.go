@@ -1,12 +0,0 @@
-package main
-
-import (
-	"chargepoints/Godeps/_workspace/src/github.com/hoisie/web"
-)
-
-func hello(val string) string { return "hello " + val }
-
-func main() {
-	web.Get("/(.*)", hello)
-	web.Run("0.0.0.0:9999")
-}
@@ -0,0 +1,135 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"fmt"
+	"time"
+)
+
+//
+// AuditLog
+//
+
+// Configures an audit trail for a Client. When set on Client.Audit every key
+// value write made through the client (Create, Update, Delete, Purge and the
+// Item variants) also records an AuditRecord as an event in the audit
+// collection. The event key is the key of the written item and the event
+// type is the name of the collection it lives in.
+type AuditLog struct {
+	// The collection that audit events are written into.
+	Collection string
+
+	// Identifies who is making the writes, for example a user name or the
+	// name of an import job.
+	Actor string
+}
+
+// A single write recorded by an AuditLog.
+type AuditRecord struct {
+	// The collection and key that was written.
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+
+	// The kind of write, one of "create", "update", "delete" or "purge".
+	Operation string `json:"operation"`
+
+	// The Actor configured on the AuditLog when the write was made.
+	Actor string `json:"actor"`
+
+	// The time the write completed.
+	Time time.Time `json:"time"`
+
+	// The ref that was replaced by this write. This is only known for
+	// conditional writes, and is empty otherwise. The previous record in the
+	// history can be used to find it in that case.
+	OldRef string `json:"old_ref,omitempty"`
+
+	// The ref created by this write. Empty for deletes.
+	NewRef string `json:"new_ref,omitempty"`
+}
+
+// Returned from a write when the write itself succeeded but recording the
+// audit event failed.
+type AuditFailedError struct {
+	// The record that could not be written.
+	Record *AuditRecord
+
+	// The error returned while writing the audit event.
+	Err error
+}
+
+func (e *AuditFailedError) Error() string {
+	return fmt.Sprintf("Write to %s/%s succeeded but auditing failed: %s",
+		e.Record.Collection, e.Record.Key, e.Err)
+}
+
+// Returns the audit history of the given key in the given collection,
+// oldest write first. This requires Audit to be set on the Client.
+func (c *Client) AuditHistory(collection, key string) ([]*AuditRecord, error) {
+	if c.Audit == nil {
+		return nil, fmt.Errorf("No AuditLog configured.")
+	}
+
+	// Events are listed newest first so the list is reversed at the end.
+	var records []*AuditRecord
+	it := c.Collection(c.Audit.Collection).ListEvents(key, collection,
+		&ListEventsQuery{Limit: 100})
+	for it.Next() {
+		record := &AuditRecord{}
+		if _, err := it.GetEvent(record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	for l, r := 0, len(records)-1; l < r; l, r = l+1, r-1 {
+		records[l], records[r] = records[r], records[l]
+	}
+	return records, nil
+}
+
+// Records a write against the audit log, if one is configured. The item and
+// error from the write are passed through so this can wrap the return of a
+// write call. If the write failed then nothing is recorded.
+func (c *Collection) audit(
+	op, key, oldRef string, item *Item, err error,
+) (*Item, error) {
+	log := c.client.Audit
+	if err != nil || log == nil {
+		return item, err
+	}
+
+	record := &AuditRecord{
+		Collection: c.Name,
+		Key:        key,
+		Operation:  op,
+		Actor:      log.Actor,
+		Time:       c.client.Now().UTC(),
+		OldRef:     oldRef,
+	}
+	if item != nil {
+		record.NewRef = item.Ref
+	}
+	// Audit records of dry run writes are not written either.
+	audit := c.client.Collection(log.Collection).WithContext(c.context())
+	_, err = audit.AddEventWithTimestamp(key, c.Name, record.Time, record)
+	if err != nil {
+		return item, &AuditFailedError{Record: record, Err: err}
+	}
+	return item, nil
+}
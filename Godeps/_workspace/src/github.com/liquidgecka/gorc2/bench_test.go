@@ -0,0 +1,229 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a Client sending its requests to a test server running handler,
+// which is closed when the test ends.
+func testClient(tb testing.TB, handler http.Handler) *Client {
+	server := httptest.NewServer(handler)
+	tb.Cleanup(server.Close)
+	c := NewClient("test")
+	c.APIHost = strings.TrimPrefix(server.URL, "http://")
+	c.HTTPClient = server.Client()
+	return c
+}
+
+// Reports the 99th percentile of the durations of the operations of a
+// benchmark.
+func reportP99(b *testing.B, durations []time.Duration) {
+	if len(durations) == 0 {
+		return
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	p99 := durations[len(durations)*99/100]
+	b.ReportMetric(float64(p99.Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkDoRequest(b *testing.B) {
+	c := testClient(b, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"Manchester Piccadilly Station"}`))
+		}))
+	ctx := context.Background()
+	for _, method := range []string{"GET", "PUT"} {
+		b.Run(method, func(b *testing.B) {
+			var body string
+			if method == "PUT" {
+				body = `{"name":"Manchester Piccadilly Station"}`
+			}
+			durations := make([]time.Duration, 0, b.N)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				resp, err := c.doRequest(ctx, method, "bench/key", nil,
+					strings.NewReader(body))
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				durations = append(durations, time.Since(start))
+			}
+			b.StopTimer()
+			reportP99(b, durations)
+		})
+	}
+}
+
+// Returns a list response of n items as Orchestrate sends it.
+func listPage(n int) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `{"count":%d,"results":[`, n)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `{"path":{"collection":"bench","key":"%04d",`+
+			`"ref":"0123456789abcdef","reftime":1700000000000},`+
+			`"value":{"ChargeDeviceName":"Station %d","Latitude":53.477,`+
+			`"Longitude":-2.2309,"Connector":[{"RatedOutputkW":50}]},`+
+			`"reftime":1700000000000}`, i, i)
+	}
+	sb.WriteString("]}")
+	return []byte(sb.String())
+}
+
+// Decodes pages of list results into values.
+func BenchmarkListDecode(b *testing.B) {
+	for _, n := range []int{10, 100} {
+		b.Run(fmt.Sprintf("page=%d", n), func(b *testing.B) {
+			page := listPage(n)
+			c := testClient(b, http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Write(page)
+				}))
+			b.SetBytes(int64(len(page)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				it := c.Collection("bench").List(&ListQuery{Limit: n})
+				for it.Next() {
+					var value struct {
+						ChargeDeviceName string
+						Latitude         float64
+						Longitude        float64
+					}
+					if _, err := it.Get(&value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if it.Error != nil {
+					b.Fatal(it.Error)
+				}
+			}
+		})
+	}
+}
+
+// Pages through every result of a search of the local backend.
+func BenchmarkSearchPagination(b *testing.B) {
+	c := NewLocalClient().Collection("bench")
+	records := make([]BulkRecord, 1000)
+	for i := range records {
+		records[i] = BulkRecord{Key: fmt.Sprintf("%04d", i),
+			Value: map[string]int{"kw": i % 150}}
+	}
+	if _, err := c.BulkUpdate(records, nil); err != nil {
+		b.Fatal(err)
+	}
+	for _, limit := range []int{10, 100} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it := c.Search("value.kw:[50 TO *]",
+					&SearchQuery{Limit: limit})
+				n := 0
+				for it.Next() {
+					n++
+				}
+				if it.Error != nil {
+					b.Fatal(it.Error)
+				} else if n == 0 {
+					b.Fatal("nothing matched")
+				}
+			}
+		})
+	}
+}
+
+// Adds status events to items of the local backend.
+func BenchmarkAddEvent(b *testing.B) {
+	c := seededCollection(b, "cp1", "cp2", "cp3", "cp4")
+	keys := []string{"cp1", "cp2", "cp3", "cp4"}
+	durations := make([]time.Duration, 0, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		_, err := c.AddEvent(keys[i%len(keys)], "status",
+			map[string]string{"status": "occupied"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		durations = append(durations, time.Since(start))
+	}
+	b.StopTimer()
+	reportP99(b, durations)
+}
+
+// Follows the relations from a chargepoint to its operator and on to the
+// operator's chargepoints in the local backend.
+func BenchmarkGetLinks(b *testing.B) {
+	client := NewLocalClient()
+	chargepoints := client.Collection("chargepoints")
+	operators := client.Collection("operators")
+	if _, err := operators.Create("op", map[string]string{}); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprint(i)
+		if _, err := chargepoints.Create(key,
+			map[string]int{"n": i}); err != nil {
+			b.Fatal(err)
+		}
+		if err := chargepoints.Link(key, "operated_by", "operators",
+			"op"); err != nil {
+			b.Fatal(err)
+		}
+		if err := operators.Link("op", "operates", "chargepoints",
+			key); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := chargepoints.GetLinks("0", &GetLinksQuery{Limit: 100},
+			"operated_by", "operates")
+		n := 0
+		for it.Next() {
+			n++
+		}
+		if it.Error != nil {
+			b.Fatal(it.Error)
+		} else if n != 200 {
+			b.Fatalf("found %d chargepoints, expected 200", n)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// CircuitBreaker
+//
+
+// The states that a CircuitBreaker can be in.
+type BreakerState int
+
+const (
+	// Requests are sent as normal.
+	BreakerClosed BreakerState = iota
+
+	// Requests fail immediately with a CircuitOpenError.
+	BreakerOpen
+
+	// A single probe request is allowed through to see if Orchestrate has
+	// recovered, all others fail as if the breaker was open.
+	BreakerHalfOpen
+)
+
+// Stops a Client from sending requests while Orchestrate is failing. The
+// breaker counts requests in fixed windows and opens when the share of
+// failures (network errors and 5xx statuses) in a window passes ErrorRate.
+// While open every request fails immediately with a CircuitOpenError. After
+// OpenFor has passed a single probe request is let through; if it succeeds
+// the breaker closes, otherwise it opens again.
+//
+// The zero value is usable and uses the defaults documented on each field.
+// A CircuitBreaker must not be copied after first use.
+type CircuitBreaker struct {
+	// The length of the window that failures are counted over. Defaults to
+	// 10 seconds.
+	Window time.Duration
+
+	// The minimum number of requests in a window before the breaker can
+	// open. Defaults to 20.
+	MinRequests int
+
+	// The fraction of failed requests in a window that opens the breaker.
+	// Defaults to 0.5.
+	ErrorRate float64
+
+	// How long the breaker stays open before a probe is allowed. Defaults
+	// to 30 seconds.
+	OpenFor time.Duration
+
+	// Tells the time windows and OpenFor are measured with. Defaults to
+	// SystemClock, set it to the Client's Clock when that is a FakeClock.
+	Clock Clock
+
+	lock        sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+}
+
+// Returned for requests rejected because the circuit breaker is open.
+type CircuitOpenError string
+
+func (c CircuitOpenError) Error() string {
+	return string(c)
+}
+
+// Returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Returns true if a request sent now would be let through, rather than
+// failing with a CircuitOpenError, without changing the state of the
+// breaker. A nil breaker always allows requests.
+func (b *CircuitBreaker) Allows() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return b.clock().Now().Sub(b.openedAt) >= b.openFor()
+	case BreakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// Returns nil if a request may be sent, or a CircuitOpenError if not. A nil
+// breaker always allows requests.
+func (b *CircuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if b.clock().Now().Sub(b.openedAt) < b.openFor() {
+			break
+		}
+		b.state = BreakerHalfOpen
+		return nil
+	case BreakerHalfOpen:
+		// A probe is already in flight.
+	default:
+		return nil
+	}
+	return CircuitOpenError("Circuit breaker open, Orchestrate is failing.")
+}
+
+// Records the outcome of a request that allow() let through. Only network
+// errors and 5xx statuses are failures, and requests whose context is done
+// are not counted since their failure says nothing about Orchestrate.
+func (b *CircuitBreaker) record(
+	ctx context.Context, resp *http.Response, err error,
+) {
+	if b == nil {
+		return
+	}
+	cancelled := ctx.Err() != nil
+	failed := isNetworkError(err) || err == nil && resp.StatusCode >= 500
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.clock().Now()
+
+	// A cancelled probe decides nothing, the next request probes again.
+	if cancelled {
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerOpen
+		}
+		return
+	}
+
+	// The outcome of a probe decides the state directly.
+	if b.state == BreakerHalfOpen {
+		if failed {
+			b.state = BreakerOpen
+			b.openedAt = now
+		} else {
+			b.state = BreakerClosed
+			b.windowStart = now
+			b.requests, b.failures = 0, 0
+		}
+		return
+	} else if b.state == BreakerOpen {
+		return
+	}
+
+	// Start a new window if the current one has expired.
+	window := b.Window
+	if window == 0 {
+		window = 10 * time.Second
+	}
+	if now.Sub(b.windowStart) >= window {
+		b.windowStart = now
+		b.requests, b.failures = 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	minRequests := b.MinRequests
+	if minRequests == 0 {
+		minRequests = 20
+	}
+	errorRate := b.ErrorRate
+	if errorRate == 0 {
+		errorRate = 0.5
+	}
+	if b.requests >= minRequests &&
+		float64(b.failures)/float64(b.requests) >= errorRate {
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
+
+// Returns Clock or its default.
+func (b *CircuitBreaker) clock() Clock {
+	if b.Clock == nil {
+		return SystemClock
+	}
+	return b.Clock
+}
+
+// Returns OpenFor or its default.
+func (b *CircuitBreaker) openFor() time.Duration {
+	if b.OpenFor == 0 {
+		return 30 * time.Second
+	}
+	return b.OpenFor
+}
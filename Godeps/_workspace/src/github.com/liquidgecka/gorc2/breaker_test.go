@@ -0,0 +1,94 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Returns a client with a breaker that opens once half of at least four
+// requests fail, answering requests with the given status.
+func breakerClient(t *testing.T, status *int) (*Client, *FakeClock) {
+	clock := NewFakeClock(time.Unix(1e9, 0))
+	c := testClient(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(*status)
+		}))
+	c.Breaker = &CircuitBreaker{MinRequests: 4, Clock: clock}
+	return c, clock
+}
+
+func TestBreakerOpensOnServerErrors(t *testing.T) {
+	status := 500
+	c, _ := breakerClient(t, &status)
+	for i := 0; i < 4; i++ {
+		c.Collection("test").Get("key", nil)
+	}
+	if state := c.Breaker.State(); state != BreakerOpen {
+		t.Fatalf("breaker is %d, expected open", state)
+	}
+	_, err := c.Collection("test").Get("key", nil)
+	if _, ok := err.(CircuitOpenError); !ok {
+		t.Fatalf("got %v, expected a CircuitOpenError", err)
+	}
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	for _, s := range []int{404, 412} {
+		status := s
+		c, _ := breakerClient(t, &status)
+		for i := 0; i < 10; i++ {
+			c.Collection("test").Get("key", nil)
+		}
+		if state := c.Breaker.State(); state != BreakerClosed {
+			t.Fatalf("breaker is %d after %ds, expected closed", state, s)
+		}
+	}
+}
+
+func TestBreakerIgnoresCancelledRequests(t *testing.T) {
+	status := 500
+	c, clock := breakerClient(t, &status)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		c.Collection("test").WithContext(ctx).Get("key", nil)
+	}
+	if state := c.Breaker.State(); state != BreakerClosed {
+		t.Fatalf("breaker is %d, expected closed", state)
+	}
+
+	// A cancelled probe leaves the breaker open for the next request to
+	// probe again.
+	for i := 0; i < 4; i++ {
+		c.Collection("test").Get("key", nil)
+	}
+	clock.Advance(time.Minute)
+	c.Collection("test").WithContext(ctx).Get("key", nil)
+	if state := c.Breaker.State(); state != BreakerOpen {
+		t.Fatalf("breaker is %d, expected open", state)
+	}
+	status = 200
+	if _, err := c.Collection("test").Get("key", nil); err == nil {
+		t.Fatal("expected an error decoding the empty reply")
+	}
+	if state := c.Breaker.State(); state != BreakerClosed {
+		t.Fatalf("breaker is %d after a probe succeeded, expected closed",
+			state)
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//
+// BulkUpdate
+//
+
+// A single key and value to be written by BulkUpdate().
+type BulkRecord struct {
+	Key   string
+	Value interface{}
+}
+
+// Provides optional parameters to a call to BulkUpdate().
+type BulkOptions struct {
+	// The number of writes made concurrently. The default if this is not
+	// set is 4, matching the idle connection limit of DefaultTransport.
+	Concurrency int
+
+	// If set then records that fail to write are handed to this sink and
+	// the rest of the batch carries on. If not set then the failures are
+	// returned in a BulkError. Note that failures are only final once the
+	// Client's RetryPolicy, if any, has given up on them.
+	DeadLetter DeadLetter
+}
+
+// Returned from bulk operations such as BulkUpdate() when records failed and
+// there was no DeadLetter configured to take them.
+type BulkError struct {
+	// The failed records along with the error returned for each.
+	Failed []*FailedRecord
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("%d records failed, first error: %s",
+		len(e.Failed), e.Failed[0].Reason)
+}
+
+// Writes all of the records into the collection using Update(), so the
+// collection options such as SkipUnchanged and Encryption apply to each one.
+// The number of records written successfully is returned. Records are
+// written concurrently so the order of writes is not defined.
+func (c *Collection) BulkUpdate(
+	records []BulkRecord, opts *BulkOptions,
+) (int, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	return c.runBulk(records, opts.Concurrency, opts.DeadLetter,
+		func(record BulkRecord) error {
+			_, err := c.Update(record.Key, record.Value)
+			return err
+		})
+}
+
+// Runs op on every record concurrently, with the same options and failure
+// handling as BulkUpdate(), and returns the number of records op succeeded
+// for. This is for bulk writes that need more than an Update() per record,
+// such as conditional writes.
+func (c *Collection) BulkApply(
+	records []BulkRecord, opts *BulkOptions, op func(BulkRecord) error,
+) (int, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	return c.runBulk(records, opts.Concurrency, opts.DeadLetter, op)
+}
+
+// Provides optional parameters to a call to DeleteByQuery().
+type DeleteByQueryOptions struct {
+	// The number of deletes made concurrently. The default if this is not
+	// set is 4.
+	Concurrency int
+
+	// Purge the matching items, removing their history as well. This can
+	// not be undone.
+	Purge bool
+
+	// If greater than zero and more items than this match the query then
+	// nothing is deleted and a TooManyMatchesError is returned. This guards
+	// against a query that is broader than intended.
+	MaxDeletes int
+
+	// Only count the matching items, nothing is deleted.
+	DryRun bool
+}
+
+// Returned from DeleteByQuery() when more items match than the MaxDeletes
+// option allows.
+type TooManyMatchesError struct {
+	Matches    int
+	MaxDeletes int
+}
+
+func (e *TooManyMatchesError) Error() string {
+	return fmt.Sprintf("%d items match the query but at most %d may be "+
+		"deleted.", e.Matches, e.MaxDeletes)
+}
+
+// Deletes every item matching the search query and returns the number of
+// items deleted, or with DryRun set the number that would have been. All of
+// the matching keys are found before anything is deleted so the deletes do
+// not disturb the search paging. Failed deletes are returned in a BulkError.
+// Since search indexing is not immediate, items written very recently may
+// be missed.
+func (c *Collection) DeleteByQuery(
+	query string, opts *DeleteByQueryOptions,
+) (int, error) {
+	if opts == nil {
+		opts = &DeleteByQueryOptions{}
+	}
+	records, err := c.searchKeys(query)
+	if err != nil {
+		return 0, err
+	} else if opts.MaxDeletes > 0 && len(records) > opts.MaxDeletes {
+		return 0, &TooManyMatchesError{
+			Matches:    len(records),
+			MaxDeletes: opts.MaxDeletes,
+		}
+	} else if opts.DryRun {
+		return len(records), nil
+	}
+	return c.runBulk(records, opts.Concurrency, nil,
+		func(record BulkRecord) error {
+			if opts.Purge {
+				return c.Purge(record.Key)
+			}
+			return c.Delete(record.Key)
+		})
+}
+
+// Provides optional parameters to a call to TouchByQuery().
+type TouchByQueryOptions struct {
+	// The number of items rewritten concurrently. The default if this is
+	// not set is 4.
+	Concurrency int
+
+	// The maximum number of items rewritten per second, across all of the
+	// workers. Each item costs a GET and a PUT. Zero means no limit.
+	PerSecond int
+}
+
+// Rewrites every item matching the search query with its current value so
+// Orchestrate indexes it again, for example after a change to how fields
+// are mapped for search. Each item is read and then written back with a
+// conditional PUT, so an item that changes in between is left alone since
+// that write reindexed it anyway. The number of items rewritten is returned.
+// Failed rewrites are returned in a BulkError.
+func (c *Collection) TouchByQuery(
+	query string, opts *TouchByQueryOptions,
+) (int, error) {
+	if opts == nil {
+		opts = &TouchByQueryOptions{}
+	}
+	records, err := c.searchKeys(query)
+	if err != nil {
+		return 0, err
+	}
+
+	var throttle <-chan time.Time
+	if opts.PerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.PerSecond))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	return c.runBulk(records, opts.Concurrency, nil,
+		func(record BulkRecord) error {
+			if throttle != nil {
+				<-throttle
+			}
+			item, err := c.Get(record.Key, nil)
+			if _, ok := err.(NotFoundError); ok {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			_, err = item.Update(item.Value)
+			if _, ok := err.(NotMostRecentError); ok {
+				return nil
+			}
+			return err
+		})
+}
+
+// Returns a record for every item matching the search query, without
+// values.
+func (c *Collection) searchKeys(query string) ([]BulkRecord, error) {
+	var records []BulkRecord
+	it := c.Search(query, &SearchQuery{Limit: 100})
+	for it.Next() {
+		records = append(records, BulkRecord{Key: it.Raw().Key})
+	}
+	return records, it.Error
+}
+
+// Runs op on every record using the given number of workers, 4 if it is not
+// positive, and returns the number of records op succeeded for. Failures are
+// handed to sink, or returned in a BulkError if sink is nil.
+func (c *Collection) runBulk(
+	records []BulkRecord, concurrency int, sink DeadLetter,
+	op func(BulkRecord) error,
+) (int, error) {
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	var lock sync.Mutex
+	var succeeded int
+	var failed []*FailedRecord
+	var sinkErr error
+
+	// Hands a failed record to the sink, or keeps it for the BulkError.
+	fail := func(record BulkRecord, err error) {
+		failure := &FailedRecord{
+			Collection: c.Name,
+			Key:        record.Key,
+			Value:      record.Value,
+			Reason:     err.Error(),
+			Err:        err,
+			Time:       c.client.Now().UTC(),
+		}
+		if sink != nil {
+			err = sink.Failed(failure)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if sink == nil {
+			failed = append(failed, failure)
+		} else if err != nil && sinkErr == nil {
+			sinkErr = err
+		}
+	}
+
+	work := make(chan BulkRecord)
+	var wg sync.WaitGroup
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range work {
+				if err := op(record); err != nil {
+					fail(record, err)
+					continue
+				}
+				lock.Lock()
+				succeeded++
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, record := range records {
+		work <- record
+	}
+	close(work)
+	wg.Wait()
+
+	if sinkErr != nil {
+		return succeeded, sinkErr
+	} else if len(failed) > 0 {
+		return succeeded, &BulkError{Failed: failed}
+	}
+	return succeeded, nil
+}
+
+//
+// DeadLetter
+//
+
+// A record that could not be written by a bulk operation.
+type FailedRecord struct {
+	// Where the record was meant to be written.
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+
+	// The value that was being written.
+	Value interface{} `json:"value"`
+
+	// Why the write failed.
+	Reason string `json:"reason"`
+	Err    error  `json:"-"`
+
+	// When the write was given up on.
+	Time time.Time `json:"time"`
+}
+
+// Receives records that bulk operations failed to write so they can be
+// looked at and reprocessed later. Failed() may be called from several
+// goroutines at once. An error returned from Failed() is returned from the
+// bulk operation once it finishes.
+type DeadLetter interface {
+	Failed(record *FailedRecord) error
+}
+
+// Returns a DeadLetter that stores failed records in the given quarantine
+// collection. Each record is keyed by its collection and key so a record
+// that fails repeatedly only keeps its latest failure.
+func (c *Client) NewCollectionDeadLetter(collection string) DeadLetter {
+	return &collectionDeadLetter{collection: c.Collection(collection)}
+}
+
+type collectionDeadLetter struct {
+	collection *Collection
+}
+
+func (d *collectionDeadLetter) Failed(record *FailedRecord) error {
+	_, err := d.collection.Update(record.Collection+"-"+record.Key, record)
+	return err
+}
+
+// Returns a DeadLetter that writes each failed record to w as a line of
+// JSON. This is typically an *os.File opened for appending.
+func NewWriterDeadLetter(w io.Writer) DeadLetter {
+	return &writerDeadLetter{encoder: json.NewEncoder(w)}
+}
+
+type writerDeadLetter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func (d *writerDeadLetter) Failed(record *FailedRecord) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.encoder.Encode(record)
+}
@@ -15,15 +15,20 @@
 package gorc2
 
 import (
+	"bufio"
+	"bytes"
 	"compress/flate"
 	"compress/gzip"
-	"encoding/json"
+	"compress/zlib"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"runtime"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -49,12 +54,39 @@ var (
 	// This is the default http.Transport that will be associated with new
 	// clients. If overwritten then only new clients will be impacted, old
 	// clients will continue to use the pre-existing transport.
-	DefaultTransport http.RoundTripper = &http.Transport{
+	DefaultTransport http.RoundTripper = NewTransport(TransportOptions{
 		// In the default configuration we allow 4 idle connections to the
 		// api server. This limits the number of live connections to our
 		// load balancer which reduces load. If needed this can be increased
 		// for high volume clients.
 		MaxIdleConnsPerHost: 4,
+	})
+)
+
+// Tuning options for transports built with NewTransport().
+type TransportOptions struct {
+	// The number of idle connections kept open to each host. If this is
+	// lower than the number of concurrent requests then connections will be
+	// closed and reopened constantly.
+	MaxIdleConnsPerHost int
+
+	// Limits the total number of connections to each host, including those
+	// in use. Requests beyond the limit wait for a connection to free up.
+	// Zero means no limit.
+	MaxConnsPerHost int
+}
+
+// Returns a new http.Transport configured with the given options and the
+// timeouts used by DefaultTransport. This can be used to build a transport
+// for a Client that makes heavy concurrent use of the API, such as bulk
+// writes with a high BulkOptions.Concurrency, for example:
+//
+//   client.HTTPClient = &http.Client{Transport: gorc2.NewTransport(
+//       gorc2.TransportOptions{MaxIdleConnsPerHost: 64})}
+func NewTransport(opts TransportOptions) *http.Transport {
+	return &http.Transport{
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
 
 		// This timeout value is how long the http client library will wait
 		// for data before abandoning the call. If this is set too low then
@@ -62,15 +94,16 @@ var (
 		// too often.
 		ResponseHeaderTimeout: 3 * time.Second,
 
-		// The default Dial function is over written so it uses net.DialTimeout
-		// instead.
-		Dial: dialFunc,
+		// The default Dial function is over written so it uses
+		// DefaultDialTimeout instead.
+		DialContext: dialFunc,
 	}
-)
+}
 
 // A dial function for the DefaultTransport.
-func dialFunc(network, addr string) (net.Conn, error) {
-	return net.DialTimeout(network, addr, DefaultDialTimeout)
+func dialFunc(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: DefaultDialTimeout}
+	return dialer.DialContext(ctx, network, addr)
 }
 
 // We keep the client version here. This is updated when arbitrarily,
@@ -88,6 +121,9 @@ var userAgent string = fmt.Sprintf("gorc2/%d (%s)",
 var userAgentDeprecated string = fmt.Sprintf("gorc2/%d (%s) [deprecated]",
 	clientVersion, runtime.Version())
 
+// Wraps a compressed response body with a reader that decompresses it.
+type ResponseDecoder func(io.Reader) (io.Reader, error)
+
 //
 // Client
 //
@@ -96,16 +132,96 @@ var userAgentDeprecated string = fmt.Sprintf("gorc2/%d (%s) [deprecated]",
 type Client struct {
 	// This is the host name that will be used in client queries. By default
 	// this will be set to DefaultAPIHost, and if this is left empty
-	// then that default will be used as well.
+	// then that default will be used as well. Like the other fields this
+	// must not be changed once the client is in use, use WithAPIHost() to
+	// get a client for a different host instead.
 	APIHost string
 
 	// This is the HTTP client that will be used to perform HTTP queries
-	// against Orchestrate.
+	// against Orchestrate. This must not be changed once the client is in
+	// use, see WithHTTPClient().
 	HTTPClient *http.Client
 
+	// If set then every key value write made through this client is also
+	// recorded in an audit collection. See AuditLog for details.
+	Audit *AuditLog
+
+	// If this is greater than zero then request bodies of at least this many
+	// bytes are gzip compressed before being sent, with a Content-Encoding
+	// header set to match. Smaller bodies are sent as is since compressing
+	// them costs more time than it saves. Zero disables compression.
+	CompressRequestsOver int
+
+	// If true then responses are requested without compression. By default
+	// gzip and deflate responses are accepted, along with any encoding that
+	// has a decoder in ResponseDecoders.
+	DisableResponseCompression bool
+
+	// Additional decoders for compressed responses keyed by Content-Encoding
+	// name. This allows encodings that are not in the standard library, such
+	// as brotli, to be supported, for example:
+	//
+	//   client.ResponseDecoders = map[string]ResponseDecoder{
+	//       "br": func(r io.Reader) (io.Reader, error) {
+	//           return brotli.NewReader(r), nil
+	//       },
+	//   }
+	ResponseDecoders map[string]ResponseDecoder
+
+	// If set then requests that fail with a network error or a transient
+	// status are retried according to this policy. See RetryPolicy.
+	Retry *RetryPolicy
+
+	// If set then requests are failed immediately with a CircuitOpenError
+	// while Orchestrate is failing rather than being sent. See
+	// CircuitBreaker.
+	Breaker *CircuitBreaker
+
+	// If set then this is called around every request sent to Orchestrate
+	// so it can be traced. See Tracer.
+	Tracer Tracer
+
+	// The JSON implementation used to encode values and decode responses.
+	// If nil then StdCodec is used. See Codec.
+	Codec Codec
+
+	// Generates the keys of items created with Collection.CreateAuto(). If
+	// nil then ULID is used. See IDGenerator.
+	IDGenerator IDGenerator
+
+	// Tells the time of audit records, soft deletes and events added
+	// without a timestamp, and times retries and polls. If nil then
+	// SystemClock is used. See Clock.
+	Clock Clock
+
+	// If true then only GET and HEAD requests are sent and every other
+	// request fails with a ReadOnlyError, so that code sharing the client,
+	// such as analytics jobs or a public frontend, can not change data even
+	// by mistake. This takes precedence over DryRun.
+	ReadOnly bool
+
+	// If true then writes are not sent to Orchestrate, so that an import or
+	// a migration can be rehearsed against production data. Each write is
+	// checked, passed to DryRunLog and then succeeds as Orchestrate would
+	// have answered it, returning Items and Events with made up refs.
+	// Reads are sent as usual, so they return what is stored rather than
+	// what the dry run wrote. See also RequestOptions.DryRun.
+	DryRun bool
+
+	// Called with each write skipped by a dry run. If nil then writes are
+	// logged with the log package.
+	DryRunLog func(w *DryRunWrite)
+
+	// The refs made up by dry runs of the client, see dryRunSession.
+	dryRunRefs *dryRunSession
+
 	// The authorization token passed into NewClient().
 	authToken string
 
+	// The application identifier set via SetAppInfo() which is appended to
+	// the User-Agent header.
+	appInfo string
+
 	// This value will be automatically set to a non zero value if a call is
 	// made to any deprecated function.
 	deprecated int32
@@ -119,9 +235,37 @@ func NewClient(authToken string) *Client {
 		APIHost:    DefaultAPIHost,
 		HTTPClient: nil,
 		authToken:  authToken,
+		dryRunRefs: &dryRunSession{},
 	}
 }
 
+// Identifies the application using this client. The name and version are
+// appended to the User-Agent header sent with every request so traffic can
+// be attributed to a given application or deployment. This should be called
+// before the client is used.
+func (c *Client) SetAppInfo(name, version string) {
+	c.appInfo = name + "/" + version
+}
+
+// Returns a copy of the client that sends requests to the given host. The
+// copy shares everything else with c, including Retry, Breaker and Audit,
+// and neither client is affected by later changes to the other one's
+// APIHost. This is safe to call while c is in use. A copy talking to a
+// different Orchestrate cluster should normally be given its own Breaker.
+func (c *Client) WithAPIHost(host string) *Client {
+	copy := *c
+	copy.APIHost = host
+	return &copy
+}
+
+// Returns a copy of the client that uses the given http.Client. Like
+// WithAPIHost() this is safe to call while c is in use.
+func (c *Client) WithHTTPClient(client *http.Client) *Client {
+	copy := *c
+	copy.HTTPClient = client
+	return &copy
+}
+
 // Returns a Collection object for a collection with the given name. Note that
 // this call does not verify that the collection exists.
 func (c *Client) Collection(name string) *Collection {
@@ -134,44 +278,59 @@ func (c *Client) Collection(name string) *Collection {
 // Check that Orchestrate is reachable.
 func (c *Client) Ping() error {
 	//	return nil
-	_, err := c.emptyReply("HEAD", "", nil, nil, 200)
+	_, err := c.emptyReply(context.Background(), "HEAD", "", nil, nil, 200)
 	return err
 }
 
 // Executes an HTTP request.
 func (c *Client) doRequest(
-	method, trailing string, headers map[string]string, body io.Reader,
+	ctx context.Context, method, trailing string, headers map[string]string,
+	body io.Reader,
 ) (*http.Response, error) {
-	// Get the URL that we should be talking too.
+	if c.ReadOnly && isWrite(method) {
+		return nil, ReadOnlyError(method + " " + trailing)
+	}
+
+	// Get the URL that we should be talking too. The host and HTTPClient are
+	// read once so every attempt of a retried request goes to the same place.
 	host := c.APIHost
 	if host == "" {
 		host = DefaultAPIHost
 	}
 	url := "http://" + host + "/v0/" + trailing
 
-	// Create the new Request.
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
+	// Bodies are read into memory up front so that the request can be sent
+	// again if it needs to be retried. This also sets GetBody on the request
+	// which lets the http package replay it on redirects.
+	var raw []byte
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Buffer:
+		// All internal callers pass a Buffer so its contents can be used
+		// directly without copying.
+		raw = b.Bytes()
+	default:
+		var err error
+		if raw, err = ioutil.ReadAll(body); err != nil {
+			return nil, err
+		}
 	}
 
-	// Ensure that the query gets the authToken as username.
-	req.SetBasicAuth(c.authToken, "")
-
-	// Add any headers that the client provided.
-	for k, v := range headers {
-		req.Header.Add(k, v)
-	}
-	if atomic.LoadInt32(&c.deprecated) == 0 {
-		req.Header.Add("User-Agent", userAgent)
-	} else {
-		req.Header.Add("User-Agent", userAgentDeprecated)
+	// Writes of a dry run are answered without being sent.
+	if session := c.dryRun(ctx); isWrite(method) && session != nil {
+		return c.dryRunReply(ctx, session, method, trailing, headers, raw,
+			body != nil)
 	}
 
-	// If the client request has a body then we need to set a Content-Type
-	// header.
-	if body != nil {
-		req.Header.Add("Content-Type", "application/json")
+	// Compress large bodies if the client is configured to.
+	compressed := false
+	if body != nil && c.CompressRequestsOver > 0 &&
+		len(raw) >= c.CompressRequestsOver {
+		var err error
+		if raw, err = gzipBytes(raw); err != nil {
+			return nil, err
+		}
+		compressed = true
 	}
 
 	// If the HTTPClient is nil we use the DefaultTransport provided in this
@@ -181,7 +340,69 @@ func (c *Client) doRequest(
 	if client == nil {
 		client = &http.Client{Transport: DefaultTransport}
 	}
-	return client.Do(req)
+
+	for attempt := 1; ; attempt++ {
+		// Create the new Request.
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(raw)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, reader)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ensure that the query gets the authToken as username.
+		req.SetBasicAuth(c.authToken, "")
+
+		agent := userAgent
+		if atomic.LoadInt32(&c.deprecated) != 0 {
+			agent = userAgentDeprecated
+		}
+		if c.appInfo != "" {
+			agent = agent + " " + c.appInfo
+		}
+		req.Header.Set("User-Agent", agent)
+
+		// If the client request has a body then we need to set a Content-Type
+		// header.
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		// Headers given by the caller, including RequestOptions, replace the
+		// defaults above rather than being sent alongside them.
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if compressed {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+
+		if err := c.Breaker.allow(); err != nil {
+			return nil, err
+		}
+		finish := func(*http.Response, error) {}
+		if c.Tracer != nil {
+			req, finish = c.Tracer.StartRequest(req, describeRequest(method, trailing))
+		}
+		resp, err := client.Do(req)
+		finish(resp, err)
+		c.Breaker.record(ctx, resp, err)
+		if !c.Retry.shouldRetry(ctx, attempt, resp, err) {
+			return resp, err
+		}
+
+		// Drain the failed response so the connection can be reused, then
+		// wait before trying again.
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := wait(ctx, c.clock(), c.Retry.delay(attempt)); err != nil {
+			return nil, err
+		}
+	}
 }
 
 // This call will perform a simple request which expects no body to be
@@ -191,9 +412,10 @@ func (c *Client) doRequest(
 // Any status return other than 'status' will cause an error to be returned
 // from this function.
 func (c *Client) emptyReply(
-	method, path string, headers map[string]string, body io.Reader, status int,
+	ctx context.Context, method, path string, headers map[string]string,
+	body io.Reader, status int,
 ) (*http.Response, error) {
-	resp, err := c.doRequest(method, path, headers, body)
+	resp, err := c.doRequest(ctx, method, path, headers, body)
 	if err != nil {
 		return nil, err
 	}
@@ -219,10 +441,17 @@ func (c *Client) emptyReply(
 // Any status return other than 'status' will cause an error to be returned
 // from this function.
 func (c *Client) jsonReply(
-	method, path string, body io.Reader, status int, value interface{},
+	ctx context.Context, method, path string, headers map[string]string,
+	body io.Reader, status int, value interface{},
 ) (*http.Response, error) {
-	headers := map[string]string{"Accept-Encoding": "gzip; deflate"}
-	resp, err := c.doRequest(method, path, headers, body)
+	if !c.DisableResponseCompression {
+		withEncoding := map[string]string{"Accept-Encoding": c.acceptEncoding()}
+		for k, v := range headers {
+			withEncoding[k] = v
+		}
+		headers = withEncoding
+	}
+	resp, err := c.doRequest(ctx, method, path, headers, body)
 	if err != nil {
 		return nil, err
 	}
@@ -234,26 +463,65 @@ func (c *Client) jsonReply(
 	}
 
 	// See what kind of encoding the server is replying with.
-	var decoder *json.Decoder
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		gzipReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		decoder = json.NewDecoder(gzipReader)
-	case "deflate":
-		decoder = json.NewDecoder(flate.NewReader(resp.Body))
-	default:
-		decoder = json.NewDecoder(resp.Body)
+	reader, err := c.decodeBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if gzipReader, ok := reader.(*gzip.Reader); ok {
+		defer gzipReaderPool.Put(gzipReader)
 	}
 
-
-	// Decode the body into a json object.
-	if err := decoder.Decode(value); err != nil {
+	// Read the body into a pooled buffer and decode it from there. Unmarshal
+	// copies any raw values out of the buffer so it can be reused as soon as
+	// decoding is done.
+	buffer := getBuffer()
+	defer putBuffer(buffer)
+	if _, err := buffer.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	if err := c.codec().Unmarshal(buffer.Bytes(), value); err != nil {
 		return nil, err
 	}
 
 	// Success!
 	return resp, nil
 }
+
+// Returns the Accept-Encoding header value sent with requests that expect a
+// body in the reply.
+func (c *Client) acceptEncoding() string {
+	encodings := make([]string, 0, len(c.ResponseDecoders))
+	for name := range c.ResponseDecoders {
+		if name != "gzip" && name != "deflate" {
+			encodings = append(encodings, name)
+		}
+	}
+	sort.Strings(encodings)
+	return strings.Join(append(encodings, "gzip", "deflate"), ", ")
+}
+
+// Returns a reader for the body of the response that undoes any
+// Content-Encoding applied to it.
+func (c *Client) decodeBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(
+		resp.Header.Get("Content-Encoding")))
+	if decoder, ok := c.ResponseDecoders[encoding]; ok {
+		return decoder(resp.Body)
+	}
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return getGzipReader(resp.Body)
+	case "deflate":
+		// HTTP deflate is supposed to be zlib wrapped, however some servers
+		// send a raw deflate stream so the header is checked first.
+		buffered := bufio.NewReader(resp.Body)
+		if header, err := buffered.Peek(2); err == nil &&
+			header[0]&0x0f == 8 && (int(header[0])<<8|int(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	}
+	return nil, fmt.Errorf("Unsupported Content-Encoding %q.", encoding)
+}
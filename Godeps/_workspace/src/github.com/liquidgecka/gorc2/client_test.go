@@ -0,0 +1,60 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Answers every write as Orchestrate does, after a delay standing in for
+// the time Orchestrate takes.
+func writeHandler(delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(delay)
+		w.Header().Set("Location", r.URL.Path+"/refs/0123456789abcdef")
+		w.WriteHeader(201)
+	})
+}
+
+// Compares bulk writes through transports keeping few and many idle
+// connections per host. With fewer idle connections than concurrent writes
+// connections are closed after each response and dialed again.
+func BenchmarkBulkUpdateTransport(b *testing.B) {
+	for _, idle := range []int{4, 32} {
+		b.Run(fmt.Sprintf("idle=%d", idle), func(b *testing.B) {
+			c := testClient(b, writeHandler(time.Millisecond))
+			c.HTTPClient = &http.Client{Transport: NewTransport(
+				TransportOptions{MaxIdleConnsPerHost: idle})}
+			records := make([]BulkRecord, b.N)
+			for i := range records {
+				records[i] = BulkRecord{Key: fmt.Sprint(i),
+					Value: map[string]int{"n": i}}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			_, err := c.Collection("bench").BulkUpdate(records,
+				&BulkOptions{Concurrency: 32})
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
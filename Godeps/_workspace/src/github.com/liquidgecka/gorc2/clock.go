@@ -0,0 +1,147 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// Clock
+//
+
+// Tells the time and waits. A Client reads the time and waits between
+// retries and polls through its Clock, so that a FakeClock can make time
+// dependent behavior run instantly and repeatably. Implementations must be
+// safe to call from multiple goroutines.
+type Clock interface {
+	Now() time.Time
+
+	// Returns a channel that receives the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// The real time, used unless Client.Clock is set.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Blocks until d has passed on a clock.
+func sleep(clock Clock, d time.Duration) {
+	if d > 0 {
+		<-clock.After(d)
+	}
+}
+
+// Returns the Clock of the client.
+func (c *Client) clock() Clock {
+	if c.Clock == nil {
+		return SystemClock
+	}
+	return c.Clock
+}
+
+// Returns the current time of the client's Clock.
+func (c *Client) Now() time.Time {
+	return c.clock().Now()
+}
+
+// Returns a channel that receives the time once d has passed on the
+// client's Clock.
+func (c *Client) After(d time.Duration) <-chan time.Time {
+	return c.clock().After(d)
+}
+
+// A Clock that only moves when Advance() or Set() is called. Waits end as
+// soon as the clock has been moved past them.
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Returns a FakeClock reading the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+	} else {
+		f.waiters = append(f.waiters, w)
+	}
+	return w.ch
+}
+
+// Moves the clock forward by d, ending the waits that are then over.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	now := f.now.Add(d)
+	f.lock.Unlock()
+	f.Set(now)
+}
+
+// Sets the time of the clock, ending the waits that are then over. Waits
+// end in the order they are due.
+func (f *FakeClock) Set(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = now
+	sort.SliceStable(f.waiters, func(i, j int) bool {
+		return f.waiters[i].at.Before(f.waiters[j].at)
+	})
+	n := 0
+	for _, w := range f.waiters {
+		if w.at.After(now) {
+			break
+		}
+		w.ch <- now
+		n++
+	}
+	f.waiters = f.waiters[n:]
+}
+
+// Returns how many waits have not ended, so a test can tell when the code
+// it runs has started waiting before it advances the clock.
+func (f *FakeClock) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.waiters)
+}
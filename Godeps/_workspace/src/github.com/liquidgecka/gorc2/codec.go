@@ -0,0 +1,92 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"encoding/json"
+	"io"
+)
+
+//
+// Codec
+//
+
+// Encodes and decodes JSON for a Client. This is used for values written to
+// and read from Orchestrate, and for decoding the pages of results returned
+// by list and search calls, which dominates the time spent on large pages.
+// The default, StdCodec, uses encoding/json. A faster implementation such as
+// jsoniter can be dropped in with a small adapter, for example:
+//
+//	type jsoniterCodec struct{ api jsoniter.API }
+//
+//	func (j jsoniterCodec) Marshal(v interface{}) ([]byte, error) {
+//		return j.api.Marshal(v)
+//	}
+//	func (j jsoniterCodec) Unmarshal(data []byte, v interface{}) error {
+//		return j.api.Unmarshal(data, v)
+//	}
+//	func (j jsoniterCodec) NewDecoder(r io.Reader) gorc2.Decoder {
+//		return j.api.NewDecoder(r)
+//	}
+//
+//	client.Codec = jsoniterCodec{jsoniter.ConfigCompatibleWithStandardLibrary}
+//
+// Implementations must honor the encoding/json struct tags and
+// json.RawMessage since the client relies on both.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	NewDecoder(r io.Reader) Decoder
+}
+
+// A streaming decoder returned from Codec.NewDecoder().
+type Decoder interface {
+	Decode(v interface{}) error
+	UseNumber()
+}
+
+// The Codec used when Client.Codec is not set. It uses encoding/json.
+var StdCodec Codec = stdCodec{}
+
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (stdCodec) NewDecoder(r io.Reader) Decoder {
+	return json.NewDecoder(r)
+}
+
+// Returns the Codec configured on the client, or StdCodec.
+func (c *Client) codec() Codec {
+	if c == nil || c.Codec == nil {
+		return StdCodec
+	}
+	return c.Codec
+}
+
+// Returns the Codec of the client this collection belongs to. Items and
+// Events built by hand may not have a Collection so this handles nil.
+func (c *Collection) codec() Codec {
+	if c == nil {
+		return StdCodec
+	}
+	return c.client.codec()
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//
+// Counters
+//
+
+// How many times Increment() reads and writes an item that keeps being
+// written to before giving up.
+const maxIncrementAttempts = 10
+
+// Adds delta to the integer at a dotted field path of an item, such as
+// "views" or "counts.views", and returns the new value. The item, and any
+// objects on the path, are created if they do not exist, and a field that
+// does not exist counts from 0. The item is read and written back
+// conditionally on its ref, and read again if it was written to in the
+// meantime, so concurrent increments are not lost. Returns an error if the
+// item is not a JSON object or the field holds something other than an
+// integer.
+func (c *Collection) Increment(key, field string, delta int64) (
+	int64, error,
+) {
+	for attempt := 0; attempt < maxIncrementAttempts; attempt++ {
+		item, err := c.Get(key, nil)
+		value := map[string]interface{}{}
+		if _, ok := err.(NotFoundError); ok {
+			item = nil
+		} else if err != nil {
+			return 0, err
+		} else if value, err = decodeObject(item.Value); err != nil {
+			return 0, err
+		} else if value == nil {
+			return 0, fmt.Errorf("%s is not a JSON object.", key)
+		}
+
+		n, err := incrementField(value, field, delta)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to increment %s of %s: %s", field,
+				key, err)
+		}
+		if item == nil {
+			_, err = c.Create(key, value)
+		} else {
+			_, err = item.Update(value)
+		}
+		switch err.(type) {
+		case nil:
+			return n, nil
+		case AlreadyExistsError, NotMostRecentError:
+			continue
+		}
+		return 0, err
+	}
+	return 0, fmt.Errorf("Unable to increment %s of %s, it was written to "+
+		"%d times while incrementing.", field, key, maxIncrementAttempts)
+}
+
+// Adds delta to the integer at a dotted path of an object, creating the
+// objects on the path as needed, and returns the new value.
+func incrementField(
+	value map[string]interface{}, path string, delta int64,
+) (int64, error) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		switch next := value[part].(type) {
+		case map[string]interface{}:
+			value = next
+		case nil:
+			value[part] = map[string]interface{}{}
+			value = value[part].(map[string]interface{})
+		default:
+			return 0, fmt.Errorf("%s is not an object.", part)
+		}
+	}
+	name := parts[len(parts)-1]
+	var n int64
+	switch current := value[name].(type) {
+	case nil:
+	case json.Number:
+		var err error
+		if n, err = current.Int64(); err != nil {
+			return 0, fmt.Errorf("%s is not an integer.", current)
+		}
+	default:
+		return 0, fmt.Errorf("%s is not a number.", name)
+	}
+	n += delta
+	value[name] = json.Number(strconv.FormatInt(n, 10))
+	return n, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+//
+// DiffRefs
+//
+
+// A single difference between two versions of a value.
+type DiffChange struct {
+	// The dotted path to the field that differs, using the same form as
+	// search queries (for example "connectors.0.type"). An empty path refers
+	// to the value as a whole.
+	Path string `json:"path"`
+
+	// The value in the older version. Not set for added fields.
+	Old interface{} `json:"old,omitempty"`
+
+	// The value in the newer version. Not set for removed fields.
+	New interface{} `json:"new,omitempty"`
+}
+
+// The differences between two refs of an item as returned by DiffRefs().
+type Diff struct {
+	// The key of the item that was compared.
+	Key string `json:"key"`
+
+	// The two refs that were compared.
+	FromRef string `json:"from_ref"`
+	ToRef   string `json:"to_ref"`
+
+	// Fields that only exist in ToRef.
+	Added []DiffChange `json:"added"`
+
+	// Fields that only exist in FromRef.
+	Removed []DiffChange `json:"removed"`
+
+	// Fields that exist in both refs but have different values.
+	Changed []DiffChange `json:"changed"`
+}
+
+// Returns true if the two refs had identical values.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Fetches two versions of an item and returns the differences between them,
+// treating refA as the older and refB as the newer version. Objects are
+// compared field by field and arrays element by element, anything else is
+// reported as a change of the whole field.
+func (c *Collection) DiffRefs(key, refA, refB string) (*Diff, error) {
+	var a, b interface{}
+	for _, fetch := range []struct {
+		ref   string
+		value *interface{}
+	}{{refA, &a}, {refB, &b}} {
+		item, err := c.GetRef(key, fetch.ref, nil)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(item.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(fetch.value); err != nil {
+			return nil, err
+		}
+	}
+
+	diff := &Diff{
+		Key:     key,
+		FromRef: refA,
+		ToRef:   refB,
+		Added:   []DiffChange{},
+		Removed: []DiffChange{},
+		Changed: []DiffChange{},
+	}
+	diffValues("", a, b, diff)
+	return diff, nil
+}
+
+// Walks two decoded JSON values adding any differences to diff.
+func diffValues(path string, a, b interface{}, diff *Diff) {
+	join := func(field string) string {
+		if path == "" {
+			return field
+		}
+		return path + "." + field
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		fields := make([]string, 0, len(av)+len(bv))
+		for field := range av {
+			fields = append(fields, field)
+		}
+		for field := range bv {
+			if _, ok := av[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			older, inA := av[field]
+			newer, inB := bv[field]
+			switch {
+			case !inA:
+				diff.Added = append(diff.Added,
+					DiffChange{Path: join(field), New: newer})
+			case !inB:
+				diff.Removed = append(diff.Removed,
+					DiffChange{Path: join(field), Old: older})
+			default:
+				diffValues(join(field), older, newer, diff)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for n := 0; n < len(av) || n < len(bv); n++ {
+			field := join(strconv.Itoa(n))
+			switch {
+			case n >= len(av):
+				diff.Added = append(diff.Added,
+					DiffChange{Path: field, New: bv[n]})
+			case n >= len(bv):
+				diff.Removed = append(diff.Removed,
+					DiffChange{Path: field, Old: av[n]})
+			default:
+				diffValues(field, av[n], bv[n], diff)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		diff.Changed = append(diff.Changed,
+			DiffChange{Path: path, Old: a, New: b})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Distance
+//
+
+// The mean radius of the Earth in kilometers, as used by Distance().
+const EarthRadius = 6371.0088
+
+// Returns the great circle distance in kilometers between two points given
+// in degrees, using the haversine formula.
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*
+			math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Returns an Iterator that returns the same results ordered nearest first
+// from the given point, for when the search did not sort by distance on the
+// server. The location of each result is read from the object at the given
+// dotted field path, such as "ChargeDeviceLocation", which must hold
+// latitude and longitude fields named as in a geo search. Results are given
+// a Distance in kilometers, and those without a location are returned last
+// in their original order. Since every result has to be known before the
+// first can be returned, the whole of the underlying Iterator is read on the
+// first call to Next(). This must be called before the first call to
+// Next() on the original Iterator, which should not be used afterwards.
+func (i *Iterator) SortByDistanceFrom(field string, lat, lon float64) *Iterator {
+	field = strings.TrimPrefix(field, "value.")
+	return &Iterator{
+		client:          i.client,
+		collection:      i.collection,
+		iteratingEvents: i.iteratingEvents,
+		iteratingItems:  i.iteratingItems,
+		inner:           i,
+		plan:            i.plan,
+		arrange: func(results []*jsonListItem) {
+			distances := make(map[*jsonListItem]float64, len(results))
+			for _, r := range results {
+				distances[r] = math.Inf(1)
+				value, err := decodeObject(r.Value)
+				if err != nil || value == nil {
+					continue
+				}
+				parent, name := lookupField(value, field)
+				if parent == nil {
+					continue
+				}
+				if pLat, pLon, ok := geoPoint(parent[name]); ok {
+					distances[r] = Distance(lat, lon, pLat, pLon)
+					r.Distance = float32(distances[r])
+				}
+			}
+			sort.SliceStable(results, func(a, b int) bool {
+				return distances[results[a]] < distances[results[b]]
+			})
+		},
+	}
+}
+
+// Returns the latitude and longitude of an object holding a geo point. The
+// field names are matched ignoring case and may be latitude or lat, and
+// longitude, lon or lng.
+func geoPoint(value interface{}) (float64, float64, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return 0, 0, false
+	}
+	var lat, lon float64
+	var haveLat, haveLon bool
+	for name, v := range object {
+		var f float64
+		var err error
+		switch n := v.(type) {
+		case json.Number:
+			f, err = n.Float64()
+		case string:
+			f, err = strconv.ParseFloat(n, 64)
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "latitude", "lat":
+			lat, haveLat = f, true
+		case "longitude", "lon", "lng":
+			lon, haveLon = f, true
+		}
+	}
+	return lat, lon, haveLat && haveLon
+}
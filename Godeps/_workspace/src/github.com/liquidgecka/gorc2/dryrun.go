@@ -0,0 +1,244 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// DryRun
+//
+
+// A write that was not sent because of a dry run, as passed to
+// Client.DryRunLog.
+type DryRunWrite struct {
+	// The method and the path after the API version, such as
+	// "PUT" and "chargepoints/key".
+	Method string
+	Path   string
+
+	// The headers the write would have been sent with, and its body if it
+	// has one.
+	Headers map[string]string
+	Body    json.RawMessage
+}
+
+// The refs and event ordinals made up for the writes skipped by a dry run.
+// Conditional writes against one of its refs pass, since they follow a
+// write of the same dry run. A Client made by NewClient() keeps one for
+// Client.DryRun, shared with its copies, and each Collection returned by
+// WithOptions() with RequestOptions.DryRun set keeps its own, so the refs
+// of one dry run are not taken for those of another and are dropped with
+// the Client or Collection.
+type dryRunSession struct {
+	lock    sync.Mutex
+	refs    map[string]bool
+	ordinal int64
+}
+
+// Returns a new made up ref, remembering it for dryRunPreconditions().
+func (s *dryRunSession) newRef() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ref := hex.EncodeToString(b)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.refs == nil {
+		s.refs = make(map[string]bool)
+	}
+	s.refs[ref] = true
+	return ref
+}
+
+// Returns true if a ref was made up by the session.
+func (s *dryRunSession) madeUp(ref string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refs[ref]
+}
+
+// Returns the ordinal of a new made up event.
+func (s *dryRunSession) newOrdinal() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ordinal++
+	return s.ordinal
+}
+
+// The context key the dryRunSession of requests of a Collection with
+// RequestOptions.DryRun set is stored under.
+type dryRunKey struct{}
+
+// Returns the session of writes made with the given context if they are a
+// dry run, or nil. A Client that was not made by NewClient() has no session
+// of its own, so its dry run writes remember no refs.
+func (c *Client) dryRun(ctx context.Context) *dryRunSession {
+	if s, ok := ctx.Value(dryRunKey{}).(*dryRunSession); ok {
+		return s
+	} else if !c.DryRun {
+		return nil
+	} else if c.dryRunRefs != nil {
+		return c.dryRunRefs
+	}
+	return &dryRunSession{}
+}
+
+// Returns true if a request with the given method writes.
+func isWrite(method string) bool {
+	return method != "GET" && method != "HEAD"
+}
+
+// Stands in for a write that is not sent. The body must be JSON and the
+// preconditions of conditional item writes must hold, checked by reading
+// the item, and otherwise the response Orchestrate would give to the write
+// is made up, with new refs and event ordinals that were never stored.
+func (c *Client) dryRunReply(
+	ctx context.Context, session *dryRunSession, method, trailing string,
+	headers map[string]string, body []byte, hasBody bool,
+) (*http.Response, error) {
+	write := &DryRunWrite{Method: method, Path: trailing, Headers: headers}
+	if hasBody {
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("Dry run %s %s has a body that is not JSON.",
+				method, trailing)
+		}
+		write.Body = json.RawMessage(body)
+	}
+
+	path := trailing
+	if i := strings.Index(path, "?"); i != -1 {
+		path = path[:i]
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) == 2 {
+		resp, err := c.dryRunPreconditions(ctx, session, path, headers)
+		if err != nil {
+			return nil, err
+		} else if resp != nil {
+			return resp, nil
+		}
+	}
+
+	if c.DryRunLog != nil {
+		c.DryRunLog(write)
+	} else {
+		log.Printf("Dry run, not sent: %s %s", method, trailing)
+	}
+
+	ref := session.newRef()
+	reply := func(status int, location string) *http.Response {
+		resp := &http.Response{
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode: status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+		resp.Header.Set("ETag", `"`+ref+`"`)
+		if location != "" {
+			resp.Header.Set("Location", location)
+		}
+		return resp
+	}
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = url.PathEscape(part)
+	}
+	switch {
+	case len(parts) == 2 && method == "PUT":
+		return reply(201, "/v0/"+strings.Join(escaped, "/")+"/refs/"+ref), nil
+	case len(parts) >= 4 && parts[2] == "events" && method == "POST":
+		// Events are added at the time given, or now.
+		if len(parts) == 4 {
+			escaped = append(escaped,
+				strconv.FormatInt(toTimestamp(c.clock().Now()), 10))
+		}
+		ordinal := session.newOrdinal()
+		escaped = append(escaped[:5], strconv.FormatInt(ordinal, 10))
+		return reply(201, "/v0/"+strings.Join(escaped, "/")), nil
+	case len(parts) == 6 && parts[2] == "events" && method == "PUT":
+		return reply(204, "/v0/"+strings.Join(escaped, "/")), nil
+	}
+	return reply(204, ""), nil
+}
+
+// Checks the If-Match and If-None-Match headers of a write to an item
+// against the item as stored, returning the 412 response Orchestrate would
+// give if they do not hold or nil if they do.
+func (c *Client) dryRunPreconditions(
+	ctx context.Context, session *dryRunSession, path string,
+	headers map[string]string,
+) (*http.Response, error) {
+	match, noneMatch := headers["If-Match"], headers["If-None-Match"]
+	if match == "" && noneMatch == "" {
+		return nil, nil
+	} else if ref, err := parseETag(match); err == nil {
+		if session.madeUp(ref) {
+			return nil, nil
+		}
+	}
+
+	resp, err := c.doRequest(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	current := ""
+	switch resp.StatusCode {
+	case 200:
+		if current, err = parseETag(resp.Header.Get("ETag")); err != nil {
+			return nil, err
+		}
+	case 404:
+	default:
+		return nil, newError(resp)
+	}
+
+	failed := false
+	if match != "" {
+		failed = match != `"`+current+`"`
+	}
+	if noneMatch == `"*"` || noneMatch == "*" {
+		failed = failed || current != ""
+	}
+	if !failed {
+		return nil, nil
+	}
+	return &http.Response{
+		Status:     "412 Precondition Failed",
+		StatusCode: 412,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import "testing"
+
+// Returns a local client holding the item "key" that logs no dry runs.
+func dryRunClient(t *testing.T) *Client {
+	c := NewLocalClient()
+	c.DryRunLog = func(*DryRunWrite) {}
+	if _, err := c.Collection("test").Create("key", map[string]int{
+		"a": 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Makes a dry run update of "key", returning the item with its made up ref.
+func dryRunUpdate(t *testing.T, c *Collection) *Item {
+	item, err := c.Get("key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item, err = item.Update(map[string]int{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestDryRunRefsOfCollection(t *testing.T) {
+	c := dryRunClient(t)
+	dry := c.Collection("test").WithOptions(&RequestOptions{DryRun: true})
+	item := dryRunUpdate(t, dry)
+	if _, err := item.Update(map[string]int{"a": 3}); err != nil {
+		t.Errorf("update after a dry run update failed: %s", err)
+	}
+
+	other := c.Collection("test").WithOptions(&RequestOptions{DryRun: true})
+	_, err := (&Item{Collection: other, Key: "key", Ref: item.Ref}).Update(
+		map[string]int{"a": 3})
+	if _, ok := err.(NotMostRecentError); !ok {
+		t.Errorf("another dry run accepted a made up ref, got %v", err)
+	}
+}
+
+func TestDryRunRefsOfClient(t *testing.T) {
+	c := dryRunClient(t)
+	c.DryRun = true
+	item := dryRunUpdate(t, c.WithAPIHost(c.APIHost).Collection("test"))
+	if _, err := (&Item{Collection: c.Collection("test"), Key: "key",
+		Ref: item.Ref}).Update(map[string]int{"a": 3}); err != nil {
+		t.Errorf("update after a dry run update failed: %s", err)
+	}
+
+	other := dryRunClient(t)
+	other.DryRun = true
+	_, err := (&Item{Collection: other.Collection("test"), Key: "key",
+		Ref: item.Ref}).Update(map[string]int{"a": 3})
+	if _, ok := err.(NotMostRecentError); !ok {
+		t.Errorf("another client accepted a made up ref, got %v", err)
+	}
+}
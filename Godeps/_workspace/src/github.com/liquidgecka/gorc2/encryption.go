@@ -0,0 +1,199 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//
+// EncryptionCodec
+//
+
+// The prefix used on encrypted field values. The key ID and the base64
+// encoded nonce and cipher text follow it, separated by colons.
+const encryptedPrefix = "enc:v1:"
+
+// Encrypts selected fields of values stored in a Collection so they never
+// reach Orchestrate in plain text. Each configured field is replaced by a
+// string holding the AES-GCM encrypted JSON of the original field value.
+// Encrypted fields can not be searched on.
+//
+// Keys are identified by an ID which is stored alongside each encrypted
+// field. To rotate keys add the new key to Keys and point CurrentKey at it;
+// values encrypted with older keys can still be read as long as those keys
+// stay in Keys, and are re-encrypted with the current key the next time they
+// are written.
+type EncryptionCodec struct {
+	// The fields to encrypt, as dotted paths into the value such as
+	// "owner.email". Values must be JSON objects.
+	Fields []string
+
+	// AES keys by ID. Keys must be 16, 24 or 32 bytes long.
+	Keys map[string][]byte
+
+	// The ID of the key in Keys that is used to encrypt new values.
+	CurrentKey string
+}
+
+// Returns true if the given raw value has any field that was encrypted with
+// a key other than CurrentKey, which makes it a candidate for rewriting
+// after a key rotation.
+func (e *EncryptionCodec) NeedsRotation(raw json.RawMessage) bool {
+	value, err := decodeObject(raw)
+	if err != nil {
+		return false
+	}
+	current := encryptedPrefix + e.CurrentKey + ":"
+	for _, field := range e.Fields {
+		parent, name := lookupField(value, field)
+		if parent == nil {
+			continue
+		}
+		if s, ok := parent[name].(string); ok &&
+			strings.HasPrefix(s, encryptedPrefix) &&
+			!strings.HasPrefix(s, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the encrypted form of the given raw JSON value.
+func (e *EncryptionCodec) encrypt(raw json.RawMessage) ([]byte, error) {
+	value, err := decodeObject(raw)
+	if err != nil || value == nil {
+		return raw, err
+	}
+	gcm, err := e.cipher(e.CurrentKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range e.Fields {
+		parent, name := lookupField(value, field)
+		if parent == nil {
+			continue
+		}
+		plain, err := json.Marshal(parent[name])
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		sealed := gcm.Seal(nonce, nonce, plain, nil)
+		parent[name] = encryptedPrefix + e.CurrentKey + ":" +
+			base64.StdEncoding.EncodeToString(sealed)
+	}
+	return json.Marshal(value)
+}
+
+// Returns the given raw JSON value with all encrypted fields decrypted.
+func (e *EncryptionCodec) decrypt(raw json.RawMessage) (json.RawMessage, error) {
+	value, err := decodeObject(raw)
+	if err != nil || value == nil {
+		return raw, err
+	}
+	for _, field := range e.Fields {
+		parent, name := lookupField(value, field)
+		if parent == nil {
+			continue
+		}
+		s, ok := parent[name].(string)
+		if !ok || !strings.HasPrefix(s, encryptedPrefix) {
+			continue
+		}
+		parts := strings.SplitN(s[len(encryptedPrefix):], ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed encrypted field %s.", field)
+		}
+		gcm, err := e.cipher(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(sealed) < gcm.NonceSize() {
+			return nil, fmt.Errorf("Malformed encrypted field %s.", field)
+		}
+		nonce := sealed[:gcm.NonceSize()]
+		plain, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt field %s: %s", field, err)
+		}
+		var fieldValue interface{}
+		decoder := json.NewDecoder(bytes.NewReader(plain))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fieldValue); err != nil {
+			return nil, err
+		}
+		parent[name] = fieldValue
+	}
+	return json.Marshal(value)
+}
+
+// Returns the AEAD for the key with the given ID.
+func (e *EncryptionCodec) cipher(id string) (cipher.AEAD, error) {
+	key, ok := e.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encryption key %q.", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decodes a raw JSON value into a generic object, keeping numbers intact.
+// Values that are not objects decode to nil.
+func decodeObject(raw json.RawMessage) (map[string]interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	object, _ := value.(map[string]interface{})
+	return object, nil
+}
+
+// Walks a dotted path through nested objects returning the object holding
+// the final field along with the final field name. A nil object is returned
+// if the path does not exist.
+func lookupField(
+	value map[string]interface{}, path string,
+) (map[string]interface{}, string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := value[part].(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		value = next
+	}
+	if _, ok := value[parts[len(parts)-1]]; !ok {
+		return nil, ""
+	}
+	return value, parts[len(parts)-1]
+}
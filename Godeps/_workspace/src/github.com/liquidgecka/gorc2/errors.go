@@ -16,7 +16,9 @@ package gorc2
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 )
 
@@ -43,6 +45,27 @@ func newError(resp *http.Response) error {
 	return oe
 }
 
+// Returns true if the error is a failure to reach Orchestrate, such as a
+// refused connection or a timeout, rather than a reply from it.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Returns true if the error is likely to go away if the request is made
+// again, such as network failures, rate limiting or server side errors.
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case RateLimitedError:
+		return true
+	case *UnknownError:
+		return e.StatusCode >= 500
+	case net.Error:
+		return true
+	}
+	return false
+}
+
 // AlreadyExistsError (412 for Create)
 
 // A error type that is returned when an item already exists which prevents
@@ -53,6 +76,15 @@ func (a AlreadyExistsError) Error() string {
 	return fmt.Sprintf("An item with the key %s already exists.", string(a))
 }
 
+// LockedError (412 taking a Lock)
+
+// Returned when a Lock is held by another holder, naming the lock.
+type LockedError string
+
+func (e LockedError) Error() string {
+	return fmt.Sprintf("The lock %s is held by another holder.", string(e))
+}
+
 // NotMostRecentError (412 on Update/Delete)
 
 // The error object returned if a Conditional*() call fails due to the item
@@ -90,6 +122,16 @@ func (p RateLimitedError) Error() string {
 	return string(p)
 }
 
+// ReadOnlyError
+
+// Returned without sending the request when a Client with ReadOnly set is
+// asked to write, naming the method and path of the write.
+type ReadOnlyError string
+
+func (e ReadOnlyError) Error() string {
+	return fmt.Sprintf("Not sending %s, the client is read only.", string(e))
+}
+
 // UnknownError
 
 // An implementation of 'error' that exposes all the orchestrate specific
@@ -16,20 +16,21 @@ package gorc2
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 )
 
 // Internal type that represents the reply form a JSON event fetch.
 type jsonEvent struct {
-	Ordinal   int64           `json:"ordinal"`
-	Path      jsonPath        `json:"path"`
-	Timestamp int64           `json:"timestamp"`
-	Value     json.RawMessage `json:"value"`
+	Ordinal    int64           `json:"ordinal"`
+	OrdinalStr string          `json:"ordinal_str"`
+	Path       jsonPath        `json:"path"`
+	Timestamp  int64           `json:"timestamp"`
+	Value      json.RawMessage `json:"value"`
 }
 
 //
@@ -38,7 +39,8 @@ type jsonEvent struct {
 
 // Adds a new event to the collection with the given key, and type. The
 // timestamp of the new event will be set by the Orchestrate server to the
-// time that the request was processed. Unlike Create this function will
+// time that the request was processed, or if Client.Clock is set to the
+// time of the clock. Unlike Create this function will
 // created an event even if an event already exists with that tuple. The
 // new event will be given a new Ordinal value. To update and existing
 // Event use UpdateEvent() instead.
@@ -69,9 +71,16 @@ func (c *Collection) innerAddEvent(
 		Type:       typ,
 	}
 
+	// Orchestrate timestamps events without one on arrival, which a Clock
+	// other than the real one would not agree with.
+	if ts == nil && c.client.Clock != nil {
+		now := c.client.Clock.Now()
+		ts = &now
+	}
+
 	// Encode the JSON message into a raw value that we can return to the
 	// client if necessary.
-	if rawMsg, err := json.Marshal(value); err != nil {
+	if rawMsg, err := c.codec().Marshal(value); err != nil {
 		return nil, err
 	} else {
 		event.Value = json.RawMessage(rawMsg)
@@ -82,47 +91,57 @@ func (c *Collection) innerAddEvent(
 	var path string
 	if ts != nil {
 		path = fmt.Sprintf("%s/%s/events/%s/%d", c.Name, key, typ,
-			ts.UnixNano()/1000000)
+			toTimestamp(*ts))
 	} else {
 		path = fmt.Sprintf("%s/%s/events/%s", c.Name, key, typ)
 	}
-	resp, err := c.client.emptyReply("POST", path, headers,
+	resp, err := c.emptyReply("POST", path, headers,
 		bytes.NewBuffer(event.Value), 201)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the Location header and parse it. The Header will give us the
-	// Ordinal.
-	location := resp.Header.Get("Location")
-	if location == "" {
-		return nil, fmt.Errorf("Missing Location header.")
-	} else if parts := strings.Split(location, "/"); len(parts) != 8 {
-		return nil, fmt.Errorf("Malformed Location header.")
-	} else if ts, err := strconv.ParseInt(parts[6], 10, 64); err != nil {
-		return nil, fmt.Errorf("Malformed Timestamp in the Location header.")
-	} else if ord, err := strconv.ParseInt(parts[7], 10, 64); err != nil {
-		return nil, fmt.Errorf("Malformed Ordinal in the Location header.")
-	} else {
-		secs := ts / 1000
-		nsecs := (ts % 1000) * 1000000
-		event.Timestamp = time.Unix(secs, nsecs)
-		event.Ordinal = ord
-	}
-
-	// Get the Ref via the Etag header.
-	if etag := resp.Header.Get("Etag"); etag == "" {
-		return nil, fmt.Errorf("Missing ETag header.")
-	} else if parts := strings.Split(etag, `"`); len(parts) != 3 {
-		return nil, fmt.Errorf("Malformed ETag header.")
-	} else {
-		event.Ref = parts[1]
+	// The Location header gives us the timestamp and Ordinal, and the ETag
+	// header gives us the Ref.
+	loc, ref, err := eventRef(resp)
+	if err != nil {
+		return nil, err
 	}
+	event.Timestamp = fromTimestamp(loc.Timestamp)
+	event.Ordinal = loc.Ordinal
+	event.OrdinalStr = strconv.FormatInt(loc.Ordinal, 10)
+	event.Ref = ref
 
 	// Success
 	return event, nil
 }
 
+// Parses the string form of an event ordinal, as found in Event.OrdinalStr
+// or the "ordinal_str" field returned by Orchestrate. Ordinals are 64 bit
+// integers which lose precision in languages that store numbers as doubles,
+// such as JavaScript, so front ends should pass them around as strings and
+// convert them with this before calling GetEvent(), UpdateEvent() or
+// DeleteEvent().
+func ParseOrdinal(s string) (int64, error) {
+	ordinal, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Malformed ordinal %q.", s)
+	}
+	return ordinal, nil
+}
+
+// Returns the ordinal and its string form given what Orchestrate returned.
+// The string form is preferred when present since it can not have lost
+// precision along the way.
+func resolveOrdinal(ordinal int64, str string) (int64, string) {
+	if str != "" {
+		if parsed, err := ParseOrdinal(str); err == nil {
+			return parsed, str
+		}
+	}
+	return ordinal, strconv.FormatInt(ordinal, 10)
+}
+
 //
 // DeleteEvent
 //
@@ -134,8 +153,8 @@ func (c *Collection) DeleteEvent(
 	key, typ string, ts time.Time, ordinal int64,
 ) error {
 	path := fmt.Sprintf("%s/%s/events/%s/%d/%d?purge=true",
-		c.Name, key, typ, ts.UnixNano()/1000000, ordinal)
-	_, err := c.client.emptyReply("DELETE", path, nil, nil, 204)
+		c.Name, key, typ, toTimestamp(ts), ordinal)
+	_, err := c.emptyReply("DELETE", path, nil, nil, 204)
 	return err
 }
 
@@ -157,9 +176,9 @@ func (c *Collection) GetEvent(
 
 	// Perform the actual GET
 	path := fmt.Sprintf("%s/%s/events/%s/%d/%d", c.Name, key, typ,
-		ts.UnixNano()/1000000, ordinal)
+		toTimestamp(ts), ordinal)
 	var responseData jsonEvent
-	_, err := c.client.jsonReply("GET", path, nil, 200, &responseData)
+	_, err := c.jsonReply("GET", path, nil, nil, 200, &responseData)
 	if err != nil {
 		return nil, err
 	}
@@ -167,10 +186,9 @@ func (c *Collection) GetEvent(
 	// Move the data from the returned values into the Event object.
 	event.Value = responseData.Value
 	event.Ref = responseData.Path.Ref
-	secs := responseData.Timestamp / 1000
-	nsecs := (responseData.Timestamp % 1000) * 1000000
-	event.Timestamp = time.Unix(secs, nsecs)
-	event.Ordinal = responseData.Ordinal
+	event.Timestamp = fromTimestamp(responseData.Timestamp)
+	event.Ordinal, event.OrdinalStr = resolveOrdinal(responseData.Ordinal,
+		responseData.OrdinalStr)
 
 	// If the user provided us a place to unmarshal the 'value' field into
 	// we do that here.
@@ -210,7 +228,7 @@ func (c *Collection) innerUpdateEvent(
 
 	// Encode the JSON message into a raw value that we can return to the
 	// client if necessary.
-	if rawMsg, err := json.Marshal(value); err != nil {
+	if rawMsg, err := c.codec().Marshal(value); err != nil {
 		return nil, err
 	} else {
 		event.Value = json.RawMessage(rawMsg)
@@ -218,39 +236,23 @@ func (c *Collection) innerUpdateEvent(
 
 	// Perform the actual PUT
 	path := fmt.Sprintf("%s/%s/events/%s/%d/%d", c.Name, key, typ,
-		ts.UnixNano()/1000000, ordinal)
-	resp, err := c.client.emptyReply("PUT", path, headers,
+		toTimestamp(ts), ordinal)
+	resp, err := c.emptyReply("PUT", path, headers,
 		bytes.NewBuffer(event.Value), 204)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the Location header and parse it. The Header will give us the
-	// Ordinal.
-	location := resp.Header.Get("Location")
-	if location == "" {
-		return nil, fmt.Errorf("Missing Location header.")
-	} else if parts := strings.Split(location, "/"); len(parts) != 8 {
-		return nil, fmt.Errorf("Malformed Location header.")
-	} else if ts, err := strconv.ParseInt(parts[6], 10, 64); err != nil {
-		return nil, fmt.Errorf("Malformed Timestamp in the Location header.")
-	} else if ord, err := strconv.ParseInt(parts[7], 10, 64); err != nil {
-		return nil, fmt.Errorf("Malformed Ordinal in the Location header.")
-	} else {
-		secs := ts / 1000
-		nsecs := (ts % 1000) * 1000000
-		event.Timestamp = time.Unix(secs, nsecs)
-		event.Ordinal = ord
-	}
-
-	// Get the Ref via the Etag header.
-	if etag := resp.Header.Get("Etag"); etag == "" {
-		return nil, fmt.Errorf("Missing ETag header.")
-	} else if parts := strings.Split(etag, `"`); len(parts) != 3 {
-		return nil, fmt.Errorf("Malformed ETag header.")
-	} else {
-		event.Ref = parts[1]
+	// The Location header gives us the timestamp and Ordinal, and the ETag
+	// header gives us the Ref.
+	loc, ref, err := eventRef(resp)
+	if err != nil {
+		return nil, err
 	}
+	event.Timestamp = fromTimestamp(loc.Timestamp)
+	event.Ordinal = loc.Ordinal
+	event.OrdinalStr = strconv.FormatInt(loc.Ordinal, 10)
+	event.Ref = ref
 
 	// Success
 	return event, nil
@@ -318,37 +320,37 @@ func (c *Collection) ListEvents(
 		if opts.After != defaultTime {
 			if opts.AfterOrdinal != 0 {
 				query.Add("afterEvent", fmt.Sprintf("%d/%d",
-					opts.After.UnixNano()/1000000, opts.AfterOrdinal))
+					toTimestamp(opts.After), opts.AfterOrdinal))
 			} else {
 				query.Add("afterEvent",
-					strconv.FormatInt(opts.After.UnixNano()/1000000, 10))
+					strconv.FormatInt(toTimestamp(opts.After), 10))
 			}
 		}
 		if opts.Before != defaultTime {
 			if opts.BeforeOrdinal != 0 {
 				query.Add("beforeEvent", fmt.Sprintf("%d/%d",
-					opts.Before.UnixNano()/1000000, opts.BeforeOrdinal))
+					toTimestamp(opts.Before), opts.BeforeOrdinal))
 			} else {
 				query.Add("beforeEvent",
-					strconv.FormatInt(opts.Before.UnixNano()/1000000, 10))
+					strconv.FormatInt(toTimestamp(opts.Before), 10))
 			}
 		}
 		if opts.End != defaultTime {
 			if opts.EndOrdinal != 0 {
 				query.Add("endEvent", fmt.Sprintf("%d/%d",
-					opts.End.UnixNano()/1000000, opts.EndOrdinal))
+					toTimestamp(opts.End), opts.EndOrdinal))
 			} else {
 				query.Add("endEvent",
-					strconv.FormatInt(opts.End.UnixNano()/1000000, 10))
+					strconv.FormatInt(toTimestamp(opts.End), 10))
 			}
 		}
 		if opts.Start != defaultTime {
 			if opts.StartOrdinal != 0 {
 				query.Add("startEvent", fmt.Sprintf("%d/%d",
-					opts.Start.UnixNano()/1000000, opts.StartOrdinal))
+					toTimestamp(opts.Start), opts.StartOrdinal))
 			} else {
 				query.Add("startEvent",
-					strconv.FormatInt(opts.Start.UnixNano()/1000000, 10))
+					strconv.FormatInt(toTimestamp(opts.Start), 10))
 			}
 		}
 
@@ -360,7 +362,72 @@ func (c *Collection) ListEvents(
 
 	return &Iterator{
 		client:          c.client,
+		collection:      c,
 		iteratingEvents: true,
 		next:            path,
 	}
 }
+
+//
+// TailEvents
+//
+
+// Watches the events of the given type on a key, calling fn with each new
+// event oldest first. Orchestrate has no push API for events so this polls
+// ListEvents() every interval for events newer than the last one seen,
+// starting from since (or now if since is zero). Events added with a
+// timestamp older than the last one seen are not reported. This returns when
+// ctx is done, when fn returns an error, or when a poll fails.
+func (c *Collection) TailEvents(
+	ctx context.Context, key, typ string, since time.Time,
+	interval time.Duration, fn func(*Event) error,
+) error {
+	if since.IsZero() {
+		since = c.client.Now()
+	}
+	lastTimestamp, lastOrdinal := toTimestamp(since), int64(0)
+	tc := c.WithContext(ctx)
+
+	for {
+		// Events are listed newest first, so gather every event from the
+		// millisecond of the last one seen onwards and then walk them
+		// backwards.
+		var events []*Event
+		it := tc.ListEvents(key, typ, &ListEventsQuery{
+			Limit: 100,
+			Start: fromTimestamp(lastTimestamp),
+		})
+		for it.Next() {
+			event, err := it.GetEvent(nil)
+			if err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		if it.Error != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return it.Error
+		}
+
+		for n := len(events) - 1; n >= 0; n-- {
+			event := events[n]
+			ts := toTimestamp(event.Timestamp)
+			if ts < lastTimestamp ||
+				(ts == lastTimestamp && event.Ordinal <= lastOrdinal) {
+				continue
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+			lastTimestamp, lastOrdinal = ts, event.Ordinal
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.client.After(interval):
+		}
+	}
+}
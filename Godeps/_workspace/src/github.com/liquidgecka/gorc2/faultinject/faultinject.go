@@ -0,0 +1,197 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package faultinject provides an http.RoundTripper that makes some of the
+// requests passing through it slow or fail, so that applications can check
+// how their RetryPolicy and CircuitBreaker settings cope with a misbehaving
+// Orchestrate.
+//
+// Wrap the transport of a client, such as the LocalBackend of a client from
+// gorc2.NewLocalClient():
+//
+//	client := gorc2.NewLocalClient()
+//	client.HTTPClient = &http.Client{Transport: &faultinject.Transport{
+//		Base: client.HTTPClient.Transport,
+//		Faults: []faultinject.Fault{
+//			{Probability: 0.1, Status: 503},
+//			{Probability: 0.05, Latency: 2 * time.Second},
+//			{Probability: 0.01, TruncateAfter: 64},
+//		},
+//	}}
+package faultinject
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Something that goes wrong with a share of the requests. The effects set
+// are all applied to the requests the fault is chosen for.
+type Fault struct {
+	// The chance, from 0 to 1, of the fault being chosen for a request.
+	Probability float64
+
+	// If set the fault is only chosen for requests this returns true for.
+	Match func(req *http.Request) bool
+
+	// Delays the request by Latency plus a random duration of up to Jitter
+	// before it is sent.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Fails the request with this error without sending it, as a network
+	// error would.
+	Err error
+
+	// Replaces the status of the response. The request is still sent, so
+	// writes are made as they are when a proxy fails after forwarding them.
+	Status int
+
+	// Removes these headers from the response, such as "Location" or
+	// "ETag".
+	DropHeaders []string
+
+	// If positive the response body ends with io.ErrUnexpectedEOF after
+	// this many bytes, as it would if the connection was dropped.
+	TruncateAfter int
+}
+
+// An http.RoundTripper that injects Faults into the requests sent through
+// it. It is safe for concurrent use.
+type Transport struct {
+	// The transport requests are sent with, http.DefaultTransport if nil.
+	Base http.RoundTripper
+
+	// The faults that may be chosen for each request, in the order their
+	// effects are applied.
+	Faults []Fault
+
+	// The source of randomness for choosing faults and jitter. Set it to a
+	// seeded source to make runs repeatable. Defaults to math/rand's.
+	Rand *rand.Rand
+
+	lock     sync.Mutex
+	injected int
+}
+
+// Returns a random number in [0, 1).
+func (t *Transport) float64() float64 {
+	if t.Rand == nil {
+		return rand.Float64()
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.Rand.Float64()
+}
+
+// Returns how many times a fault has been chosen for a request.
+func (t *Transport) Injected() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.injected
+}
+
+// Sends a request through Base, applying the faults chosen for it.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var chosen []*Fault
+	for i := range t.Faults {
+		f := &t.Faults[i]
+		if (f.Match == nil || f.Match(req)) && t.float64() < f.Probability {
+			chosen = append(chosen, f)
+		}
+	}
+	if len(chosen) > 0 {
+		t.lock.Lock()
+		t.injected += len(chosen)
+		t.lock.Unlock()
+	}
+
+	for _, f := range chosen {
+		delay := f.Latency
+		if f.Jitter > 0 {
+			delay += time.Duration(t.float64() * float64(f.Jitter))
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				closeBody(req)
+				return nil, req.Context().Err()
+			}
+		}
+		if f.Err != nil {
+			closeBody(req)
+			return nil, f.Err
+		}
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || len(chosen) == 0 {
+		return resp, err
+	}
+
+	// The headers may be shared with the backend, so change a copy.
+	resp.Header = resp.Header.Clone()
+	for _, f := range chosen {
+		if f.Status != 0 {
+			resp.StatusCode = f.Status
+			resp.Status = fmt.Sprintf("%d %s", f.Status,
+				http.StatusText(f.Status))
+		}
+		for _, name := range f.DropHeaders {
+			resp.Header.Del(name)
+		}
+		if f.TruncateAfter > 0 {
+			resp.Body = &truncatedBody{resp.Body, f.TruncateAfter}
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+	}
+	return resp, nil
+}
+
+// Closes the body of a request that will not be sent, as RoundTrip must.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// A response body that fails after some bytes have been read.
+type truncatedBody struct {
+	io.ReadCloser
+	left int
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= n
+	return n, err
+}
@@ -0,0 +1,635 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//
+// Filter Expressions
+//
+
+// A parsed filter expression that can be checked against Items on the
+// client, such as:
+//
+//	value.power * value.kw >= 50 and not value.private
+//	key != "GB-123" or (score > 1.5 and value.owner.name = "Pod Point")
+//
+// Identifiers name fields of the Item's value by dotted path, with an
+// optional "value." prefix. Array elements are reached by index, as in
+// "value.Connector.0.RatedOutputkW", and other fields of an array are those
+// of all of its elements, as in Orchestrate searches, so a comparison with
+// "value.Connector.RatedOutputkW" holds if it holds for any connector. The
+// identifiers key, ref, score and distance name those fields of the Item
+// itself. Literals are numbers, double quoted strings, true, false and null.
+//
+// The operators, from loosest to tightest binding, are "or", "and", "not",
+// the comparisons = != < <= > >=, then + - and * / %, and they may be
+// grouped with parentheses. "&&", "||", "!" and "==" may be used as well.
+// Arithmetic on anything but numbers, and ordering anything but two numbers
+// or two strings, gives null, and comparisons with null other than = and !=
+// are false. A missing field is null. Where a boolean is needed null, false,
+// 0 and "" count as false and everything else as true.
+type FilterExpr struct {
+	source string
+	root   filterNode
+}
+
+// Parses a filter expression, see FilterExpr.
+func ParseFilter(expr string) (*FilterExpr, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter %q: %s", expr, err)
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != filterEOF {
+		err = fmt.Errorf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter %q: %s", expr, err)
+	}
+	return &FilterExpr{source: expr, root: root}, nil
+}
+
+// Returns the expression as it was given to ParseFilter().
+func (f *FilterExpr) String() string {
+	return f.source
+}
+
+// Returns true if the expression holds for the given Item. Values that are
+// not JSON objects have no fields.
+func (f *FilterExpr) Match(item *Item) bool {
+	return truthy(f.root.eval(&filterEnv{item: item}))
+}
+
+// Returns the value of the expression for the given Item: a float64,
+// string, bool, nil, or the decoded JSON of an object or array field. A
+// field of the elements of an array gives a []interface{} of their values.
+func (f *FilterExpr) Eval(item *Item) interface{} {
+	v := f.root.eval(&filterEnv{item: item})
+	if values, ok := v.(filterAny); ok {
+		return []interface{}(values)
+	}
+	return v
+}
+
+// Makes Next() skip the results that the filter expression does not hold
+// for, see FilterExpr and Filter(). If the expression is invalid the error
+// is stored in Error and no results are returned. This must be called
+// before the first call to Next() and returns the Iterator so it can be
+// chained:
+//
+//	it := collection.List(nil).Where("value.power * value.kw >= 50")
+func (i *Iterator) Where(expr string) *Iterator {
+	f, err := ParseFilter(expr)
+	if err != nil {
+		i.Error = err
+		return i
+	}
+	return i.Filter(f.Match)
+}
+
+// The Item being checked, with its value decoded the first time a field of
+// it is needed.
+type filterEnv struct {
+	item    *Item
+	decoded bool
+	value   map[string]interface{}
+}
+
+func (e *filterEnv) field(path []string) interface{} {
+	if !e.decoded {
+		e.decoded = true
+		e.value, _ = decodeObject(e.item.Value)
+	}
+	var values filterAny
+	spread := false
+	var walk func(current interface{}, path []string)
+	walk = func(current interface{}, path []string) {
+		if len(path) == 0 {
+			if n, ok := current.(json.Number); ok {
+				f, err := n.Float64()
+				if err != nil {
+					return
+				}
+				current = f
+			}
+			values = append(values, current)
+			return
+		}
+		switch v := current.(type) {
+		case map[string]interface{}:
+			if next, ok := v[path[0]]; ok {
+				walk(next, path[1:])
+			}
+		case []interface{}:
+			if n, err := strconv.Atoi(path[0]); err == nil {
+				if n >= 0 && n < len(v) {
+					walk(v[n], path[1:])
+				}
+				return
+			}
+			spread = true
+			for _, element := range v {
+				walk(element, path)
+			}
+		}
+	}
+	walk(e.value, path)
+	if spread {
+		return values
+	} else if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// The values of a field of the elements of an array. Comparisons with it
+// hold if they hold for any of the values.
+type filterAny []interface{}
+
+// Returns true if fn holds for v, or for any of its values if it is a
+// filterAny.
+func anyOf(v interface{}, fn func(interface{}) bool) bool {
+	if values, ok := v.(filterAny); ok {
+		for _, value := range values {
+			if fn(value) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(v)
+}
+
+//
+// Evaluation
+//
+
+type filterNode interface {
+	eval(env *filterEnv) interface{}
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+func (n *filterLiteral) eval(*filterEnv) interface{} {
+	return n.value
+}
+
+// A field of the Item's value.
+type filterField struct {
+	path []string
+}
+
+func (n *filterField) eval(env *filterEnv) interface{} {
+	return env.field(n.path)
+}
+
+// One of the key, ref, score or distance fields of the Item.
+type filterItemField struct {
+	name string
+}
+
+func (n *filterItemField) eval(env *filterEnv) interface{} {
+	switch n.name {
+	case "key":
+		return env.item.Key
+	case "ref":
+		return env.item.Ref
+	case "score":
+		return float64(env.item.Score)
+	default:
+		return float64(env.item.Distance)
+	}
+}
+
+type filterNot struct {
+	operand filterNode
+}
+
+func (n *filterNot) eval(env *filterEnv) interface{} {
+	return !truthy(n.operand.eval(env))
+}
+
+type filterNegate struct {
+	operand filterNode
+}
+
+func (n *filterNegate) eval(env *filterEnv) interface{} {
+	if f, ok := n.operand.eval(env).(float64); ok {
+		return -f
+	}
+	return nil
+}
+
+type filterBinary struct {
+	op          string
+	left, right filterNode
+}
+
+func (n *filterBinary) eval(env *filterEnv) interface{} {
+	// "and" and "or" only evaluate the right side if they need to.
+	switch n.op {
+	case "and":
+		return truthy(n.left.eval(env)) && truthy(n.right.eval(env))
+	case "or":
+		return truthy(n.left.eval(env)) || truthy(n.right.eval(env))
+	}
+
+	left, right := n.left.eval(env), n.right.eval(env)
+	switch n.op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		return anyOf(left, func(l interface{}) bool {
+			return anyOf(right, func(r interface{}) bool {
+				return filterCompares(n.op, l, r)
+			})
+		})
+	}
+
+	a, aok := left.(float64)
+	b, bok := right.(float64)
+	if !aok || !bok {
+		return nil
+	}
+	switch n.op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		if b == 0 {
+			return nil
+		}
+		return a / b
+	default:
+		if b == 0 {
+			return nil
+		}
+		return float64(int64(a) % int64(b))
+	}
+}
+
+// Returns true if a comparison holds for two values.
+func filterCompares(op string, a, b interface{}) bool {
+	switch op {
+	case "=":
+		return filterEqual(a, b)
+	case "!=":
+		return !filterEqual(a, b)
+	}
+	c, ok := filterCompare(a, b)
+	if !ok {
+		return false
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// Returns false for null, false, 0 and "", and true for everything else.
+// The values of an array field are true if any of them are.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case filterAny:
+		return anyOf(v, truthy)
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// Returns true if two scalar values are the same. Objects and arrays are
+// never equal to anything.
+func filterEqual(a, b interface{}) bool {
+	switch a.(type) {
+	case nil, bool, float64, string:
+		return a == b
+	}
+	return false
+}
+
+// Orders two numbers or two strings, returning false for anything else.
+func filterCompare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+//
+// Parsing
+//
+
+const (
+	filterEOF = iota
+	filterIdent
+	filterNumber
+	filterString
+	filterOp
+)
+
+type filterToken struct {
+	kind  int
+	text  string
+	value interface{}
+}
+
+func (t filterToken) String() string {
+	if t.kind == filterEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// The operators in the order they are tried, longest first.
+var filterOperators = []string{
+	"&&", "||", "==", "!=", "<=", ">=",
+	"=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")",
+}
+
+// Splits an expression into tokens, ending with a filterEOF token. The
+// words and, or and not become the operators they name.
+func lexFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for pos := 0; ; {
+		for pos < len(expr) && unicode.IsSpace(rune(expr[pos])) {
+			pos++
+		}
+		if pos == len(expr) {
+			return append(tokens, filterToken{kind: filterEOF}), nil
+		}
+		rest := expr[pos:]
+		c := rest[0]
+
+		switch {
+		case c == '"':
+			// Find the closing quote, skipping escaped characters.
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s", rest[:end+1])
+			}
+			tokens = append(tokens,
+				filterToken{kind: filterString, text: rest[:end+1], value: s})
+			pos += end + 1
+
+		case c >= '0' && c <= '9' || c == '.':
+			// Signs are only part of the number straight after an exponent.
+			end := 1
+			for end < len(rest) {
+				signed := rest[end] == '+' || rest[end] == '-'
+				if strings.IndexByte("0123456789.eE", rest[end]) < 0 &&
+					!(signed && strings.IndexByte("eE", rest[end-1]) >= 0) {
+					break
+				}
+				end++
+			}
+			f, err := strconv.ParseFloat(rest[:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q", rest[:end])
+			}
+			tokens = append(tokens,
+				filterToken{kind: filterNumber, text: rest[:end], value: f})
+			pos += end
+
+		case c == '_' || c == '$' || unicode.IsLetter(rune(c)):
+			end := 0
+			for end < len(rest) && (rest[end] == '_' || rest[end] == '$' ||
+				rest[end] == '.' || unicode.IsLetter(rune(rest[end])) ||
+				unicode.IsDigit(rune(rest[end]))) {
+				end++
+			}
+			word := rest[:end]
+			switch strings.ToLower(word) {
+			case "and", "or", "not":
+				tokens = append(tokens, filterToken{
+					kind: filterOp, text: strings.ToLower(word)})
+			default:
+				tokens = append(tokens,
+					filterToken{kind: filterIdent, text: word})
+			}
+			pos += end
+
+		default:
+			found := false
+			for _, op := range filterOperators {
+				if strings.HasPrefix(rest, op) {
+					tokens = append(tokens, filterToken{kind: filterOp, text: op})
+					pos += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+		}
+	}
+}
+
+// A recursive descent parser with one function per precedence level.
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+// Consumes the next token if it is one of the given operators, returning
+// the operator in its canonical form.
+func (p *filterParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != filterOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			switch op {
+			case "&&":
+				return "and", true
+			case "||":
+				return "or", true
+			case "!":
+				return "not", true
+			case "==":
+				return "=", true
+			}
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	return p.parseBinary(p.parseAnd, "or", "||")
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	return p.parseBinary(p.parseNot, "and", "&&")
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if _, ok := p.accept("not", "!"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+// Comparisons do not chain, so "a < b < c" is an error.
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("=", "==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	return &filterBinary{op, left, right}, nil
+}
+
+func (p *filterParser) parseSum() (filterNode, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *filterParser) parseProduct() (filterNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+// Parses a left associative chain of the given operators.
+func (p *filterParser) parseBinary(
+	operand func() (filterNode, error), ops ...string,
+) (filterNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterBinary{op, left, right}
+	}
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNegate{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case filterNumber, filterString:
+		p.pos++
+		return &filterLiteral{t.value}, nil
+	case filterIdent:
+		p.pos++
+		switch t.text {
+		case "true":
+			return &filterLiteral{true}, nil
+		case "false":
+			return &filterLiteral{false}, nil
+		case "null":
+			return &filterLiteral{nil}, nil
+		case "key", "ref", "score", "distance":
+			return &filterItemField{t.text}, nil
+		}
+		path := strings.Split(strings.TrimPrefix(t.text, "value."), ".")
+		for _, part := range path {
+			if part == "" {
+				return nil, fmt.Errorf("bad field path %q", t.text)
+			}
+		}
+		return &filterField{path}, nil
+	}
+	if _, ok := p.accept("("); ok {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("expected \")\" but found %s", p.peek())
+		}
+		return inner, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
@@ -0,0 +1,120 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func FuzzParseLocation(f *testing.F) {
+	for _, seed := range []string{
+		"/v0/col/key/refs/abc",
+		"https://api.orchestrate.io/v0/col/key/refs/abc?x=1",
+		"/proxy/prefix/v0/col/a%2Fb%20c/refs/abc",
+		"/v0/col/key/events/typ/1400000000000/7",
+		"/v0/col/key/events/typ/-1/99999999999999999999",
+		"/v0//key/refs/abc",
+		"/v0/col/%zz/refs/abc",
+		"::",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		loc, err := parseLocation(header)
+		if err != nil {
+			return
+		}
+		if loc.Collection == "" || loc.Key == "" ||
+			(loc.Ref == "" && loc.Type == "") {
+			t.Fatalf("%q parsed as %+v, which has empty parts", header, loc)
+		}
+	})
+}
+
+func FuzzParseETag(f *testing.F) {
+	for _, seed := range []string{
+		`"abc"`, `W/"abc"`, `"abc-gzip"`, ` "abc" `, `""`, `"-gzip"`, `"a"b"`,
+		`W/`, `"`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		ref, err := parseETag(header)
+		if err != nil {
+			return
+		}
+		if ref == "" || strings.Contains(ref, `"`) {
+			t.Fatalf("%q parsed as %q", header, ref)
+		}
+		strong := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+		if weak, err := parseETag("W/" + strong); err != nil || weak != ref {
+			t.Fatalf("weak form of %q parsed as %q, %v", header, weak, err)
+		}
+	})
+}
+
+// Answers every request with the same body, as a list of results.
+type bodyTransport []byte
+
+func (b bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(b)),
+		Request:    req,
+	}, nil
+}
+
+func FuzzListDecode(f *testing.F) {
+	for _, seed := range []string{
+		string(listPage(2)),
+		`{"count":1,"results":[{"path":{"collection":"c","key":"k",` +
+			`"ref":"r"},"value":{"a":1}}],"next":"/v0/c?limit=1&afterKey=k"}`,
+		`{"count":1,"results":[{"path":{"collection":"c","key":"k",` +
+			`"type":"t","timestamp":1,"ordinal":2},"value":{}}]}`,
+		`{"results":[null]}`,
+		`{"results":[{}],"next":"::"}`,
+		`{"results":null}`,
+		`[]`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		c := NewClient("test")
+		c.HTTPClient = &http.Client{Transport: bodyTransport(body)}
+		collection := c.Collection("c")
+		for _, it := range []*Iterator{
+			collection.List(&ListQuery{Limit: 10}),
+			collection.Search("*", &SearchQuery{Limit: 10}),
+			collection.ListEvents("k", "t", nil),
+		} {
+			// The same page is returned forever if it has a next link.
+			for n := 0; n < 3 && it.Next(); n++ {
+				it.Raw()
+				if it.iteratingEvents {
+					it.GetEvent(nil)
+				} else {
+					var value interface{}
+					it.Get(&value)
+				}
+			}
+		}
+	})
+}
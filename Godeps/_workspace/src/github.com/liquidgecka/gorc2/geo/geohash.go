@@ -0,0 +1,249 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package geo provides a geohash based spatial index that works with plain
+// term searches, for backends without native geo search such as the local
+// in-memory backend.
+//
+// On write store the result of Prefixes() for the location in a field of
+// the value, then search with the query returned by BoxQuery() for that
+// field. Geohash cells only approximate the box, so the results must be
+// filtered with Box.Contains() to drop the points just outside of it.
+package geo
+
+import (
+	"math"
+	"strings"
+)
+
+// The geohash alphabet.
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// The precision used by Prefixes() if none is given, which is cells of
+// roughly 5 meters.
+const DefaultPrecision = 9
+
+// The maximum supported precision.
+const MaxPrecision = 12
+
+//
+// Box
+//
+
+// An area bounded by latitudes and longitudes in degrees. If West is
+// greater than East then the box crosses the antimeridian.
+type Box struct {
+	North float64
+	South float64
+	East  float64
+	West  float64
+}
+
+// Returns true if the given point is inside the box, including its edges.
+func (b Box) Contains(lat, lon float64) bool {
+	if lat < b.South || lat > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return lon >= b.West && lon <= b.East
+	}
+	return lon >= b.West || lon <= b.East
+}
+
+//
+// Encoding
+//
+
+// Returns the geohash of a point with the given number of characters.
+// Precision is clamped to between 1 and MaxPrecision.
+func Encode(lat, lon float64, precision int) string {
+	precision = clamp(precision)
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true
+	bits, ch := 0, 0
+	for len(hash) < precision {
+		if even {
+			ch = ch<<1 | bisect(&lonRange, lon)
+		} else {
+			ch = ch<<1 | bisect(&latRange, lat)
+		}
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, base32[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// Returns the cell covered by a geohash. Characters outside of the geohash
+// alphabet are ignored.
+func Bounds(hash string) Box {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		n := strings.IndexRune(base32, c)
+		if n < 0 {
+			continue
+		}
+		for bit := 4; bit >= 0; bit-- {
+			r := &latRange
+			if even {
+				r = &lonRange
+			}
+			mid := (r[0] + r[1]) / 2
+			if n>>uint(bit)&1 == 1 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return Box{
+		North: latRange[1],
+		South: latRange[0],
+		East:  lonRange[1],
+		West:  lonRange[0],
+	}
+}
+
+// Returns every prefix of the geohash of a point, shortest first, up to the
+// given precision. Storing these in an array field lets any cell containing
+// the point be found with an exact term search. A precision of zero or less
+// uses DefaultPrecision.
+func Prefixes(lat, lon float64, precision int) []string {
+	if precision <= 0 {
+		precision = DefaultPrecision
+	}
+	hash := Encode(lat, lon, precision)
+	prefixes := make([]string, len(hash))
+	for n := range hash {
+		prefixes[n] = hash[:n+1]
+	}
+	return prefixes
+}
+
+// Narrows a range to the half holding value, returning 1 for the upper half
+// and 0 for the lower.
+func bisect(r *[2]float64, value float64) int {
+	mid := (r[0] + r[1]) / 2
+	if value >= mid {
+		r[0] = mid
+		return 1
+	}
+	r[1] = mid
+	return 0
+}
+
+// Clamps a precision to the supported range.
+func clamp(precision int) int {
+	if precision < 1 {
+		return 1
+	} else if precision > MaxPrecision {
+		return MaxPrecision
+	}
+	return precision
+}
+
+//
+// Queries
+//
+
+// Returns the geohash cells covering a box using the finest precision that
+// needs no more than maxCells cells. If even single character cells exceed
+// maxCells those are returned anyway. The cells may extend beyond the box.
+func Cover(box Box, maxCells int) []string {
+	if box.South > box.North {
+		return nil
+	}
+	precision := 1
+	for p := 2; p <= MaxPrecision; p++ {
+		if cellCount(box, p) > maxCells {
+			break
+		}
+		precision = p
+	}
+
+	latStep, lonStep := cellSize(precision)
+	var cells []string
+	seen := make(map[string]bool)
+	for _, span := range lonSpans(box) {
+		for row := cellIndex(box.South+90, latStep); row <= cellIndex(box.North+90, latStep); row++ {
+			lat := math.Min(-90+(float64(row)+0.5)*latStep, 90)
+			for col := cellIndex(span[0]+180, lonStep); col <= cellIndex(span[1]+180, lonStep); col++ {
+				lon := math.Min(-180+(float64(col)+0.5)*lonStep, 180)
+				hash := Encode(lat, lon, precision)
+				if !seen[hash] {
+					seen[hash] = true
+					cells = append(cells, hash)
+				}
+			}
+		}
+	}
+	return cells
+}
+
+// Returns a search query matching items whose field holds the prefix of any
+// cell covering the box, where field was populated with Prefixes(). The
+// query is for a field such as "value.geohash" and can be combined with
+// other clauses using AND.
+func BoxQuery(field string, box Box, maxCells int) string {
+	cells := Cover(box, maxCells)
+	if len(cells) == 0 {
+		return "NOT *"
+	}
+	terms := make([]string, len(cells))
+	for n, cell := range cells {
+		terms[n] = field + ":" + cell
+	}
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
+
+// Returns the height and width in degrees of cells at a precision.
+func cellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// Returns the number of cells at a precision needed to cover a box.
+func cellCount(box Box, precision int) int {
+	latStep, lonStep := cellSize(precision)
+	rows := cellIndex(box.North+90, latStep) - cellIndex(box.South+90, latStep) + 1
+	count := 0
+	for _, span := range lonSpans(box) {
+		cols := cellIndex(span[1]+180, lonStep) - cellIndex(span[0]+180, lonStep) + 1
+		count += rows * cols
+	}
+	return count
+}
+
+// Returns the index of the cell holding an offset from the origin.
+func cellIndex(offset, step float64) int {
+	return int(math.Floor(offset / step))
+}
+
+// Returns the longitude spans of a box, splitting boxes that cross the
+// antimeridian in two.
+func lonSpans(box Box) [][2]float64 {
+	if box.West <= box.East {
+		return [][2]float64{{box.West, box.East}}
+	}
+	return [][2]float64{{box.West, 180}, {-180, box.East}}
+}
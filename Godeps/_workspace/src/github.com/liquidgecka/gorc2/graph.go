@@ -51,6 +51,7 @@ func (c *Collection) GetLinks(
 	}
 	return &Iterator{
 		client:         c.client,
+		collection:     c,
 		iteratingItems: true,
 		next:           path,
 	}
@@ -66,7 +67,7 @@ func (c *Collection) GetLinks(
 func (c *Collection) Link(key, kind, toCollection, toKey string) error {
 	path := fmt.Sprintf("%s/%s/relation/%s/%s/%s", c.Name, key, kind,
 		toCollection, toKey)
-	_, err := c.client.emptyReply("PUT", path, nil, nil, 204)
+	_, err := c.emptyReply("PUT", path, nil, nil, 204)
 	return err
 }
 
@@ -79,6 +80,6 @@ func (c *Collection) Link(key, kind, toCollection, toKey string) error {
 func (c *Collection) Unlink(key, kind, toCollection, toKey string) error {
 	path := fmt.Sprintf("%s/%s/relation/%s/%s/%s?purge=true", c.Name, key,
 		kind, toCollection, toKey)
-	_, err := c.client.emptyReply("DELETE", path, nil, nil, 204)
+	_, err := c.emptyReply("DELETE", path, nil, nil, 204)
 	return err
 }
@@ -0,0 +1,160 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//
+// Response header parsing
+//
+
+// The details carried in a Location or Content-Location header returned by
+// Orchestrate. Item locations look like:
+//
+//	/v0/collection/key/refs/ref
+//
+// and event locations look like:
+//
+//	/v0/collection/key/events/type/timestamp/ordinal
+type resourceLocation struct {
+	Collection string
+	Key        string
+
+	// Set for item locations.
+	Ref string
+
+	// Set for event locations.
+	Type      string
+	Timestamp int64
+	Ordinal   int64
+}
+
+// Parses a Location or Content-Location header value. The value may be a
+// full URL or just a path, and may have extra segments in front of the API
+// version (added by a proxy for example) or a query string after it.
+func parseLocation(header string) (*resourceLocation, error) {
+	if header == "" {
+		return nil, fmt.Errorf("Empty location.")
+	}
+	u, err := url.Parse(header)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed location %q.", header)
+	}
+
+	// Find where the API path starts, skipping anything in front of the
+	// version segment.
+	parts := strings.Split(strings.Trim(u.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		if part == "v0" {
+			parts = parts[i+1:]
+			break
+		}
+	}
+	for i, part := range parts {
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			return nil, fmt.Errorf("Malformed location %q.", header)
+		} else if parts[i] == "" {
+			return nil, fmt.Errorf("Malformed location %q.", header)
+		}
+	}
+
+	switch {
+	case len(parts) == 4 && parts[2] == "refs":
+		return &resourceLocation{
+			Collection: parts[0],
+			Key:        parts[1],
+			Ref:        parts[3],
+		}, nil
+	case len(parts) == 6 && parts[2] == "events":
+		loc := &resourceLocation{
+			Collection: parts[0],
+			Key:        parts[1],
+			Type:       parts[3],
+		}
+		if loc.Timestamp, err = strconv.ParseInt(parts[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("Malformed timestamp in location %q.",
+				header)
+		}
+		if loc.Ordinal, err = strconv.ParseInt(parts[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("Malformed ordinal in location %q.", header)
+		}
+		return loc, nil
+	}
+	return nil, fmt.Errorf("Unrecognized location %q.", header)
+}
+
+// Parses an ETag header value into the ref it carries. Both strong ("ref")
+// and weak (W/"ref") forms are accepted, along with the "-gzip" suffix some
+// proxies add when they compress a response.
+func parseETag(header string) (string, error) {
+	etag := strings.TrimSpace(header)
+	etag = strings.TrimPrefix(etag, "W/")
+	if len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return "", fmt.Errorf("Malformed ETag %q.", header)
+	}
+	etag = etag[1 : len(etag)-1]
+	etag = strings.TrimSuffix(etag, "-gzip")
+	if etag == "" || strings.Contains(etag, `"`) {
+		return "", fmt.Errorf("Malformed ETag %q.", header)
+	}
+	return etag, nil
+}
+
+// Returns the ref of the item a response refers to, read from the given
+// location header. The ETag header is used if the location is missing.
+func itemRef(resp *http.Response, header string) (string, error) {
+	if value := resp.Header.Get(header); value != "" {
+		loc, err := parseLocation(value)
+		if err != nil {
+			return "", err
+		} else if loc.Ref == "" {
+			return "", fmt.Errorf("%s header is not an item location.", header)
+		}
+		return loc.Ref, nil
+	} else if etag := resp.Header.Get("ETag"); etag != "" {
+		return parseETag(etag)
+	}
+	return "", fmt.Errorf("Missing %s header.", header)
+}
+
+// Returns the location and ref of the event a response refers to, read from
+// the Location and ETag headers.
+func eventRef(resp *http.Response) (*resourceLocation, string, error) {
+	value := resp.Header.Get("Location")
+	if value == "" {
+		return nil, "", fmt.Errorf("Missing Location header.")
+	}
+	loc, err := parseLocation(value)
+	if err != nil {
+		return nil, "", err
+	} else if loc.Type == "" {
+		return nil, "", fmt.Errorf("Location header is not an event location.")
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return nil, "", fmt.Errorf("Missing ETag header.")
+	}
+	ref, err := parseETag(etag)
+	if err != nil {
+		return nil, "", err
+	}
+	return loc, ref, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		want   *resourceLocation
+	}{
+		{"/v0/col/key/refs/abc",
+			&resourceLocation{Collection: "col", Key: "key", Ref: "abc"}},
+		{"https://api.orchestrate.io/v0/col/key/refs/abc?x=1",
+			&resourceLocation{Collection: "col", Key: "key", Ref: "abc"}},
+		{"/proxy/prefix/v0/col/a%2Fb%20c/refs/abc",
+			&resourceLocation{Collection: "col", Key: "a/b c", Ref: "abc"}},
+		{"/v0/col/key/events/typ/1400000000000/7",
+			&resourceLocation{Collection: "col", Key: "key", Type: "typ",
+				Timestamp: 1400000000000, Ordinal: 7}},
+	} {
+		got, err := parseLocation(test.header)
+		if err != nil {
+			t.Errorf("%q: %s", test.header, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q parsed as %+v, expected %+v", test.header, got,
+				test.want)
+		}
+	}
+
+	for _, header := range []string{
+		"",
+		"/v0/col/key",
+		"/v0/col/key/refs",
+		"/v0/col/key/events/typ/abc/7",
+		"/v0/col/key/events/typ/1400000000000/x",
+		"/v0/col/%zz/refs/abc",
+		"::",
+	} {
+		if loc, err := parseLocation(header); err == nil {
+			t.Errorf("%q parsed as %+v, expected an error", header, loc)
+		}
+	}
+}
+
+func TestParseETag(t *testing.T) {
+	for header, want := range map[string]string{
+		`"abc"`:        "abc",
+		` "abc" `:      "abc",
+		`W/"abc"`:      "abc",
+		`"abc-gzip"`:   "abc",
+		`W/"abc-gzip"`: "abc",
+	} {
+		if got, err := parseETag(header); err != nil {
+			t.Errorf("%q: %s", header, err)
+		} else if got != want {
+			t.Errorf("%q parsed as %q, expected %q", header, got, want)
+		}
+	}
+	for _, header := range []string{
+		"", `""`, `"`, "abc", `"a"b"`, `W/abc`, `"-gzip"`,
+	} {
+		if ref, err := parseETag(header); err == nil {
+			t.Errorf("%q parsed as %q, expected an error", header, ref)
+		}
+	}
+}
+
+func TestItemRef(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if _, err := itemRef(resp, "Location"); err == nil {
+		t.Error("expected an error without headers")
+	}
+	resp.Header.Set("ETag", `"frometag"`)
+	if ref, err := itemRef(resp, "Location"); err != nil || ref != "frometag" {
+		t.Errorf("got %q, %v, expected the ETag ref", ref, err)
+	}
+	resp.Header.Set("Location", "/v0/col/key/refs/fromlocation")
+	if ref, err := itemRef(resp, "Location"); err != nil ||
+		ref != "fromlocation" {
+		t.Errorf("got %q, %v, expected the Location ref", ref, err)
+	}
+	resp.Header.Set("Location", "/v0/col/key/events/typ/1/2")
+	if _, err := itemRef(resp, "Location"); err == nil {
+		t.Error("expected an error for an event location")
+	}
+}
+
+func TestEventRef(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Location", "/v0/col/key/events/typ/1400000000000/7")
+	if _, _, err := eventRef(resp); err == nil {
+		t.Error("expected an error without an ETag")
+	}
+	resp.Header.Set("ETag", `"ref"`)
+	loc, ref, err := eventRef(resp)
+	if err != nil {
+		t.Fatal(err)
+	} else if ref != "ref" || loc.Type != "typ" || loc.Ordinal != 7 {
+		t.Errorf("got %+v and %q", loc, ref)
+	}
+	resp.Header.Set("Location", "/v0/col/key/refs/abc")
+	if _, _, err := eventRef(resp); err == nil {
+		t.Error("expected an error for an item location")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//
+// IDGenerator
+//
+
+// Generates the keys of items created with Collection.CreateAuto(), for
+// values that have no natural key. Implementations must be safe to call
+// from multiple goroutines. The client uses ULID unless Client.IDGenerator
+// is set.
+type IDGenerator interface {
+	NewID() string
+}
+
+// Generates ULIDs: 26 character keys made of the millisecond they were
+// generated in and 80 random bits, so keys sort in the order they were
+// created. Keys generated in the same millisecond by one generator are
+// made by incrementing the random bits, so they sort in order too.
+var ULID IDGenerator = &ulidGenerator{}
+
+// Generates random (version 4) UUIDs, such as
+// "0f8fad5b-d9cb-469f-a165-70867728950e".
+var UUID IDGenerator = uuidGenerator{}
+
+// The alphabet of ULIDs, Crockford's base 32.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type ulidGenerator struct {
+	mu      sync.Mutex
+	last    int64
+	entropy [10]byte
+}
+
+func (g *ulidGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := time.Now().UnixMilli()
+	if ms <= g.last {
+		// Increment the random bits so the key sorts after the last one,
+		// moving to the next millisecond if they overflow.
+		ms = g.last
+		i := len(g.entropy) - 1
+		for ; i >= 0; i-- {
+			if g.entropy[i]++; g.entropy[i] != 0 {
+				break
+			}
+		}
+		if i < 0 {
+			ms++
+			rand.Read(g.entropy[:])
+		}
+	} else {
+		rand.Read(g.entropy[:])
+	}
+	g.last = ms
+
+	// 48 bits of time and 80 of entropy, 5 bits to a character.
+	var id [26]byte
+	for i := 9; i >= 0; i-- {
+		id[i] = crockford[ms&31]
+		ms >>= 5
+	}
+	var bits uint64
+	var n uint
+	j := 10
+	for _, b := range g.entropy {
+		bits = bits<<8 | uint64(b)
+		for n += 8; n >= 5; n -= 5 {
+			id[j] = crockford[(bits>>(n-5))&31]
+			j++
+		}
+	}
+	return string(id[:])
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" +
+		h[20:]
+}
+
+// The bits of a snowflake ID given to the node and to the sequence number
+// within a millisecond. The rest hold the milliseconds since the epoch.
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+)
+
+// The epoch of snowflake IDs generated by NewSnowflake() when none is
+// given, 2015-01-01 UTC.
+var SnowflakeEpoch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Returns a generator of snowflake IDs: 64 bit numbers made of the
+// milliseconds since the epoch, the node and a sequence number, written
+// as 19 decimal digits so that they sort in the order they were created.
+// Every process generating keys for the same collection must be given a
+// different node, from 0 to 1023. If epoch is zero SnowflakeEpoch is used.
+func NewSnowflake(node int64, epoch time.Time) (IDGenerator, error) {
+	if node < 0 || node >= 1<<snowflakeNodeBits {
+		return nil, fmt.Errorf("Snowflake node %d is not between 0 and %d.",
+			node, 1<<snowflakeNodeBits-1)
+	}
+	if epoch.IsZero() {
+		epoch = SnowflakeEpoch
+	}
+	return &snowflakeGenerator{node: node, epoch: epoch}, nil
+}
+
+type snowflakeGenerator struct {
+	node  int64
+	epoch time.Time
+
+	mu       sync.Mutex
+	last     int64
+	sequence int64
+}
+
+func (g *snowflakeGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := time.Since(g.epoch).Milliseconds()
+	if ms <= g.last {
+		// Take the next sequence number, borrowing the next millisecond
+		// when they run out.
+		ms = g.last
+		if g.sequence++; g.sequence == 1<<snowflakeSequenceBits {
+			ms++
+			g.sequence = 0
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.last = ms
+	id := ms<<(snowflakeNodeBits+snowflakeSequenceBits) |
+		g.node<<snowflakeSequenceBits | g.sequence
+	return fmt.Sprintf("%019d", id)
+}
+
+// Returns the IDGenerator configured on the client, or ULID.
+func (c *Client) idGenerator() IDGenerator {
+	if c == nil || c.IDGenerator == nil {
+		return ULID
+	}
+	return c.IDGenerator
+}
+
+// How many keys CreateAuto() tries before giving up, in case a generated
+// key is already taken.
+const createAutoAttempts = 3
+
+// Creates a new value under a key generated by the client's IDGenerator and
+// returns the Item, which holds the key. A key that is already taken, which
+// only happens if generators are misconfigured, is replaced with a new one
+// a few times before an AlreadyExistsError is returned.
+func (c *Collection) CreateAuto(value interface{}) (*Item, error) {
+	generator := c.client.idGenerator()
+	for attempt := 1; ; attempt++ {
+		item, err := c.Create(generator.NewID(), value)
+		_, taken := err.(AlreadyExistsError)
+		if !taken || attempt == createAutoAttempts {
+			return item, err
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+//
+// IndexedCollection
+//
+
+// A Collection that maintains exact match indexes on some of its fields so
+// items can be looked up by field value without a search. This is useful for
+// identifiers such as OCPI party IDs which search tokenizes into pieces.
+//
+// For each indexed field and value an index document listing the keys of
+// the items holding that value is kept in Index. Only Create, Update, Delete
+// and Purge on the IndexedCollection maintain the indexes; writes made any
+// other way, including through the embedded Collection, must be followed by
+// Reindex. Fields may hold strings, numbers, booleans or arrays of those,
+// with each array element indexed separately.
+type IndexedCollection struct {
+	*Collection
+
+	// The collection the index documents are stored in. This can be shared
+	// between several IndexedCollections.
+	Index *Collection
+
+	// The indexed fields, as dotted paths into the value such as
+	// "owner.party_id". Values must be JSON objects.
+	Fields []string
+}
+
+// An index document stored in Index.
+type indexDocument struct {
+	Collection string          `json:"collection"`
+	Field      string          `json:"field"`
+	Value      json.RawMessage `json:"value"`
+	Keys       []string        `json:"keys"`
+}
+
+// Creates a new value like Collection.Create() and adds it to the indexes.
+func (c *IndexedCollection) Create(
+	key string, value interface{},
+) (*Item, error) {
+	item, err := c.Collection.Create(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return item, c.reindex(key, nil, item.Value)
+}
+
+// Writes a value like Collection.Update() and moves the key between index
+// documents for any indexed field whose value changed.
+func (c *IndexedCollection) Update(
+	key string, value interface{},
+) (*Item, error) {
+	previous, err := c.current(key)
+	if err != nil {
+		return nil, err
+	}
+	item, err := c.Collection.Update(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return item, c.reindex(key, previous, item.Value)
+}
+
+// Deletes a key like Collection.Delete() and removes it from the indexes.
+func (c *IndexedCollection) Delete(key string) error {
+	previous, err := c.current(key)
+	if err != nil {
+		return err
+	}
+	if err := c.Collection.Delete(key); err != nil {
+		return err
+	}
+	return c.reindex(key, previous, nil)
+}
+
+// Purges a key like Collection.Purge() and removes it from the indexes.
+func (c *IndexedCollection) Purge(key string) error {
+	previous, err := c.current(key)
+	if err != nil {
+		return err
+	}
+	if err := c.Collection.Purge(key); err != nil {
+		return err
+	}
+	return c.reindex(key, previous, nil)
+}
+
+// Adds the current value of the given key to the indexes. This is needed
+// after writing to the key other than through the IndexedCollection. Stale
+// index entries left behind by such writes are ignored by GetByField.
+func (c *IndexedCollection) Reindex(key string) error {
+	current, err := c.current(key)
+	if err != nil {
+		return err
+	}
+	return c.reindex(key, nil, current)
+}
+
+// Returns all of the items whose field holds the given value, ordered by
+// key. Each item is read back and checked, so entries the index has not
+// caught up with are skipped rather than returned.
+func (c *IndexedCollection) GetByField(
+	field string, value interface{},
+) ([]*Item, error) {
+	if !c.indexed(field) {
+		return nil, fmt.Errorf("Field %s is not indexed.", field)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	token, ok := indexToken(raw)
+	if !ok {
+		return nil, fmt.Errorf("Values of type %T can not be indexed.", value)
+	}
+
+	var doc indexDocument
+	_, err = c.Index.Get(c.indexKey(field, token), &doc)
+	if _, ok := err.(NotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	items := make([]*Item, 0, len(doc.Keys))
+	for _, key := range doc.Keys {
+		item, err := c.Collection.Get(key, nil)
+		if _, ok := err.(NotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if indexTokens(item.Value, field)[token] {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// Returns the current raw value of a key, or nil if it does not exist.
+func (c *IndexedCollection) current(key string) (json.RawMessage, error) {
+	item, err := c.Collection.Get(key, nil)
+	if _, ok := err.(NotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+// Returns true if the given field is one of the indexed Fields.
+func (c *IndexedCollection) indexed(field string) bool {
+	for _, f := range c.Fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves a key from the index documents of its previous values to those of
+// its current values. Either raw value may be nil.
+func (c *IndexedCollection) reindex(
+	key string, previous, current json.RawMessage,
+) error {
+	for _, field := range c.Fields {
+		before := indexTokens(previous, field)
+		after := indexTokens(current, field)
+		for token := range before {
+			if !after[token] {
+				if err := c.updateIndex(field, token, key, false); err != nil {
+					return err
+				}
+			}
+		}
+		for token := range after {
+			if !before[token] {
+				if err := c.updateIndex(field, token, key, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Adds or removes a key from a single index document. Index documents are
+// written conditionally and the change is retried if another writer got
+// there first.
+func (c *IndexedCollection) updateIndex(
+	field, token, key string, add bool,
+) error {
+	indexKey := c.indexKey(field, token)
+	for {
+		doc := indexDocument{
+			Collection: c.Name,
+			Field:      field,
+			Value:      json.RawMessage(token),
+		}
+		item, err := c.Index.Get(indexKey, &doc)
+		if _, ok := err.(NotFoundError); ok {
+			item = nil
+		} else if err != nil {
+			return err
+		}
+
+		n := sort.SearchStrings(doc.Keys, key)
+		present := n < len(doc.Keys) && doc.Keys[n] == key
+		switch {
+		case add && present, !add && !present:
+			return nil
+		case add:
+			doc.Keys = append(doc.Keys, "")
+			copy(doc.Keys[n+1:], doc.Keys[n:])
+			doc.Keys[n] = key
+		default:
+			doc.Keys = append(doc.Keys[:n], doc.Keys[n+1:]...)
+		}
+
+		switch {
+		case item == nil:
+			_, err = c.Index.Create(indexKey, &doc)
+		case len(doc.Keys) == 0:
+			err = item.Delete()
+		default:
+			_, err = item.Update(&doc)
+		}
+		switch err.(type) {
+		case AlreadyExistsError, NotMostRecentError:
+			continue
+		}
+		return err
+	}
+}
+
+// Returns the key of the index document for a field value. The value is
+// hashed since it may hold characters that are not valid in a key.
+func (c *IndexedCollection) indexKey(field, token string) string {
+	sum := sha1.Sum([]byte(c.Name + "\x00" + field + "\x00" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the set of index tokens for a field of a raw JSON value.
+func indexTokens(raw json.RawMessage, field string) map[string]bool {
+	tokens := make(map[string]bool)
+	if raw == nil {
+		return tokens
+	}
+	value, err := decodeObject(raw)
+	if err != nil || value == nil {
+		return tokens
+	}
+	parent, name := lookupField(value, field)
+	if parent == nil {
+		return tokens
+	}
+	values := []interface{}{parent[name]}
+	if list, ok := parent[name].([]interface{}); ok {
+		values = list
+	}
+	for _, v := range values {
+		data, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		if token, ok := indexToken(data); ok {
+			tokens[token] = true
+		}
+	}
+	return tokens
+}
+
+// Returns the canonical form of a scalar JSON value, so that for example
+// 7 and 7.0 share an index document. Nulls, objects and arrays can not be
+// indexed.
+func indexToken(raw json.RawMessage) (string, bool) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", false
+	}
+	switch value.(type) {
+	case string, float64, bool:
+		data, err := json.Marshal(value)
+		return string(data), err == nil
+	}
+	return "", false
+}
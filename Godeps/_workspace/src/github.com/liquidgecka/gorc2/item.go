@@ -15,6 +15,7 @@
 package gorc2
 
 import (
+	"context"
 	"fmt"
 	"encoding/json"
 	"time"
@@ -29,6 +30,46 @@ type Collection struct {
 	// The unique name of this collection.
 	Name string
 
+	// If this is true then Update() will fetch the current value of the key
+	// first and skip the write entirely if the new value is the same once
+	// both are reduced to canonical JSON. This costs a GET per Update() but
+	// saves the write, which is worthwhile for imports that mostly rewrite
+	// unchanged data.
+	SkipUnchanged bool
+
+	// If SkipUnchanged is set and this is not empty then a hash of the
+	// canonical value is stored in this top level field of every value
+	// written by Update(), and only the stored hash is compared rather than
+	// the whole value. Values must be JSON objects for this to work.
+	HashField string
+
+	// If set then the fields configured in the codec are encrypted before
+	// values are written and decrypted when they are read back. See
+	// EncryptionCodec for details.
+	Encryption *EncryptionCodec
+
+	// If true then Item.Unmarshal(), and so Get() and Iterator.Get(), fill
+	// in struct fields tagged orc:"key", orc:"ref", orc:"score" and
+	// orc:"distance" with the metadata of the item, so application models
+	// can carry their identity with them. For example:
+	//
+	//	type Chargepoint struct {
+	//		ID    string  `json:"-" orc:"key"`
+	//		Score float32 `json:"-" orc:"score"`
+	//		Name  string  `json:"name"`
+	//	}
+	InjectMetadata bool
+
+	// Extra headers and query parameters sent with every request made via
+	// this Collection. Set with WithOptions().
+	options *RequestOptions
+
+	// The refs made up by writes of a dry run set in options.
+	dryRun *dryRunSession
+
+	// The context requests are made with. Set with WithContext().
+	ctx context.Context
+
 	// A reference back to the Client that created this Collection.
 	client *Client
 }
@@ -48,6 +89,11 @@ type Event struct {
 	// The update Ordinal for this event.
 	Ordinal int64
 
+	// The Ordinal as a decimal string. Use this when passing the ordinal
+	// through JSON to clients that can not hold a 64 bit integer exactly,
+	// and ParseOrdinal() to turn it back into an Ordinal.
+	OrdinalStr string
+
 	// The Reference number for this specific event.
 	Ref string
 
@@ -69,9 +115,9 @@ type Event struct {
 func (e *Event) Delete() error {
 	headers := map[string]string{"If-Match": `"` + e.Ref + `"`}
 	path := fmt.Sprintf("%s/%s/events/%s/%d/%d?purge=true",
-		e.Collection.Name, e.Key, e.Type, e.Timestamp.UnixNano()/1000000,
+		e.Collection.Name, e.Key, e.Type, toTimestamp(e.Timestamp),
 		e.Ordinal)
-	_, err := e.Collection.client.emptyReply("DELETE", path, headers, nil, 204)
+	_, err := e.Collection.emptyReply("DELETE", path, headers, nil, 204)
 	if err != nil {
 		if _, ok := err.(PreconditionFailedError); ok {
 			err = NotMostRecentError(e.Ref)
@@ -82,7 +128,7 @@ func (e *Event) Delete() error {
 
 // Unmarshal's the data from 'Value' into the given item.
 func (e *Event) Unmarshal(value interface{}) error {
-	return json.Unmarshal(e.Value, value)
+	return e.Collection.codec().Unmarshal(e.Value, value)
 }
 
 // Updates this event if it represents the most recent event for the key,
@@ -149,19 +195,27 @@ type Item struct {
 func (i *Item) Delete() error {
 	headers := map[string]string{"If-Match": `"` + i.Ref + `"`}
 	path := i.Collection.Name + "/" + i.Key
-	_, err := i.Collection.client.emptyReply("DELETE", path, headers, nil, 204)
+	_, err := i.Collection.emptyReply("DELETE", path, headers, nil, 204)
 	if err != nil {
 		if _, ok := err.(PreconditionFailedError); ok {
 			err = NotMostRecentError(i.Ref)
 		}
 	}
+	_, err = i.Collection.audit("delete", i.Key, i.Ref, nil, err)
 	return err
 }
 
 // This will take the raw JSON data returned from Orchestrate and Unmarshal it
-// into the given object.
+// into the given object. If InjectMetadata is set on the Collection then
+// the metadata of the item is copied into any orc tagged fields as well.
 func (i *Item) Unmarshal(value interface{}) error {
-	return json.Unmarshal(i.Value, value)
+	if err := i.Collection.codec().Unmarshal(i.Value, value); err != nil {
+		return err
+	}
+	if i.Collection != nil && i.Collection.InjectMetadata {
+		return injectMetadata(value, i)
+	}
+	return nil
 }
 
 // Updates this Item in the key value store if it is the most recent 'Ref'
@@ -176,5 +230,5 @@ func (i *Item) Update(value interface{}) (*Item, error) {
 			err = NotMostRecentError(i.Key)
 		}
 	}
-	return item, err
+	return i.Collection.audit("update", i.Key, i.Ref, item, err)
 }
@@ -16,11 +16,16 @@ package gorc2
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // TODO: CreateCollection
@@ -40,7 +45,7 @@ func (c *Collection) Create(key string, value interface{}) (*Item, error) {
 			err = AlreadyExistsError(key)
 		}
 	}
-	return item, err
+	return c.audit("create", key, "", item, err)
 }
 
 //
@@ -52,7 +57,8 @@ func (c *Collection) Create(key string, value interface{}) (*Item, error) {
 // collection before this call.
 func (c *Collection) Delete(key string) error {
 	path := c.Name + "/" + key
-	_, err := c.client.emptyReply("DELETE", path, nil, nil, 204)
+	_, err := c.emptyReply("DELETE", path, nil, nil, 204)
+	_, err = c.audit("delete", key, "", nil, err)
 	return err
 }
 
@@ -60,7 +66,8 @@ func (c *Collection) Delete(key string) error {
 // collection. This operation can not be undone.
 func (c *Collection) Purge(key string) error {
 	path := c.Name + "/" + key + "?purge=true"
-	_, err := c.client.emptyReply("DELETE", path, nil, nil, 204)
+	_, err := c.emptyReply("DELETE", path, nil, nil, 204)
+	_, err = c.audit("purge", key, "", nil, err)
 	return err
 }
 
@@ -96,23 +103,27 @@ func (c *Collection) GetRef(
 	} else {
 		path = c.Name + "/" + key + "/refs/" + ref
 	}
-	resp, err := c.client.jsonReply("GET", path, nil, 200, &item.Value)
+	resp, err := c.jsonReply("GET", path, nil, nil, 200, &item.Value)
 	if err != nil {
 		return nil, err
 	}
 
 	// Get the ref value.
 	if ref == "" {
-		loc := resp.Header.Get("Content-Location")
-		if i := strings.LastIndex(loc, "/"); i == -1 {
-			return nil, errors.New("Missing Content-Location header.")
-		} else {
-			item.Ref = loc[i+1 : len(loc)]
+		if item.Ref, err = itemRef(resp, "Content-Location"); err != nil {
+			return nil, err
 		}
 	} else {
 		item.Ref = ref
 	}
 
+	// Decrypt any encrypted fields.
+	if c.Encryption != nil {
+		if item.Value, err = c.Encryption.decrypt(item.Value); err != nil {
+			return nil, err
+		}
+	}
+
 	// If the user provided a value then decode into that value.
 	if value != nil {
 		return item, item.Unmarshal(value)
@@ -122,6 +133,37 @@ func (c *Collection) GetRef(
 	return item, nil
 }
 
+// Gets the version of an item that was current at the given time, found by
+// walking the item's ref history from the most recent ref backwards. If the
+// item did not exist yet, or had been deleted, at that time then a
+// NotFoundError is returned. If value is non nil then the results will be
+// JSON decoded into the object given.
+func (c *Collection) GetAsOf(
+	key string, t time.Time, value interface{},
+) (*Item, error) {
+	it := c.History(key, &HistoryQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		if fromTimestamp(raw.RefTime).After(t) {
+			continue
+		}
+		if it.results[it.index].Path.Tombstone {
+			break
+		}
+		item, err := c.GetRef(key, raw.Ref, value)
+		if err != nil {
+			return nil, err
+		}
+		item.Updated = fromTimestamp(raw.RefTime)
+		return item, nil
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	return nil, NotFoundError(fmt.Sprintf("404: %s did not exist at %s.",
+		key, t.UTC().Format(time.RFC3339)))
+}
+
 //
 // History
 //
@@ -169,6 +211,7 @@ func (c *Collection) History(key string, opts *HistoryQuery) *Iterator {
 
 	return &Iterator{
 		client:         c.client,
+		collection:     c,
 		iteratingItems: true,
 		next:           path,
 	}
@@ -199,10 +242,28 @@ type ListQuery struct {
 	// All keys before this key, as well as this key will be included in the
 	// listing.
 	EndKey string
+
+	// Controls how items marked by SoftDelete() are handled. Since listing
+	// can not be filtered by Orchestrate this is done as results are
+	// returned, so pages may appear shorter than Limit.
+	Deleted DeletedFilter
+
+	// Returns the keys in descending rather than ascending order. Orchestrate
+	// can only list forwards so the whole listing is loaded into memory on
+	// the first call to Next(); bound the listing with the key range fields
+	// above when the collection is large. Resume tokens are not supported
+	// for reversed listings.
+	Reverse bool
 }
 
 // Sets up a list query. Note that the actual query will not be performed
 // until Next() is called on the Iterator returned.
+//
+// Items are always returned in ascending key order (or descending if
+// Reverse is set), compared byte by byte. The StartKey, AfterKey, BeforeKey
+// and EndKey fields select a range within that order. If Orchestrate ever
+// returns keys out of order the Iterator stops with an error rather than
+// risk skipping or repeating items across pages.
 func (c *Collection) List(query *ListQuery) *Iterator {
 	path := c.Name
 
@@ -228,11 +289,59 @@ func (c *Collection) List(query *ListQuery) *Iterator {
 		path = c.Name + "?" + queryVariables.Encode()
 	}
 
-	return &Iterator{
+	it := &Iterator{
 		client:         c.client,
+		collection:     c,
 		iteratingItems: true,
 		next:           path,
+		ascending:      true,
+	}
+	if query != nil {
+		it.filter = query.Deleted.filter()
+		if query.Reverse {
+			return &Iterator{
+				client:         c.client,
+				collection:     c,
+				iteratingItems: true,
+				inner:          it,
+				arrange:        reverseResults,
+			}
+		}
+	}
+	return it
+}
+
+// Reverses the order of a page of results in place.
+func reverseResults(results []*jsonListItem) {
+	for l, r := 0, len(results)-1; l < r; l, r = l+1, r-1 {
+		results[l], results[r] = results[r], results[l]
+	}
+}
+
+//
+// Scroll
+//
+
+// Sets up a snapshot style listing of the collection. This works like List()
+// except that each page is requested strictly after the last key returned by
+// the previous page, so each key is returned at most once even if writes are
+// made to the collection while iterating. This is intended for exports and
+// backups that need a consistent dump. Note that keys written behind the
+// current position will not be seen.
+func (c *Collection) Scroll(opts *ListQuery) *Iterator {
+	query := ListQuery{}
+	if opts != nil {
+		query = *opts
 	}
+	query.Reverse = false
+	it := c.List(&query)
+
+	// The path used for all following pages drops the starting keys since
+	// afterKey will be appended to it.
+	query.StartKey = ""
+	query.AfterKey = ""
+	it.scrollPath = c.List(&query).next
+	return it
 }
 
 //
@@ -254,6 +363,10 @@ type SearchQuery struct {
 	// then the ordering will be based on scores.
 	// TODO: Link to documentation on this field.
 	Sort string
+
+	// Controls how items marked by SoftDelete() are handled. This is added
+	// to the query so it is applied by Orchestrate.
+	Deleted DeletedFilter
 }
 
 // Sets up a search query. If opts is nil then the default options will be
@@ -267,6 +380,15 @@ type SearchQuery struct {
 // Or alternatively the Lucene query syntax page at:
 //   <a href="http://lucene.apache.org/core/4_5_1/queryparser/org/apache/lucene/queryparser/classic/package-summary.html#Overview">http://lucene.apache.org/core/4_5_1/queryparser/org/apache/lucene/queryparser/classic/package-summary.html#Overview</a>
 func (c *Collection) Search(query string, opts *SearchQuery) *Iterator {
+	if opts != nil {
+		switch opts.Deleted {
+		case ExcludeDeleted:
+			query = "(" + query + ") AND NOT value." + softDeleteField + ":true"
+		case OnlyDeleted:
+			query = "(" + query + ") AND value." + softDeleteField + ":true"
+		}
+	}
+
 	queryVariables := make(url.Values, 10)
 	queryVariables.Add("query", query)
 
@@ -284,27 +406,234 @@ func (c *Collection) Search(query string, opts *SearchQuery) *Iterator {
 
 	}
 
+	path := c.Name + "?" + queryVariables.Encode()
 	return &Iterator{
 		client:         c.client,
+		collection:     c,
 		iteratingItems: true,
-		next:           c.Name + "?" + queryVariables.Encode(),
+		next:           path,
+		plan:           newQueryPlan(c.Name, path),
 	}
 }
 
+// Returns an Iterator over the items in the collection that have been
+// written after the given time, oldest change first. This is a search over
+// the @path.reftime field so it is subject to the usual indexing delay, and
+// only the most recent ref of each item is considered. The time is truncated
+// to milliseconds.
+func (c *Collection) ListUpdatedSince(t time.Time) *Iterator {
+	query := fmt.Sprintf("@path.reftime:{%d TO *}", toTimestamp(t))
+	return c.Search(query, &SearchQuery{
+		Limit: 100,
+		Sort:  "@path.reftime:asc",
+	})
+}
+
+// Runs the same search query against several collections concurrently and
+// returns a single Iterator that merges the results, highest score first.
+// Each collection is queried with the same opts, so Limit applies per
+// collection page rather than to the merged results. Since the merge is done
+// on score any Sort given in opts should be left empty, otherwise the
+// ordering of the merged results is undefined.
+func (c *Client) MultiSearch(
+	collections []string, query string, opts *SearchQuery,
+) *Iterator {
+	return c.MultiSearchContext(context.Background(), collections, query,
+		opts)
+}
+
+// Like MultiSearch() but the search of every collection is made with the
+// given context, as with Collection.WithContext().
+func (c *Client) MultiSearchContext(
+	ctx context.Context, collections []string, query string,
+	opts *SearchQuery,
+) *Iterator {
+	sources := make([]*Iterator, len(collections))
+	for i, name := range collections {
+		sources[i] = c.Collection(name).WithContext(ctx).Search(query, opts)
+	}
+	plan := &QueryPlan{Collection: strings.Join(collections, ",")}
+	if len(sources) > 0 {
+		*plan = *sources[0].plan
+		plan.Collection = strings.Join(collections, ",")
+	}
+	return &Iterator{
+		client:         c,
+		iteratingItems: true,
+		sources:        sources,
+		plan:           plan,
+	}
+}
+
+//
+// SoftDelete
+//
+
+// The fields set on values by SoftDelete().
+const (
+	softDeleteField   = "deleted"
+	softDeleteAtField = "deleted_at"
+)
+
+// Controls how List() and Search() treat items that have been marked as
+// deleted via SoftDelete().
+type DeletedFilter int
+
+const (
+	// Soft deleted items are returned like any other item. This is the
+	// default.
+	IncludeDeleted DeletedFilter = iota
+
+	// Soft deleted items are not returned.
+	ExcludeDeleted
+
+	// Only soft deleted items are returned.
+	OnlyDeleted
+)
+
+// Returns the Iterator filter that implements this DeletedFilter, or nil if
+// no filtering is needed.
+func (d DeletedFilter) filter() func(*jsonListItem) bool {
+	if d == IncludeDeleted {
+		return nil
+	}
+	return func(r *jsonListItem) bool {
+		var value map[string]interface{}
+		json.Unmarshal(r.Value, &value)
+		deleted, _ := value[softDeleteField].(bool)
+		return deleted == (d == OnlyDeleted)
+	}
+}
+
+// Marks an item as deleted without removing it. The value is rewritten with
+// a "deleted" field set to true and a "deleted_at" field holding the current
+// time, so the item stays visible to Get() and History() and can be brought
+// back with Restore(). Use the Deleted field on ListQuery or SearchQuery to
+// hide soft deleted items. The value must be a JSON object. If the item is
+// changed between reading and rewriting it a NotMostRecentError is returned.
+func (c *Collection) SoftDelete(key string) (*Item, error) {
+	return c.setDeleted(key, true)
+}
+
+// Reverses a prior call to SoftDelete() by removing the deleted markers from
+// the value.
+func (c *Collection) Restore(key string) (*Item, error) {
+	return c.setDeleted(key, false)
+}
+
+// Shared implementation of SoftDelete() and Restore().
+func (c *Collection) setDeleted(key string, deleted bool) (*Item, error) {
+	var value map[string]interface{}
+	item, err := c.Get(key, &value)
+	if err != nil {
+		return nil, err
+	} else if value == nil {
+		return nil, errors.New("Only JSON objects can be soft deleted.")
+	}
+	if deleted {
+		value[softDeleteField] = true
+		value[softDeleteAtField] = c.client.Now().UTC().Format(
+			time.RFC3339Nano)
+	} else {
+		delete(value, softDeleteField)
+		delete(value, softDeleteAtField)
+	}
+	return item.Update(value)
+}
+
 //
 // Update (PUT)
 //
 
 // Updates a given key in the collection. If the object does not exist then
 // this call will create it and returned a CreatedError as its error type.
+//
+// If SkipUnchanged is set on the Collection and the value is the same as the
+// one already stored then no write is made and the current Item is returned.
 func (c *Collection) Update(key string, value interface{}) (*Item, error) {
-	return c.innerPut(key, nil, value)
+	if c.SkipUnchanged {
+		return c.updateIfChanged(key, value)
+	}
+	item, err := c.innerPut(key, nil, value)
+	return c.audit("update", key, "", item, err)
 }
 
 //
 // Private
 //
 
+// Reduces a value to canonical JSON (object keys sorted, no insignificant
+// white space) and returns it along with its hex encoded SHA-256 hash.
+func canonicalJSON(value interface{}) ([]byte, string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, "", err
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, "", err
+	}
+	if raw, err = json.Marshal(generic); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(raw)
+	return raw, hex.EncodeToString(sum[:]), nil
+}
+
+// The Update() implementation used when SkipUnchanged is set on the
+// Collection.
+func (c *Collection) updateIfChanged(
+	key string, value interface{},
+) (*Item, error) {
+	raw, hash, err := canonicalJSON(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare against the currently stored value, if there is one.
+	current, err := c.Get(key, nil)
+	if _, ok := err.(NotFoundError); ok {
+		current = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		if c.HashField != "" {
+			var stored map[string]interface{}
+			if current.Unmarshal(&stored) == nil && stored[c.HashField] == hash {
+				return current, nil
+			}
+		} else if _, currentHash, err := canonicalJSON(current.Value); err != nil {
+			return nil, err
+		} else if currentHash == hash {
+			return current, nil
+		}
+	}
+
+	// The value changed so write it, adding the hash if requested.
+	oldRef := ""
+	if current != nil {
+		oldRef = current.Ref
+	}
+	if c.HashField == "" {
+		item, err := c.innerPut(key, nil, json.RawMessage(raw))
+		return c.audit("update", key, oldRef, item, err)
+	}
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	} else if object == nil {
+		return nil, errors.New("HashField requires a JSON object value.")
+	}
+	object[c.HashField] = hash
+	item, err := c.innerPut(key, nil, object)
+	return c.audit("update", key, oldRef, item, err)
+}
+
 // This is the inner Put implementation for Create(), Update() and
 // Item.Update().
 func (c *Collection) innerPut(
@@ -317,26 +646,33 @@ func (c *Collection) innerPut(
 
 	// Encode the json message into a raw value that we can return to the
 	// client if necessary.
-	if rawMsg, err := json.Marshal(value); err != nil {
+	if rawMsg, err := c.codec().Marshal(value); err != nil {
 		return nil, err
 	} else {
 		item.Value = json.RawMessage(rawMsg)
 	}
 
+	// Encrypt any configured fields. The caller still gets the plain text
+	// value back in the Item.
+	body := []byte(item.Value)
+	if c.Encryption != nil {
+		var err error
+		if body, err = c.Encryption.encrypt(item.Value); err != nil {
+			return nil, err
+		}
+	}
+
 	// Make the actual PUT call.
 	path := c.Name + "/" + key
-	resp, err := c.client.emptyReply("PUT", path, headers,
-		bytes.NewBuffer([]byte(item.Value)), 201)
+	resp, err := c.emptyReply("PUT", path, headers,
+		bytes.NewBuffer(body), 201)
 	if err != nil {
 		return nil, err
 	}
 
 	// Get the ref from the returned strings.
-	loc := resp.Header.Get("Location")
-	if i := strings.LastIndex(loc, "/"); i == -1 {
-		return nil, errors.New("Missing Location header.")
-	} else {
-		item.Ref = loc[i+1 : len(loc)]
+	if item.Ref, err = itemRef(resp, "Location"); err != nil {
+		return nil, err
 	}
 
 	return item, err
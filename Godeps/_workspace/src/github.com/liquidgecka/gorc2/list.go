@@ -15,9 +15,13 @@
 package gorc2
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -36,6 +40,9 @@ type jsonPath struct {
 	// Used with Events
 	Ordinal int64 `json:"ordinal"`
 
+	// The string form of Ordinal, used with Events.
+	OrdinalStr string `json:"ordinal_str"`
+
 	// The Ref of this specific item.
 	Ref string `json:"ref"`
 
@@ -99,9 +106,24 @@ type Iterator struct {
 	// complex semantics. See the Examples for details.
 	Error error
 
+	// The number of times a failed page fetch is retried by Next() before
+	// the error is stored in Error. Only transient failures (network errors,
+	// rate limiting and 5xx statuses) are retried. Defaults to no retries.
+	PageRetries int
+
+	// The number of distinct values remembered by DedupeBy(). Once more
+	// values than this have been seen the oldest are forgotten, so a
+	// duplicate that is further than this from the first copy is returned
+	// again. Defaults to 10000.
+	DedupeWindow int
+
 	// The client that this listing was run against.
 	client *Client
 
+	// The Collection that created this Iterator, if any. Results from this
+	// collection share its settings.
+	collection *Collection
+
 	// Set to true when the last item has been returned.
 	done bool
 
@@ -116,8 +138,47 @@ type Iterator struct {
 	// The path to the "next" group of results for pagination.
 	next string
 
+	// The path that the current page of results was fetched from, and the
+	// number of results dropped from the front of it. These make up the
+	// resume token.
+	page       string
+	pageOffset int
+
+	// The number of results to skip on the next page fetched, set when
+	// resuming.
+	resume int
+
 	// The results returned from the raw JSON unmarshaling.
 	results []*jsonListItem
+
+	// For iterators created via MultiSearch() these are the per collection
+	// iterators being merged. live tracks which of them still has a current
+	// item that has not been returned yet.
+	sources []*Iterator
+	live    []bool
+
+	// For iterators created via Scroll() this is the listing path that the
+	// next page is built from, along with the last key that has been seen.
+	scrollPath string
+	scrollKey  string
+
+	// If set then results that this returns false for are skipped by Next().
+	filter func(*jsonListItem) bool
+
+	// Set for List() iterators, which check that keys are returned in
+	// strictly ascending order. lastKey is the last key returned.
+	ascending bool
+	lastKey   string
+
+	// For reversed and sorted listings this is the Iterator that is drained
+	// into results on the first call to Next(), after which arrange is
+	// called to reorder them.
+	inner   *Iterator
+	arrange func([]*jsonListItem)
+
+	// Set for search iterators, see Plan(). Iterators wrapping another,
+	// such as those of SortByDistanceFrom(), share its plan.
+	plan *QueryPlan
 }
 
 // Returns the Item for the current iteration index. This should be used if
@@ -128,29 +189,101 @@ func (i *Iterator) Get(value interface{}) (*Item, error) {
 	if i.iteratingItems != true {
 		return nil, fmt.Errorf("Not an Item Iterator.")
 	}
-	r := i.results[i.index]
-	secs := int64(r.RefTime / 1000)
-	nsecs := int64((r.RefTime % 1000) * 1000000)
+	item, err := i.itemFor(i.results[i.index])
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode value if necessary.
+	if value != nil {
+		return item, item.Unmarshal(value)
+	}
+
+	// Success
+	return item, nil
+}
+
+// Builds the Item for a result, decrypting its value if the collection has
+// an EncryptionCodec.
+func (i *Iterator) itemFor(r *jsonListItem) (*Item, error) {
 	item := &Item{
-		Collection: i.client.Collection(r.Path.Collection),
+		Collection: i.collectionFor(r.Path.Collection),
 		Distance:   r.Distance,
 		Key:        r.Path.Key,
 		Ref:        r.Path.Ref,
 		Score:      r.Score,
 		Tombstone:  r.Path.Tombstone,
-		Updated:    time.Unix(secs, nsecs),
+		Updated:    fromTimestamp(r.RefTime),
 		Value:      r.Value,
 	}
 
-	// Decode value if necessary.
-	if value != nil {
-		return item, json.Unmarshal(r.Value, value)
+	// Decrypt any encrypted fields.
+	if codec := item.Collection.Encryption; codec != nil && len(r.Value) > 0 {
+		raw, err := codec.decrypt(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		item.Value = raw
 	}
-
-	// Success
 	return item, nil
 }
 
+// The undecoded form of a single result, returned by Iterator.Raw().
+type RawResult struct {
+	// The collection, key and ref of the result.
+	Collection string
+	Key        string
+	Ref        string
+
+	// The time the ref was written in milliseconds since the epoch. Only set
+	// for History() results.
+	RefTime int64
+
+	// The search score and geo distance, if any.
+	Score    float32
+	Distance float32
+
+	// Set for event results.
+	Type      string
+	Timestamp int64
+	Ordinal   int64
+
+	// The value exactly as returned by Orchestrate. This shares memory with
+	// the Iterator so it must not be modified, and it is not decrypted even
+	// if the Collection has an EncryptionCodec.
+	Value json.RawMessage
+}
+
+// Returns the current result without building an Item or Event and without
+// decoding or copying its value. This is the cheapest way to pass results
+// through to another JSON encoder unchanged. It works with every kind of
+// Iterator.
+func (i *Iterator) Raw() RawResult {
+	r := i.results[i.index]
+	return RawResult{
+		Collection: r.Path.Collection,
+		Key:        r.Path.Key,
+		Ref:        r.Path.Ref,
+		RefTime:    r.RefTime,
+		Score:      r.Score,
+		Distance:   r.Distance,
+		Type:       r.Path.Type,
+		Timestamp:  r.Timestamp,
+		Ordinal:    r.Path.Ordinal,
+		Value:      r.Value,
+	}
+}
+
+// Returns the Collection that results from the named collection belong to.
+// This is the Collection that created the Iterator if the names match so its
+// settings carry over to the returned items.
+func (i *Iterator) collectionFor(name string) *Collection {
+	if i.collection != nil && i.collection.Name == name {
+		return i.collection
+	}
+	return i.client.Collection(name)
+}
+
 // Returns the Event for the current iteration. This should only be used if the
 // call was made to ListEvents() otherwise this will return an error.
 func (i *Iterator) GetEvent(value interface{}) (event *Event, err error) {
@@ -158,21 +291,23 @@ func (i *Iterator) GetEvent(value interface{}) (event *Event, err error) {
 		return nil, fmt.Errorf("Not an Event Iterator.")
 	}
 	r := i.results[i.index]
-	secs := int64(r.Timestamp / 1000)
-	nsecs := int64((r.Timestamp % 1000) * 1000000)
 	event = &Event{
-		Collection: i.client.Collection(r.Path.Collection),
+		Collection: i.collectionFor(r.Path.Collection),
 		Key:        r.Path.Key,
 		Ordinal:    r.Path.Ordinal,
+		OrdinalStr: r.Path.OrdinalStr,
 		Ref:        r.Path.Ref,
 		Type:       r.Path.Type,
-		Timestamp:  time.Unix(secs, nsecs),
+		Timestamp:  fromTimestamp(r.Timestamp),
 		Value:      r.Value,
 	}
 
+	event.Ordinal, event.OrdinalStr = resolveOrdinal(event.Ordinal,
+		event.OrdinalStr)
+
 	// Decode value if necessary.
 	if value != nil {
-		return event, json.Unmarshal(r.Value, value)
+		return event, i.client.codec().Unmarshal(r.Value, value)
 	}
 
 	// Success
@@ -184,10 +319,115 @@ func (i *Iterator) GetEvent(value interface{}) (event *Event, err error) {
 // of true means that an item has been loaded and can be retrieved via a call
 // to Get(), while a return of false means that iteration has finished.
 func (i *Iterator) Next() bool {
+	for i.advance() {
+		if i.filter == nil || i.filter(i.results[i.index]) {
+			return true
+		}
+		if i.plan != nil {
+			i.plan.Filtered++
+		}
+	}
+	return false
+}
+
+// Makes Next() skip results whose value at the given dotted field path,
+// such as "ChargeDeviceId" or "owner.id", has already been returned, for
+// example to hide records that were imported twice under different keys.
+// Results without the field are never skipped. Only the last DedupeWindow
+// values are remembered so memory use stays bounded on long iterations.
+// Fields encrypted by an EncryptionCodec can not be used. This must be
+// called before the first call to Next() and returns the Iterator so it can
+// be chained:
+//
+//	it := collection.Search(query, nil).DedupeBy("ChargeDeviceId")
+func (i *Iterator) DedupeBy(fieldPath string) *Iterator {
+	seen := make(map[string]bool)
+	var order []string
+	previous := i.filter
+	i.filter = func(r *jsonListItem) bool {
+		if previous != nil && !previous(r) {
+			return false
+		}
+		value, err := decodeObject(r.Value)
+		if err != nil || value == nil {
+			return true
+		}
+		parent, name := lookupField(value, fieldPath)
+		if parent == nil {
+			return true
+		}
+		raw, err := json.Marshal(parent[name])
+		if err != nil {
+			return true
+		}
+		key := string(raw)
+		if seen[key] {
+			return false
+		}
+
+		// Remember the value, forgetting the oldest one if the window is
+		// full.
+		window := i.DedupeWindow
+		if window <= 0 {
+			window = 10000
+		}
+		for len(order) >= window {
+			delete(seen, order[0])
+			order = order[1:]
+		}
+		seen[key] = true
+		order = append(order, key)
+		return true
+	}
+	return i
+}
+
+// Makes Next() skip the results that pred returns false for, for queries
+// the server can not filter by itself. pred is given the Item that Get()
+// would return, with its value decrypted. If the value can not be decrypted
+// the error is stored in Error and iteration stops. This must be called
+// before the first call to Next() and returns the Iterator so it can be
+// chained:
+//
+//	it := collection.List(nil).Filter(func(item *gorc2.Item) bool {
+//		return strings.HasPrefix(item.Key, "GB")
+//	})
+func (i *Iterator) Filter(pred func(*Item) bool) *Iterator {
+	previous := i.filter
+	i.filter = func(r *jsonListItem) bool {
+		if previous != nil && !previous(r) {
+			return false
+		}
+		item, err := i.itemFor(r)
+		if err != nil {
+			i.Error = err
+			return false
+		}
+		return pred(item)
+	}
+	return i
+}
+
+// Moves to the next result without applying the filter.
+func (i *Iterator) advance() bool {
 	if i.done {
 		return false
 	} else if i.Error != nil {
 		return false
+	} else if i.sources != nil {
+		return i.nextMerged()
+	} else if i.inner != nil {
+		// Load the whole inner listing then put it in the order wanted.
+		for i.inner.Next() {
+			i.results = append(i.results, i.inner.results[i.inner.index])
+		}
+		if i.inner.Error != nil {
+			i.Error = i.inner.Error
+			return false
+		}
+		i.arrange(i.results)
+		i.inner = nil
+		i.index = -1
 	}
 
 	// See if we can just quickly iterate to the next item without performing
@@ -207,19 +447,103 @@ func (i *Iterator) Next() bool {
 	// to us in the 'next' field. After fetching we should get the replacement
 	// URL from the server.
 	var results jsonList
-	_, err := i.client.jsonReply("GET", i.next, nil, 200, &results)
+	var err error
+	clock := i.client.clock()
+	start := clock.Now()
+	for attempt := 0; ; attempt++ {
+		if i.collection != nil {
+			_, err = i.collection.jsonReply("GET", i.next, nil, nil, 200,
+				&results)
+		} else {
+			_, err = i.client.jsonReply(context.Background(), "GET", i.next,
+				nil, nil, 200, &results)
+		}
+		if err == nil || attempt >= i.PageRetries || !isTransient(err) {
+			break
+		}
+		sleep(clock, time.Duration(attempt+1)*100*time.Millisecond)
+	}
+	if i.plan != nil {
+		i.plan.Latency += clock.Now().Sub(start)
+	}
 	if err != nil {
 		i.Error = err
 		return false
 	}
+	if i.plan != nil {
+		i.plan.Pages++
+		i.plan.Fetched += len(results.Results)
+	}
+
+	for _, r := range results.Results {
+		if r == nil {
+			i.Error = fmt.Errorf("List returned a null result.")
+			return false
+		}
+	}
 
 	// Capture the Link header into the next field.
+	i.page = i.next
+	i.pageOffset = 0
 	i.next = strings.TrimPrefix(results.Next, "/v0/")
 	i.results = results.Results
 
+	// Scrolling iterators ignore the offset in the server provided link and
+	// instead continue strictly after the last key seen, dropping any key
+	// that is not past it. This keeps keys from being returned twice.
+	if i.scrollPath != "" {
+		i.results = i.results[:0]
+		for _, r := range results.Results {
+			if r.Path.Key > i.scrollKey {
+				i.results = append(i.results, r)
+				i.scrollKey = r.Path.Key
+			}
+		}
+		if i.next != "" {
+			sep := "&"
+			if strings.HasSuffix(i.scrollPath, "?") {
+				sep = ""
+			}
+			i.next = i.scrollPath + sep + "afterKey=" +
+				url.QueryEscape(i.scrollKey)
+		}
+		if len(i.results) == 0 && len(results.Results) != 0 && i.next != "" {
+			return i.advance()
+		}
+	}
+
+	// Listings are guaranteed to be in ascending key order, anything else
+	// would break pagination so it is treated as an error.
+	if i.ascending {
+		for _, r := range i.results {
+			if r.Path.Key <= i.lastKey && i.lastKey != "" {
+				i.Error = fmt.Errorf("List returned key %q after %q, keys are "+
+					"out of order.", r.Path.Key, i.lastKey)
+				return false
+			}
+			i.lastKey = r.Path.Key
+		}
+	}
+
+	// When resuming skip the results that were returned before the resume
+	// token was taken.
+	if i.resume > 0 {
+		skip := i.resume
+		i.resume = 0
+		if skip >= len(i.results) {
+			if i.next != "" {
+				i.results = nil
+				return i.advance()
+			}
+			skip = len(i.results)
+		}
+		i.results = i.results[skip:]
+		i.pageOffset = skip
+	}
+
 	// Make sure we set done if nothing was returned, otherwise reset our
 	// index back to the start.
-	if len(results.Results) == 0 {
+	if len(i.results) == 0 {
 		i.done = true
 	} else {
 		i.index = 0
@@ -228,6 +552,115 @@ func (i *Iterator) Next() bool {
 	return !i.done
 }
 
+// The Next() implementation for iterators that merge several sources. The
+// first call fetches the first page of every source concurrently, after that
+// the source with the highest scoring current item is picked on each call.
+func (i *Iterator) nextMerged() bool {
+	if i.live == nil {
+		i.live = make([]bool, len(i.sources))
+		var wg sync.WaitGroup
+		for n, src := range i.sources {
+			wg.Add(1)
+			go func(n int, src *Iterator) {
+				defer wg.Done()
+				i.live[n] = src.Next()
+			}(n, src)
+		}
+		wg.Wait()
+	}
+
+	// Pick the source with the best scoring current item.
+	best := -1
+	for n, src := range i.sources {
+		if src.Error != nil {
+			i.Error = src.Error
+			return false
+		} else if !i.live[n] {
+			continue
+		}
+		if best == -1 || src.results[src.index].Score >
+			i.sources[best].results[i.sources[best].index].Score {
+			best = n
+		}
+	}
+	if best == -1 {
+		i.done = true
+		return false
+	}
+
+	// Take the item and move the winning source along so its next item is
+	// ready for the following call.
+	src := i.sources[best]
+	i.results = []*jsonListItem{src.results[src.index]}
+	i.index = 0
+	i.live[best] = src.Next()
+	return true
+}
+
+// The state saved in a resume token.
+type resumeState struct {
+	Page       string `json:"p"`
+	Index      int    `json:"i"`
+	ScrollPath string `json:"sp,omitempty"`
+	ScrollKey  string `json:"sk,omitempty"`
+}
+
+// Returns an opaque token that records the position of the Iterator. If a
+// long iteration fails the token can be passed to ResumeFrom() on a new
+// Iterator to carry on after the item most recently returned, rather than
+// starting again from the beginning. The page holding that item is fetched
+// again when resuming. An empty string is returned before the first call to
+// Next(), and for iterators created by MultiSearch() which can not be
+// resumed.
+func (i *Iterator) ResumeToken() string {
+	if i.sources != nil || i.page == "" {
+		return ""
+	}
+	state := &resumeState{
+		Page:  i.page,
+		Index: i.pageOffset + i.index + 1,
+	}
+
+	// Scrolling iterators can simply continue after the current key.
+	if i.scrollPath != "" && i.index < len(i.results) {
+		key := i.results[i.index].Path.Key
+		state.Page = i.scrollPath + "&afterKey=" + url.QueryEscape(key)
+		if strings.HasSuffix(i.scrollPath, "?") {
+			state.Page = i.scrollPath + "afterKey=" + url.QueryEscape(key)
+		}
+		state.Index = 0
+		state.ScrollPath = i.scrollPath
+		state.ScrollKey = key
+	}
+
+	raw, _ := json.Marshal(state)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Positions a new Iterator at the point recorded in a token returned by
+// ResumeToken(). The Iterator must be of the same kind (items or events) as
+// the one the token came from, and this must be called before Next().
+func (i *Iterator) ResumeFrom(token string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("Malformed resume token.")
+	}
+	var state resumeState
+	if err := json.Unmarshal(raw, &state); err != nil || state.Page == "" {
+		return fmt.Errorf("Malformed resume token.")
+	} else if i.sources != nil {
+		return fmt.Errorf("MultiSearch iterators can not be resumed.")
+	}
+	i.next = state.Page
+	i.resume = state.Index
+	i.scrollPath = state.ScrollPath
+	i.scrollKey = state.ScrollKey
+	i.done = false
+	i.results = nil
+	i.index = 0
+	return nil
+}
+
 // Like Next() except this returns the error as well.
 func (i *Iterator) NextWithError() (bool, error) {
 	return i.Next(), i.Error
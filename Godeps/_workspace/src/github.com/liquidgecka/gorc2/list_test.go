@@ -0,0 +1,76 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListAscendingAcrossPages(t *testing.T) {
+	c := seededCollection(t, "d", "b", "e", "a", "c", "B")
+	got := iteratorKeys(t, c.List(&ListQuery{Limit: 2}))
+	if want := []string{"B", "a", "b", "c", "d", "e"}; !reflect.DeepEqual(
+		got, want) {
+		t.Fatalf("listed %q, expected %q", got, want)
+	}
+}
+
+func TestListRanges(t *testing.T) {
+	c := seededCollection(t, "a", "b", "c", "d", "e")
+	for _, test := range []struct {
+		query ListQuery
+		want  []string
+	}{
+		{ListQuery{StartKey: "b", EndKey: "d"}, []string{"b", "c", "d"}},
+		{ListQuery{AfterKey: "b", BeforeKey: "d"}, []string{"c"}},
+		{ListQuery{StartKey: "d", Reverse: true}, []string{"e", "d"}},
+		{ListQuery{AfterKey: "a", BeforeKey: "e", Reverse: true, Limit: 1},
+			[]string{"d", "c", "b"}},
+	} {
+		query := test.query
+		got := iteratorKeys(t, c.List(&query))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v listed %q, expected %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestListReverse(t *testing.T) {
+	c := seededCollection(t, "c", "a", "b")
+	got := iteratorKeys(t, c.List(&ListQuery{Limit: 1, Reverse: true}))
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %q, expected %q", got, want)
+	}
+}
+
+func TestListOutOfOrder(t *testing.T) {
+	c := testClient(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"count": 2, "results": [
+				{"path": {"collection": "test", "key": "b", "ref": "1"}},
+				{"path": {"collection": "test", "key": "a", "ref": "2"}}
+			]}`))
+		}))
+	it := c.Collection("test").List(nil)
+	for it.Next() {
+	}
+	if it.Error == nil || !strings.Contains(it.Error.Error(), "out of order") {
+		t.Fatalf("got %v, expected an out of order error", it.Error)
+	}
+}
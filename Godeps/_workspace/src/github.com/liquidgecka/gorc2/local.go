@@ -0,0 +1,759 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// LocalBackend
+//
+
+// Returns a Client that keeps all of its data in memory rather than talking
+// to Orchestrate. This is intended for local development and demos where no
+// Orchestrate account is available. See LocalBackend for what is supported.
+func NewLocalClient() *Client {
+	c := NewClient("local")
+	c.APIHost = "local"
+	c.HTTPClient = &http.Client{Transport: NewLocalBackend()}
+	return c
+}
+
+// An in-memory implementation of the Orchestrate REST API. It is used as the
+// Transport of an http.Client so everything in this package works against it
+// unchanged, see NewLocalClient(). It supports key value items with refs and
+// history, conditional writes, events, graph relations and listing.
+//
+// Search is naive: every item in the collection is scanned, results are not
+// ranked (all scores are 1 and results are ordered by key unless a sort is
+// given) and only a subset of the Lucene syntax is understood. Terms,
+// quoted phrases, trailing wildcards, fuzzy terms (term~ or term~N),
+// inclusive and exclusive ranges, grouping and the AND, OR and NOT
+// operators work. Terms next to each other
+// without an operator must all match. Of the geo queries only bounding boxes
+// (field:IN:{north:... east:... south:... west:...}) are supported, NEAR
+// queries are not.
+type LocalBackend struct {
+	lock        sync.Mutex
+	collections map[string]*localCollection
+	lastRef     uint64
+	lastOrdinal int64
+}
+
+// Returns a new, empty LocalBackend.
+func NewLocalBackend() *LocalBackend {
+	return &LocalBackend{collections: make(map[string]*localCollection)}
+}
+
+// The data held for a single collection.
+type localCollection struct {
+	// Every ref of every key, oldest first.
+	items map[string][]*localRef
+
+	// Events by key then type.
+	events map[string]map[string][]*localEvent
+
+	// Outgoing relations by key then kind.
+	links map[string]map[string][]localLink
+}
+
+type localRef struct {
+	ref       string
+	reftime   int64
+	tombstone bool
+	value     json.RawMessage
+}
+
+type localEvent struct {
+	ref       string
+	timestamp int64
+	ordinal   int64
+	value     json.RawMessage
+}
+
+type localLink struct {
+	collection string
+	key        string
+}
+
+// Returns the latest ref of the key, or nil if it does not exist or was
+// deleted.
+func (c *localCollection) current(key string) *localRef {
+	refs := c.items[key]
+	if len(refs) == 0 || refs[len(refs)-1].tombstone {
+		return nil
+	}
+	return refs[len(refs)-1]
+}
+
+// Returns the keys that currently exist in ascending order.
+func (c *localCollection) keys() []string {
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		if c.current(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Implements http.RoundTripper by answering the request from memory.
+func (b *LocalBackend) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var reader io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(req.Body)
+			if err != nil {
+				req.Body.Close()
+				return localError(req, 400, err.Error()), nil
+			}
+			reader = gz
+		}
+		var err error
+		body, err = ioutil.ReadAll(reader)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Split the path after the API version into its unescaped segments.
+	path := strings.Trim(req.URL.EscapedPath(), "/")
+	path = strings.Trim(strings.TrimPrefix(path, "v0"), "/")
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+	for i, part := range parts {
+		var err error
+		if parts[i], err = url.PathUnescape(part); err != nil {
+			return localError(req, 400, "Malformed path."), nil
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch {
+	case len(parts) == 0:
+		return localReply(req, 200, nil, nil), nil
+	case len(parts) == 1 && req.Method == "GET":
+		if req.URL.Query().Get("query") != "" {
+			return b.search(req, parts[0]), nil
+		}
+		return b.list(req, parts[0]), nil
+	case len(parts) == 2:
+		return b.item(req, parts[0], parts[1], body), nil
+	case len(parts) == 3 && parts[2] == "refs" && req.Method == "GET":
+		return b.history(req, parts[0], parts[1]), nil
+	case len(parts) == 4 && parts[2] == "refs" && req.Method == "GET":
+		return b.getRef(req, parts[0], parts[1], parts[3]), nil
+	case len(parts) >= 4 && len(parts) <= 6 && parts[2] == "events":
+		return b.event(req, parts[0], parts[1], parts[3], parts[4:], body), nil
+	case len(parts) == 6 && parts[2] == "relation":
+		return b.relation(req, parts[0], parts[1], parts[3], parts[4],
+			parts[5]), nil
+	case len(parts) >= 4 && parts[2] == "relations" && req.Method == "GET":
+		return b.relations(req, parts[0], parts[1], parts[3:]), nil
+	}
+	return localError(req, 404, "The requested items could not be found."), nil
+}
+
+// Returns the named collection, creating it if necessary.
+func (b *LocalBackend) collection(name string) *localCollection {
+	c, ok := b.collections[name]
+	if !ok {
+		c = &localCollection{
+			items:  make(map[string][]*localRef),
+			events: make(map[string]map[string][]*localEvent),
+			links:  make(map[string]map[string][]localLink),
+		}
+		b.collections[name] = c
+	}
+	return c
+}
+
+// Returns a new unique ref.
+func (b *LocalBackend) newRef() string {
+	b.lastRef++
+	return fmt.Sprintf("%016x", b.lastRef)
+}
+
+//
+// Key value
+//
+
+// Handles GET, PUT and DELETE of collection/key.
+func (b *LocalBackend) item(
+	req *http.Request, collection, key string, body []byte,
+) *http.Response {
+	c := b.collection(collection)
+	current := c.current(key)
+	if resp := checkPreconditions(req, current); resp != nil {
+		return resp
+	}
+
+	switch req.Method {
+	case "GET":
+		if current == nil {
+			return localError(req, 404, "The requested items could not be "+
+				"found.")
+		}
+		return localReply(req, 200, map[string]string{
+			"Content-Location": itemPath(collection, key, current.ref),
+			"ETag":             `"` + current.ref + `"`,
+		}, current.value)
+	case "PUT":
+		if !json.Valid(body) {
+			return localError(req, 400, "The request body is not valid JSON.")
+		}
+		ref := &localRef{
+			ref:     b.newRef(),
+			reftime: toTimestamp(time.Now()),
+			value:   json.RawMessage(body),
+		}
+		c.items[key] = append(c.items[key], ref)
+		return localReply(req, 201, map[string]string{
+			"Location": itemPath(collection, key, ref.ref),
+			"ETag":     `"` + ref.ref + `"`,
+		}, nil)
+	case "DELETE":
+		if req.URL.Query().Get("purge") == "true" {
+			delete(c.items, key)
+		} else if current != nil {
+			c.items[key] = append(c.items[key], &localRef{
+				ref:       b.newRef(),
+				reftime:   toTimestamp(time.Now()),
+				tombstone: true,
+			})
+		}
+		return localReply(req, 204, nil, nil)
+	}
+	return localError(req, 405, "Method not allowed.")
+}
+
+// Handles GET of collection/key/refs/ref.
+func (b *LocalBackend) getRef(
+	req *http.Request, collection, key, ref string,
+) *http.Response {
+	for _, r := range b.collection(collection).items[key] {
+		if r.ref == ref && !r.tombstone {
+			return localReply(req, 200, map[string]string{
+				"Content-Location": itemPath(collection, key, r.ref),
+				"ETag":             `"` + r.ref + `"`,
+			}, r.value)
+		}
+	}
+	return localError(req, 404, "The requested items could not be found.")
+}
+
+// Handles GET of collection/key/refs, newest ref first.
+func (b *LocalBackend) history(
+	req *http.Request, collection, key string,
+) *http.Response {
+	refs := b.collection(collection).items[key]
+	values := req.URL.Query().Get("values") == "true"
+	results := make([]*jsonListItem, 0, len(refs))
+	for n := len(refs) - 1; n >= 0; n-- {
+		r := refs[n]
+		result := &jsonListItem{
+			Path: jsonPath{
+				Collection: collection,
+				Key:        key,
+				Ref:        r.ref,
+				Tombstone:  r.tombstone,
+			},
+			RefTime: r.reftime,
+		}
+		if values && !r.tombstone {
+			result.Value = r.value
+		}
+		results = append(results, result)
+	}
+	return localPage(req, results)
+}
+
+// Handles GET of a collection listing.
+func (b *LocalBackend) list(req *http.Request, collection string) *http.Response {
+	c := b.collection(collection)
+	query := req.URL.Query()
+	start, after := query.Get("startKey"), query.Get("afterKey")
+	end, before := query.Get("endKey"), query.Get("beforeKey")
+
+	limit := localLimit(query)
+	var results []*jsonListItem
+	next := ""
+	for _, key := range c.keys() {
+		switch {
+		case start != "" && key < start, after != "" && key <= after:
+			continue
+		case end != "" && key > end, before != "" && key >= before:
+			continue
+		}
+		if len(results) == limit {
+			// There is at least one more key so link to the page after the
+			// last key returned.
+			query.Del("startKey")
+			query.Set("afterKey", results[len(results)-1].Path.Key)
+			next = "/v0/" + collection + "?" + query.Encode()
+			break
+		}
+		r := c.current(key)
+		results = append(results, &jsonListItem{
+			Path:    jsonPath{Collection: collection, Key: key, Ref: r.ref},
+			RefTime: r.reftime,
+			Value:   r.value,
+		})
+	}
+	return localJSON(req, 200, &jsonList{
+		Count:   len(results),
+		Next:    next,
+		Results: results,
+	})
+}
+
+// Handles GET of a collection search.
+func (b *LocalBackend) search(req *http.Request, collection string) *http.Response {
+	query := req.URL.Query()
+	matcher, err := parseLocalQuery(query.Get("query"))
+	if err != nil {
+		return localError(req, 400, err.Error())
+	}
+
+	c := b.collection(collection)
+	var docs []*localDocument
+	for _, key := range c.keys() {
+		r := c.current(key)
+		doc := &localDocument{key: key, ref: r.ref, reftime: r.reftime}
+		if decodeLocalValue(r.value, &doc.value) == nil && matcher(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	if spec := query.Get("sort"); spec != "" {
+		sortLocalDocuments(docs, spec)
+	}
+
+	results := make([]*jsonListItem, len(docs))
+	for n, doc := range docs {
+		results[n] = &jsonListItem{
+			Path:    jsonPath{Collection: collection, Key: doc.key, Ref: doc.ref},
+			RefTime: doc.reftime,
+			Score:   1,
+			Value:   c.current(doc.key).value,
+		}
+	}
+	return localPage(req, results)
+}
+
+//
+// Events
+//
+
+// Handles the event paths, collection/key/events/type with an optional
+// timestamp and ordinal following.
+func (b *LocalBackend) event(
+	req *http.Request, collection, key, typ string, rest []string,
+	body []byte,
+) *http.Response {
+	c := b.collection(collection)
+	byType, ok := c.events[key]
+	if !ok {
+		byType = make(map[string][]*localEvent)
+		c.events[key] = byType
+	}
+
+	var timestamp, ordinal int64
+	var err error
+	if len(rest) > 0 {
+		if timestamp, err = strconv.ParseInt(rest[0], 10, 64); err != nil {
+			return localError(req, 400, "Malformed timestamp.")
+		}
+	}
+	if len(rest) > 1 {
+		if ordinal, err = strconv.ParseInt(rest[1], 10, 64); err != nil {
+			return localError(req, 400, "Malformed ordinal.")
+		}
+	}
+
+	// Listing and adding work on the type, everything else on a single
+	// event.
+	switch {
+	case len(rest) == 0 && req.Method == "GET":
+		return b.listEvents(req, collection, key, typ, byType[typ])
+	case len(rest) < 2 && req.Method == "POST":
+		if !json.Valid(body) {
+			return localError(req, 400, "The request body is not valid JSON.")
+		}
+		if len(rest) == 0 {
+			timestamp = toTimestamp(time.Now())
+		}
+		b.lastOrdinal++
+		event := &localEvent{
+			ref:       b.newRef(),
+			timestamp: timestamp,
+			ordinal:   b.lastOrdinal,
+			value:     json.RawMessage(body),
+		}
+		byType[typ] = append(byType[typ], event)
+		return localReply(req, 201, map[string]string{
+			"Location": eventPath(collection, key, typ, event),
+			"ETag":     `"` + event.ref + `"`,
+		}, nil)
+	case len(rest) != 2:
+		return localError(req, 405, "Method not allowed.")
+	}
+
+	index := -1
+	for n, event := range byType[typ] {
+		if event.timestamp == timestamp && event.ordinal == ordinal {
+			index = n
+		}
+	}
+	var current *localRef
+	if index >= 0 {
+		current = &localRef{ref: byType[typ][index].ref}
+	}
+	if resp := checkPreconditions(req, current); resp != nil {
+		return resp
+	}
+
+	switch req.Method {
+	case "GET":
+		if index < 0 {
+			return localError(req, 404, "The requested items could not be "+
+				"found.")
+		}
+		event := byType[typ][index]
+		return localJSON(req, 200, &jsonEvent{
+			Ordinal:    event.ordinal,
+			OrdinalStr: strconv.FormatInt(event.ordinal, 10),
+			Path:       eventJSONPath(collection, key, typ, event),
+			Timestamp:  event.timestamp,
+			Value:      event.value,
+		})
+	case "PUT":
+		if index < 0 {
+			return localError(req, 404, "The requested items could not be "+
+				"found.")
+		} else if !json.Valid(body) {
+			return localError(req, 400, "The request body is not valid JSON.")
+		}
+		event := byType[typ][index]
+		event.ref = b.newRef()
+		event.value = json.RawMessage(body)
+		return localReply(req, 204, map[string]string{
+			"Location": eventPath(collection, key, typ, event),
+			"ETag":     `"` + event.ref + `"`,
+		}, nil)
+	case "DELETE":
+		if index >= 0 {
+			events := byType[typ]
+			byType[typ] = append(events[:index:index], events[index+1:]...)
+		}
+		return localReply(req, 204, nil, nil)
+	}
+	return localError(req, 405, "Method not allowed.")
+}
+
+// Handles GET of an event listing, newest event first.
+func (b *LocalBackend) listEvents(
+	req *http.Request, collection, key, typ string, events []*localEvent,
+) *http.Response {
+	query := req.URL.Query()
+	type bound struct {
+		name  string
+		check func(cmp int) bool
+	}
+	bounds := []bound{
+		{"startEvent", func(cmp int) bool { return cmp >= 0 }},
+		{"afterEvent", func(cmp int) bool { return cmp > 0 }},
+		{"endEvent", func(cmp int) bool { return cmp <= 0 }},
+		{"beforeEvent", func(cmp int) bool { return cmp < 0 }},
+	}
+
+	sorted := make([]*localEvent, len(events))
+	copy(sorted, events)
+	sort.Slice(sorted, func(l, r int) bool {
+		return compareEvent(sorted[l], sorted[r].timestamp,
+			sorted[r].ordinal) > 0
+	})
+
+	results := make([]*jsonListItem, 0, len(sorted))
+	for _, event := range sorted {
+		included := true
+		for _, bound := range bounds {
+			value := query.Get(bound.name)
+			if value == "" {
+				continue
+			}
+			ts, ord, err := parseEventBound(value)
+			if err != nil {
+				return localError(req, 400, err.Error())
+			}
+			if !bound.check(compareEvent(event, ts, ord)) {
+				included = false
+			}
+		}
+		if included {
+			results = append(results, &jsonListItem{
+				Ordinal:   event.ordinal,
+				Path:      eventJSONPath(collection, key, typ, event),
+				Timestamp: event.timestamp,
+				Value:     event.value,
+			})
+		}
+	}
+	return localPage(req, results)
+}
+
+// Compares an event to a timestamp and ordinal.
+func compareEvent(event *localEvent, timestamp, ordinal int64) int {
+	switch {
+	case event.timestamp < timestamp:
+		return -1
+	case event.timestamp > timestamp:
+		return 1
+	case event.ordinal < ordinal:
+		return -1
+	case event.ordinal > ordinal:
+		return 1
+	}
+	return 0
+}
+
+// Parses an event listing bound of the form "timestamp" or
+// "timestamp/ordinal".
+func parseEventBound(value string) (int64, int64, error) {
+	parts := strings.SplitN(value, "/", 2)
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Malformed event bound %q.", value)
+	}
+	var ord int64
+	if len(parts) == 2 {
+		if ord, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Malformed event bound %q.", value)
+		}
+	}
+	return ts, ord, nil
+}
+
+//
+// Graph
+//
+
+// Handles PUT and DELETE of collection/key/relation/kind/toCollection/toKey.
+func (b *LocalBackend) relation(
+	req *http.Request, collection, key, kind, toCollection, toKey string,
+) *http.Response {
+	c := b.collection(collection)
+	byKind, ok := c.links[key]
+	if !ok {
+		byKind = make(map[string][]localLink)
+		c.links[key] = byKind
+	}
+	to := localLink{collection: toCollection, key: toKey}
+	if req.Method != "PUT" && req.Method != "DELETE" {
+		return localError(req, 405, "Method not allowed.")
+	} else if req.Method == "PUT" && (c.current(key) == nil ||
+		b.collection(toCollection).current(toKey) == nil) {
+		return localError(req, 404, "The requested items could not be found.")
+	}
+
+	// Drop any existing copy of the link, then add it back for a PUT.
+	var links []localLink
+	for _, link := range byKind[kind] {
+		if link != to {
+			links = append(links, link)
+		}
+	}
+	if req.Method == "PUT" {
+		links = append(links, to)
+	}
+	byKind[kind] = links
+	return localReply(req, 204, nil, nil)
+}
+
+// Handles GET of collection/key/relations/kind..., following each kind in
+// turn.
+func (b *LocalBackend) relations(
+	req *http.Request, collection, key string, kinds []string,
+) *http.Response {
+	frontier := []localLink{{collection: collection, key: key}}
+	for _, kind := range kinds {
+		seen := make(map[localLink]bool)
+		var next []localLink
+		for _, from := range frontier {
+			for _, to := range b.collection(from.collection).links[from.key][kind] {
+				if !seen[to] {
+					seen[to] = true
+					next = append(next, to)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	results := make([]*jsonListItem, 0, len(frontier))
+	for _, link := range frontier {
+		r := b.collection(link.collection).current(link.key)
+		if r == nil {
+			continue
+		}
+		results = append(results, &jsonListItem{
+			Path: jsonPath{
+				Collection: link.collection,
+				Key:        link.key,
+				Ref:        r.ref,
+			},
+			RefTime: r.reftime,
+			Value:   r.value,
+		})
+	}
+	return localPage(req, results)
+}
+
+//
+// Responses
+//
+
+// Returns a 412 response if the If-Match or If-None-Match headers of the
+// request do not hold for the given current ref, which is nil if there is
+// none.
+func checkPreconditions(req *http.Request, current *localRef) *http.Response {
+	if match := req.Header.Get("If-Match"); match != "" {
+		ref, err := parseETag(match)
+		if err != nil || current == nil || current.ref != ref {
+			return localError(req, 412, "The item has been changed.")
+		}
+	}
+	if req.Header.Get("If-None-Match") == `"*"` && current != nil {
+		return localError(req, 412, "The item already exists.")
+	}
+	return nil
+}
+
+// Returns one page of results using the limit and offset parameters of the
+// request, with a next link if there are more.
+func localPage(req *http.Request, results []*jsonListItem) *http.Response {
+	query := req.URL.Query()
+	limit := localLimit(query)
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 || offset > len(results) {
+		offset = len(results)
+	}
+
+	page := &jsonList{TotalCount: len(results)}
+	page.Results = results[offset:]
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		query.Set("offset", strconv.Itoa(offset+limit))
+		page.Next = req.URL.EscapedPath() + "?" + query.Encode()
+	}
+	page.Count = len(page.Results)
+	return localJSON(req, 200, page)
+}
+
+// Returns the page size requested, defaulting to 10 and capped at 100.
+func localLimit(query url.Values) int {
+	limit, err := strconv.Atoi(query.Get("limit"))
+	switch {
+	case err != nil || limit <= 0:
+		return 10
+	case limit > 100:
+		return 100
+	}
+	return limit
+}
+
+// Returns a response with the given value encoded as JSON.
+func localJSON(req *http.Request, status int, value interface{}) *http.Response {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return localError(req, 500, err.Error())
+	}
+	return localReply(req, status, nil, body)
+}
+
+// Returns an error response in the form Orchestrate uses.
+func localError(req *http.Request, status int, message string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"message": message})
+	return localReply(req, status, nil, body)
+}
+
+// Builds a response.
+func localReply(
+	req *http.Request, status int, headers map[string]string, body []byte,
+) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if body != nil {
+		resp.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
+
+// Returns the location of an item ref.
+func itemPath(collection, key, ref string) string {
+	return "/v0/" + url.PathEscape(collection) + "/" + url.PathEscape(key) +
+		"/refs/" + ref
+}
+
+// Returns the location of an event.
+func eventPath(collection, key, typ string, event *localEvent) string {
+	return fmt.Sprintf("/v0/%s/%s/events/%s/%d/%d", url.PathEscape(collection),
+		url.PathEscape(key), url.PathEscape(typ), event.timestamp,
+		event.ordinal)
+}
+
+// Returns the path object describing an event.
+func eventJSONPath(collection, key, typ string, event *localEvent) jsonPath {
+	return jsonPath{
+		Collection: collection,
+		Key:        key,
+		Ordinal:    event.ordinal,
+		OrdinalStr: strconv.FormatInt(event.ordinal, 10),
+		Ref:        event.ref,
+		Timestamp:  event.timestamp,
+		Type:       typ,
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns a collection of a local client holding the given keys, written
+// in the order given.
+func seededCollection(t testing.TB, keys ...string) *Collection {
+	c := NewLocalClient().Collection("test")
+	for _, key := range keys {
+		if _, err := c.Update(key, map[string]string{"key": key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// Returns the keys an Iterator returns.
+func iteratorKeys(t *testing.T, it *Iterator) []string {
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, it.Raw().Key)
+	}
+	if it.Error != nil {
+		t.Fatal(it.Error)
+	}
+	return keys
+}
+
+func TestLocalConditionalWrites(t *testing.T) {
+	c := seededCollection(t, "a")
+	if _, err := c.Create("a", map[string]int{"n": 1}); err == nil {
+		t.Error("created an item that exists")
+	} else if _, ok := err.(AlreadyExistsError); !ok {
+		t.Errorf("create of an item that exists returned %T %v", err, err)
+	}
+
+	item, err := c.Get("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := item.Update(map[string]int{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := item.Update(map[string]int{"n": 3}); err == nil {
+		t.Error("updated an item with a stale ref")
+	} else if _, ok := err.(NotMostRecentError); !ok {
+		t.Errorf("update with a stale ref returned %T %v", err, err)
+	}
+
+	var value map[string]int
+	if _, err := c.Get("a", &value); err != nil || value["n"] != 2 {
+		t.Errorf("read %v, %v after the updates", value, err)
+	}
+	if _, err := c.Get("missing", nil); err == nil {
+		t.Error("read a missing item")
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("read of a missing item returned %T %v", err, err)
+	}
+}
+
+func TestLocalEvents(t *testing.T) {
+	c := seededCollection(t, "a")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, status := range []string{"available", "occupied", "available"} {
+		_, err := c.AddEventWithTimestamp("a", "status",
+			start.Add(time.Duration(i)*time.Minute),
+			map[string]string{"status": status})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.AddEvent("a", "report", map[string]int{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are listed newest first, across pages.
+	var got []string
+	it := c.ListEvents("a", "status", &ListEventsQuery{Limit: 2})
+	for it.Next() {
+		var value struct{ Status string }
+		event, err := it.GetEvent(&value)
+		if err != nil {
+			t.Fatal(err)
+		} else if event.Type != "status" || event.Key != "a" {
+			t.Errorf("listed the %s event of %s", event.Type, event.Key)
+		}
+		got = append(got, value.Status)
+	}
+	if it.Error != nil {
+		t.Fatal(it.Error)
+	}
+	want := []string{"available", "occupied", "available"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %q, expected %q", got, want)
+	}
+
+	// After without an ordinal includes the events at that time.
+	it = c.ListEvents("a", "status", &ListEventsQuery{
+		After: start, Before: start.Add(2 * time.Minute),
+	})
+	if n := len(iteratorEvents(t, it)); n != 2 {
+		t.Errorf("listed %d events before the last, expected 2", n)
+	}
+}
+
+// Returns the ordinals of the events an Iterator returns.
+func iteratorEvents(t *testing.T, it *Iterator) []int64 {
+	var ordinals []int64
+	for it.Next() {
+		event, err := it.GetEvent(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ordinals = append(ordinals, event.Ordinal)
+	}
+	if it.Error != nil {
+		t.Fatal(it.Error)
+	}
+	return ordinals
+}
+
+func TestLocalGraph(t *testing.T) {
+	client := NewLocalClient()
+	chargepoints := client.Collection("chargepoints")
+	operators := client.Collection("operators")
+	if _, err := operators.Create("op", map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"cp1", "cp2"} {
+		if _, err := chargepoints.Create(key, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := chargepoints.Link(key, "operated_by", "operators",
+			"op"); err != nil {
+			t.Fatal(err)
+		}
+		if err := operators.Link("op", "operates", "chargepoints",
+			key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := iteratorKeys(t, operators.GetLinks("op", nil, "operates"))
+	if want := []string{"cp1", "cp2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("op operates %q, expected %q", got, want)
+	}
+
+	// Each kind after the first is a further hop.
+	got = iteratorKeys(t, chargepoints.GetLinks("cp1",
+		&GetLinksQuery{Limit: 1}, "operated_by", "operates"))
+	if want := []string{"cp1", "cp2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chargepoints of the operator of cp1 are %q, expected %q",
+			got, want)
+	}
+
+	if err := operators.Unlink("op", "operates", "chargepoints",
+		"cp1"); err != nil {
+		t.Fatal(err)
+	}
+	got = iteratorKeys(t, operators.GetLinks("op", nil, "operates"))
+	if want := []string{"cp2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("op operates %q after unlinking cp1, expected %q", got,
+			want)
+	}
+}
+
+func TestLocalSearch(t *testing.T) {
+	c := NewLocalClient().Collection("test")
+	for key, kw := range map[string]int{"a": 7, "b": 22, "c": 50} {
+		if _, err := c.Create(key, map[string]int{"kw": kw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for query, want := range map[string][]string{
+		"*":                         {"a", "b", "c"},
+		"value.kw:[20 TO *]":        {"b", "c"},
+		"value.kw:7 OR value.kw:50": {"a", "c"},
+		"NOT value.kw:22":           {"a", "c"},
+	} {
+		got := iteratorKeys(t, c.Search(query, &SearchQuery{Limit: 2}))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s matched %q, expected %q", query, got, want)
+		}
+	}
+}
+
+// Fails requests whose context is done, as the network transports do.
+type contextTransport struct {
+	http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestLocalMultiSearchContext(t *testing.T) {
+	client := NewLocalClient()
+	client.HTTPClient.Transport = contextTransport{
+		client.HTTPClient.Transport}
+	for _, name := range []string{"a", "b"} {
+		if _, err := client.Collection(name).Create("k",
+			map[string]int{"n": 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := &SearchQuery{Limit: 10}
+	it := client.MultiSearch([]string{"a", "b"}, "*", opts)
+	if got := iteratorKeys(t, it); len(got) != 2 {
+		t.Errorf("matched %q, expected a key of each collection", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = client.MultiSearchContext(ctx, []string{"a", "b"}, "*", opts)
+	if it.Next() || it.Error == nil {
+		t.Errorf("search with a cancelled context returned %v", it.Error)
+	}
+}
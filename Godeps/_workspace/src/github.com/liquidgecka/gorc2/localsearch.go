@@ -0,0 +1,669 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//
+// LocalBackend search
+//
+
+// An item being matched against a search query.
+type localDocument struct {
+	key     string
+	ref     string
+	reftime int64
+	value   interface{}
+}
+
+// Returns true if a document matches a query, or part of one.
+type localMatcher func(doc *localDocument) bool
+
+// Decodes a stored value for matching, keeping numbers as json.Number.
+func decodeLocalValue(raw json.RawMessage, value *interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// Returns the leaf values of the document at the given field. Fields are
+// dotted paths into the value, with or without a leading "value.", or one
+// of @path.key, @path.ref and @path.reftime. Arrays are flattened. An empty
+// field returns every leaf in the value.
+func (d *localDocument) fields(field string) []interface{} {
+	switch field {
+	case "@path.key":
+		return []interface{}{d.key}
+	case "@path.ref":
+		return []interface{}{d.ref}
+	case "@path.reftime":
+		return []interface{}{json.Number(strconv.FormatInt(d.reftime, 10))}
+	case "":
+		return localLeaves(d.value, nil)
+	}
+
+	values := []interface{}{d.value}
+	for _, part := range strings.Split(strings.TrimPrefix(field, "value."), ".") {
+		var next []interface{}
+		for _, v := range values {
+			for _, v := range localFlatten(v) {
+				if object, ok := v.(map[string]interface{}); ok {
+					if child, ok := object[part]; ok {
+						next = append(next, child)
+					}
+				}
+			}
+		}
+		values = next
+	}
+	var leaves []interface{}
+	for _, v := range values {
+		leaves = append(leaves, localFlatten(v)...)
+	}
+	return leaves
+}
+
+// Returns the value itself, or its elements if it is an array.
+func localFlatten(value interface{}) []interface{} {
+	if array, ok := value.([]interface{}); ok {
+		var values []interface{}
+		for _, v := range array {
+			values = append(values, localFlatten(v)...)
+		}
+		return values
+	}
+	return []interface{}{value}
+}
+
+// Appends every leaf value found under value to leaves.
+func localLeaves(value interface{}, leaves []interface{}) []interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			leaves = localLeaves(child, leaves)
+		}
+	case []interface{}:
+		for _, child := range v {
+			leaves = localLeaves(child, leaves)
+		}
+	default:
+		leaves = append(leaves, v)
+	}
+	return leaves
+}
+
+//
+// Query parsing
+//
+
+// Parses a search query into a matcher. See LocalBackend for the supported
+// syntax.
+func parseLocalQuery(query string) (localMatcher, error) {
+	p := &localQueryParser{s: []rune(query)}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.done() {
+		return nil, fmt.Errorf("Unexpected %q in query.", string(p.s[p.pos:]))
+	}
+	return m, nil
+}
+
+type localQueryParser struct {
+	s   []rune
+	pos int
+}
+
+func (p *localQueryParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *localQueryParser) skipSpace() {
+	for !p.done() && unicode.IsSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+// Consumes the given text if it is next.
+func (p *localQueryParser) consume(text string) bool {
+	r := []rune(text)
+	if len(p.s)-p.pos < len(r) || string(p.s[p.pos:p.pos+len(r)]) != text {
+		return false
+	}
+	p.pos += len(r)
+	return true
+}
+
+// Consumes the given operator keyword if it is next and stands alone.
+func (p *localQueryParser) keyword(word string) bool {
+	end := p.pos + len(word)
+	if end > len(p.s) || string(p.s[p.pos:end]) != word {
+		return false
+	} else if end < len(p.s) && !unicode.IsSpace(p.s[end]) && p.s[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// or := and (("OR" | "||") and)*
+func (p *localQueryParser) parseOr() (localMatcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if !p.keyword("OR") && !p.consume("||") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(doc *localDocument) bool { return l(doc) || right(doc) }
+	}
+}
+
+// and := unary ((("AND" | "&&")? unary)*
+func (p *localQueryParser) parseAnd() (localMatcher, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.done() || p.s[p.pos] == ')' {
+			return left, nil
+		}
+		start := p.pos
+		if p.keyword("OR") || p.consume("||") {
+			p.pos = start
+			return left, nil
+		}
+		if !p.keyword("AND") {
+			p.consume("&&")
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(doc *localDocument) bool { return l(doc) && right(doc) }
+	}
+}
+
+// unary := ("NOT" | "!" | "-") unary | "+" unary | "(" or ")" | clause
+func (p *localQueryParser) parseUnary() (localMatcher, error) {
+	p.skipSpace()
+	switch {
+	case p.done():
+		return nil, fmt.Errorf("Unexpected end of query.")
+	case p.keyword("NOT"), p.consume("!"), p.consume("-"):
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(doc *localDocument) bool { return !m(doc) }, nil
+	case p.consume("+"):
+		return p.parseUnary()
+	case p.consume("("):
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, fmt.Errorf("Missing ) in query.")
+		}
+		return m, nil
+	}
+	return p.parseClause()
+}
+
+// clause := (field ":")? (phrase | range | term)
+func (p *localQueryParser) parseClause() (localMatcher, error) {
+	field := ""
+	if p.s[p.pos] != '"' {
+		start := p.pos
+		word, _ := p.readWord(true)
+		if p.consume(":") {
+			field = word
+		} else {
+			p.pos = start
+		}
+	}
+
+	switch {
+	case p.done():
+		return nil, fmt.Errorf("Missing value for %s in query.", field)
+	case field != "" && p.consume("IN:"):
+		return p.parseBoundingBox(field)
+	case p.s[p.pos] == '"':
+		phrase, err := p.readPhrase()
+		if err != nil {
+			return nil, err
+		}
+		return termMatcher(field, strings.ToLower(phrase), false, true), nil
+	case p.s[p.pos] == '[' || p.s[p.pos] == '{':
+		return p.parseRange(field)
+	}
+	word, wildcard := p.readWord(field == "")
+	if word == "" && !wildcard {
+		return nil, fmt.Errorf("Unexpected %q in query.", string(p.s[p.pos]))
+	}
+	if !wildcard && p.consume("~") {
+		return fuzzyMatcher(field, strings.ToLower(word), p.readFuzziness()),
+			nil
+	}
+	return termMatcher(field, strings.ToLower(word), wildcard, false), nil
+}
+
+// Reads the edit distance after the ~ of a fuzzy term, which defaults to
+// and is at most 2 as in Lucene. Similarities below 1, from the older
+// term~0.8 syntax, are taken as a single edit.
+func (p *localQueryParser) readFuzziness() int {
+	start := p.pos
+	for !p.done() && (unicode.IsDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		return 2
+	}
+	f, err := strconv.ParseFloat(string(p.s[start:p.pos]), 64)
+	switch {
+	case err != nil || f >= 2:
+		return 2
+	case f < 1 && f > 0:
+		return 1
+	}
+	return int(f)
+}
+
+// range := ("[" | "{") value "TO" value ("]" | "}")
+func (p *localQueryParser) parseRange(field string) (localMatcher, error) {
+	lowInclusive := p.s[p.pos] == '['
+	p.pos++
+	p.skipSpace()
+	low, err := p.readRangeValue()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.keyword("TO") {
+		return nil, fmt.Errorf("Missing TO in range for %s.", field)
+	}
+	p.skipSpace()
+	high, err := p.readRangeValue()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	var highInclusive bool
+	switch {
+	case p.consume("]"):
+		highInclusive = true
+	case p.consume("}"):
+	default:
+		return nil, fmt.Errorf("Unterminated range for %s.", field)
+	}
+
+	return func(doc *localDocument) bool {
+		for _, v := range doc.fields(field) {
+			if low != "*" {
+				if cmp, ok := compareLocal(v, low); !ok || cmp < 0 ||
+					(cmp == 0 && !lowInclusive) {
+					continue
+				}
+			}
+			if high != "*" {
+				if cmp, ok := compareLocal(v, high); !ok || cmp > 0 ||
+					(cmp == 0 && !highInclusive) {
+					continue
+				}
+			}
+			return true
+		}
+		return false
+	}, nil
+}
+
+// box := "{" (("north" | "south" | "east" | "west") ":" number)* "}"
+func (p *localQueryParser) parseBoundingBox(field string) (localMatcher, error) {
+	p.skipSpace()
+	if !p.consume("{") {
+		return nil, fmt.Errorf("Missing { in bounding box for %s.", field)
+	}
+	box := make(map[string]float64, 4)
+	for {
+		p.skipSpace()
+		if p.consume("}") {
+			break
+		} else if p.done() {
+			return nil, fmt.Errorf("Unterminated bounding box for %s.", field)
+		}
+		name, _ := p.readWord(true)
+		if !p.consume(":") {
+			return nil, fmt.Errorf("Malformed bounding box for %s.", field)
+		}
+		value, _ := p.readWord(false)
+		f, err := strconv.ParseFloat(strings.TrimSuffix(value, ","), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed %s in bounding box for %s.",
+				name, field)
+		}
+		box[strings.ToLower(name)] = f
+	}
+	for _, side := range []string{"north", "south", "east", "west"} {
+		if _, ok := box[side]; !ok {
+			return nil, fmt.Errorf("Missing %s in bounding box for %s.", side,
+				field)
+		}
+	}
+
+	return func(doc *localDocument) bool {
+		for _, v := range doc.fields(field) {
+			lat, lon, ok := geoPoint(v)
+			if !ok || lat < box["south"] || lat > box["north"] {
+				continue
+			}
+			// A box whose west edge is east of its east edge crosses the
+			// antimeridian.
+			if box["west"] <= box["east"] {
+				if lon >= box["west"] && lon <= box["east"] {
+					return true
+				}
+			} else if lon >= box["west"] || lon <= box["east"] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Reads a word, undoing backslash escapes. The word ends at white space,
+// a bracket, or a colon if stopAtColon is set. An unescaped trailing * is
+// stripped and reported as a wildcard.
+func (p *localQueryParser) readWord(stopAtColon bool) (string, bool) {
+	var word []rune
+	wildcard := false
+	for !p.done() {
+		r := p.s[p.pos]
+		if unicode.IsSpace(r) || r == '(' || r == ')' || r == ']' ||
+			r == '}' || r == '~' || (r == ':' && stopAtColon) {
+			break
+		}
+		p.pos++
+		wildcard = false
+		if r == '\\' && !p.done() {
+			r = p.s[p.pos]
+			p.pos++
+		} else if r == '*' {
+			wildcard = true
+			continue
+		}
+		word = append(word, r)
+	}
+	return string(word), wildcard
+}
+
+// Reads a quoted phrase, undoing backslash escapes.
+func (p *localQueryParser) readPhrase() (string, error) {
+	p.pos++
+	var phrase []rune
+	for !p.done() {
+		r := p.s[p.pos]
+		p.pos++
+		if r == '"' {
+			return string(phrase), nil
+		} else if r == '\\' && !p.done() {
+			r = p.s[p.pos]
+			p.pos++
+		}
+		phrase = append(phrase, r)
+	}
+	return "", fmt.Errorf("Unterminated phrase in query.")
+}
+
+// Reads one end of a range, which may be quoted or *.
+func (p *localQueryParser) readRangeValue() (string, error) {
+	if p.done() {
+		return "", fmt.Errorf("Unterminated range in query.")
+	} else if p.s[p.pos] == '"' {
+		return p.readPhrase()
+	}
+	word, wildcard := p.readWord(false)
+	if word == "" && wildcard {
+		return "*", nil
+	}
+	return word, nil
+}
+
+//
+// Matching
+//
+
+// Returns a matcher for a single term or phrase, which must already be lower
+// case. An empty wildcard term matches any document that has the field.
+func termMatcher(field, term string, wildcard, phrase bool) localMatcher {
+	return func(doc *localDocument) bool {
+		for _, v := range doc.fields(field) {
+			if v != nil && wildcard && term == "" {
+				return true
+			} else if matchLocalTerm(v, term, wildcard, phrase) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Returns a matcher for a term, which must already be lower case, that also
+// matches words up to distance edits away from it.
+func fuzzyMatcher(field, term string, distance int) localMatcher {
+	return func(doc *localDocument) bool {
+		for _, v := range doc.fields(field) {
+			text, ok := v.(string)
+			if !ok {
+				if matchLocalTerm(v, term, false, false) {
+					return true
+				}
+				continue
+			}
+			words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+			})
+			for _, word := range words {
+				if editDistance(word, term, distance) <= distance {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// Returns the number of single character insertions, deletions,
+// substitutions and transpositions needed to turn a into b, or max+1 if it
+// is more than max.
+func editDistance(a, b string, max int) int {
+	s, t := []rune(a), []rune(b)
+	if d := len(s) - len(t); d > max || -d > max {
+		return max + 1
+	}
+	// Rows of the optimal string alignment distance matrix.
+	prev2 := make([]int, len(t)+1)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return min(prev[len(t)], max+1)
+}
+
+// Returns true if a leaf value matches a term. Strings are matched word by
+// word ignoring case, phrases are matched as a substring.
+func matchLocalTerm(value interface{}, term string, wildcard, phrase bool) bool {
+	switch v := value.(type) {
+	case string:
+		text := strings.ToLower(v)
+		if text == term || (phrase && strings.Contains(text, term)) {
+			return true
+		}
+		words := strings.FieldsFunc(text, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for _, word := range words {
+			if word == term || (wildcard && strings.HasPrefix(word, term)) {
+				return true
+			}
+		}
+		return wildcard && strings.HasPrefix(text, term)
+	case json.Number:
+		if cmp, ok := compareLocal(v, term); ok {
+			return cmp == 0
+		}
+	case bool:
+		return strconv.FormatBool(v) == term
+	}
+	return false
+}
+
+// Compares a leaf value against a query value. Numbers are compared
+// numerically when the query value is a number and RFC3339 dates as times,
+// everything else is compared as strings. The bool is false if the two can not be compared.
+func compareLocal(value interface{}, query string) (int, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		a, err1 := v.Float64()
+		b, err2 := strconv.ParseFloat(query, 64)
+		if err1 != nil || err2 != nil {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		// Dates are compared as times so differing precision does not
+		// matter.
+		a, err1 := time.Parse(time.RFC3339Nano, v)
+		b, err2 := time.Parse(time.RFC3339Nano, query)
+		if err1 == nil && err2 == nil {
+			switch {
+			case a.Before(b):
+				return -1, true
+			case a.After(b):
+				return 1, true
+			}
+			return 0, true
+		}
+		return strings.Compare(v, query), true
+	}
+	return 0, false
+}
+
+//
+// Sorting
+//
+
+// Sorts documents by a sort parameter such as "value.name:asc,
+// value.power_kw:desc". Documents missing a field sort after those that
+// have it.
+func sortLocalDocuments(docs []*localDocument, spec string) {
+	type sortField struct {
+		field string
+		desc  bool
+	}
+	var fields []sortField
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := sortField{field: part}
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			f.field = part[:i]
+			f.desc = strings.EqualFold(part[i+1:], "desc")
+		}
+		fields = append(fields, f)
+	}
+
+	sort.SliceStable(docs, func(l, r int) bool {
+		for _, f := range fields {
+			lv, rv := docs[l].fields(f.field), docs[r].fields(f.field)
+			switch {
+			case len(lv) == 0 && len(rv) == 0:
+				continue
+			case len(lv) == 0:
+				return false
+			case len(rv) == 0:
+				return true
+			}
+			cmp := compareLeaves(lv[0], rv[0])
+			if cmp == 0 {
+				continue
+			} else if f.desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+}
+
+// Compares two leaf values for sorting.
+func compareLeaves(l, r interface{}) int {
+	if ln, ok := l.(json.Number); ok {
+		if cmp, ok := compareLocal(ln, fmt.Sprint(r)); ok {
+			return cmp
+		}
+	}
+	return strings.Compare(fmt.Sprint(l), fmt.Sprint(r))
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// Lock
+//
+
+// A lock held as an item of a collection, taken with AcquireLock(). A lock
+// is only ever written conditionally, on the key not existing when it is
+// taken and on the ref its holder last wrote when it is renewed or
+// released, so only one holder can have it at a time. A holder that stops
+// without releasing its lock loses it once it expires. Locks expire by the
+// clocks of the clients taking them, so clients relying on a lock should
+// stop trusting it a while before it expires if their clocks may differ.
+type Lock struct {
+	// The key of the lock.
+	Name string
+
+	ttl     time.Duration
+	lock    sync.Mutex
+	item    *Item
+	expires time.Time
+}
+
+// The value of a lock item.
+type lockValue struct {
+	Expires time.Time `json:"expires"`
+}
+
+// Takes the lock of the given name, the item of the collection keyed by it,
+// for ttl. A lock that has expired is deleted, if it has not changed since
+// it was read, and taken again. Returns a LockedError if another holder has
+// the lock.
+func (c *Collection) AcquireLock(name string, ttl time.Duration) (
+	*Lock, error,
+) {
+	for attempt := 0; attempt < 3; attempt++ {
+		now := c.client.Now()
+		item, err := c.Create(name, &lockValue{Expires: now.Add(ttl)})
+		if err == nil {
+			return &Lock{Name: name, ttl: ttl, item: item,
+				expires: now.Add(ttl)}, nil
+		} else if _, ok := err.(AlreadyExistsError); !ok {
+			return nil, err
+		}
+
+		current := &lockValue{}
+		item, err = c.Get(name, current)
+		if _, ok := err.(NotFoundError); ok {
+			// Released since, try again.
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if now.Before(current.Expires) {
+			return nil, LockedError(name)
+		}
+		err = item.Delete()
+		if _, ok := err.(NotMostRecentError); !ok && err != nil {
+			return nil, err
+		}
+	}
+	return nil, LockedError(name)
+}
+
+// Returns when the lock expires unless it is renewed.
+func (l *Lock) Expires() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.expires
+}
+
+// Returns true if the lock has not expired by the client's clock. It may
+// still have been lost if the clocks of other clients are ahead.
+func (l *Lock) Held() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.item != nil && l.item.Collection.client.Now().Before(l.expires)
+}
+
+// Extends the lock to expire ttl from now. Returns a LockedError if the
+// lock was released, or expired and was taken by another holder.
+func (l *Lock) Renew() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.item == nil {
+		return LockedError(l.Name)
+	}
+	expires := l.item.Collection.client.Now().Add(l.ttl)
+	item, err := l.item.Update(&lockValue{Expires: expires})
+	if _, ok := err.(NotMostRecentError); ok {
+		l.item = nil
+		return LockedError(l.Name)
+	} else if err != nil {
+		return err
+	}
+	l.item, l.expires = item, expires
+	return nil
+}
+
+// Releases the lock so that it can be taken without waiting for it to
+// expire. Releasing a lock that was already lost does nothing.
+func (l *Lock) Release() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.item == nil {
+		return nil
+	}
+	err := l.item.Delete()
+	if _, ok := err.(NotMostRecentError); ok {
+		err = nil
+	}
+	if err == nil {
+		l.item = nil
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"fmt"
+	"reflect"
+)
+
+//
+// Metadata injection
+//
+
+// Copies the Orchestrate metadata of an Item into the fields of value that
+// carry an "orc" struct tag. This is done by Item.Unmarshal() when
+// InjectMetadata is set on the Collection. The supported tags are:
+//
+//	orc:"key"       the item key, into a string field
+//	orc:"ref"       the item ref, into a string field
+//	orc:"score"     the search score, into a float field
+//	orc:"distance"  the geo distance, into a float field
+//
+// Only top level exported fields of a struct pointer are considered. Tagged
+// fields should normally also be tagged json:"-" so they are not written
+// back into the stored value.
+func injectMetadata(value interface{}, item *Item) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil
+	}
+	v = v.Elem()
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("orc")
+		if tag == "" || field.PkgPath != "" {
+			continue
+		}
+
+		f := v.Field(i)
+		switch tag {
+		case "key", "ref":
+			if f.Kind() != reflect.String {
+				return fmt.Errorf("Field %s tagged orc:%q must be a string.",
+					field.Name, tag)
+			}
+			if tag == "key" {
+				f.SetString(item.Key)
+			} else {
+				f.SetString(item.Ref)
+			}
+		case "score", "distance":
+			if f.Kind() != reflect.Float32 && f.Kind() != reflect.Float64 {
+				return fmt.Errorf("Field %s tagged orc:%q must be a float.",
+					field.Name, tag)
+			}
+			if tag == "score" {
+				f.SetFloat(float64(item.Score))
+			} else {
+				f.SetFloat(float64(item.Distance))
+			}
+		default:
+			return fmt.Errorf("Field %s has unknown tag orc:%q.",
+				field.Name, tag)
+		}
+	}
+	return nil
+}
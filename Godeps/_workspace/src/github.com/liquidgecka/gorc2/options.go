@@ -0,0 +1,136 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//
+// RequestOptions
+//
+
+// Extra details added to requests made through a Collection. This allows
+// features that the client has no direct support for, such as tracing
+// headers or new query flags, to be used without changes to the library.
+type RequestOptions struct {
+	// Headers added to every request. These replace any header of the same
+	// name that the client would otherwise send.
+	Headers map[string]string
+
+	// Query parameters added to every request, including the requests for
+	// later pages made by an Iterator.
+	Query url.Values
+
+	// If true then writes are not sent, as with Client.DryRun. The refs
+	// made up for them are only known to the Collection returned by
+	// WithOptions() and those derived from it.
+	DryRun bool
+}
+
+// Returns a copy of the Collection that sends the given options with every
+// request, including requests made by Iterators, Items and Events that come
+// from the returned Collection. For example:
+//
+//	c := client.Collection("chargepoints").WithOptions(&RequestOptions{
+//	    Headers: map[string]string{"X-Request-Id": id},
+//	})
+//	item, err := c.Get("key", &value)
+func (c *Collection) WithOptions(opts *RequestOptions) *Collection {
+	copy := *c
+	copy.options = opts
+	copy.dryRun = nil
+	if opts != nil && opts.DryRun {
+		copy.dryRun = &dryRunSession{}
+	}
+	return &copy
+}
+
+// Returns a copy of the Collection that makes all of its requests with the
+// given context. The context is used for cancellation and deadlines, and is
+// passed on to the Tracer so spans can be parented to the caller's span. It
+// applies to Iterators, Items and Events that come from the returned
+// Collection as well.
+func (c *Collection) WithContext(ctx context.Context) *Collection {
+	copy := *c
+	copy.ctx = ctx
+	return &copy
+}
+
+// Returns the context requests should be made with.
+func (c *Collection) context() context.Context {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.dryRun != nil {
+		ctx = context.WithValue(ctx, dryRunKey{}, c.dryRun)
+	}
+	return ctx
+}
+
+// Like Client.emptyReply() but applies the Collection options.
+func (c *Collection) emptyReply(
+	method, path string, headers map[string]string, body io.Reader, status int,
+) (*http.Response, error) {
+	path, headers = c.options.apply(path, headers)
+	return c.client.emptyReply(c.context(), method, path, headers, body,
+		status)
+}
+
+// Like Client.jsonReply() but applies the Collection options.
+func (c *Collection) jsonReply(
+	method, path string, headers map[string]string, body io.Reader,
+	status int, value interface{},
+) (*http.Response, error) {
+	path, headers = c.options.apply(path, headers)
+	return c.client.jsonReply(c.context(), method, path, headers, body,
+		status, value)
+}
+
+// Returns the path and headers with the options added. A nil RequestOptions
+// returns them unchanged.
+func (o *RequestOptions) apply(
+	path string, headers map[string]string,
+) (string, map[string]string) {
+	if o == nil {
+		return path, headers
+	}
+	if len(o.Query) > 0 {
+		if strings.Contains(path, "?") {
+			if !strings.HasSuffix(path, "?") {
+				path += "&"
+			}
+		} else {
+			path += "?"
+		}
+		path += o.Query.Encode()
+	}
+	if len(o.Headers) > 0 {
+		merged := make(map[string]string, len(headers)+len(o.Headers))
+		for k, v := range headers {
+			merged[k] = v
+		}
+		for k, v := range o.Headers {
+			merged[k] = v
+		}
+		headers = merged
+	}
+	return path, headers
+}
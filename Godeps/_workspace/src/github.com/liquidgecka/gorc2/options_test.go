@@ -0,0 +1,56 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRequestOptionsReplaceHeaders(t *testing.T) {
+	var got *http.Request
+	c := testClient(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = r
+			w.Header().Set("Location", r.URL.Path+"/refs/0123456789abcdef")
+			w.WriteHeader(201)
+		}))
+	collection := c.Collection("test").WithOptions(&RequestOptions{
+		Headers: map[string]string{
+			"User-Agent":   "custom/1",
+			"Content-Type": "application/merge-patch+json",
+			"X-Trace":      "abc",
+		},
+		Query: url.Values{"async": {"true"}},
+	})
+	if _, err := collection.Update("key", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"User-Agent":   "custom/1",
+		"Content-Type": "application/merge-patch+json",
+		"X-Trace":      "abc",
+	} {
+		if values := got.Header.Values(name); len(values) != 1 ||
+			values[0] != want {
+			t.Errorf("%s is %q, expected only %q", name, values, want)
+		}
+	}
+	if async := got.URL.Query().Get("async"); async != "true" {
+		t.Errorf("async is %q, expected true", async)
+	}
+}
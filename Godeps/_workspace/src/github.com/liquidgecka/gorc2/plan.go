@@ -0,0 +1,98 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// What a search Iterator asked Orchestrate for and how long it took, for
+// working out why a search is slow or returns nothing. See Iterator.Plan().
+type QueryPlan struct {
+	// The collection searched, or for MultiSearch() the collections
+	// joined with commas.
+	Collection string
+
+	// The Lucene query exactly as sent, including any clauses added for
+	// the Deleted option.
+	Query string
+
+	// The other parameters of the first request, such as limit, offset and
+	// sort.
+	Params url.Values
+
+	// The number of pages fetched and the results they held.
+	Pages   int
+	Fetched int
+
+	// The results dropped by Iterator filters such as DedupeBy(), Filter() and the
+	// Deleted option.
+	Filtered int
+
+	// The total time spent fetching pages, including retries.
+	Latency time.Duration
+
+	// The plans of the collections searched by MultiSearch(), whose pages,
+	// results and latency are added up in the fields above. Since the
+	// collections are searched concurrently the latency is more than the
+	// time waited.
+	Sources []*QueryPlan
+}
+
+// Returns a plan for a search request path.
+func newQueryPlan(collection, path string) *QueryPlan {
+	plan := &QueryPlan{Collection: collection, Params: url.Values{}}
+	if u, err := url.Parse(path); err == nil {
+		plan.Params = u.Query()
+		plan.Query = plan.Params.Get("query")
+		plan.Params.Del("query")
+	}
+	return plan
+}
+
+// Returns a one line summary of the plan for logging.
+func (p *QueryPlan) String() string {
+	return fmt.Sprintf("search %s %q %s: %d pages, %d results, %d filtered "+
+		"in %s", p.Collection, p.Query, p.Params.Encode(), p.Pages,
+		p.Fetched, p.Filtered, p.Latency)
+}
+
+// Returns the plan of a search Iterator as it stands, so far as it has been
+// iterated, or nil for iterators that are not searches. The plan returned is
+// a copy and does not change as iteration carries on.
+func (i *Iterator) Plan() *QueryPlan {
+	if i.plan == nil {
+		return nil
+	}
+	plan := *i.plan
+	plan.Params = url.Values{}
+	for k, v := range i.plan.Params {
+		plan.Params[k] = append([]string(nil), v...)
+	}
+	if i.sources != nil {
+		plan.Sources = make([]*QueryPlan, len(i.sources))
+		for n, src := range i.sources {
+			s := src.Plan()
+			plan.Sources[n] = s
+			plan.Pages += s.Pages
+			plan.Fetched += s.Fetched
+			plan.Filtered += s.Filtered
+			plan.Latency += s.Latency
+		}
+	}
+	return &plan
+}
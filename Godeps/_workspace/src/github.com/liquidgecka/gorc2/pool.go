@@ -0,0 +1,80 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Buffers larger than this are dropped rather than returned to the pool so
+// that one huge response does not pin a lot of memory.
+const maxPooledBuffer = 1 << 20
+
+// Reusable buffers for reading response bodies.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Reusable gzip readers and writers. These carry large internal state so
+// reusing them saves a good deal of allocation on busy clients.
+var (
+	gzipReaderPool sync.Pool
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} { return gzip.NewWriter(nil) },
+	}
+)
+
+// Returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	return buffer
+}
+
+// Returns a buffer to the pool. The buffer must not be used afterwards.
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buffer)
+	}
+}
+
+// Returns a gzip reader reading from r, reusing a pooled reader if one is
+// available.
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if reader, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := reader.Reset(r); err != nil {
+			return nil, err
+		}
+		return reader, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// Compresses raw with a pooled gzip writer and returns the result.
+func gzipBytes(raw []byte) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(writer)
+	writer.Reset(buffer)
+	if _, err := writer.Write(raw); err != nil {
+		return nil, err
+	} else if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
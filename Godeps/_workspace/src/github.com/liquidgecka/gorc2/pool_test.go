@@ -0,0 +1,139 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGzipBytesRoundTrip(t *testing.T) {
+	raw := []byte(strings.Repeat(`{"name": "chargepoint"}`, 100))
+	// Twice, so the second compression reuses the pooled writer.
+	for i := 0; i < 2; i++ {
+		compressed, err := gzipBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := getGzipReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		gzipReaderPool.Put(reader)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, raw) {
+			t.Fatalf("round trip %d changed the value", i)
+		}
+	}
+}
+
+func TestPutBufferDropsLargeBuffers(t *testing.T) {
+	large := bytes.NewBuffer(make([]byte, 0, 2*maxPooledBuffer))
+	putBuffer(large)
+	for i := 0; i < 100; i++ {
+		if getBuffer() == large {
+			t.Fatal("a buffer above maxPooledBuffer was pooled")
+		}
+	}
+}
+
+// Answers every request with a gzipped copy of the JSON value, and checks
+// that compressed request bodies decompress to JSON.
+func gzipHandler(t testing.TB, value string) http.Handler {
+	compressed, err := gzipBytes([]byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			body, err := ioutil.ReadAll(reader)
+			if err != nil || !json.Valid(body) {
+				w.WriteHeader(400)
+				return
+			}
+		}
+		if r.Method == "PUT" {
+			w.Header().Set("Location", r.URL.Path+"/refs/0123456789abcdef")
+			w.WriteHeader(201)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"0123456789abcdef"`)
+		w.Write(compressed)
+	})
+}
+
+func TestCompressedRequestsAndResponses(t *testing.T) {
+	value := `{"name": "` + strings.Repeat("x", 1000) + `"}`
+	c := testClient(t, gzipHandler(t, value))
+	c.CompressRequestsOver = 100
+
+	// Concurrently, so pooled buffers and readers are shared.
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprint(i)
+			if _, err := c.Collection("test").Update(key,
+				json.RawMessage(value)); err != nil {
+				errs <- err
+				return
+			}
+			var got map[string]string
+			if _, err := c.Collection("test").Get(key, &got); err != nil {
+				errs <- err
+			} else if len(got["name"]) != 1000 {
+				errs <- fmt.Errorf("decoded %q", got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Measures reading and decoding a gzipped value, which goes through the
+// pooled buffers and gzip readers.
+func BenchmarkGetCompressed(b *testing.B) {
+	value := `{"name": "` + strings.Repeat("x", 1000) + `"}`
+	c := testClient(b, gzipHandler(b, value))
+	collection := c.Collection("bench")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var got map[string]string
+		if _, err := collection.Get("key", &got); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
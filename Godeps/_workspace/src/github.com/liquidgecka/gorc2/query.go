@@ -0,0 +1,264 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//
+// QueryBuilder
+//
+
+// Composes a Lucene query string for use with Search(). Each call adds a
+// clause and all clauses must match. Values are escaped so user input can
+// be passed in directly:
+//
+//	query := gorc2.NewQuery().
+//		Term("connector", "CCS").
+//		NumericRange("power_kw", 50, math.Inf(1)).
+//		DateRange("installed", since, time.Time{}).
+//		String()
+//	it := collection.Search(query, nil)
+type QueryBuilder struct {
+	clauses []string
+}
+
+// Returns a new, empty QueryBuilder.
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+// Adds a clause requiring the field to match the given value exactly.
+func (q *QueryBuilder) Term(field, value string) *QueryBuilder {
+	return q.Raw(escapeField(field) + `:"` + escapeQuoted(value) + `"`)
+}
+
+// Adds a clause requiring the numeric field to be between min and max,
+// inclusive. Pass math.Inf(-1) or math.Inf(1) to leave a side open, for
+// example NumericRange("power_kw", 50, math.Inf(1)) gives
+// power_kw:[50 TO *].
+func (q *QueryBuilder) NumericRange(field string, min, max float64) *QueryBuilder {
+	return q.Raw(escapeField(field) + ":[" + formatBound(min) + " TO " +
+		formatBound(max) + "]")
+}
+
+// Adds a clause requiring the numeric field to be no more than max, for
+// example AtMost("price_per_kwh", 0.3) gives price_per_kwh:[* TO 0.3].
+func (q *QueryBuilder) AtMost(field string, max float64) *QueryBuilder {
+	return q.NumericRange(field, math.Inf(-1), max)
+}
+
+// Adds a clause requiring the numeric field to be at least min.
+func (q *QueryBuilder) AtLeast(field string, min float64) *QueryBuilder {
+	return q.NumericRange(field, min, math.Inf(1))
+}
+
+// Adds a clause requiring the date field to be between from and to,
+// inclusive. A zero time leaves that side of the range open. Times are
+// formatted as RFC3339 in UTC with millisecond precision, which matches how
+// Orchestrate indexes date strings.
+func (q *QueryBuilder) DateRange(field string, from, to time.Time) *QueryBuilder {
+	return q.Raw(escapeField(field) + ":[" + formatDate(from) + " TO " +
+		formatDate(to) + "]")
+}
+
+// Adds a clause requiring each word of value to match the field within
+// distance edits, so that misspellings still match. A distance of 0 or less
+// picks one from the length of each word, see FuzzyDistance(). Words too
+// short to be made fuzzy must match exactly.
+func (q *QueryBuilder) Fuzzy(field, value string, distance int) *QueryBuilder {
+	var terms []string
+	for _, word := range strings.Fields(value) {
+		terms = append(terms, escapeField(field)+":"+
+			fuzzyTerm(EscapeQuery(word), len([]rune(word)), distance))
+	}
+	if len(terms) == 0 {
+		return q
+	} else if len(terms) == 1 {
+		return q.Raw(terms[0])
+	}
+	return q.Raw("(" + strings.Join(terms, " AND ") + ")")
+}
+
+// Adds a clause as is, without any escaping. Use this for syntax the builder
+// does not cover.
+func (q *QueryBuilder) Raw(clause string) *QueryBuilder {
+	q.clauses = append(q.clauses, clause)
+	return q
+}
+
+// Returns the query string. An empty builder matches everything.
+func (q *QueryBuilder) String() string {
+	if len(q.clauses) == 0 {
+		return "*"
+	}
+	return strings.Join(q.clauses, " AND ")
+}
+
+// Escapes all characters that have special meaning in the Lucene query
+// syntax so the given string is matched literally.
+func EscapeQuery(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '+', '-', '&', '|', '!', '(', ')', '{', '}', '[', ']', '^',
+			'"', '~', '*', '?', ':', '\\', '/', ' ':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Field names are dotted paths so the dots are left alone.
+func escapeField(field string) string {
+	parts := strings.Split(field, ".")
+	for i, part := range parts {
+		parts[i] = EscapeQuery(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Inside a quoted phrase only quotes and backslashes need escaping.
+func escapeQuoted(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return "*"
+	}
+	return EscapeQuery(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "*"
+	}
+	return EscapeQuery(t.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+}
+
+// Returns the edit distance used for a fuzzy word of the given length in
+// characters: none for words under 3 characters, where a single edit
+// matches too much, 1 up to 5 characters and 2 beyond.
+func FuzzyDistance(length int) int {
+	switch {
+	case length < 3:
+		return 0
+	case length <= 5:
+		return 1
+	}
+	return 2
+}
+
+// Returns a word with the fuzzy operator appended, or unchanged if
+// FuzzyDistance() is 0 for it. A distance of 0 or less uses
+// FuzzyDistance().
+func fuzzyTerm(term string, length, distance int) string {
+	if distance <= 0 {
+		distance = FuzzyDistance(length)
+	} else if FuzzyDistance(length) == 0 {
+		distance = 0
+	}
+	if distance == 0 {
+		return term
+	}
+	return term + "~" + strconv.Itoa(distance)
+}
+
+// Returns a Lucene query with its plain terms made fuzzy, so "field:milton
+// AND keynse" becomes "field:milton~2 AND keynse~2". Phrases, ranges,
+// wildcards, terms already fuzzy or boosted, numbers and the operators are
+// left alone. A distance of 0 or less picks one per term, see
+// FuzzyDistance().
+func Fuzzify(query string, distance int) string {
+	s := []rune(query)
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r := s[i]
+		switch {
+		case r == '"':
+			// Copy phrases whole.
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(s))
+			b.WriteString(string(s[i:j]))
+			i = j
+		case r == '[' || r == '{':
+			// Copy ranges and bounding boxes whole.
+			j := i + 1
+			for j < len(s) && s[j] != ']' && s[j] != '}' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(s))
+			b.WriteString(string(s[i:j]))
+			i = j
+		case unicode.IsSpace(r) || strings.ContainsRune("()+-!", r):
+			b.WriteRune(r)
+			i++
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(s[j]) &&
+				!strings.ContainsRune(`()"[{`, s[j]) {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j, len(s))
+			b.WriteString(fuzzifyWord(string(s[i:j]), distance))
+			i = j
+		}
+	}
+	return b.String()
+}
+
+// Makes a single word of a query fuzzy, see Fuzzify(). The word may start
+// with a field name.
+func fuzzifyWord(word string, distance int) string {
+	switch word {
+	case "AND", "OR", "NOT", "&&", "||", "TO":
+		return word
+	}
+	field, term := "", word
+	for i := 0; i < len(word); i++ {
+		if word[i] == '\\' {
+			i++
+		} else if word[i] == ':' {
+			field, term = word[:i+1], word[i+1:]
+			break
+		}
+	}
+	if term == "" || strings.ContainsAny(term, "~^*?:") {
+		return word
+	} else if _, err := strconv.ParseFloat(term, 64); err == nil {
+		return word
+	}
+	length := len([]rune(strings.ReplaceAll(term, `\`, "")))
+	return field + fuzzyTerm(term, length, distance)
+}
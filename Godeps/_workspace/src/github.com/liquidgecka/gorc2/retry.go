@@ -0,0 +1,90 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+//
+// RetryPolicy
+//
+
+// Controls how a Client retries requests that fail with a network error, a
+// 5xx status or a rate limit (419 or 429). Request bodies are buffered by the
+// Client so PUT and POST requests can be replayed safely. Note that a POST
+// that reached Orchestrate before failing may add an event twice when it is
+// retried.
+type RetryPolicy struct {
+	// The total number of attempts made for a request, including the first
+	// one. Values below 2 disable retrying.
+	MaxAttempts int
+
+	// The delay before the first retry. Each following retry waits twice as
+	// long as the one before it, up to MaxDelay.
+	Delay time.Duration
+
+	// The upper bound on the delay between attempts. Zero means no bound.
+	MaxDelay time.Duration
+}
+
+// Returns true if the request that produced the given response or error
+// should be tried again. A nil policy never retries, and neither are
+// requests whose context is done or that failed with anything other than a
+// network error.
+func (r *RetryPolicy) shouldRetry(
+	ctx context.Context, attempt int, resp *http.Response, err error,
+) bool {
+	if r == nil || attempt >= r.MaxAttempts || ctx.Err() != nil {
+		return false
+	} else if err != nil {
+		return isNetworkError(err)
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		return true
+	case resp.StatusCode == 419, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// Waits for the delay before the next attempt, returning the context's
+// error early if it is done first.
+func wait(ctx context.Context, clock Clock, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns how long to wait after the given attempt before the next one.
+func (r *RetryPolicy) delay(attempt int) time.Duration {
+	delay := r.Delay
+	for n := 1; n < attempt; n++ {
+		delay *= 2
+		if r.MaxDelay > 0 && delay >= r.MaxDelay {
+			return r.MaxDelay
+		}
+	}
+	return delay
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns a client retrying up to three times that answers every request
+// with respond, and the number of requests the server has seen.
+func retryClient(
+	t *testing.T, respond func(w http.ResponseWriter, r *http.Request),
+) (*Client, *int32) {
+	var requests int32
+	c := testClient(t, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			respond(w, r)
+		}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3, Delay: time.Millisecond}
+	return c, &requests
+}
+
+func TestRetryTransientStatus(t *testing.T) {
+	c, requests := retryClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(503)
+	})
+	if _, err := c.Collection("test").Get("key", nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("made %d requests, expected 3", n)
+	}
+}
+
+func TestRetryNetworkError(t *testing.T) {
+	c, requests := retryClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	if _, err := c.Collection("test").Get("key", nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("made %d requests, expected 3", n)
+	}
+}
+
+func TestRetrySkipsClientErrors(t *testing.T) {
+	for _, status := range []int{400, 404, 412} {
+		c, requests := retryClient(t,
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			})
+		c.Collection("test").Get("key", nil)
+		if n := atomic.LoadInt32(requests); n != 1 {
+			t.Fatalf("made %d requests for a %d, expected 1", n, status)
+		}
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c, requests := retryClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		cancel()
+		w.WriteHeader(503)
+	})
+	c.Retry.Delay = time.Hour
+	start := time.Now()
+	_, err := c.Collection("test").WithContext(ctx).Get("key", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, expected context.Canceled", err)
+	} else if time.Since(start) > time.Minute {
+		t.Fatal("waited out the retry delay")
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("made %d requests, expected 1", n)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"fmt"
+	"sync"
+)
+
+//
+// Sequence
+//
+
+// Hands out increasing numbers, starting from 1, kept in a counter item.
+// Numbers are reserved in batches with one Increment(), so only one call
+// in Batch makes a request, and processes sharing a sequence never hand
+// out the same number. Numbers reserved but not handed out before a
+// process stops are skipped, and processes hand out numbers from their own
+// batches, so numbers are unique but have gaps and are not handed out in
+// the order of the calls across processes. Safe to use from multiple
+// goroutines.
+type Sequence struct {
+	Collection *Collection
+	Key        string
+
+	// The numbers reserved at a time. Defaults to 1, which hands out every
+	// number in order at the cost of a request each.
+	Batch int64
+
+	lock sync.Mutex
+	// The next number to hand out and the last one reserved.
+	next, last int64
+}
+
+// The field of the counter item holding the last number reserved.
+const sequenceField = "last"
+
+// Returns a sequence kept in the item of the collection with the given key,
+// reserving batch numbers at a time.
+func (c *Collection) Sequence(key string, batch int64) *Sequence {
+	return &Sequence{Collection: c, Key: key, Batch: batch}
+}
+
+// Returns the next number of the sequence.
+func (s *Sequence) Next() (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.next == 0 || s.next > s.last {
+		batch := s.Batch
+		if batch <= 0 {
+			batch = 1
+		}
+		last, err := s.Collection.Increment(s.Key, sequenceField, batch)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to reserve numbers of %s: %s",
+				s.Key, err)
+		}
+		s.next, s.last = last-batch+1, last
+	}
+	n := s.next
+	s.next++
+	return n, nil
+}
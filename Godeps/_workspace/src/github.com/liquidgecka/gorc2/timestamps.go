@@ -0,0 +1,40 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"time"
+)
+
+// Timestamps with a magnitude above this can not be milliseconds since the
+// epoch (it is well past the year 5000) so they are read as microseconds.
+const microsecondTimestamps = 100000000000000
+
+// Converts a timestamp returned by Orchestrate into a time. Orchestrate uses
+// milliseconds since the epoch, but microsecond timestamps are detected and
+// kept at full precision. The result is always in UTC so that times compare
+// equal regardless of the local time zone.
+func fromTimestamp(ts int64) time.Time {
+	if ts > microsecondTimestamps || ts < -microsecondTimestamps {
+		return time.UnixMicro(ts).UTC()
+	}
+	return time.UnixMilli(ts).UTC()
+}
+
+// Converts a time into the millisecond timestamp used in Orchestrate paths
+// and queries.
+func toTimestamp(t time.Time) int64 {
+	return t.UnixMilli()
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//
+// Tracer
+//
+
+// Hooks requests made by a Client into a tracing system such as
+// OpenTelemetry. This is kept small so gorc2 has no dependency on any given
+// tracing library; an adapter only needs to start a span from the request's
+// context, inject any propagation headers, and end the span when called
+// back.
+type Tracer interface {
+	// Called before each request is sent, including retries. The returned
+	// request is the one that is sent, so the tracer can attach a new
+	// context or headers to it. The returned function is called with the
+	// outcome of the request.
+	StartRequest(req *http.Request, span SpanInfo) (
+		*http.Request, func(*http.Response, error))
+}
+
+// Describes a request to a Tracer. None of these fields contain keys or
+// query strings so they are safe to use as low cardinality span names and
+// attributes.
+type SpanInfo struct {
+	// A name for the kind of request such as "kv.get" or "search".
+	Operation string
+
+	// The HTTP method used.
+	Method string
+
+	// The collection the request is made against. Empty for Ping.
+	Collection string
+}
+
+// Works out the SpanInfo for a request from its method and the path below
+// the API version.
+func describeRequest(method, trailing string) SpanInfo {
+	info := SpanInfo{Method: method}
+	path, query := trailing, ""
+	if i := strings.Index(trailing, "?"); i != -1 {
+		path, query = trailing[:i], trailing[i+1:]
+	}
+	parts := strings.Split(path, "/")
+	info.Collection = parts[0]
+
+	switch {
+	case path == "":
+		info.Operation = "ping"
+	case len(parts) == 1:
+		values, _ := url.ParseQuery(query)
+		if values.Get("query") != "" {
+			info.Operation = "search"
+		} else {
+			info.Operation = "kv.list"
+		}
+	case len(parts) == 2:
+		info.Operation = "kv." + verb(method)
+	case parts[2] == "refs" && len(parts) == 3:
+		info.Operation = "kv.history"
+	case parts[2] == "refs":
+		info.Operation = "kv.get_ref"
+	case parts[2] == "events" && method == "GET" && len(parts) < 6:
+		info.Operation = "events.list"
+	case parts[2] == "events":
+		info.Operation = "events." + verb(method)
+	case parts[2] == "relations":
+		info.Operation = "graph.get_links"
+	case parts[2] == "relation" && method == "DELETE":
+		info.Operation = "graph.unlink"
+	case parts[2] == "relation":
+		info.Operation = "graph.link"
+	default:
+		info.Operation = "unknown"
+	}
+	return info
+}
+
+// Maps an HTTP method to the operation verb used in SpanInfo.
+func verb(method string) string {
+	switch method {
+	case "GET":
+		return "get"
+	case "PUT":
+		return "put"
+	case "POST":
+		return "add"
+	case "DELETE":
+		return "delete"
+	}
+	return strings.ToLower(method)
+}
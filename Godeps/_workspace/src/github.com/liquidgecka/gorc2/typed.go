@@ -0,0 +1,78 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"time"
+)
+
+//
+// Typed events
+//
+
+// An Event whose value has been decoded into a T.
+type TypedEvent[T any] struct {
+	*Event
+
+	// The decoded value of the event.
+	Data T
+}
+
+// An Iterator over events that decodes every event value into a T. All of
+// the Iterator fields and methods, such as Next() and Error, are available
+// as well.
+type TypedEventIterator[T any] struct {
+	*Iterator
+}
+
+// Sets up an Events listing like Collection.ListEvents() which decodes the
+// event values into T. Go does not allow methods with type parameters so
+// this takes the Collection as its first argument:
+//
+//	it := gorc2.ListEventsTyped[ChargeSession](sessions, key, "session", nil)
+//	for it.Next() {
+//		event, err := it.Event()
+//		...
+//	}
+func ListEventsTyped[T any](
+	c *Collection, key, typ string, opts *ListEventsQuery,
+) *TypedEventIterator[T] {
+	return &TypedEventIterator[T]{Iterator: c.ListEvents(key, typ, opts)}
+}
+
+// Returns the event for the current iteration with its value decoded.
+func (i *TypedEventIterator[T]) Event() (*TypedEvent[T], error) {
+	typed := &TypedEvent[T]{}
+	event, err := i.Iterator.GetEvent(&typed.Data)
+	if err != nil {
+		return nil, err
+	}
+	typed.Event = event
+	return typed, nil
+}
+
+// Returns an individual event like Collection.GetEvent() with its value
+// decoded into T.
+func GetEventTyped[T any](
+	c *Collection, key, typ string, ts time.Time, ordinal int64,
+) (*TypedEvent[T], error) {
+	typed := &TypedEvent[T]{}
+	event, err := c.GetEvent(key, typ, ts, ordinal, &typed.Data)
+	if err != nil {
+		return nil, err
+	}
+	typed.Event = event
+	return typed, nil
+}
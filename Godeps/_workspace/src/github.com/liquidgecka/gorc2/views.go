@@ -0,0 +1,258 @@
+// Copyright 2014 Orchestrate, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorc2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+//
+// View
+//
+
+// A single value emitted by the Map function of a View.
+type ViewEmit struct {
+	// The key of the document in the view that this value contributes to.
+	Key string
+
+	// The value contributed. This is passed to Reduce as JSON.
+	Value interface{}
+}
+
+// Maintains a derived collection from a source collection using map and
+// reduce functions. Every changed source item is passed to Map, which emits
+// values against view keys, and for every view key touched the values that
+// all source items have emitted against it are passed to Reduce, whose
+// result is stored in Target under that key. For example a summary of
+// chargepoints by postcode district:
+//
+//	view := &gorc2.View{
+//		Name:   "by-district",
+//		Source: client.Collection("ChargePoints"),
+//		Target: client.Collection("ChargePointsByDistrict"),
+//		State:  client.Collection("ViewState"),
+//		Map: func(item *gorc2.Item) ([]gorc2.ViewEmit, error) {
+//			var cp Chargepoint
+//			if err := item.Unmarshal(&cp); err != nil {
+//				return nil, err
+//			}
+//			return []gorc2.ViewEmit{{Key: cp.District(), Value: 1}}, nil
+//		},
+//		Reduce: func(key string, values []json.RawMessage) (interface{}, error) {
+//			return map[string]int{"count": len(values)}, nil
+//		},
+//	}
+//	n, err := view.Refresh()
+//
+// Changes are found with ListUpdatedSince() and a checkpoint is kept in
+// State, so each call to Refresh() only processes the items changed since
+// the last one. Since that is a search, changes only show up once they are
+// indexed, and items that are deleted outright are not seen at all; use
+// SoftDelete() on the source and have Map emit nothing for deleted items, or
+// call Reset() and rebuild the view. Refresh() must not be called
+// concurrently for the same view.
+type View struct {
+	// Identifies the view within State. Several views may share a State
+	// collection as long as their names differ.
+	Name string
+
+	// The collection the view is derived from.
+	Source *Collection
+
+	// The collection the reduced documents are written to.
+	Target *Collection
+
+	// The collection the view keeps its bookkeeping in: the checkpoint, the
+	// view keys each source item emitted to and the values emitted against
+	// each view key.
+	State *Collection
+
+	// Returns the values a source item contributes to the view. Each item
+	// may emit at most one value per view key.
+	Map func(item *Item) ([]ViewEmit, error)
+
+	// Returns the document stored in Target for a view key given all of the
+	// values emitted against it, ordered by source key.
+	Reduce func(key string, values []json.RawMessage) (interface{}, error)
+}
+
+// The bookkeeping documents stored in State.
+type viewCheckpoint struct {
+	RefTime int64 `json:"reftime"`
+}
+
+type viewSource struct {
+	Keys []string `json:"keys"`
+}
+
+type viewGroup struct {
+	Sources map[string]json.RawMessage `json:"sources"`
+}
+
+// Processes every source item changed since the last call and returns the
+// number of items processed. The checkpoint is only moved forward once all
+// of the items have been processed, so a failed Refresh() can simply be
+// retried.
+func (v *View) Refresh() (int, error) {
+	var checkpoint viewCheckpoint
+	_, err := v.State.Get(v.stateKey("checkpoint"), &checkpoint)
+	if _, ok := err.(NotFoundError); !ok && err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	latest := checkpoint.RefTime
+	it := v.Source.ListUpdatedSince(fromTimestamp(checkpoint.RefTime))
+	for it.Next() {
+		item, err := it.Get(nil)
+		if err != nil {
+			return processed, err
+		}
+		if err := v.apply(item); err != nil {
+			return processed, fmt.Errorf("View %s failed on %s: %s", v.Name,
+				item.Key, err)
+		}
+		processed++
+		if ts := toTimestamp(item.Updated); ts > latest {
+			latest = ts
+		}
+	}
+	if it.Error != nil {
+		return processed, it.Error
+	}
+
+	if latest != checkpoint.RefTime {
+		checkpoint.RefTime = latest
+		if _, err := v.State.Update(v.stateKey("checkpoint"),
+			&checkpoint); err != nil {
+			return processed, err
+		}
+	}
+	return processed, nil
+}
+
+// Forgets the checkpoint so the next call to Refresh() processes every item
+// in the source collection again.
+func (v *View) Reset() error {
+	return v.State.Delete(v.stateKey("checkpoint"))
+}
+
+// Applies a single changed source item to the view.
+func (v *View) apply(item *Item) error {
+	emits, err := v.Map(item)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]json.RawMessage, len(emits))
+	for _, emit := range emits {
+		raw, err := json.Marshal(emit.Value)
+		if err != nil {
+			return err
+		}
+		values[emit.Key] = raw
+	}
+
+	// Every view key the item emitted to before or emits to now needs to
+	// be reduced again.
+	sourceKey := v.stateKey("source", item.Key)
+	var previous viewSource
+	_, err = v.State.Get(sourceKey, &previous)
+	if _, ok := err.(NotFoundError); !ok && err != nil {
+		return err
+	}
+	affected := make(map[string]bool, len(previous.Keys)+len(values))
+	for _, key := range previous.Keys {
+		affected[key] = true
+	}
+	for key := range values {
+		affected[key] = true
+	}
+	for key := range affected {
+		value, emitted := values[key]
+		if err := v.reduce(key, item.Key, value, emitted); err != nil {
+			return err
+		}
+	}
+
+	// Record where the item emitted to for next time.
+	if len(values) == 0 {
+		return v.State.Delete(sourceKey)
+	}
+	current := viewSource{Keys: make([]string, 0, len(values))}
+	for key := range values {
+		current.Keys = append(current.Keys, key)
+	}
+	sort.Strings(current.Keys)
+	_, err = v.State.Update(sourceKey, &current)
+	return err
+}
+
+// Replaces the value a source item contributes to a view key, removing it
+// if emitted is false, and stores the reduced result.
+func (v *View) reduce(
+	key, source string, value json.RawMessage, emitted bool,
+) error {
+	groupKey := v.stateKey("group", key)
+	group := viewGroup{}
+	_, err := v.State.Get(groupKey, &group)
+	if _, ok := err.(NotFoundError); !ok && err != nil {
+		return err
+	}
+	if group.Sources == nil {
+		group.Sources = make(map[string]json.RawMessage)
+	}
+	if emitted {
+		group.Sources[source] = value
+	} else {
+		delete(group.Sources, source)
+	}
+
+	if len(group.Sources) == 0 {
+		if err := v.Target.Delete(key); err != nil {
+			return err
+		}
+		return v.State.Delete(groupKey)
+	}
+
+	sources := make([]string, 0, len(group.Sources))
+	for source := range group.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	values := make([]json.RawMessage, len(sources))
+	for n, source := range sources {
+		values[n] = group.Sources[source]
+	}
+	reduced, err := v.Reduce(key, values)
+	if err != nil {
+		return err
+	}
+	if _, err := v.Target.Update(key, reduced); err != nil {
+		return err
+	}
+	_, err = v.State.Update(groupKey, &group)
+	return err
+}
+
+// Returns the key of a bookkeeping document in State.
+func (v *View) stateKey(parts ...string) string {
+	key := v.Name
+	for _, part := range parts {
+		key += "_" + part
+	}
+	return key
+}
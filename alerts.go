@@ -0,0 +1,137 @@
+package main
+
+import (
+	"chargepoints/alerts"
+	"chargepoints/apikeys"
+	"chargepoints/router"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Returns true if the request carries the secret of a saved search, or the
+// admin token or an admin API key, otherwise aborts it.
+func ownsSearch(ctx *Context, s *alerts.Search) bool {
+	given := ctx.Request.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(given),
+		[]byte("Bearer "+s.Secret)) == 1 {
+		return true
+	}
+	if requestRole(ctx.Request, "").Includes(apikeys.Admin) {
+		return true
+	}
+	ctx.SetHeader("WWW-Authenticate", "Bearer", true)
+	ctx.Abort(401, "Missing or invalid search secret.")
+	return false
+}
+
+// Saves a search of a collection, for API keys with the partner role, from
+// a body such as {"name": "Rapid chargers in MK", "query":
+// "value.ChargeDeviceLocation.Address.PostCode:MK* AND
+// value.Connector.RatedOutputkW:[50 TO *]", "url":
+// "https://example.com/"}. The URL's host must resolve to public
+// addresses. Chargepoints that start matching it are posted
+// to the URL, signed like webhook deliveries with a secret that is
+// generated unless one is given. The secret is included in the response,
+// but not shown again, and is needed to read or delete the search.
+func saveSearch(ctx *Context) {
+	var s alerts.Search
+	if !readJSON(ctx, &s) {
+		return
+	}
+	s.Collection = ctx.Request.PathValue("collection")
+	if err := alerts.Save(orc, &s); err != nil {
+		ctx.Abort(400, err.Error())
+		return
+	}
+	s.Matches = nil
+	data, _ := json.Marshal(&s)
+	ctx.ContentType("json")
+	ctx.WriteHeader(201)
+	ctx.Write(data)
+}
+
+// Returns the saved search with the given ID if it is of the collection
+// asked for, otherwise writes a 404.
+func savedSearch(ctx *Context) (*alerts.Search, bool) {
+	s, err := alerts.Get(orc, ctx.Request.PathValue("id"))
+	if err == nil && s.Collection != ctx.Request.PathValue("collection") {
+		ctx.Abort(404, "Not found.")
+		return nil, false
+	} else if err != nil {
+		writeJSON(ctx, nil, err)
+		return nil, false
+	}
+	return s, true
+}
+
+func getSavedSearch(ctx *Context) {
+	s, ok := savedSearch(ctx)
+	if !ok || !ownsSearch(ctx, s) {
+		return
+	}
+	s.Secret = ""
+	writeJSON(ctx, s, nil)
+}
+
+func deleteSavedSearch(ctx *Context) {
+	s, ok := savedSearch(ctx)
+	if !ok || !ownsSearch(ctx, s) {
+		return
+	}
+	writeJSON(ctx, map[string]string{"deleted": s.ID},
+		alerts.Delete(orc, s.ID))
+}
+
+// Lists every saved search. Their secrets and matches are left out.
+func listSavedSearches(ctx *Context) {
+	searches, err := alerts.List(orc)
+	for _, s := range searches {
+		s.Secret = ""
+		s.Matches = nil
+	}
+	writeJSON(ctx, searches, err)
+}
+
+// Runs the saved searches when called and then every schedules.alerts, if
+// this replica leads the scheduler.
+func runSavedSearches() {
+	s := &alerts.Scheduler{Client: orc, Serves: served}
+	for {
+		if scheduler.IsLeader() {
+			if n, err := s.RunAll(); err != nil {
+				log.Printf("Saved search scheduler failed: %s", err)
+			} else if n > 0 {
+				log.Printf("Sent %d saved search notifications.", n)
+			}
+		}
+		time.Sleep(conf().Schedules.Alerts)
+	}
+}
+
+// Registers the saved search endpoints. These must be registered before
+// the search endpoint.
+func alertRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/searches", timeout: lookupTimeout,
+		handler: listSavedSearches, role: apikeys.Admin,
+		summary:  "Lists every saved search.",
+		response: []*alerts.Search{},
+	}, route{
+		method: "POST", pattern: "/api/{collection}/searches",
+		timeout: searchTimeout, handler: saveSearch, role: apikeys.Partner,
+		summary: "Saves a search whose new matches are posted to a URL.",
+		body:    alerts.Search{}, response: alerts.Search{}, status: 201,
+	}, route{
+		method: "GET", pattern: "/api/{collection}/searches/{id}",
+		timeout: lookupTimeout, handler: getSavedSearch,
+		summary:  "Returns a saved search.",
+		response: alerts.Search{},
+	}, route{
+		method: "DELETE", pattern: "/api/{collection}/searches/{id}",
+		timeout: lookupTimeout, handler: deleteSavedSearch,
+		summary:  "Deletes a saved search.",
+		response: map[string]string{},
+	})
+}
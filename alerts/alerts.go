@@ -0,0 +1,175 @@
+// Package alerts keeps saved searches and notifies their owners when new
+// chargepoints match them, such as new rapid chargers in a postcode area.
+// A Scheduler re-runs the searches, compares the results with those of the
+// last run, and posts the new matches to the search's URL using the signed
+// deliveries of the webhooks package.
+package alerts
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The collection saved searches are stored in.
+const Collection = "SavedSearches"
+
+// The most chargepoints a search is compared by. Matches beyond these are
+// not noticed until others stop matching.
+const MaxMatches = 1000
+
+// The change type of notifications, see Scheduler.
+const NewMatchesType = "new_matches"
+
+// A search run again every so often, and where to send its new matches.
+type Search struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+
+	// The collection searched and the Lucene query run on it.
+	Collection string `json:"collection"`
+	Query      string `json:"query"`
+
+	// Where new matches are posted.
+	URL string `json:"url"`
+
+	// Signs the notifications, see webhooks.Sign(), and is needed to read
+	// or delete the search. Generated when the search is saved if it is
+	// empty.
+	Secret string `json:"secret,omitempty"`
+
+	Created time.Time  `json:"created"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+
+	// The keys of the chargepoints that matched on the last run, sorted.
+	Matches []string `json:"matches,omitempty"`
+}
+
+// Checks and stores a new search, filling in its ID, secret and creation
+// time. The host of its URL must only resolve to public addresses, see
+// publicAddress(). The search is run straight away so that only
+// chargepoints that match later are notified, which also checks the query
+// is valid.
+func Save(client *gorc2.Client, s *Search) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return fmt.Errorf("Search URL must be an absolute http or https URL.")
+	} else if err := checkHost(u.Hostname()); err != nil {
+		return err
+	} else if s.Collection == "" {
+		return fmt.Errorf("Search has no collection.")
+	} else if strings.TrimSpace(s.Query) == "" {
+		return fmt.Errorf("Search has no query.")
+	}
+	matches, err := run(client, s)
+	if err != nil {
+		return fmt.Errorf("Unable to run the search query: %s", err)
+	}
+	if s.Secret == "" {
+		s.Secret = randomHex(32)
+	}
+	s.ID = randomHex(8)
+	now := time.Now().UTC()
+	s.Created = now
+	s.LastRun = &now
+	s.Matches = keys(matches)
+	_, err = client.Collection(Collection).Create(s.ID, s)
+	return err
+}
+
+// Returns a saved search.
+func Get(client *gorc2.Client, id string) (*Search, error) {
+	s := &Search{}
+	if _, err := client.Collection(Collection).Get(id, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns every saved search ordered by ID.
+func List(client *gorc2.Client) ([]*Search, error) {
+	searches := []*Search{}
+	it := client.Collection(Collection).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		s := &Search{}
+		if _, err := it.Get(s); err != nil {
+			return nil, err
+		}
+		searches = append(searches, s)
+	}
+	sort.Slice(searches, func(i, j int) bool {
+		return searches[i].ID < searches[j].ID
+	})
+	return searches, it.Error
+}
+
+// Removes a saved search.
+func Delete(client *gorc2.Client, id string) error {
+	return client.Collection(Collection).Delete(id)
+}
+
+// Returns an error unless every address a host resolves to is public.
+func checkHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("Unable to resolve the search URL's host %s.", host)
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return fmt.Errorf("Search URL's host %s is not a public address.",
+				host)
+		}
+	}
+	return nil
+}
+
+// Returns true unless an address is loopback, private, link-local, such as
+// the 169.254.169.254 of cloud metadata services, multicast or unspecified,
+// which notifications must not be posted to.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// A chargepoint matching a search.
+type Match struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Returns up to MaxMatches chargepoints matching a search.
+func run(client *gorc2.Client, s *Search) ([]Match, error) {
+	var matches []Match
+	it := client.Collection(s.Collection).Search(s.Query,
+		&gorc2.SearchQuery{Limit: 100})
+	for len(matches) < MaxMatches && it.Next() {
+		raw := it.Raw()
+		matches = append(matches, Match{Key: raw.Key, Value: raw.Value})
+	}
+	return matches, it.Error
+}
+
+// Returns the sorted keys of matches.
+func keys(matches []Match) []string {
+	keys := make([]string, len(matches))
+	for i, m := range matches {
+		keys[i] = m.Key
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
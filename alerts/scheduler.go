@@ -0,0 +1,157 @@
+package alerts
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/webhooks"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// The value of a notification, sent as the value of a webhooks.Change of
+// type NewMatchesType whose key is the ID of the search.
+type Notification struct {
+	Search string `json:"search"`
+	Name   string `json:"name,omitempty"`
+	Query  string `json:"query"`
+
+	// The chargepoints that match now but did not on the last run.
+	Matches []Match `json:"matches"`
+}
+
+// Re-runs saved searches and notifies them of new matches.
+type Scheduler struct {
+	Client *gorc2.Client
+
+	// Sends the notifications. A nil Sender uses the defaults with a client
+	// that only connects to public addresses.
+	Sender *webhooks.Sender
+
+	// If set, searches of collections it returns false for are skipped.
+	Serves func(collection string) bool
+}
+
+// Posts notifications, refusing to connect to addresses that are not
+// public even if the host of a search's URL has come to resolve to one
+// since it was saved.
+var defaultSender = &webhooks.Sender{Client: &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+					return fmt.Errorf("%s is not a public address.", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}}
+
+// Runs every saved search, notifying those with new matches, and returns
+// the number of notifications sent. A search whose notification fails
+// every attempt keeps the matches of its last run, so it is notified of
+// the same chargepoints next time. RunAll() must not be called
+// concurrently.
+func (s *Scheduler) RunAll() (int, error) {
+	searches, err := List(s.Client)
+	if err != nil {
+		return 0, err
+	}
+	notified := 0
+	for _, search := range searches {
+		if s.Serves != nil && !s.Serves(search.Collection) {
+			continue
+		}
+		sent, err := s.run(search)
+		if err != nil {
+			log.Printf("Saved search %s failed: %s", search.ID, err)
+			continue
+		}
+		if sent {
+			notified++
+		}
+	}
+	return notified, nil
+}
+
+// Calls RunAll() every interval of the client's Clock until stop is closed,
+// logging failures.
+func (s *Scheduler) Run(interval time.Duration, stop <-chan struct{}) {
+	for {
+		if n, err := s.RunAll(); err != nil {
+			log.Printf("Saved search scheduler failed: %s", err)
+		} else if n > 0 {
+			log.Printf("Sent %d saved search notifications.", n)
+		}
+		select {
+		case <-s.Client.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Runs one search, returning true if it was notified of new matches.
+func (s *Scheduler) run(search *Search) (bool, error) {
+	matches, err := run(s.Client, search)
+	if err != nil {
+		return false, err
+	}
+	previous := search.Matches
+	var added []Match
+	for _, m := range matches {
+		i := sort.SearchStrings(previous, m.Key)
+		if i == len(previous) || previous[i] != m.Key {
+			added = append(added, m)
+		}
+	}
+
+	now := s.Client.Now().UTC()
+	if len(added) > 0 {
+		value, err := json.Marshal(&Notification{
+			Search:  search.ID,
+			Name:    search.Name,
+			Query:   search.Query,
+			Matches: added,
+		})
+		if err != nil {
+			return false, err
+		}
+		hook := &webhooks.Webhook{
+			ID:     search.ID,
+			URL:    search.URL,
+			Secret: search.Secret,
+		}
+		sender := s.Sender
+		if sender == nil {
+			sender = defaultSender
+		}
+		_, err = sender.Deliver(hook, &webhooks.Change{
+			ID:         fmt.Sprint(now.UnixMilli()),
+			Type:       NewMatchesType,
+			Collection: search.Collection,
+			Key:        search.ID,
+			Timestamp:  now,
+			Value:      value,
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	search.LastRun = &now
+	search.Matches = keys(matches)
+	_, err = s.Client.Collection(Collection).Update(search.ID, search)
+	return len(added) > 0, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/analytics"
+	"chargepoints/apikeys"
+	"chargepoints/router"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Records the searches made through the API, or nil if they are not
+// recorded. Recording is turned off by setting ANALYTICS to false.
+var searchRecorder *analytics.Recorder
+
+// Counts the views of chargepoints, or nil if they are not counted, which
+// is when searches are not recorded.
+var viewCounter *analytics.ViewCounter
+
+// How often the views counted are added to the counters.
+const viewFlushInterval = time.Minute
+
+// The salt clients are hashed with, set with ANALYTICS_SALT. Instances must
+// share it for clients to be counted once across them. Defaults to a random
+// salt.
+var analyticsSalt = randomHex(16)
+
+// Parameters that are not recorded as filters.
+var unrecordedParams = map[string]bool{"query": true, "api_key": true}
+
+// Parameters holding coordinates, which are rounded to about a kilometer so
+// the exact location of the person searching is not recorded.
+var coordinateParams = map[string]bool{
+	"lat": true, "lon": true,
+	"north": true, "south": true, "east": true, "west": true,
+}
+
+// Returns the address of the client that made a request, taken from
+// X-Forwarded-For when behind a proxy.
+func clientAddr(ctx *Context) string {
+	if forwarded := ctx.Request.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addr, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(addr)
+	}
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		return ctx.Request.RemoteAddr
+	}
+	return host
+}
+
+// Records a search that was started at start and found the given number of
+// results.
+func recordSearch(
+	ctx *Context, endpoint, collection string, results int,
+	start time.Time,
+) {
+	if searchRecorder == nil {
+		return
+	}
+	filters := make(map[string]string)
+	for name, value := range ctx.Params {
+		switch {
+		case unrecordedParams[name]:
+		case coordinateParams[name]:
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				value = strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+			}
+			filters[name] = value
+		case name == "code":
+			// Only the outward code, the district, of postcodes is kept.
+			code := strings.ToUpper(strings.Join(strings.Fields(value), ""))
+			if len(code) > 3 {
+				code = code[:len(code)-3]
+			}
+			filters[name] = code
+		default:
+			filters[name] = value
+		}
+	}
+	searchRecorder.Record(&analytics.Search{
+		Endpoint:   endpoint,
+		Collection: strings.TrimSuffix(collection, "/"),
+		Query:      ctx.Params["query"],
+		Filters:    filters,
+		Results:    results,
+		LatencyMs:  float64(time.Since(start).Microseconds()) / 1000,
+		Client:     analytics.Anonymize(analyticsSalt, clientAddr(ctx), start),
+		Time:       start,
+	})
+}
+
+// Adds the views counted to their counters every viewFlushInterval.
+func flushViews() {
+	for {
+		time.Sleep(viewFlushInterval)
+		if _, err := viewCounter.Flush(); err != nil {
+			log.Printf("Unable to count views: %s", err)
+		}
+	}
+}
+
+// Returns the number of times a record has been viewed.
+func getViews(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	key := ctx.Request.PathValue("key")
+	n, err := analytics.ViewCount(orc, collection, key)
+	writeJSON(ctx, &Views{Collection: collection, Key: key, Views: n}, err)
+}
+
+// The views of a record.
+type Views struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Views      int64  `json:"views"`
+}
+
+// Rolls up the previous day's searches shortly after midnight UTC each day,
+// if this replica leads the scheduler.
+func rollupAnalytics() {
+	for {
+		now := time.Now().UTC()
+		next := now.Truncate(24 * time.Hour).Add(24*time.Hour + 5*time.Minute)
+		time.Sleep(next.Sub(now))
+		if !scheduler.IsLeader() {
+			continue
+		}
+
+		day := next.Add(-24 * time.Hour)
+		r, err := analytics.RollUp(orc, day)
+		if err == nil {
+			err = analytics.Save(orc, r)
+		}
+		if err != nil {
+			log.Printf("Unable to roll up searches of %s: %s",
+				day.Format(analytics.DayLayout), err)
+			continue
+		}
+		log.Printf("Rolled up %d searches of %s.", r.Searches, r.Day)
+	}
+}
+
+// Returns the rollup of a day's searches. Today's searches, or those of a
+// day that has not been rolled up yet, are rolled up when asked for.
+func getRollup(ctx *Context) {
+	day := ctx.Request.PathValue("day")
+	t, err := time.Parse(analytics.DayLayout, day)
+	if err != nil {
+		ctx.Abort(400, "Day must be given as YYYY-MM-DD.")
+		return
+	}
+	r, err := analytics.Get(orc, day)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		r, err = analytics.RollUp(orc, t)
+	}
+	writeJSON(ctx, r, err)
+}
+
+// Registers the analytics admin endpoints. These must be registered before
+// the search endpoint.
+func analyticsRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/analytics/rollups/{day}",
+		timeout: searchTimeout, handler: getRollup, role: apikeys.Admin,
+		summary:  "Returns the rollup of a day's searches.",
+		response: analytics.Rollup{},
+	}, route{
+		method: "GET", pattern: "/api/analytics/views/{collection}/{key}",
+		timeout: lookupTimeout, handler: getViews, role: apikeys.Admin,
+		summary:  "Returns the number of times a record has been viewed.",
+		response: Views{},
+	})
+}
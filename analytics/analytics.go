@@ -0,0 +1,131 @@
+// Package analytics records the searches made through the API so we can
+// learn what people look for. Each search is added as an event to an item
+// for its day in the Analytics collection, and a daily rollup summarises
+// them. Clients are only recorded as a salted hash that changes every day.
+// Views of records are counted too, by a counter per record.
+package analytics
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// The collection searches are recorded in, keyed by day, and the type of
+// their events.
+const (
+	Collection  = "Analytics"
+	SearchEvent = "search"
+)
+
+// The layout of the day keys.
+const DayLayout = "2006-01-02"
+
+// A search made through the API.
+type Search struct {
+	// The endpoint used, such as "search" or "near".
+	Endpoint   string `json:"endpoint"`
+	Collection string `json:"collection"`
+	Query      string `json:"query,omitempty"`
+
+	// The other parameters given, such as the sort order or location.
+	Filters map[string]string `json:"filters,omitempty"`
+
+	Results   int     `json:"results"`
+	LatencyMs float64 `json:"latency_ms"`
+
+	// The anonymised client, see Anonymize().
+	Client string `json:"client"`
+
+	// When the search was made. Stored as the timestamp of the event.
+	Time time.Time `json:"-"`
+}
+
+// Returns an ID for a client address that is the same for every search it
+// makes in a day, but can not be traced back to the address or matched
+// across days.
+func Anonymize(salt, addr string, t time.Time) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" +
+		t.UTC().Format(DayLayout) + "\x00" + addr))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Writes searches to Orchestrate in the background. Record() never blocks;
+// searches are dropped if the buffer is full, and searches that can not be
+// written are logged and dropped.
+type Recorder struct {
+	client  *gorc2.Client
+	queue   chan *Search
+	done    chan struct{}
+	dropped int64
+
+	// The day whose item was last written, only used by run().
+	day string
+}
+
+// Returns a Recorder buffering up to size searches, and starts writing
+// them.
+func NewRecorder(client *gorc2.Client, size int) *Recorder {
+	r := &Recorder{
+		client: client,
+		queue:  make(chan *Search, size),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Queues a search to be written. Does nothing on a nil Recorder.
+func (r *Recorder) Record(s *Search) {
+	if r == nil {
+		return
+	}
+	if s.Time.IsZero() {
+		s.Time = time.Now()
+	}
+	select {
+	case r.queue <- s:
+	default:
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+// Returns the number of searches dropped because the buffer was full.
+func (r *Recorder) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// Stops the Recorder once the searches already queued are written. Record()
+// must not be called afterwards.
+func (r *Recorder) Close() {
+	close(r.queue)
+	<-r.done
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	for s := range r.queue {
+		if err := r.write(s); err != nil {
+			log.Printf("Unable to record search: %s", err)
+		}
+	}
+}
+
+// Adds a search as an event to the item for its day, creating the item
+// first if needed since events can only be added to items that exist.
+func (r *Recorder) write(s *Search) error {
+	c := r.client.Collection(Collection)
+	day := s.Time.UTC().Format(DayLayout)
+	if day != r.day {
+		_, err := c.Update(day, map[string]string{"day": day})
+		if err != nil {
+			return err
+		}
+		r.day = day
+	}
+	_, err := c.AddEventWithTimestamp(day, SearchEvent, s.Time, s)
+	return err
+}
@@ -0,0 +1,147 @@
+package analytics
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The collection rollups are stored in, keyed by day.
+const Rollups = "AnalyticsRollups"
+
+// The number of queries listed in each of the top query lists.
+const topQueries = 50
+
+// How often a query was searched for.
+type QueryCount struct {
+	Query string `json:"query"`
+	Count int    `json:"count"`
+}
+
+// A summary of the searches made in a day.
+type Rollup struct {
+	Day       string    `json:"day"`
+	Generated time.Time `json:"generated"`
+	Searches  int       `json:"searches"`
+
+	// The number of different clients that searched.
+	Clients int `json:"clients"`
+
+	// The searches made through each endpoint and of each collection.
+	Endpoints   map[string]int `json:"endpoints"`
+	Collections map[string]int `json:"collections"`
+
+	// The number of searches using each filter.
+	Filters map[string]int `json:"filters"`
+
+	// Searches that found nothing.
+	ZeroResults int `json:"zero_results"`
+
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	P95LatencyMs float64 `json:"p95_latency_ms"`
+
+	// The most common queries, and the most common of those that found
+	// nothing. Queries are compared ignoring case and surrounding space.
+	TopQueries           []QueryCount `json:"top_queries"`
+	TopZeroResultQueries []QueryCount `json:"top_zero_result_queries"`
+}
+
+// Summarises the searches recorded on the given day.
+func RollUp(client *gorc2.Client, day time.Time) (*Rollup, error) {
+	r := &Rollup{
+		Day:         day.UTC().Format(DayLayout),
+		Generated:   time.Now().UTC(),
+		Endpoints:   map[string]int{},
+		Collections: map[string]int{},
+		Filters:     map[string]int{},
+	}
+	clients := make(map[string]bool)
+	queries := make(map[string]int)
+	zeroQueries := make(map[string]int)
+	var latencies []float64
+
+	it := client.Collection(Collection).ListEvents(r.Day, SearchEvent,
+		&gorc2.ListEventsQuery{Limit: 100})
+	for it.Next() {
+		event, err := it.GetEvent(nil)
+		if err != nil {
+			return nil, err
+		}
+		var s Search
+		if err := json.Unmarshal(event.Value, &s); err != nil {
+			continue
+		}
+
+		r.Searches++
+		clients[s.Client] = true
+		r.Endpoints[s.Endpoint]++
+		r.Collections[s.Collection]++
+		for name := range s.Filters {
+			r.Filters[name]++
+		}
+		latencies = append(latencies, s.LatencyMs)
+
+		query := strings.ToLower(strings.TrimSpace(s.Query))
+		if query != "" {
+			queries[query]++
+		}
+		if s.Results == 0 {
+			r.ZeroResults++
+			if query != "" {
+				zeroQueries[query]++
+			}
+		}
+	}
+	if _, ok := it.Error.(gorc2.NotFoundError); it.Error != nil && !ok {
+		return nil, it.Error
+	}
+
+	r.Clients = len(clients)
+	if len(latencies) > 0 {
+		total := 0.0
+		for _, l := range latencies {
+			total += l
+		}
+		r.AvgLatencyMs = total / float64(len(latencies))
+		sort.Float64s(latencies)
+		r.P95LatencyMs = latencies[(len(latencies)*95-1)/100]
+	}
+	r.TopQueries = top(queries)
+	r.TopZeroResultQueries = top(zeroQueries)
+	return r, nil
+}
+
+// Writes a rollup to the Rollups collection.
+func Save(client *gorc2.Client, r *Rollup) error {
+	_, err := client.Collection(Rollups).Update(r.Day, r)
+	return err
+}
+
+// Returns the saved rollup of a day, given as YYYY-MM-DD.
+func Get(client *gorc2.Client, day string) (*Rollup, error) {
+	r := &Rollup{}
+	if _, err := client.Collection(Rollups).Get(day, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the most common queries, most common first.
+func top(counts map[string]int) []QueryCount {
+	list := make([]QueryCount, 0, len(counts))
+	for query, count := range counts {
+		list = append(list, QueryCount{query, count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Query < list[j].Query
+	})
+	if len(list) > topQueries {
+		list = list[:topQueries]
+	}
+	return list
+}
@@ -0,0 +1,81 @@
+package analytics
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"sync"
+)
+
+// The collection the view counters of records are kept in, keyed by
+// keys.Views keys of the collection and key of the record.
+const Views = "Views"
+
+// The counter of a record as it is stored.
+type counter struct {
+	Views int64 `json:"views"`
+}
+
+// Counts the views of records in memory and adds them to their counters
+// when flushed, so that a record viewed many times between flushes costs
+// one increment. Safe to use from multiple goroutines.
+type ViewCounter struct {
+	client *gorc2.Client
+
+	lock   sync.Mutex
+	counts map[[2]string]int64
+}
+
+// Returns a ViewCounter adding to the counters of the client.
+func NewViewCounter(client *gorc2.Client) *ViewCounter {
+	return &ViewCounter{client: client, counts: make(map[[2]string]int64)}
+}
+
+// Counts a view of a record. Does nothing on a nil ViewCounter.
+func (v *ViewCounter) Record(collection, key string) {
+	if v == nil {
+		return
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.counts[[2]string{collection, key}]++
+}
+
+// Adds the views counted since the last flush to their counters, and
+// returns the number of records whose counters were written. Views that
+// can not be added are kept for the next flush.
+func (v *ViewCounter) Flush() (int, error) {
+	v.lock.Lock()
+	counts := v.counts
+	v.counts = make(map[[2]string]int64)
+	v.lock.Unlock()
+
+	c := v.client.Collection(Views)
+	written := 0
+	var firstErr error
+	for record, n := range counts {
+		key := keys.Build(keys.Views, record[0], record[1])
+		if _, err := c.Increment(key, "views", n); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			v.lock.Lock()
+			v.counts[record] += n
+			v.lock.Unlock()
+			continue
+		}
+		written++
+	}
+	return written, firstErr
+}
+
+// Returns the number of times a record has been viewed, not counting the
+// views a ViewCounter has not flushed yet.
+func ViewCount(client *gorc2.Client, collection, key string) (int64, error) {
+	var cnt counter
+	_, err := client.Collection(Views).Get(
+		keys.Build(keys.Views, collection, key), &cnt)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		return 0, nil
+	}
+	return cnt.Views, err
+}
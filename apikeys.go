@@ -0,0 +1,289 @@
+package main
+
+import (
+	"chargepoints/apikeys"
+	"chargepoints/router"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether API requests must carry an API key, set with REQUIRE_API_KEY.
+// Requests that carry one are rate limited and scoped to its collections
+// either way.
+var apiKeysRequired bool
+
+var (
+	apiKeyCache   = &apikeys.Cache{}
+	apiKeyLimiter = &apikeys.Limiter{}
+)
+
+// Paths of the admin endpoints, which are not limited to the collections of
+// API keys. They need the admin token or an API key with the admin role.
+var adminPaths = []string{
+	"/api/analytics", "/api/config", "/api/jobs", "/api/keys",
+	"/api/reports", "/api/searches", "/api/snapshots", "/api/webhooks",
+}
+
+// Returns true if the path is of an admin endpoint.
+func isAdminPath(path string) bool {
+	path = legacyPath(path)
+	for _, p := range adminPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the API key a request carries in the X-API-Key header or the
+// api_key parameter.
+func requestAPIKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return req.URL.Query().Get("api_key")
+}
+
+// Returns the collections an API request reads from, and false for requests
+// that are not limited to particular collections.
+func requestCollections(path string) ([]string, bool) {
+	if path == "/graphql" {
+		return nil, false
+	}
+	name := strings.TrimPrefix(path, "/api/")
+	name, _, _ = strings.Cut(name, "/")
+	return strings.Split(name, ","), true
+}
+
+// The context key the API key of a request is stored under.
+type apiKeyKey struct{}
+
+// Returns the API key a request was made with, or nil if it had none.
+func requestKey(req *http.Request) *apikeys.Key {
+	key, _ := req.Context().Value(apiKeyKey{}).(*apikeys.Key)
+	return key
+}
+
+// The bearer token admin endpoints require, set with ADMIN_TOKEN. The admin
+// endpoints are disabled if it is empty.
+var adminToken string
+
+// Returns true if a request carries the admin token.
+func hasAdminToken(req *http.Request) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare(
+		[]byte(req.Header.Get("Authorization")),
+		[]byte("Bearer "+adminToken)) == 1
+}
+
+// Returns the role a request has for a collection, or for no collection in
+// particular if it is "": Admin with the admin token, the role of its API
+// key, or Public without one.
+func requestRole(req *http.Request, collection string) apikeys.Role {
+	if hasAdminToken(req) {
+		return apikeys.Admin
+	} else if key := requestKey(req); key != nil {
+		return key.RoleFor(collection)
+	}
+	return apikeys.Public
+}
+
+// Wraps a handler so that it is only called for requests with at least the
+// given role for the collection in their path. The admin role is not about
+// a collection, the admin token grants it as well.
+func requireRole(role apikeys.Role, h handlerFunc) handlerFunc {
+	return func(ctx *Context) {
+		collection := ctx.Request.PathValue("collection")
+		if role == apikeys.Admin {
+			collection = ""
+		}
+		switch {
+		case requestRole(ctx.Request, collection).Includes(role):
+			h(ctx)
+		case requestKey(ctx.Request) != nil && role == apikeys.Admin:
+			ctx.Abort(403, "API key does not have the admin role.")
+		case requestKey(ctx.Request) != nil:
+			ctx.Abort(403, fmt.Sprintf("API key does not have the %s role "+
+				"for %s.", role, collection))
+		case role != apikeys.Admin:
+			ctx.Abort(401, fmt.Sprintf("An API key with the %s role is "+
+				"required.", role))
+		case adminToken == "":
+			ctx.Abort(403, "Admin endpoints are disabled.")
+		default:
+			ctx.SetHeader("WWW-Authenticate", "Bearer", true)
+			ctx.Abort(401, "Missing or invalid admin token.")
+		}
+	}
+}
+
+// Wraps the API with API key checks. Requests to /api/ and /graphql without
+// a key are let through unless keys are required, or the path is of an
+// admin endpoint and they lack the admin token. Those with one are turned
+// away if it is invalid, if the key may not be used with the collections
+// asked for, or if it has used up its rate limit, and otherwise carry the
+// key for requireRole().
+func checkAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path := legacyPath(req.URL.Path)
+		if !strings.HasPrefix(path, "/api/") && path != "/graphql" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		admin := isAdminPath(path)
+
+		token := requestAPIKey(req)
+		if token == "" {
+			if admin && !hasAdminToken(req) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "An API key or the admin token is required.",
+					401)
+				return
+			} else if apiKeysRequired && !admin {
+				http.Error(w, "An API key is required.", 401)
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+		key, err := apiKeyCache.Authenticate(token)
+		if err == apikeys.ErrInvalidKey || err == apikeys.ErrRevoked {
+			http.Error(w, err.Error(), 401)
+			return
+		} else if err != nil {
+			log.Println(err)
+			http.Error(w, "Unable to check API key.", 502)
+			return
+		}
+
+		collections, scoped := requestCollections(path)
+		if admin {
+			// Admin endpoints are not about collections, requireRole()
+			// checks the key's role instead.
+			collections, scoped = nil, true
+		}
+		if !scoped && len(key.Collections) > 0 {
+			http.Error(w, "API key is limited to some collections.", 403)
+			return
+		}
+		for _, c := range collections {
+			if !key.Allows(c) {
+				http.Error(w, "API key may not be used with "+c+".", 403)
+				return
+			}
+		}
+
+		ok, remaining, wait := apiKeyLimiter.Allow(key)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(apiKeyLimiter.Limit(key)))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !ok {
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "API key rate limit exceeded.", 429)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(
+			context.WithValue(req.Context(), apiKeyKey{}, key)))
+	})
+}
+
+// Drops expired keys from apiKeyCache every minute.
+func sweepAPIKeyCache() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		apiKeyCache.Sweep()
+	}
+}
+
+// Lists the API keys. Their hashes are left out.
+func listAPIKeys(ctx *Context) {
+	keys, err := apikeys.List(orc)
+	for _, k := range keys {
+		k.Hash = ""
+	}
+	writeJSON(ctx, keys, err)
+}
+
+// Issues an API key from a body such as {"name": "Partner",
+// "collections": ["ChargePoints"], "rate_limit": 120, "role": "partner"}.
+// The role is public, partner or admin, and defaults to public, and
+// "collection_roles" can give the key other roles for some collections.
+// The response includes the key to hand to the partner in the key field,
+// which is not shown again.
+func issueAPIKey(ctx *Context) {
+	var key apikeys.Key
+	if !readJSON(ctx, &key) {
+		return
+	}
+	token, err := apikeys.Issue(orc, &key)
+	if err != nil {
+		ctx.Abort(400, err.Error())
+		return
+	}
+	key.Hash = ""
+	data, _ := json.Marshal(struct {
+		*apikeys.Key
+		Token string `json:"key"`
+	}{&key, token})
+	ctx.ContentType("json")
+	ctx.WriteHeader(201)
+	ctx.Write(data)
+}
+
+func getAPIKey(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	key, err := apikeys.Get(orc, id)
+	if key != nil {
+		key.Hash = ""
+	}
+	writeJSON(ctx, key, err)
+}
+
+// Revokes an API key.
+func revokeAPIKey(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	key, err := apikeys.Revoke(orc, id)
+	if key != nil {
+		key.Hash = ""
+	}
+	writeJSON(ctx, key, err)
+}
+
+// Registers the API key admin endpoints. These must be registered before
+// the search endpoint.
+func apiKeyRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/keys", timeout: lookupTimeout,
+		handler: listAPIKeys, role: apikeys.Admin,
+		summary:  "Lists every API key.",
+		response: []*apikeys.Key{},
+	}, route{
+		method: "POST", pattern: "/api/keys", timeout: lookupTimeout,
+		handler: issueAPIKey, role: apikeys.Admin,
+		summary: "Issues an API key, returned once in the key field.",
+		body:    apikeys.Key{},
+		response: struct {
+			apikeys.Key
+			Token string `json:"key"`
+		}{},
+		status: 201,
+	}, route{
+		method: "GET", pattern: "/api/keys/{id}", timeout: lookupTimeout,
+		handler: getAPIKey, role: apikeys.Admin,
+		summary:  "Returns an API key.",
+		response: apikeys.Key{},
+	}, route{
+		method: "DELETE", pattern: "/api/keys/{id}", timeout: lookupTimeout,
+		handler: revokeAPIKey, role: apikeys.Admin,
+		summary:  "Revokes an API key.",
+		response: apikeys.Key{},
+	})
+}
@@ -0,0 +1,307 @@
+// Package apikeys manages the API keys partners use to call the API. Each
+// key has its own rate limit, a Role deciding which endpoints it may call,
+// and may be limited to some collections, and can be revoked at any time.
+// Only a hash of each key's secret is stored.
+package apikeys
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The collection keys are stored in.
+const Keys = "APIKeys"
+
+// The requests a minute a key may make if it has no rate limit of its own
+// and the Limiter is not given another default.
+const DefaultRateLimit = 60
+
+// Returned by Authenticate() for keys that do not exist or whose secret is
+// wrong, and for revoked keys.
+var (
+	ErrInvalidKey = fmt.Errorf("Invalid API key.")
+	ErrRevoked    = fmt.Errorf("API key has been revoked.")
+)
+
+// What a key may do. Each role may do everything the roles before it may.
+type Role string
+
+const (
+	// Reads, and the submissions any user can make such as reports. This is
+	// the role of requests without a key.
+	Public Role = "public"
+
+	// Writes to the data, such as status updates and photos.
+	Partner Role = "partner"
+
+	// The admin endpoints, as with the admin token.
+	Admin Role = "admin"
+)
+
+// The lengths of the hex ID and secret of the keys Issue() makes.
+const (
+	idLength     = 16
+	secretLength = 48
+)
+
+var roleRanks = map[Role]int{Public: 0, Partner: 1, Admin: 2}
+
+// Returns the Role with the given name.
+func ParseRole(name string) (Role, error) {
+	r := Role(name)
+	if _, ok := roleRanks[r]; !ok {
+		return "", fmt.Errorf("Unknown role %q, must be %s, %s or %s.", name,
+			Public, Partner, Admin)
+	}
+	return r, nil
+}
+
+// Returns true if the role may do everything other may.
+func (r Role) Includes(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// An API key. The key given to its holder is the ID, a dot and a secret.
+type Key struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// The hex SHA-256 of the secret.
+	Hash string `json:"hash,omitempty"`
+
+	// The collections the key may be used with, or every collection if
+	// empty.
+	Collections []string `json:"collections,omitempty"`
+
+	// The role of the key, Public if empty, and the roles it has for
+	// particular collections instead.
+	Role            Role            `json:"role,omitempty"`
+	CollectionRoles map[string]Role `json:"collection_roles,omitempty"`
+
+	// The requests a minute the key may make. The default of the Limiter is
+	// used if it is zero.
+	RateLimit int `json:"rate_limit,omitempty"`
+
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// Returns true if the key may be used with a collection.
+func (k *Key) Allows(collection string) bool {
+	if len(k.Collections) == 0 {
+		return true
+	}
+	for _, c := range k.Collections {
+		if strings.EqualFold(c, collection) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the role of the key for requests to a collection, or to no
+// collection in particular if it is "".
+func (k *Key) RoleFor(collection string) Role {
+	for c, r := range k.CollectionRoles {
+		if collection != "" && strings.EqualFold(c, collection) {
+			return r
+		}
+	}
+	if k.Role == "" {
+		return Public
+	}
+	return k.Role
+}
+
+// Checks and stores a new key, filling in its ID, hash and creation time.
+// Returns the key to give to its holder, which can not be recovered later.
+func Issue(client *gorc2.Client, k *Key) (string, error) {
+	if k.Name == "" {
+		return "", fmt.Errorf("API key has no name.")
+	} else if k.RateLimit < 0 {
+		return "", fmt.Errorf("API key rate limit can not be negative.")
+	}
+	if k.Role == "" {
+		k.Role = Public
+	} else if _, err := ParseRole(string(k.Role)); err != nil {
+		return "", err
+	}
+	for c, r := range k.CollectionRoles {
+		if _, err := ParseRole(string(r)); err != nil {
+			return "", err
+		} else if !k.Allows(c) {
+			return "", fmt.Errorf("API key has a role for %s but may not "+
+				"be used with it.", c)
+		}
+	}
+	secret := randomHex(secretLength / 2)
+	k.ID = randomHex(idLength / 2)
+	k.Hash = hash(secret)
+	k.Created = time.Now().UTC()
+	k.Revoked = nil
+	if _, err := client.Collection(Keys).Create(k.ID, k); err != nil {
+		return "", err
+	}
+	return k.ID + "." + secret, nil
+}
+
+// Returns a key.
+func Get(client *gorc2.Client, id string) (*Key, error) {
+	k := &Key{}
+	if _, err := client.Collection(Keys).Get(id, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Returns every key, revoked or not, ordered by name.
+func List(client *gorc2.Client) ([]*Key, error) {
+	keys := []*Key{}
+	it := client.Collection(Keys).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		k := &Key{}
+		if _, err := it.Get(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys, it.Error
+}
+
+// Revokes a key. Revoked keys are kept so their use can still be traced.
+func Revoke(client *gorc2.Client, id string) (*Key, error) {
+	k, err := Get(client, id)
+	if err != nil {
+		return nil, err
+	} else if k.Revoked != nil {
+		return k, nil
+	}
+	now := time.Now().UTC()
+	k.Revoked = &now
+	if _, err := client.Collection(Keys).Update(id, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Returns the key a holder presented, or ErrInvalidKey or ErrRevoked if it
+// may not be used. Tokens that are not shaped like the keys Issue() makes
+// are refused without reading anything.
+func Authenticate(client *gorc2.Client, token string) (*Key, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || !isHex(id, idLength) || !isHex(secret, secretLength) {
+		return nil, ErrInvalidKey
+	}
+	k, err := Get(client, id)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		return nil, ErrInvalidKey
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(k.Hash)) != 1 {
+		return nil, ErrInvalidKey
+	} else if k.Revoked != nil {
+		return nil, ErrRevoked
+	}
+	return k, nil
+}
+
+// Authenticates keys, remembering the keys that exist for a while so that
+// not every request needs a read from Orchestrate. Revoking a key therefore
+// takes up to TTL to take effect. Tokens refused as invalid are not
+// remembered, so made up tokens can not fill the cache, and neither are
+// failures to read keys. Results are kept under the hash of the token, and
+// Sweep() must be called now and then to drop those that have expired.
+type Cache struct {
+	Client *gorc2.Client
+
+	// How long results are kept. Defaults to a minute.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	key     *Key
+	err     error
+	expires time.Time
+}
+
+// Returns the key a holder presented as Authenticate() does.
+func (c *Cache) Authenticate(token string) (*Key, error) {
+	now := time.Now()
+	sum := hash(token)
+	c.mu.Lock()
+	entry, ok := c.entries[sum]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.key, entry.err
+	}
+
+	k, err := Authenticate(c.Client, token)
+	if err != nil && err != ErrRevoked {
+		return nil, err
+	}
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	c.entries[sum] = cacheEntry{key: k, err: err, expires: now.Add(ttl)}
+	c.mu.Unlock()
+	return k, err
+}
+
+// Drops the results that have expired, returning how many were.
+func (c *Cache) Sweep() int {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for sum, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, sum)
+			n++
+		}
+	}
+	return n
+}
+
+// Returns true if s is n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,84 @@
+package apikeys
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Counts the requests made to the backend.
+type countingTransport struct {
+	http.RoundTripper
+	n int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (
+	*http.Response, error,
+) {
+	t.n++
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestCacheRemembersOnlyKeysThatExist(t *testing.T) {
+	client := gorc2.NewLocalClient()
+	transport := &countingTransport{RoundTripper: client.HTTPClient.Transport}
+	client.HTTPClient.Transport = transport
+	token, err := Issue(client, &Key{Name: "Test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := strings.Cut(token, ".")
+	cache := &Cache{Client: client}
+
+	// Malformed tokens are refused without a read.
+	transport.n = 0
+	for _, bad := range []string{"", "x", id, id + ".", "../" + id + ".x",
+		strings.ToUpper(token), token + "0", id + "/x." + token[17:]} {
+		if _, err := cache.Authenticate(bad); err != ErrInvalidKey {
+			t.Errorf("%q returned %v", bad, err)
+		}
+	}
+	if transport.n != 0 {
+		t.Errorf("malformed tokens made %d requests", transport.n)
+	}
+
+	// Well formed tokens that are refused are read every time and not kept.
+	wrong := id + "." + strings.Repeat("0", secretLength)
+	unknown := strings.Repeat("0", idLength) + token[idLength:]
+	for i := 0; i < 2; i++ {
+		for _, bad := range []string{wrong, unknown} {
+			if _, err := cache.Authenticate(bad); err != ErrInvalidKey {
+				t.Errorf("%q returned %v", bad, err)
+			}
+		}
+	}
+	if transport.n != 4 || len(cache.entries) != 0 {
+		t.Errorf("refused tokens made %d requests and left %d entries",
+			transport.n, len(cache.entries))
+	}
+
+	transport.n = 0
+	for i := 0; i < 2; i++ {
+		if k, err := cache.Authenticate(token); err != nil || k.ID != id {
+			t.Fatalf("key returned %v, %v", k, err)
+		}
+	}
+	if transport.n != 1 {
+		t.Errorf("key was read %d times", transport.n)
+	}
+	for sum := range cache.entries {
+		if strings.Contains(sum, token) {
+			t.Errorf("cache is keyed by the token")
+		}
+	}
+
+	if n := cache.Sweep(); n != 0 {
+		t.Errorf("swept %d entries before they expired", n)
+	}
+	cache.entries[hash(token)] = cacheEntry{expires: time.Now()}
+	if n := cache.Sweep(); n != 1 || len(cache.entries) != 0 {
+		t.Errorf("swept %d entries, %d are left", n, len(cache.entries))
+	}
+}
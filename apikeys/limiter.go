@@ -0,0 +1,74 @@
+package apikeys
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limits keys with a token bucket for each, holding a minute's worth
+// of requests and refilling at the key's rate limit. Buckets are kept in
+// memory, so each instance of the app limits keys separately. The zero
+// value is ready to use.
+type Limiter struct {
+	mu           sync.Mutex
+	buckets      map[string]*bucket
+	defaultLimit int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Sets the requests a minute keys without a rate limit of their own may
+// make, in place of DefaultRateLimit.
+func (l *Limiter) SetDefault(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaultLimit = limit
+}
+
+// Returns the requests a minute a key may make.
+func (l *Limiter) Limit(k *Key) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit(k)
+}
+
+func (l *Limiter) limit(k *Key) int {
+	if k.RateLimit > 0 {
+		return k.RateLimit
+	} else if l.defaultLimit > 0 {
+		return l.defaultLimit
+	}
+	return DefaultRateLimit
+}
+
+// Takes a request from a key's bucket. Returns whether the request is
+// allowed, the requests left, and if it is not allowed how long until it
+// would be.
+func (l *Limiter) Allow(k *Key) (bool, int, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit := float64(l.limit(k))
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[k.ID]
+	if !ok {
+		b = &bucket{tokens: limit, last: now}
+		l.buckets[k.ID] = b
+	}
+	b.tokens = math.Min(limit,
+		b.tokens+now.Sub(b.last).Minutes()*limit)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit * float64(time.Minute))
+		return false, 0, wait
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
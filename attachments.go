@@ -0,0 +1,141 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/apikeys"
+	"chargepoints/attachments"
+	"chargepoints/openapi"
+	"chargepoints/publish"
+	"chargepoints/router"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Where attachment data is kept, or nil if attachments are disabled. Set
+// with ATTACHMENT_DIR for a local directory, ATTACHMENT_S3_BUCKET and
+// ATTACHMENT_S3_REGION for S3 with ATTACHMENT_S3_ENDPOINT for other S3
+// compatible services, or ATTACHMENT_GCS_BUCKET for Google Cloud Storage.
+var attachmentStore publish.Store
+
+// The content types attachments can be uploaded as. The type stored is
+// found from the data.
+var attachmentTypes = []string{
+	"application/octet-stream", "image/gif", "image/jpeg", "image/png",
+	"image/webp",
+}
+
+// Returns true if attachments are enabled, otherwise aborts the request.
+func attachmentsEnabled(ctx *Context) bool {
+	if attachmentStore == nil {
+		ctx.Abort(404, "Attachments are not enabled.")
+		return false
+	}
+	return true
+}
+
+// Attaches the image in the body of the request to a chargepoint. The
+// name and caption parameters describe it. The type is found from the
+// data, which must be a GIF, JPEG, PNG or WebP image. Needs the partner
+// role.
+func uploadAttachment(ctx *Context) {
+	if !attachmentsEnabled(ctx) {
+		return
+	}
+	data, ok := readBody(ctx, conf().Limits.MaxAttachmentBytes,
+		attachmentTypes...)
+	if !ok {
+		return
+	}
+	a := &attachments.Attachment{
+		Collection: ctx.Request.PathValue("collection"),
+		Key:        ctx.Request.PathValue("key"),
+		Name:       ctx.Params["name"],
+		Caption:    ctx.Params["caption"],
+	}
+	err := attachments.Upload(orc, attachmentStore, a, data)
+	switch err.(type) {
+	case nil:
+	case attachments.InvalidError:
+		ctx.Abort(400, err.Error())
+		return
+	case gorc2.NotFoundError:
+		ctx.Abort(404, fmt.Sprintf("Unknown chargepoint %s.", a.Key))
+		return
+	default:
+		log.Println(err)
+		ctx.Abort(502, "Unable to store attachment.")
+		return
+	}
+	data, _ = json.Marshal(a)
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+	ctx.WriteHeader(201)
+	ctx.Write(data)
+}
+
+// Lists the attachments of a chargepoint.
+func listAttachments(ctx *Context) {
+	list, err := attachments.List(orc, ctx.Request.PathValue("collection"),
+		ctx.Request.PathValue("key"))
+	writeJSON(ctx, list, err)
+}
+
+// Returns the data of an attachment of a chargepoint.
+func attachmentData(ctx *Context) {
+	if !attachmentsEnabled(ctx) {
+		return
+	}
+	a, err := attachments.Get(orc, ctx.Request.PathValue("id"))
+	if err == nil && (a.Collection != ctx.Request.PathValue("collection") ||
+		a.Key != ctx.Request.PathValue("key")) {
+		err = gorc2.NotFoundError("404: Attachment is of another " +
+			"chargepoint.")
+	}
+	if err != nil {
+		writeJSON(ctx, nil, err)
+		return
+	}
+	data, err := attachments.Data(attachmentStore, a)
+	if err == publish.ErrNotFound {
+		ctx.Abort(404, "Not found.")
+		return
+	} else if err != nil {
+		log.Println(err)
+		ctx.Abort(502, "Unable to read attachment.")
+		return
+	}
+	allowOrigin(ctx)
+	// Attachments never change once uploaded.
+	ctx.SetHeader("Cache-Control", "public, max-age=31536000, immutable",
+		true)
+	ctx.SetHeader("X-Content-Type-Options", "nosniff", true)
+	ctx.ContentType(a.ContentType)
+	ctx.Write(data)
+}
+
+// Registers the attachment endpoints. These must be registered before the
+// search endpoint.
+func attachmentRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "POST", pattern: "/api/{collection}/{key}/attachments",
+		timeout: downloadTimeout, handler: uploadAttachment,
+		role:    apikeys.Partner,
+		summary: "Uploads a photo or document of a chargepoint.",
+		params: []openapi.Param{
+			{Name: "name", Description: "The file name."},
+			{Name: "caption", Description: "What the attachment shows."},
+		},
+		response: attachments.Attachment{}, status: 201,
+	}, route{
+		method: "GET", pattern: "/api/{collection}/{key}/attachments",
+		timeout: lookupTimeout, handler: listAttachments,
+		summary:  "Lists the attachments of a chargepoint.",
+		response: []*attachments.Attachment{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}/{key}/attachments/{id}",
+		timeout: downloadTimeout, handler: attachmentData,
+		summary:      "Returns the data of an attachment.",
+		responseType: "application/octet-stream",
+	})
+}
@@ -0,0 +1,177 @@
+// Package attachments keeps photos of chargepoints. The image data is
+// written to a blob store, a local directory or S3 bucket as used for
+// published datasets, and a metadata document for it is kept in Orchestrate
+// and linked to the chargepoint in both directions.
+package attachments
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/publish"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The collection attachment metadata is stored in, keyed by generated IDs.
+const Collection = "Attachments"
+
+// The relation kinds between a chargepoint and its attachments.
+const (
+	HasAttachmentRelation = "has_attachment"
+	AttachedToRelation    = "attached_to"
+)
+
+// The largest attachment that can be uploaded, in bytes.
+const MaxSize = 10 << 20
+
+// The content types attachments can have. The type is found from the data
+// rather than taken from the upload.
+var contentTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// The metadata of a file attached to a chargepoint.
+type Attachment struct {
+	ID string `json:"id,omitempty"`
+
+	// The chargepoint the file is attached to.
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+
+	// The file name given when it was uploaded, and a caption.
+	Name    string `json:"name,omitempty"`
+	Caption string `json:"caption,omitempty"`
+
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+
+	// The size of the image in pixels, when it is known.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// The name of the data in the blob store.
+	Blob string `json:"blob"`
+
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// Returned for uploads that are not valid.
+type InvalidError string
+
+func (e InvalidError) Error() string {
+	return string(e)
+}
+
+// Returns the name of the blob holding data. Blobs are named by their hash
+// so an image uploaded twice is stored once.
+func blobName(sum string) string {
+	return "attachments/" + sum[:2] + "/" + sum
+}
+
+// Stores data as a file attached to a chargepoint and links it to the
+// chargepoint, filling in the rest of the attachment's metadata from the
+// data. Returns an InvalidError if the data is not an image of a known
+// type or is too large, and a gorc2.NotFoundError if the chargepoint does
+// not exist.
+func Upload(
+	client *gorc2.Client, blobs publish.Store, a *Attachment, data []byte,
+) error {
+	if len(data) == 0 {
+		return InvalidError("Attachment is empty.")
+	} else if len(data) > MaxSize {
+		return InvalidError(fmt.Sprintf(
+			"Attachment is larger than %d bytes.", MaxSize))
+	}
+	a.ContentType = http.DetectContentType(data)
+	if !contentTypes[a.ContentType] {
+		return InvalidError(fmt.Sprintf("Attachments of type %s are not "+
+			"supported.", a.ContentType))
+	}
+	a.Width, a.Height = 0, 0
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil {
+		a.Width, a.Height = config.Width, config.Height
+	}
+	a.Name = strings.TrimSpace(path.Base("/" + a.Name))
+	if a.Name == "/" {
+		a.Name = ""
+	} else if len(a.Name) > 200 {
+		return InvalidError("Attachment name is longer than 200 bytes.")
+	}
+	chargepoints := client.Collection(a.Collection)
+	if _, err := chargepoints.Get(a.Key, nil); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	a.ID = ""
+	a.Size = len(data)
+	a.SHA256 = hex.EncodeToString(sum[:])
+	a.Blob = blobName(a.SHA256)
+	a.Uploaded = time.Now().UTC()
+	if err := blobs.Put(a.Blob, data, a.ContentType); err != nil {
+		return err
+	}
+	item, err := client.Collection(Collection).CreateAuto(a)
+	if err != nil {
+		return err
+	}
+	a.ID = item.Key
+	err = chargepoints.Link(a.Key, HasAttachmentRelation, Collection, a.ID)
+	if err != nil {
+		return err
+	}
+	return client.Collection(Collection).Link(a.ID, AttachedToRelation,
+		a.Collection, a.Key)
+}
+
+// Returns the metadata of an attachment.
+func Get(client *gorc2.Client, id string) (*Attachment, error) {
+	a := &Attachment{}
+	if _, err := client.Collection(Collection).Get(id, a); err != nil {
+		return nil, err
+	}
+	a.ID = id
+	return a, nil
+}
+
+// Returns the attachments of a chargepoint, oldest first.
+func List(
+	client *gorc2.Client, collection, key string,
+) ([]*Attachment, error) {
+	attachments := []*Attachment{}
+	it := client.Collection(collection).GetLinks(key,
+		&gorc2.GetLinksQuery{Limit: 100}, HasAttachmentRelation)
+	for it.Next() {
+		a := &Attachment{}
+		if _, err := it.Get(a); err != nil {
+			return nil, err
+		}
+		a.ID = it.Raw().Key
+		attachments = append(attachments, a)
+	}
+	// IDs sort in the order they were generated.
+	sort.Slice(attachments, func(i, j int) bool {
+		return attachments[i].ID < attachments[j].ID
+	})
+	return attachments, it.Error
+}
+
+// Returns the data of an attachment.
+func Data(blobs publish.Store, a *Attachment) ([]byte, error) {
+	return blobs.Get(a.Blob)
+}
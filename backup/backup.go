@@ -0,0 +1,554 @@
+// Package backup writes every item of a collection to a publish.BlobStore,
+// such as a directory, an S3 bucket or a GCS bucket, and restores them.
+// Backups are gzipped JSON lines of the form {"key": "...", "value": {...}},
+// as "orcctl export" prints, named after their collection and the time they
+// were taken:
+//
+//	backups/ChargePoints/20240331T020000Z.jsonl.gz
+//
+// Backups are full, holding every item, or incremental, holding only the
+// items whose ref changed since the backup before and the keys deleted
+// since, and are written with a manifest recording the ref of every key.
+// Restoring an incremental backup reads the backups it is based on, back to
+// the last full one, so those are kept until it is pruned too.
+//
+// Old backups are pruned by a Retention keeping the latest backup of each
+// of the last few days and weeks.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/publish"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The prefix of the names of backups if none is given.
+const DefaultPrefix = "backups/"
+
+// The layout of the time in the names of backups, and the extensions of
+// full and incremental backups and of manifests.
+const (
+	timeLayout           = "20060102T150405Z"
+	extension            = ".jsonl.gz"
+	incrementalExtension = ".incr.jsonl.gz"
+	manifestExtension    = ".manifest.json.gz"
+)
+
+// A backup of a collection.
+type Backup struct {
+	// The name of the file in the store.
+	Name       string    `json:"name"`
+	Collection string    `json:"collection"`
+	Taken      time.Time `json:"taken"`
+
+	// Set if the backup only holds the changes since Base, the backup
+	// before it.
+	Incremental bool   `json:"incremental,omitempty"`
+	Base        string `json:"base,omitempty"`
+
+	// The number of items in the collection, and of those written and keys
+	// deleted since Base, only known when the backup is taken or its
+	// manifest is read.
+	Count   int `json:"count,omitempty"`
+	Changed int `json:"changed,omitempty"`
+	Deleted int `json:"deleted,omitempty"`
+}
+
+// A backup along with the ref of every key backed up, written next to it.
+type Manifest struct {
+	Backup
+	Refs map[string]string `json:"refs"`
+}
+
+// A line of a backup. Incremental backups have a line with Deleted set for
+// each key deleted.
+type record struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// Returns the name of the backup of a collection taken at a time.
+func name(prefix, collection string, t time.Time, incremental bool) string {
+	name := prefix + collection + "/" + t.UTC().Format(timeLayout)
+	if incremental {
+		return name + incrementalExtension
+	}
+	return name + extension
+}
+
+// Returns the name of the manifest of a backup.
+func manifestName(name string) string {
+	if stem, ok := strings.CutSuffix(name, incrementalExtension); ok {
+		return stem + manifestExtension
+	}
+	return strings.TrimSuffix(name, extension) + manifestExtension
+}
+
+// Returns the backup a file name is of, or nil if it is not of a backup.
+func Parse(prefix, name string) *Backup {
+	rest, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return nil
+	}
+	b := &Backup{Name: name}
+	if stem, ok := strings.CutSuffix(rest, incrementalExtension); ok {
+		rest, b.Incremental = stem, true
+	} else if rest, ok = strings.CutSuffix(rest, extension); !ok {
+		return nil
+	}
+	slash := strings.LastIndex(rest, "/")
+	if slash <= 0 {
+		return nil
+	}
+	t, err := time.Parse(timeLayout, rest[slash+1:])
+	if err != nil {
+		return nil
+	}
+	b.Collection, b.Taken = rest[:slash], t
+	return b
+}
+
+// Options for Take.
+type Options struct {
+	// Takes an incremental backup unless this many have been taken since
+	// the last full backup, or the last backup has no manifest. Full
+	// backups are always taken if it is 0.
+	FullEvery int
+}
+
+// Writes the items of a collection to the store as a new backup, and then
+// its manifest. Writes made while the collection is read may or may not be
+// included.
+func Take(
+	client *gorc2.Client, store publish.BlobStore, prefix, collection string,
+	opts *Options,
+) (*Backup, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	base, err := incrementalBase(store, prefix, collection, opts.FullEvery)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{Refs: map[string]string{}}
+	b := &m.Backup
+	b.Collection = collection
+	b.Taken = time.Now().UTC().Truncate(time.Second)
+	b.Incremental = base != nil
+	b.Name = name(prefix, collection, b.Taken, b.Incremental)
+	if base != nil {
+		b.Base = base.Name
+	}
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	encoder := json.NewEncoder(gz)
+	it := client.Collection(collection).Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		m.Refs[raw.Key] = raw.Ref
+		if base != nil {
+			if base.Refs[raw.Key] == raw.Ref {
+				continue
+			}
+			b.Changed++
+		}
+		err := encoder.Encode(&record{Key: raw.Key, Value: raw.Value})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	if base != nil {
+		var deleted []string
+		for key := range base.Refs {
+			if _, ok := m.Refs[key]; !ok {
+				deleted = append(deleted, key)
+			}
+		}
+		sort.Strings(deleted)
+		for _, key := range deleted {
+			err := encoder.Encode(&record{Key: key, Deleted: true})
+			if err != nil {
+				return nil, err
+			}
+		}
+		b.Deleted = len(deleted)
+	}
+	b.Count = len(m.Refs)
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	if err := store.Put(b.Name, buf.Bytes(), "application/gzip"); err != nil {
+		return nil, err
+	}
+
+	buf.Reset()
+	gz.Reset(buf)
+	if err := json.NewEncoder(gz).Encode(m); err != nil {
+		return nil, err
+	} else if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b, store.Put(manifestName(b.Name), buf.Bytes(), "application/gzip")
+}
+
+// Returns the manifest of the backup an incremental backup should hold the
+// changes since, or nil if a full backup should be taken.
+func incrementalBase(
+	store publish.BlobStore, prefix, collection string, fullEvery int,
+) (*Manifest, error) {
+	if fullEvery <= 0 {
+		return nil, nil
+	}
+	backups, err := List(store, prefix, collection)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	incrementals := 0
+	for n := len(backups) - 1; n >= 0 && backups[n].Incremental; n-- {
+		incrementals++
+	}
+	if incrementals == len(backups) || incrementals >= fullEvery {
+		return nil, nil
+	}
+	m, err := ReadManifest(store, backups[len(backups)-1].Name)
+	if err == publish.ErrNotFound {
+		return nil, nil
+	}
+	return m, err
+}
+
+// Returns the manifest of a backup, or publish.ErrNotFound if it has none,
+// as backups taken before manifests were written do not.
+func ReadManifest(store publish.Store, name string) (*Manifest, error) {
+	data, err := store.Get(manifestName(name))
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("The manifest of %s is not gzipped: %s", name,
+			err)
+	}
+	m := &Manifest{}
+	if err := json.NewDecoder(gz).Decode(m); err != nil {
+		return nil, fmt.Errorf("The manifest of %s is not valid: %s", name,
+			err)
+	}
+	return m, nil
+}
+
+// Returns the backups of a collection in the store, oldest first.
+func List(
+	store publish.BlobStore, prefix, collection string,
+) ([]*Backup, error) {
+	names, err := store.List(prefix + collection + "/")
+	if err != nil {
+		return nil, err
+	}
+	backups := []*Backup{}
+	for _, name := range names {
+		if b := Parse(prefix, name); b != nil && b.Collection == collection {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Taken.Before(backups[j].Taken)
+	})
+	return backups, nil
+}
+
+// Which backups Prune() keeps: the latest backup of each of the last Daily
+// days, and of each of the last Weekly ISO weeks, that have backups. The
+// latest backup is always kept, as are the backups those that are kept are
+// based on, and a Retention of zeroes keeps every backup.
+type Retention struct {
+	Daily  int `json:"daily"`
+	Weekly int `json:"weekly"`
+}
+
+// Deletes the backups of a collection the retention does not keep, and
+// returns them.
+func Prune(
+	store publish.BlobStore, prefix, collection string, keep Retention,
+) ([]*Backup, error) {
+	backups, err := List(store, prefix, collection)
+	if err != nil || (keep.Daily <= 0 && keep.Weekly <= 0) {
+		return nil, err
+	}
+
+	kept := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[[2]int]bool)
+	for n := len(backups) - 1; n >= 0; n-- {
+		b := backups[n]
+		day := b.Taken.Format("2006-01-02")
+		year, week := b.Taken.ISOWeek()
+		if n == len(backups)-1 {
+			kept[b.Name] = true
+		}
+		if !days[day] && len(days) < keep.Daily {
+			days[day] = true
+			kept[b.Name] = true
+		}
+		if !weeks[[2]int{year, week}] && len(weeks) < keep.Weekly {
+			weeks[[2]int{year, week}] = true
+			kept[b.Name] = true
+		}
+	}
+
+	// Incremental backups need the backups before them, back to the last
+	// full one.
+	for n := len(backups) - 1; n > 0; n-- {
+		if kept[backups[n].Name] && backups[n].Incremental {
+			kept[backups[n-1].Name] = true
+		}
+	}
+
+	deleted := []*Backup{}
+	for _, b := range backups {
+		if kept[b.Name] {
+			continue
+		}
+		if err := store.Delete(b.Name); err != nil {
+			return deleted, err
+		}
+		if err := store.Delete(manifestName(b.Name)); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, b)
+	}
+	return deleted, nil
+}
+
+// Options for Restore.
+type RestoreOptions struct {
+	// The collection to restore into. Defaults to the one backed up.
+	Collection string
+
+	// Also deletes the items of the collection that are not in the backup,
+	// so it holds exactly what was backed up.
+	Delete bool
+
+	// The number of writes made at once. Defaults to 4.
+	Concurrency int
+
+	// Reads each item back after writing it and reports those whose value
+	// is not the one backed up.
+	Verify bool
+
+	// Writes nothing, and instead reports the items of the collection that
+	// are missing, differ from the backup or are not in it.
+	VerifyOnly bool
+}
+
+// What Restore did.
+type RestoreResult struct {
+	Collection string `json:"collection"`
+	Restored   int    `json:"restored"`
+	Deleted    int    `json:"deleted"`
+
+	// The number of items compared with the backup, and those that did not
+	// match it, ordered by key.
+	Verified   int         `json:"verified,omitempty"`
+	Mismatches []*Mismatch `json:"mismatches,omitempty"`
+}
+
+// Writes every item of the backup with the given name to its collection,
+// replacing the items there, or only compares them with VerifyOnly. Items
+// written since the backup was taken keep their history, with the backed
+// up value as their latest. Returns the first failed writes in a
+// gorc2.BulkError.
+func Restore(
+	client *gorc2.Client, store publish.BlobStore, prefix, name string,
+	opts *RestoreOptions,
+) (*RestoreResult, error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	b := Parse(prefix, name)
+	if b == nil {
+		return nil, fmt.Errorf("%s is not the name of a backup.", name)
+	}
+	result := &RestoreResult{Collection: b.Collection}
+	if opts.Collection != "" {
+		result.Collection = opts.Collection
+	}
+
+	records, err := Read(store, prefix, name)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Collection(result.Collection)
+	if opts.VerifyOnly {
+		return result, verify(collection, records, result)
+	}
+	v := &verifier{result: result}
+	result.Restored, err = collection.BulkApply(records,
+		&gorc2.BulkOptions{Concurrency: opts.Concurrency},
+		func(r gorc2.BulkRecord) error {
+			if _, err := collection.Update(r.Key, r.Value); err != nil {
+				return err
+			} else if !opts.Verify {
+				return nil
+			}
+			item, err := collection.Get(r.Key, nil)
+			if err != nil {
+				return err
+			}
+			return v.check(r.Key, r.Value.(json.RawMessage), item.Value)
+		})
+	v.finish()
+	if err != nil || !opts.Delete {
+		return result, err
+	}
+
+	backedUp := make(map[string]bool, len(records))
+	for _, r := range records {
+		backedUp[r.Key] = true
+	}
+	var extra []string
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		if key := it.Raw().Key; !backedUp[key] {
+			extra = append(extra, key)
+		}
+	}
+	if it.Error != nil {
+		return result, it.Error
+	}
+	for _, key := range extra {
+		if err := collection.Delete(key); err != nil {
+			return result, err
+		}
+		result.Deleted++
+	}
+	return result, nil
+}
+
+// Returns the items of the collection as they were when the backup with
+// the given name was taken, ordered by key. The items of an incremental
+// backup are read from the backups it is based on, which are checked
+// against its manifest.
+func Read(
+	store publish.BlobStore, prefix, name string,
+) ([]gorc2.BulkRecord, error) {
+	b := Parse(prefix, name)
+	if b == nil {
+		return nil, fmt.Errorf("%s is not the name of a backup.", name)
+	}
+	chain := []*Backup{b}
+	if b.Incremental {
+		var err error
+		if chain, err = basedOn(store, prefix, b); err != nil {
+			return nil, err
+		}
+	}
+
+	items := make(map[string]json.RawMessage)
+	for _, link := range chain {
+		records, err := readRecords(store, link.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.Deleted {
+				delete(items, r.Key)
+			} else {
+				items[r.Key] = r.Value
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]gorc2.BulkRecord, len(keys))
+	for i, key := range keys {
+		records[i] = gorc2.BulkRecord{Key: key, Value: items[key]}
+	}
+	return records, nil
+}
+
+// Returns the backups an incremental backup is based on, from the last
+// full backup before it up to the backup itself, checking each
+// incremental backup holds the changes since the one before it.
+func basedOn(store publish.BlobStore, prefix string, b *Backup) ([]*Backup,
+	error,
+) {
+	backups, err := List(store, prefix, b.Collection)
+	if err != nil {
+		return nil, err
+	}
+	end := -1
+	for n, other := range backups {
+		if other.Name == b.Name {
+			end = n
+		}
+	}
+	if end < 0 {
+		return nil, publish.ErrNotFound
+	}
+	start := end
+	for start >= 0 && backups[start].Incremental {
+		start--
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("There is no full backup before %s.", b.Name)
+	}
+	chain := backups[start : end+1]
+	for n := 1; n < len(chain); n++ {
+		m, err := ReadManifest(store, chain[n].Name)
+		if err != nil {
+			return nil, err
+		} else if m.Base != chain[n-1].Name {
+			return nil, fmt.Errorf("%s is based on %s, which is missing.",
+				chain[n].Name, m.Base)
+		}
+	}
+	return chain, nil
+}
+
+// Returns the lines of a backup file.
+func readRecords(store publish.Store, name string) ([]record, error) {
+	data, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not gzipped: %s", name, err)
+	}
+	var records []record
+	reader := bufio.NewReader(gz)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var r record
+			if err := json.Unmarshal(data, &r); err != nil || r.Key == "" {
+				return nil, fmt.Errorf("Line %d of %s is not a record.", line,
+					name)
+			}
+			records = append(records, r)
+		}
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
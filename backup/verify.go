@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// What is wrong with an item found when verifying a restore.
+const (
+	Missing   = "missing"
+	Different = "different"
+	Extra     = "extra"
+)
+
+// An item of a collection that does not match the backup.
+type Mismatch struct {
+	Key string `json:"key"`
+
+	// Missing if the item is in the backup but not the collection,
+	// Different if their values differ, or Extra if it is in the
+	// collection but not the backup.
+	Problem string `json:"problem"`
+
+	// The value in the backup and the value read from the collection.
+	Backup  json.RawMessage `json:"backup,omitempty"`
+	Current json.RawMessage `json:"current,omitempty"`
+}
+
+// Compares items with the backup, recording mismatches in a RestoreResult.
+// Safe to use from the writes of a bulk operation.
+type verifier struct {
+	mu     sync.Mutex
+	result *RestoreResult
+}
+
+// Compares the value of an item with the one backed up, which match if
+// their canonical JSON does.
+func (v *verifier) check(key string, backup, current json.RawMessage) error {
+	a, err := canonical(backup)
+	if err != nil {
+		return err
+	}
+	b, err := canonical(current)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.result.Verified++
+	if !bytes.Equal(a, b) {
+		v.result.Mismatches = append(v.result.Mismatches, &Mismatch{
+			Key: key, Problem: Different, Backup: backup, Current: current,
+		})
+	}
+	return nil
+}
+
+func (v *verifier) add(m *Mismatch) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.result.Mismatches = append(v.result.Mismatches, m)
+}
+
+// Orders the mismatches by key.
+func (v *verifier) finish() {
+	sort.Slice(v.result.Mismatches, func(i, j int) bool {
+		return v.result.Mismatches[i].Key < v.result.Mismatches[j].Key
+	})
+}
+
+// Compares every item of a collection with the items of a backup, without
+// writing anything.
+func verify(
+	collection *gorc2.Collection, records []gorc2.BulkRecord,
+	result *RestoreResult,
+) error {
+	current := make(map[string]json.RawMessage)
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		current[raw.Key] = raw.Value
+	}
+	if it.Error != nil {
+		return it.Error
+	}
+
+	v := &verifier{result: result}
+	for _, r := range records {
+		backup := r.Value.(json.RawMessage)
+		value, ok := current[r.Key]
+		if !ok {
+			result.Verified++
+			v.add(&Mismatch{Key: r.Key, Problem: Missing, Backup: backup})
+			continue
+		}
+		delete(current, r.Key)
+		if err := v.check(r.Key, backup, value); err != nil {
+			return err
+		}
+	}
+	for key, value := range current {
+		v.add(&Mismatch{Key: key, Problem: Extra, Current: value})
+	}
+	v.finish()
+	return nil
+}
+
+// Returns a JSON value with the keys of objects sorted and no insignificant
+// white space, keeping numbers as written.
+func canonical(data json.RawMessage) ([]byte, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
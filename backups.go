@@ -0,0 +1,60 @@
+package main
+
+import (
+	"chargepoints/backup"
+	"chargepoints/model"
+	"chargepoints/publish"
+	"log"
+	"time"
+)
+
+// Where the chargepoints are backed up to, or nil if backups are disabled.
+// Set with BACKUP_DIR, BACKUP_S3_BUCKET or BACKUP_GCS_BUCKET, as described
+// by storeFromEnv().
+var backupStore publish.BlobStore
+
+// Backs up the chargepoints when called and then every schedules.backups,
+// if this replica leads the scheduler, pruning the backups the backups
+// settings do not keep. While the schedule is 0 no backups are taken, and
+// it is checked again every minute.
+func takeBackups() {
+	for {
+		interval := conf().Schedules.Backups
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		if scheduler.IsLeader() {
+			backUp()
+		}
+		time.Sleep(interval)
+	}
+}
+
+func backUp() {
+	keep := conf().Backups
+	b, err := backup.Take(orc, backupStore, backup.DefaultPrefix,
+		model.ChargePoints, &backup.Options{FullEvery: keep.FullEvery})
+	if err != nil {
+		log.Printf("Unable to back up %s: %s", model.ChargePoints, err)
+		return
+	} else if b.Incremental {
+		log.Printf("Backed up %d changed and %d deleted chargepoints to %s.",
+			b.Changed, b.Deleted, b.Name)
+	} else {
+		log.Printf("Backed up %d chargepoints to %s.", b.Count, b.Name)
+	}
+
+	deleted, err := backup.Prune(backupStore, backup.DefaultPrefix,
+		model.ChargePoints, backup.Retention{
+			Daily:  keep.KeepDaily,
+			Weekly: keep.KeepWeekly,
+		})
+	if err != nil {
+		log.Printf("Unable to prune the backups of %s: %s",
+			model.ChargePoints, err)
+	} else if len(deleted) > 0 {
+		log.Printf("Pruned %d backups of %s.", len(deleted),
+			model.ChargePoints)
+	}
+}
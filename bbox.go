@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2/geo"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+type BBoxResults struct {
+	Results  []Result  `json:"results,omitempty"`
+	Clusters []Cluster `json:"clusters,omitempty"`
+	Count    int       `json:"count"`
+}
+
+// The location of a chargepoint, decoded from its value.
+type location struct {
+	ChargeDeviceLocation struct {
+		Latitude  float64
+		Longitude float64
+	}
+}
+
+// Returns every chargepoint within the viewport given by the north, south,
+// east and west parameters. An optional query parameter narrows the results
+// further. If there are more than bboxMaxResults then clusters are returned
+// rather than the chargepoints.
+func bbox(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	start := time.Now()
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+
+	var box [4]float64
+	for n, side := range []string{"north", "south", "east", "west"} {
+		value, err := strconv.ParseFloat(ctx.Params[side], 64)
+		if err != nil {
+			ctx.Abort(400, fmt.Sprintf("Missing or invalid %s.", side))
+			return
+		}
+		box[n] = value
+	}
+	north, south, east, west := box[0], box[1], box[2], box[3]
+	if south > north {
+		ctx.Abort(400, "South is north of north.")
+		return
+	}
+
+	query := fmt.Sprintf("value.%s:IN:{north:%g south:%g east:%g west:%g}",
+		locationField, north, south, east, west)
+	if extra := ctx.Params["query"]; extra != "" {
+		query += " AND (" + extra + ")"
+	}
+	it := orc.Collection(collection).WithContext(traceContext(ctx.Request)).
+		Search(query, &gorc2.SearchQuery{Limit: 100})
+
+	results := BBoxResults{}
+	for it.Next() {
+		raw := it.Raw()
+		results.Results = append(results.Results,
+			Result{Key: raw.Key, Ref: raw.Ref, Value: raw.Value})
+	}
+	results.Count = len(results.Results)
+	if it.Error == nil {
+		recordSearch(ctx, "bbox", collection, results.Count, start)
+		if notModified(ctx, resultsETag(ctx, results.Results)) {
+			return
+		}
+	}
+	// Above the most chargepoints returned individually they are grouped
+	// into clusters and the clusters are returned instead.
+	if limits := conf().Limits; results.Count > limits.BBoxMaxResults {
+		results.Clusters = cluster(results.Results, geo.Box{
+			North: north, South: south, East: east, West: west,
+		}, limits.BBoxMaxClusters)
+		results.Results = nil
+	}
+	transformResults(ctx, collection, results.Results)
+
+	if wantsJSONAPI(ctx) {
+		if results.Clusters != nil && it.Error == nil {
+			writeAPIClusters(ctx, results.Clusters, results.Count)
+		} else {
+			writeAPIChargepoints(ctx, collection, results.Results, it.Error)
+		}
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+
+	if it.Error != nil {
+		ctx.WriteHeader(502)
+		encoder.Encode(it.Error)
+		log.Println(it.Error)
+	} else {
+		encoder.Encode(&results)
+	}
+
+	ctx.Write(buf.Bytes())
+}
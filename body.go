@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Returns the largest body any endpoint accepts. The limits of each are
+// set in the limits config.
+func maxRequestBytes() int64 {
+	limits := conf().Limits
+	max := limits.MaxBodyBytes
+	for _, n := range []int64{limits.MaxGraphQLBytes,
+		limits.MaxAttachmentBytes} {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// Wraps the app so that no request body can be read past the largest any
+// endpoint accepts, including form bodies parsed for the parameters of
+// every request. Larger bodies are refused up front when their length is
+// known.
+func limitBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		max := maxRequestBytes()
+		if req.ContentLength > max {
+			http.Error(w, "Request body is too large.", 413)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, max)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Returns the body of a request if it has one of the given media types and
+// is at most limit bytes, otherwise aborts the request with a 415 or 413.
+func readBody(ctx *Context, limit int64, types ...string) ([]byte, bool) {
+	mediaType, _, err := mime.ParseMediaType(
+		ctx.Request.Header.Get("Content-Type"))
+	allowed := false
+	for _, t := range types {
+		allowed = allowed || (err == nil && mediaType == t)
+	}
+	if !allowed {
+		ctx.Abort(415, fmt.Sprintf("Content-Type must be %s.",
+			strings.Join(types, " or ")))
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, limit+1))
+	var tooLarge *http.MaxBytesError
+	if int64(len(body)) > limit || errors.As(err, &tooLarge) {
+		ctx.Abort(413, fmt.Sprintf("Request body can be at most %d bytes.",
+			limit))
+		return nil, false
+	} else if err != nil {
+		ctx.Abort(400, "Unable to read body.")
+		return nil, false
+	}
+	return body, true
+}
+
+// Decodes a JSON object from the body of a request into v, otherwise
+// aborts the request. The body must be application/json, at most
+// limits.max_body_bytes and nested at most limits.max_json_depth deep.
+func readJSON(ctx *Context, v interface{}) bool {
+	body, ok := readBody(ctx, conf().Limits.MaxBodyBytes, "application/json")
+	if !ok {
+		return false
+	}
+	return decodeJSON(ctx, body, v)
+}
+
+// Decodes a JSON object read from a request into v, otherwise aborts the
+// request.
+func decodeJSON(ctx *Context, data []byte, v interface{}) bool {
+	if max := conf().Limits.MaxJSONDepth; jsonDepth(data) > max {
+		ctx.Abort(400, fmt.Sprintf("JSON can be nested at most %d deep.",
+			max))
+		return false
+	} else if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") ||
+		json.Unmarshal(data, v) != nil {
+		ctx.Abort(400, "Body must be a JSON object.")
+		return false
+	}
+	return true
+}
+
+// Returns how deeply arrays and objects are nested in a JSON value. Invalid
+// JSON is left for the decoder to reject.
+func jsonDepth(data []byte) int {
+	depth, max := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = c == '\\'
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > max {
+				max = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return max
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"chargepoints/bus"
+	"chargepoints/model"
+	"log"
+	"time"
+)
+
+// Publishes changes to the chargepoints to the message bus at BUS_URL, if it
+// is set. BUS_TYPES lists the change types published, comma separated, and
+// BUS_PREFIX sets the prefix of the topics.
+var forwarder = &bus.Forwarder{Collections: []string{model.ChargePoints}}
+
+// Publishes the changes to the chargepoints when called and then every
+// schedules.bus, if this replica leads the scheduler.
+func forwardChanges() {
+	forwarder.Client = orc
+	for {
+		if scheduler.IsLeader() {
+			if n, err := forwarder.Poll(); err != nil {
+				log.Printf("Change forwarding failed: %s", err)
+			} else if n > 0 {
+				log.Printf("Published %d changes.", n)
+			}
+		}
+		time.Sleep(conf().Schedules.Bus)
+	}
+}
@@ -0,0 +1,74 @@
+// Package bus forwards changes to chargepoints to a message bus, so that
+// other systems can react to them without polling the API. Changes are found
+// as package webhooks finds them and published as the JSON of a
+// webhooks.Change, keyed by the key of the item changed so that the changes
+// to an item keep their order on buses that partition by key.
+//
+// Messages are published to a topic per collection and change type, such as
+// "chargepoints.ChargePoints.status", to NATS or to Kafka through a Kafka
+// REST Proxy. Changes are published at least once: a change may be
+// published again if forwarding stops before its checkpoint is saved, so
+// consumers should skip changes whose ID they have seen.
+package bus
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The prefix of topics if none is given.
+const DefaultPrefix = "chargepoints"
+
+// A message to publish.
+type Message struct {
+	// Used by Kafka to choose the partition. NATS has no keys.
+	Key   string
+	Value []byte
+}
+
+// Publishes messages to a message bus.
+type Publisher interface {
+	// Publishes messages to a topic in order, returning once the bus has
+	// accepted them.
+	Publish(topic string, messages []*Message) error
+
+	// Closes any connections to the bus.
+	Close() error
+}
+
+// Returns a Publisher for a URL: nats://[USER:PASSWORD@]HOST[:PORT] or
+// tls://... for NATS, or the http or https URL of a Kafka REST Proxy.
+func Open(rawURL string) (Publisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bus URL %q.", rawURL)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+		return NewNATS(rawURL)
+	case "http", "https":
+		return &KafkaREST{URL: rawURL}, nil
+	}
+	return nil, fmt.Errorf("Unsupported bus URL %q, it must be a nats, tls, "+
+		"http or https URL.", rawURL)
+}
+
+// Returns the topic of the changes of a type to a collection. Characters
+// that neither NATS subjects nor Kafka topics allow are replaced with "_".
+func Topic(prefix, collection, typ string) string {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return prefix + "." + clean(collection) + "." + clean(typ)
+}
+
+func clean(part string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' ||
+			'0' <= r && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, part)
+}
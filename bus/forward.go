@@ -0,0 +1,149 @@
+package bus
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"chargepoints/webhooks"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The collection the checkpoints of Forwarders are kept in, keyed by
+// collection.
+const State = "BusState"
+
+// The checkpoint of a collection stored in State.
+type checkpoint struct {
+	RefTime int64 `json:"reftime"`
+}
+
+// Publishes the changes to collections, as a webhooks.Watcher delivers
+// them to webhooks.
+type Forwarder struct {
+	Client    *gorc2.Client
+	Publisher Publisher
+
+	// The collections whose changes are published, and the change types
+	// published: webhooks.UpdateType and event types. If Types is empty only
+	// updates are published.
+	Collections []string
+	Types       []string
+
+	// The prefix of topics, see Topic(). Defaults to DefaultPrefix.
+	Prefix string
+}
+
+// Publishes the changes made since the last call and returns the number
+// published. The first call for a collection only records where to start
+// from. Poll() must not be called concurrently.
+func (f *Forwarder) Poll() (int, error) {
+	published := 0
+	for _, collection := range f.Collections {
+		n, err := f.poll(collection)
+		published += n
+		if err != nil {
+			return published, err
+		}
+	}
+	return published, nil
+}
+
+// Publishes the changes to one collection.
+func (f *Forwarder) poll(collection string) (int, error) {
+	state := f.Client.Collection(State)
+	key := keys.Build(keys.BusCheckpoint, collection)
+	var cp checkpoint
+	_, err := state.Get(key, &cp)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		cp.RefTime = f.Client.Now().UnixMilli()
+		_, err = state.Update(key, &cp)
+		return 0, err
+	} else if err != nil {
+		return 0, err
+	}
+
+	types := f.Types
+	if len(types) == 0 {
+		types = []string{webhooks.UpdateType}
+	}
+	update := false
+	var eventTypes []string
+	for _, typ := range types {
+		if typ == webhooks.UpdateType {
+			update = true
+		} else {
+			eventTypes = append(eventTypes, typ)
+		}
+	}
+
+	changes, latest, err := webhooks.ListChanges(
+		f.Client.Collection(collection), time.UnixMilli(cp.RefTime),
+		eventTypes)
+	if err != nil {
+		return 0, err
+	}
+	if !update {
+		var events []*webhooks.Change
+		for _, c := range changes {
+			if c.Type != webhooks.UpdateType {
+				events = append(events, c)
+			}
+		}
+		changes = events
+	}
+	n, err := PublishChanges(f.Publisher, f.Prefix, changes)
+	if err != nil || latest.UnixMilli() == cp.RefTime {
+		return n, err
+	}
+	cp.RefTime = latest.UnixMilli()
+	_, err = state.Update(key, &cp)
+	return n, err
+}
+
+// Publishes changes to the topics of their collection and type, keeping
+// the order of the changes to each topic, and returns the number published
+// before any error.
+func PublishChanges(
+	p Publisher, prefix string, changes []*webhooks.Change,
+) (int, error) {
+	var topics []string
+	byTopic := make(map[string][]*Message)
+	for _, c := range changes {
+		value, err := json.Marshal(c)
+		if err != nil {
+			return 0, err
+		}
+		topic := Topic(prefix, c.Collection, c.Type)
+		if byTopic[topic] == nil {
+			topics = append(topics, topic)
+		}
+		byTopic[topic] = append(byTopic[topic],
+			&Message{Key: c.Key, Value: value})
+	}
+	published := 0
+	for _, topic := range topics {
+		if err := p.Publish(topic, byTopic[topic]); err != nil {
+			return published, fmt.Errorf("Unable to publish to %s: %s",
+				topic, err)
+		}
+		published += len(byTopic[topic])
+	}
+	return published, nil
+}
+
+// Publishes the events of a type on a key as they are added, as
+// gorc2.Collection.TailEvents() finds them, until ctx is done or publishing
+// fails. Each event is published as it is found.
+func TailEvents(
+	ctx context.Context, p Publisher, prefix string, c *gorc2.Collection,
+	key, typ string, since time.Time, interval time.Duration,
+) error {
+	return c.TailEvents(ctx, key, typ, since, interval,
+		func(e *gorc2.Event) error {
+			_, err := PublishChanges(p, prefix, []*webhooks.Change{
+				webhooks.EventChange(c.Name, key, typ, e)})
+			return err
+		})
+}
@@ -0,0 +1,110 @@
+package bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Publishes to Kafka through a Kafka REST Proxy, with its v2 API, as JSON
+// records. Credentials in the URL are sent with basic authentication.
+type KafkaREST struct {
+	// The base URL of the proxy, such as http://kafka-rest:8082.
+	URL string
+
+	// Defaults to a client with a 10 second timeout.
+	Client *http.Client
+}
+
+var kafkaClient = &http.Client{Timeout: 10 * time.Second}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		Partition int     `json:"partition"`
+		Offset    int64   `json:"offset"`
+		ErrorCode *int    `json:"error_code"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Publishes messages to a topic. The values of messages must be JSON.
+func (k *KafkaREST) Publish(topic string, messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	records := make([]kafkaRecord, len(messages))
+	for i, m := range messages {
+		if !json.Valid(m.Value) {
+			return fmt.Errorf("Message %d to %s is not JSON.", i, topic)
+		}
+		records[i] = kafkaRecord{Key: m.Key, Value: m.Value}
+	}
+	body, err := json.Marshal(map[string][]kafkaRecord{"records": records})
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(k.URL, "/") + "/topics/" +
+		url.PathEscape(topic))
+	if err != nil {
+		return err
+	}
+	user := u.User
+	u.User = nil
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+
+	client := k.Client
+	if client == nil {
+		client = kafkaClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Kafka REST Proxy returned %s: %s", resp.Status,
+			bytes.TrimSpace(data))
+	}
+	var result kafkaResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("Unexpected response from Kafka REST Proxy: %s",
+			err)
+	}
+	for i, offset := range result.Offsets {
+		if offset.Error != nil || offset.ErrorCode != nil {
+			msg := ""
+			if offset.Error != nil {
+				msg = *offset.Error
+			}
+			return fmt.Errorf("Kafka rejected message %d to %s: %s", i, topic,
+				msg)
+		}
+	}
+	return nil
+}
+
+// Does nothing, as requests are not kept open.
+func (k *KafkaREST) Close() error {
+	return nil
+}
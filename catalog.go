@@ -0,0 +1,142 @@
+package main
+
+import (
+	"chargepoints/catalog"
+	"chargepoints/model"
+	"chargepoints/publish"
+	"chargepoints/router"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// The URL the app is reached at, such as "https://chargepoints.example.com",
+// set with PUBLIC_URL. Sitemaps and dataset metadata need absolute URLs, so
+// without it they are built from the Host of the request.
+var publicURL string
+
+// The statistics of the chargepoints the sitemap and dataset metadata are
+// built from.
+var chargepointStats = &catalog.Cache{}
+
+// What the dataset metadata says about the chargepoints.
+var datasetDescription = catalog.Description{
+	Name: "UK Chargepoints",
+	Description: "The public electric vehicle chargepoints of the United " +
+		"Kingdom, with their locations, connectors and operators, from " +
+		"the National Chargepoint Registry.",
+	License: "https://www.nationalarchives.gov.uk/doc/" +
+		"open-government-licence/version/3/",
+	Keywords: []string{
+		"electric vehicles", "chargepoints", "EV charging",
+		"United Kingdom",
+	},
+}
+
+// Returns the URL the app was reached at, without a trailing slash.
+func baseURL(ctx *Context) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	scheme := "http"
+	if ctx.Request.TLS != nil ||
+		ctx.Request.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host
+}
+
+// Returns the chargepoint statistics, writing a 502 if they can not be
+// gathered.
+func catalogStats(ctx *Context) (*catalog.Stats, bool) {
+	chargepointStats.Collection = orc.Collection(model.ChargePoints)
+	stats, err := chargepointStats.Stats(conf().Cache.CatalogTTL)
+	if err != nil {
+		log.Println(err)
+		ctx.Abort(502, "Unable to read chargepoints.")
+		return nil, false
+	}
+	seconds := int(conf().Cache.CatalogTTL.Seconds())
+	ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", seconds),
+		true)
+	return stats, true
+}
+
+// Returns a sitemap of the URL of each chargepoint, up to the most a
+// sitemap may list.
+func sitemap(ctx *Context) {
+	stats, ok := catalogStats(ctx)
+	if !ok {
+		return
+	}
+	data, err := catalog.Sitemap(baseURL(ctx)+"/api/"+model.ChargePoints+"/",
+		stats.Keys)
+	if err != nil {
+		log.Println(err)
+		ctx.Abort(500, "Unable to encode sitemap.")
+		return
+	}
+	ctx.ContentType("application/xml")
+	ctx.Write(data)
+}
+
+// Returns a Schema.org Dataset document describing the chargepoints and the
+// files the latest published version can be downloaded as.
+func datasetMetadata(ctx *Context) {
+	stats, ok := catalogStats(ctx)
+	if !ok {
+		return
+	}
+	base := baseURL(ctx)
+	d := datasetDescription
+	d.URL = base + "/"
+	if datasetStore != nil {
+		manifest, err := publish.Latest(datasetStore)
+		if err != nil && err != publish.ErrNotFound {
+			log.Printf("Unable to read dataset manifest: %s", err)
+		} else if err == nil {
+			d.Modified = manifest.Generated
+			for _, f := range manifest.Files {
+				url := f.URL
+				if strings.HasPrefix(url, "/") {
+					url = base + url
+				}
+				d.Distributions = append(d.Distributions,
+					catalog.Distribution{
+						URL:            url,
+						EncodingFormat: mediaTypes[f.Format],
+						Size:           int64(f.Size),
+					})
+			}
+		}
+	}
+	data, err := catalog.Dataset(&d, stats)
+	if err != nil {
+		log.Println(err)
+		ctx.Abort(500, "Unable to encode dataset metadata.")
+		return
+	}
+	ctx.ContentType("application/ld+json")
+	allowOrigin(ctx)
+	ctx.Write(data)
+}
+
+// The media types of the formats datasets are published in.
+var mediaTypes = map[string]string{
+	"json": "application/json",
+	"csv":  "text/csv",
+}
+
+func catalogRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/sitemap.xml", timeout: searchTimeout,
+		handler: sitemap, tag: "catalog",
+		summary:      "Returns a sitemap of the URL of each chargepoint.",
+		responseType: "application/xml",
+	}, route{
+		method: "GET", pattern: "/dataset.json", timeout: searchTimeout,
+		handler: datasetMetadata, tag: "catalog",
+		summary:      "Returns a Schema.org Dataset of the chargepoints.",
+		responseType: "application/ld+json",
+	})
+}
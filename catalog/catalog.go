@@ -0,0 +1,206 @@
+// Package catalog describes a collection for search engines and data
+// portals: a sitemap listing the URL of each of its records, and a
+// Schema.org Dataset document, which DCAT based portals can also harvest,
+// built from statistics gathered by reading the whole collection.
+package catalog
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2/geo"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The most URLs a sitemap may list.
+const MaxSitemapURLs = 50000
+
+// What a scan of a collection found.
+type Stats struct {
+	Collection string
+	Scanned    time.Time
+
+	// The number of records.
+	Count int
+
+	// The keys of the records in key order, up to MaxSitemapURLs of them.
+	Keys []string
+
+	// The smallest box holding every record's location, or nil if none has
+	// one.
+	Box *geo.Box
+}
+
+// The fields of a record that are read.
+type record struct {
+	ChargeDeviceLocation struct {
+		Latitude  *float64
+		Longitude *float64
+	}
+}
+
+// Reads every record in a collection and returns its statistics.
+func Scan(collection *gorc2.Collection) (*Stats, error) {
+	stats := &Stats{Collection: collection.Name, Scanned: time.Now().UTC()}
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		stats.Count++
+		if len(stats.Keys) < MaxSitemapURLs {
+			stats.Keys = append(stats.Keys, raw.Key)
+		}
+
+		var r record
+		if json.Unmarshal(raw.Value, &r) != nil {
+			continue
+		}
+		lat, lon := r.ChargeDeviceLocation.Latitude,
+			r.ChargeDeviceLocation.Longitude
+		if lat == nil || lon == nil || (*lat == 0 && *lon == 0) {
+			continue
+		} else if stats.Box == nil {
+			stats.Box = &geo.Box{North: *lat, South: *lat, East: *lon,
+				West: *lon}
+			continue
+		}
+		b := stats.Box
+		b.North, b.South = max(b.North, *lat), min(b.South, *lat)
+		b.East, b.West = max(b.East, *lon), min(b.West, *lon)
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	return stats, nil
+}
+
+// Keeps the Stats of a collection so that it is not read for every request.
+type Cache struct {
+	Collection *gorc2.Collection
+
+	lock  sync.Mutex
+	stats *Stats
+}
+
+// Returns the statistics of the collection, scanning it if those kept are
+// older than maxAge. Only one scan runs at a time, other callers wait for
+// it.
+func (c *Cache) Stats(maxAge time.Duration) (*Stats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stats != nil && time.Since(c.stats.Scanned) < maxAge {
+		return c.stats, nil
+	}
+	stats, err := Scan(c.Collection)
+	if err != nil {
+		return nil, err
+	}
+	c.stats = stats
+	return stats, nil
+}
+
+type urlSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// Returns a sitemap listing the URL of each key, which is urlPrefix followed
+// by the escaped key.
+func Sitemap(urlPrefix string, keys []string) ([]byte, error) {
+	set := urlSet{URLs: make([]sitemapURL, len(keys))}
+	for i, key := range keys {
+		set.URLs[i].Loc = urlPrefix + url.PathEscape(key)
+	}
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// A file the dataset can be downloaded as.
+type Distribution struct {
+	URL            string
+	EncodingFormat string
+	Size           int64
+}
+
+// What a Dataset document says about the dataset besides its statistics.
+type Description struct {
+	Name        string
+	Description string
+	URL         string
+	License     string
+	Publisher   string
+	Keywords    []string
+
+	// When the data was last published, or the zero time if it never has
+	// been.
+	Modified      time.Time
+	Distributions []Distribution
+}
+
+// Returns a Schema.org Dataset document, as JSON-LD, describing a collection
+// from its statistics.
+func Dataset(d *Description, stats *Stats) ([]byte, error) {
+	doc := map[string]interface{}{
+		"@context":            "https://schema.org/",
+		"@type":               "Dataset",
+		"name":                d.Name,
+		"description":         d.Description,
+		"url":                 d.URL,
+		"isAccessibleForFree": true,
+		"variableMeasured": map[string]interface{}{
+			"@type": "PropertyValue",
+			"name":  "Number of " + stats.Collection,
+			"value": stats.Count,
+		},
+	}
+	if d.License != "" {
+		doc["license"] = d.License
+	}
+	if d.Publisher != "" {
+		doc["publisher"] = map[string]interface{}{
+			"@type": "Organization",
+			"name":  d.Publisher,
+		}
+	}
+	if len(d.Keywords) > 0 {
+		doc["keywords"] = d.Keywords
+	}
+	if !d.Modified.IsZero() {
+		doc["dateModified"] = d.Modified.UTC().Format(time.RFC3339)
+	}
+	if b := stats.Box; b != nil {
+		doc["spatialCoverage"] = map[string]interface{}{
+			"@type": "Place",
+			"geo": map[string]interface{}{
+				"@type": "GeoShape",
+				"box": fmt.Sprintf("%g %g %g %g",
+					b.South, b.West, b.North, b.East),
+			},
+		}
+	}
+	var distributions []interface{}
+	for _, dist := range d.Distributions {
+		download := map[string]interface{}{
+			"@type":          "DataDownload",
+			"contentUrl":     dist.URL,
+			"encodingFormat": dist.EncodingFormat,
+		}
+		if dist.Size > 0 {
+			download["contentSize"] = fmt.Sprintf("%d B", dist.Size)
+		}
+		distributions = append(distributions, download)
+	}
+	if distributions != nil {
+		doc["distribution"] = distributions
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
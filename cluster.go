@@ -0,0 +1,79 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2/geo"
+	"encoding/json"
+	"sort"
+)
+
+// A group of nearby chargepoints shown as a single marker.
+type Cluster struct {
+	// The geohash cell holding the chargepoints, or for clusters of the
+	// tiles endpoint the tile as z/x/y, and its bounds.
+	Geohash string  `json:"geohash,omitempty"`
+	Tile    string  `json:"tile,omitempty"`
+	North   float64 `json:"north"`
+	South   float64 `json:"south"`
+	East    float64 `json:"east"`
+	West    float64 `json:"west"`
+
+	// The number of chargepoints in the cluster and their mean position,
+	// which is where the marker should go.
+	Count     int     `json:"count"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Groups results into clusters by geohash cell. The cell size is the
+// smallest that covers the viewport in no more than maxClusters cells, so
+// the clusters shrink as the map is zoomed in. Clusters are returned
+// largest first. Results without a location are left out.
+func cluster(results []Result, box geo.Box, maxClusters int) []Cluster {
+	cells := geo.Cover(box, maxClusters)
+	if len(cells) == 0 {
+		return nil
+	}
+	precision := len(cells[0])
+
+	byCell := make(map[string]*Cluster)
+	for _, r := range results {
+		var loc location
+		if err := json.Unmarshal(r.Value, &loc); err != nil {
+			continue
+		}
+		lat := loc.ChargeDeviceLocation.Latitude
+		lon := loc.ChargeDeviceLocation.Longitude
+		hash := geo.Encode(lat, lon, precision)
+		c, ok := byCell[hash]
+		if !ok {
+			c = &Cluster{Geohash: hash}
+			byCell[hash] = c
+		}
+		c.Count++
+		c.Latitude += lat
+		c.Longitude += lon
+	}
+
+	clusters := make([]Cluster, 0, len(byCell))
+	for hash, c := range byCell {
+		bounds := geo.Bounds(hash)
+		c.North, c.South = bounds.North, bounds.South
+		c.East, c.West = bounds.East, bounds.West
+		c.Latitude /= float64(c.Count)
+		c.Longitude /= float64(c.Count)
+		clusters = append(clusters, *c)
+	}
+	sortClusters(clusters)
+	return clusters
+}
+
+// Sorts clusters largest first.
+func sortClusters(clusters []Cluster) {
+	sort.Slice(clusters, func(a, b int) bool {
+		if clusters[a].Count != clusters[b].Count {
+			return clusters[a].Count > clusters[b].Count
+		}
+		return clusters[a].Geohash+clusters[a].Tile <
+			clusters[b].Geohash+clusters[b].Tile
+	})
+}
@@ -0,0 +1,822 @@
+// Command orcctl inspects and patches records stored in Orchestrate from the
+// terminal.
+//
+// Usage:
+//
+//	orcctl [-key KEY] [-host HOST] [-local] [-dry-run] [-read-only]
+//	       COMMAND [ARGS]
+//
+// The commands are:
+//
+//	get COLLECTION KEY             print the value of a key
+//	put COLLECTION KEY [FILE]      write a JSON value read from FILE or stdin
+//	delete COLLECTION KEY          delete a key
+//	search COLLECTION QUERY        print matching items as JSON lines
+//	export COLLECTION              print every item as JSON lines
+//	import COLLECTION [FILE]       write items from JSON lines, merging
+//	                               them with edits, and rebuild the index
+//	                               of names to suggest
+//	conflicts COLLECTION           print the edits imports conflicted with
+//	                               as JSON lines
+//	link COLLECTION KEY KIND TO_COLLECTION TO_KEY
+//	                               create a graph relation
+//	events tail COLLECTION KEY TYPE
+//	                               print new events as JSON lines, or
+//	                               publish them to NATS or Kafka, until
+//	                               interrupted
+//	events export COLLECTION       write events as CSV files partitioned by
+//	                               type and day to a directory or S3
+//	report COLLECTION              check for data quality problems and save
+//	                               the report for the web app
+//	dedupe COLLECTION              print likely duplicate chargepoints as
+//	                               JSON lines, merging them with -apply
+//	publish COLLECTION             write a gzipped JSON and CSV dataset of
+//	                               the collection to a directory or S3
+//	geocode COLLECTION             fill in missing postcodes, towns and
+//	                               counties from coordinates
+//	backup take|list|prune COLLECTION
+//	                               back up a collection to a directory, S3
+//	                               or GCS, list its backups or delete old
+//	                               ones
+//	restore NAME                   write the items of a backup, and of the
+//	                               backups an incremental one is based on,
+//	                               back to its collection, or with
+//	                               -verify-only compare them with it
+//	migrate COLLECTION             apply the migrations of a collection to
+//	                               every item, resuming an interrupted run,
+//	                               or with -status print what was applied
+//
+// Run "orcctl COMMAND -h" for the options of a command. The API key defaults
+// to the ORC_KEY environment variable, as used by the web app. Export writes
+// and import reads lines of the form {"key": "...", "value": {...}}, so the
+// output of one can be fed to the other. With -dry-run any command can be
+// rehearsed: reads are made as usual but writes are only logged. With
+// -read-only writes fail instead.
+package main
+
+import (
+	"bufio"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/backup"
+	"chargepoints/bus"
+	"chargepoints/dedupe"
+	"chargepoints/devdata"
+	"chargepoints/eventexport"
+	"chargepoints/geocode"
+	"chargepoints/merge"
+	"chargepoints/migrations"
+	"chargepoints/model"
+	"chargepoints/publish"
+	"chargepoints/quality"
+	"chargepoints/suggest"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// A single line of export output or import input.
+type record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// The subcommands, each of which is given the arguments that follow its
+// name.
+var commands = map[string]func(args []string) error{
+	"get":       get,
+	"put":       put,
+	"delete":    del,
+	"search":    search,
+	"export":    export,
+	"import":    importRecords,
+	"link":      link,
+	"events":    events,
+	"report":    report,
+	"dedupe":    dedupeRecords,
+	"publish":   publishDataset,
+	"geocode":   geocodeRecords,
+	"conflicts": conflicts,
+	"backup":    backupCommand,
+	"restore":   restore,
+	"migrate":   migrate,
+}
+
+var orc *gorc2.Client
+
+func main() {
+	key := flag.String("key", os.Getenv("ORC_KEY"), "Orchestrate API key")
+	host := flag.String("host", gorc2.DefaultAPIHost, "Orchestrate API host")
+	local := flag.Bool("local", false, "use an in-memory backend holding "+
+		"the sample data instead of Orchestrate")
+	dryRun := flag.Bool("dry-run", false, "log the writes a command makes "+
+		"instead of making them")
+	readOnly := flag.Bool("read-only", false, "fail rather than make any "+
+		"write")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "orcctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if *local {
+		orc = gorc2.NewLocalClient()
+		if _, err := devdata.LoadSeed(orc.Collection("ChargePoints")); err != nil {
+			fatalf("unable to load sample data: %s", err)
+		}
+		if _, err := devdata.LoadOperators(model.NewStore(orc)); err != nil {
+			fatalf("unable to load sample operators: %s", err)
+		}
+		if _, err := devdata.LoadTariffs(model.NewStore(orc)); err != nil {
+			fatalf("unable to load sample tariffs: %s", err)
+		}
+	} else if *key == "" {
+		fatalf("no API key, set ORC_KEY or pass -key")
+	} else {
+		orc = gorc2.NewClient(*key)
+		orc.APIHost = *host
+	}
+	orc.SetAppInfo("orcctl", "1")
+	// Set after the sample data is loaded, which is then read as usual.
+	orc.DryRun, orc.ReadOnly = *dryRun, *readOnly
+
+	if err := command(flag.Args()[1:]); err != nil {
+		fatalf("%s", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: orcctl [flags] "+
+		"get|put|delete|search|export|import|link|events|report|dedupe|"+
+		"publish|geocode|conflicts|backup|restore|migrate [args]\n")
+	flag.PrintDefaults()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "orcctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// Parses the flags of a subcommand and checks the number of positional
+// arguments is between min and max.
+func parse(fs *flag.FlagSet, args []string, min, max int, usage string) {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: orcctl %s %s\n", fs.Name(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// Reads a JSON value from the named file, or stdin if name is empty or "-".
+func readValue(name string) (json.RawMessage, error) {
+	var data []byte
+	var err error
+	if name == "" || name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	} else if !json.Valid(data) {
+		return nil, fmt.Errorf("input is not valid JSON")
+	}
+	return json.RawMessage(data), nil
+}
+
+// Writes each item of the iterator to stdout as a JSON line.
+func printItems(it *gorc2.Iterator) error {
+	out := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(out)
+	for it.Next() {
+		raw := it.Raw()
+		if err := encoder.Encode(&record{Key: raw.Key, Value: raw.Value}); err != nil {
+			return err
+		}
+	}
+	if it.Error != nil {
+		return it.Error
+	}
+	return out.Flush()
+}
+
+func get(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	ref := fs.String("ref", "", "fetch this ref rather than the latest")
+	showRef := fs.Bool("show-ref", false, "print the ref to stderr")
+	parse(fs, args, 2, 2, "COLLECTION KEY")
+
+	item, err := orc.Collection(fs.Arg(0)).GetRef(fs.Arg(1), *ref, nil)
+	if err != nil {
+		return err
+	}
+	if *showRef {
+		fmt.Fprintln(os.Stderr, item.Ref)
+	}
+	_, err = fmt.Printf("%s\n", item.Value)
+	return err
+}
+
+func put(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	create := fs.Bool("create", false, "fail if the key already exists")
+	ifMatch := fs.String("if-match", "",
+		"only write if this is the current ref of the key")
+	parse(fs, args, 2, 3, "COLLECTION KEY [FILE]")
+
+	value, err := readValue(fs.Arg(2))
+	if err != nil {
+		return err
+	}
+	collection := orc.Collection(fs.Arg(0))
+	var item *gorc2.Item
+	switch {
+	case *create:
+		item, err = collection.Create(fs.Arg(1), value)
+	case *ifMatch != "":
+		current := &gorc2.Item{Collection: collection, Key: fs.Arg(1),
+			Ref: *ifMatch}
+		item, err = current.Update(value)
+	default:
+		item, err = collection.Update(fs.Arg(1), value)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(item.Ref)
+	return nil
+}
+
+func del(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	purge := fs.Bool("purge", false, "remove all refs, this can not be undone")
+	parse(fs, args, 2, 2, "COLLECTION KEY")
+
+	collection := orc.Collection(fs.Arg(0))
+	if *purge {
+		return collection.Purge(fs.Arg(1))
+	}
+	return collection.Delete(fs.Arg(1))
+}
+
+func search(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "results fetched per request")
+	sort := fs.String("sort", "", "sort order, for example value.name:asc")
+	parse(fs, args, 2, 2, "COLLECTION QUERY")
+
+	return printItems(orc.Collection(fs.Arg(0)).Search(fs.Arg(1),
+		&gorc2.SearchQuery{Limit: *limit, Sort: *sort}))
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	return printItems(orc.Collection(fs.Arg(0)).Scroll(
+		&gorc2.ListQuery{Limit: 100}))
+}
+
+func importRecords(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	concurrency := fs.Int("concurrency", 4, "number of concurrent writes")
+	deadLetter := fs.String("dead-letter", "",
+		"append records that fail to write to this file")
+	normalize := fs.Bool("normalize", true, "add the canonical standard of "+
+		"each connector using the mapping table in "+model.ConnectorTypes)
+	index := fs.Bool("suggest", true, "rebuild the index of town and "+
+		"operator names suggested by the web app once imported")
+	policyName := fs.String("merge", string(merge.FieldLevel), "what to "+
+		"keep of records edited since the last import that the import "+
+		"changes too: import-wins, manual-wins, or field to merge them "+
+		"field by field keeping edits")
+	importFields := fs.String("import-fields", "", "comma separated "+
+		"fields the import wins for with -merge=field even if edited")
+	queue := fs.Bool("queue", false, "queue the import as a job run by "+
+		"the web app instead of importing the records now")
+	parse(fs, args, 1, 2, "COLLECTION [FILE]")
+
+	policy, err := merge.ParsePolicy(*policyName)
+	if err != nil {
+		return err
+	}
+
+	var normalizer *model.ConnectorNormalizer
+	if *normalize {
+		if normalizer, err = model.NewStore(orc).ConnectorNormalizer(); err != nil {
+			return err
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(1); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var records []gorc2.BulkRecord
+	decoder := json.NewDecoder(in)
+	for {
+		var r record
+		if err := decoder.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		} else if r.Key == "" {
+			return fmt.Errorf("record %d has no key", len(records)+1)
+		}
+		if normalizer != nil {
+			value, unknown, err := normalizer.Normalize(r.Value)
+			if err != nil {
+				return fmt.Errorf("record %s: %s", r.Key, err)
+			}
+			for _, spelling := range unknown {
+				fmt.Fprintf(os.Stderr, "%s: unknown connector type %q\n",
+					r.Key, spelling)
+			}
+			r.Value = value
+		}
+		records = append(records, gorc2.BulkRecord{Key: r.Key, Value: r.Value})
+	}
+
+	opts := &merge.Options{Policy: policy, Concurrency: *concurrency}
+	if *importFields != "" {
+		opts.ImportFields = strings.Split(*importFields, ",")
+	}
+	if *queue {
+		if *deadLetter != "" {
+			return fmt.Errorf("-dead-letter can not be used with -queue")
+		}
+		i := &merge.ImportJob{Collection: fs.Arg(0), Policy: opts.Policy,
+			ImportFields: opts.ImportFields, Concurrency: opts.Concurrency,
+			Reindex: *index}
+		for _, r := range records {
+			i.Records = append(i.Records, merge.Record{Key: r.Key,
+				Value: r.Value.(json.RawMessage)})
+		}
+		job, err := merge.Enqueue(orc, i)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "queued import of %d records as job %s\n",
+			len(records), job.ID)
+		return nil
+	}
+	if *deadLetter != "" {
+		f, err := os.OpenFile(*deadLetter,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		opts.DeadLetter = gorc2.NewWriterDeadLetter(f)
+	}
+	result, err := merge.Import(orc, fs.Arg(0), records, opts)
+	fmt.Fprintf(os.Stderr, "wrote %d and left %d of %d records, "+
+		"%d conflicted with edits\n", result.Written, result.Unchanged,
+		len(records), result.Conflicts)
+	if err != nil || !*index {
+		return err
+	}
+	n, err := suggest.Build(orc, fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("indexing names: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "indexed %d names\n", n)
+	return nil
+}
+
+func link(args []string) error {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	unlink := fs.Bool("unlink", false, "remove the relation instead")
+	parse(fs, args, 5, 5, "COLLECTION KEY KIND TO_COLLECTION TO_KEY")
+
+	collection := orc.Collection(fs.Arg(0))
+	if *unlink {
+		return collection.Unlink(fs.Arg(1), fs.Arg(2), fs.Arg(3), fs.Arg(4))
+	}
+	return collection.Link(fs.Arg(1), fs.Arg(2), fs.Arg(3), fs.Arg(4))
+}
+
+// A single line of events tail output.
+type eventRecord struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Ordinal   string          `json:"ordinal"`
+	Ref       string          `json:"ref"`
+	Value     json.RawMessage `json:"value"`
+}
+
+func events(args []string) error {
+	if len(args) > 0 && args[0] == "tail" {
+		return tailEvents(args[1:])
+	} else if len(args) > 0 && args[0] == "export" {
+		return exportEvents(args[1:])
+	}
+	return fmt.Errorf("usage: orcctl events tail|export [args]")
+}
+
+func tailEvents(args []string) error {
+	fs := flag.NewFlagSet("events tail", flag.ExitOnError)
+	interval := fs.Duration("interval", 2*time.Second, "how often to poll")
+	since := fs.Duration("since", 0,
+		"also print events from this long ago, for example 10m")
+	publishURL := fs.String("publish", "", "publish events to this NATS "+
+		"or Kafka REST Proxy URL instead of printing them")
+	prefix := fs.String("prefix", bus.DefaultPrefix,
+		"the prefix of the topics events are published to")
+	parse(fs, args, 3, 3, "COLLECTION KEY TYPE")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *publishURL != "" {
+		p, err := bus.Open(*publishURL)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		err = bus.TailEvents(ctx, p, *prefix, orc.Collection(fs.Arg(0)),
+			fs.Arg(1), fs.Arg(2), time.Now().Add(-*since), *interval)
+		if err == context.Canceled {
+			return nil
+		}
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	err := orc.Collection(fs.Arg(0)).TailEvents(ctx, fs.Arg(1), fs.Arg(2),
+		time.Now().Add(-*since), *interval, func(e *gorc2.Event) error {
+			return encoder.Encode(&eventRecord{
+				Timestamp: e.Timestamp,
+				Ordinal:   e.OrdinalStr,
+				Ref:       e.Ref,
+				Value:     e.Value,
+			})
+		})
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+func exportEvents(args []string) error {
+	fs := flag.NewFlagSet("events export", flag.ExitOnError)
+	types := fs.String("types", "", "comma separated event types to export")
+	keys := fs.String("keys", "", "comma separated keys whose events to "+
+		"export, or every key if empty")
+	since := fs.String("since", "", "export events from this day, "+
+		"for example 2024-03-01")
+	until := fs.String("until", "", "export events before this day")
+	prefix := fs.String("prefix", "", "prepend this to file names")
+	storeFlags := addStoreFlags(fs, "events")
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	opts := &eventexport.Options{Prefix: *prefix}
+	if *types == "" {
+		return fmt.Errorf("-types is required")
+	}
+	opts.Types = strings.Split(*types, ",")
+	if *keys != "" {
+		opts.Keys = strings.Split(*keys, ",")
+	}
+	for _, day := range []struct {
+		value string
+		t     *time.Time
+	}{{*since, &opts.Since}, {*until, &opts.Until}} {
+		if day.value == "" {
+			continue
+		}
+		t, err := time.Parse(eventexport.DayLayout, day.value)
+		if err != nil {
+			return fmt.Errorf("invalid day %q", day.value)
+		}
+		*day.t = t
+	}
+	store, err := storeFlags.store()
+	if err != nil {
+		return err
+	}
+
+	result, err := eventexport.Export(orc.Collection(fs.Arg(0)), store, opts)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+func report(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	field := fs.String("verified-field", "DateUpdated",
+		"the field holding the date a record was last verified")
+	maxAge := fs.Duration("max-age", 365*24*time.Hour,
+		"report records last verified longer ago than this")
+	save := fs.Bool("save", true, "save the report to "+quality.Reports)
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	r, err := quality.Scan(orc.Collection(fs.Arg(0)), &quality.Options{
+		VerifiedField: *field,
+		MaxAge:        *maxAge,
+	})
+	if err != nil {
+		return err
+	}
+	if *save {
+		if err := quality.Save(orc, r); err != nil {
+			return err
+		}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func dedupeRecords(args []string) error {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	distance := fs.Float64("distance", 25,
+		"the furthest apart in meters duplicates can be")
+	similarity := fs.Float64("similarity", 0.5,
+		"the lowest name similarity, from 0 to 1, of duplicates")
+	apply := fs.Bool("apply", false, "merge the duplicates found")
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	candidates, err := dedupe.Find(orc.Collection(fs.Arg(0)), &dedupe.Options{
+		MaxDistance:   *distance,
+		MinSimilarity: *similarity,
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, c := range candidates {
+		if err := encoder.Encode(&c); err != nil {
+			return err
+		}
+		if *apply {
+			if err := dedupe.Merge(orc, c); err != nil {
+				return fmt.Errorf("merging %s into %s: %s", c.Duplicate,
+					c.Keep, err)
+			}
+		}
+	}
+	return nil
+}
+
+// The flags choosing where files are kept.
+type storeFlags struct {
+	dir, bucket, region, endpoint, gcsBucket *string
+}
+
+// Adds the flags choosing where files are kept to a subcommand, which keeps
+// what.
+func addStoreFlags(fs *flag.FlagSet, what string) *storeFlags {
+	return &storeFlags{
+		dir: fs.String("dir", "", "keep the "+what+" in this directory"),
+		bucket: fs.String("s3-bucket", "", "keep the "+what+" in this S3 "+
+			"bucket using AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY"),
+		region: fs.String("s3-region", "us-east-1",
+			"the region of the bucket"),
+		endpoint: fs.String("s3-endpoint", "",
+			"the URL of an S3 compatible service to use rather than AWS"),
+		gcsBucket: fs.String("gcs-bucket", "", "keep the "+what+" in this "+
+			"Google Cloud Storage bucket using the service account key in "+
+			"GOOGLE_APPLICATION_CREDENTIALS"),
+	}
+}
+
+// Returns the store the flags choose.
+func (f *storeFlags) store() (publish.BlobStore, error) {
+	switch {
+	case *f.dir != "":
+		return publish.Dir(*f.dir), nil
+	case *f.bucket != "":
+		s3 := publish.NewS3(*f.bucket, *f.region)
+		if *f.endpoint != "" {
+			s3.Endpoint = *f.endpoint
+		}
+		return s3, nil
+	case *f.gcsBucket != "":
+		return publish.NewGCS(*f.gcsBucket)
+	}
+	return nil, fmt.Errorf("one of -dir, -s3-bucket or -gcs-bucket is " +
+		"required")
+}
+
+func publishDataset(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	storeFlags := addStoreFlags(fs, "dataset")
+	baseURL := fs.String("base-url", "",
+		"prepend this to file names to give their URLs in the manifest")
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	store, err := storeFlags.store()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := publish.Publish(orc.Collection(fs.Arg(0)), store,
+		&publish.Options{BaseURL: *baseURL})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+func backupCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: orcctl backup take|list|prune COLLECTION")
+	}
+	fs := flag.NewFlagSet("backup "+args[0], flag.ExitOnError)
+	prefix := fs.String("prefix", backup.DefaultPrefix,
+		"the prefix of the names of backups")
+	storeFlags := addStoreFlags(fs, "backups")
+	var daily, weekly, fullEvery *int
+	if args[0] == "take" {
+		fullEvery = fs.Int("full-every", 0, "take an incremental backup "+
+			"of the items changed since the last backup unless this many "+
+			"have been taken since the last full backup, or always take "+
+			"full backups if 0")
+	} else if args[0] == "prune" {
+		daily = fs.Int("daily", 7, "keep the latest backup of this many days")
+		weekly = fs.Int("weekly", 4,
+			"keep the latest backup of this many weeks")
+	}
+	parse(fs, args[1:], 1, 1, "COLLECTION")
+	store, err := storeFlags.store()
+	if err != nil {
+		return err
+	}
+
+	var result interface{}
+	switch args[0] {
+	case "take":
+		result, err = backup.Take(orc, store, *prefix, fs.Arg(0),
+			&backup.Options{FullEvery: *fullEvery})
+	case "list":
+		result, err = backup.List(store, *prefix, fs.Arg(0))
+	case "prune":
+		result, err = backup.Prune(store, *prefix, fs.Arg(0),
+			backup.Retention{Daily: *daily, Weekly: *weekly})
+	default:
+		return fmt.Errorf("usage: orcctl backup take|list|prune COLLECTION")
+	}
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	prefix := fs.String("prefix", backup.DefaultPrefix,
+		"the prefix of the names of backups")
+	collection := fs.String("collection", "", "restore into this "+
+		"collection rather than the one backed up")
+	deleteOthers := fs.Bool("delete", false, "also delete the items that "+
+		"are not in the backup")
+	concurrency := fs.Int("concurrency", 4, "number of concurrent writes")
+	verify := fs.Bool("verify", false, "read each item back after writing "+
+		"it and report those that do not match the backup")
+	verifyOnly := fs.Bool("verify-only", false, "write nothing and report "+
+		"the items of the collection that do not match the backup")
+	storeFlags := addStoreFlags(fs, "backups")
+	parse(fs, args, 1, 1, "NAME")
+	store, err := storeFlags.store()
+	if err != nil {
+		return err
+	}
+
+	result, err := backup.Restore(orc, store, *prefix, fs.Arg(0),
+		&backup.RestoreOptions{
+			Collection:  *collection,
+			Delete:      *deleteOthers,
+			Concurrency: *concurrency,
+			Verify:      *verify,
+			VerifyOnly:  *verifyOnly,
+		})
+	if result != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	}
+	if err == nil && len(result.Mismatches) > 0 {
+		err = fmt.Errorf("%d items do not match the backup",
+			len(result.Mismatches))
+	}
+	return err
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.Int("to", 0, "migrate to this version rather than the latest")
+	status := fs.Bool("status", false, "print the versions applied and "+
+		"their rollback notes instead")
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var s *migrations.Status
+	var err error
+	if *status {
+		s, err = migrations.GetStatus(orc, fs.Arg(0))
+	} else {
+		s, err = migrations.Run(orc, fs.Arg(0),
+			&migrations.Options{Target: *to, Context: ctx})
+	}
+	if s != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(s); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func geocodeRecords(args []string) error {
+	fs := flag.NewFlagSet("geocode", flag.ExitOnError)
+	rate := fs.Float64("rate", 5, "the most lookups made a second")
+	postcodesURL := fs.String("postcodes-url", geocode.DefaultPostcodesURL,
+		"the postcodes.io API to reverse geocode with")
+	radius := fs.Int("radius", 100, "how far in meters, up to 2000, the "+
+		"nearest postcode may be from a chargepoint")
+	cache := fs.String("cache", geocode.CacheCollection, "keep lookups in "+
+		"this collection so they are not made again, or none if empty")
+	dryRun := fs.Bool("dry-run", false,
+		"report what would be filled in without writing it")
+	parse(fs, args, 1, 1, "COLLECTION")
+	if *rate <= 0 {
+		return fmt.Errorf("-rate must be above 0")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var g geocode.Geocoder = geocode.RateLimit(&geocode.PostcodesIO{
+		URL:    *postcodesURL,
+		Radius: *radius,
+	}, *rate)
+	if *cache != "" {
+		g = &geocode.Cache{Geocoder: g, Client: orc, Collection: *cache}
+	}
+	report, err := geocode.Enrich(orc.Collection(fs.Arg(0)), g,
+		&geocode.Options{DryRun: *dryRun, Context: ctx})
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func conflicts(args []string) error {
+	fs := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	resolve := fs.String("resolve", "",
+		"remove the conflict of this key once reviewed instead")
+	parse(fs, args, 1, 1, "COLLECTION")
+
+	if *resolve != "" {
+		return merge.ResolveConflict(orc, fs.Arg(0), *resolve)
+	}
+	list, err := merge.ListConflicts(orc, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, c := range list {
+		if err := encoder.Encode(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses smaller than this are sent uncompressed since compressing them
+// saves little.
+const minCompressSize = 1024
+
+// The content types worth compressing. Images and other binary formats are
+// compressed already.
+var compressibleTypes = []string{
+	"application/javascript", "application/json", "application/vnd.api+json",
+	"application/xml", "image/svg+xml", "text/",
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+// Returns true if the Accept-Encoding header of a request allows gzip.
+func acceptsGzip(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// Wraps a handler to gzip responses for clients that accept it. Only
+// responses of compressible types and at least minCompressSize bytes are
+// compressed. Brotli is not offered since the standard library has no
+// encoder for it.
+//
+// The ETag of a compressed response gets a -gzip suffix, as it is a
+// different representation, and the suffix is removed from If-None-Match so
+// that handlers see the ETags they set.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if req.Method == "HEAD" || !acceptsGzip(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if match := req.Header.Get("If-None-Match"); match != "" {
+			req.Header.Set("If-None-Match",
+				strings.ReplaceAll(match, `-gzip"`, `"`))
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, req)
+	})
+}
+
+// Buffers the start of a response to decide whether to compress it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < minCompressSize {
+			return len(p), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Writes the headers, compressing the rest of the response if it is worth
+// it, and then what has been buffered.
+func (w *gzipResponseWriter) decide() error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = 200
+	}
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if w.compressible() {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+		}
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Returns true if the buffered response should be compressed.
+func (w *gzipResponseWriter) compressible() bool {
+	h := w.Header()
+	if len(w.buf) < minCompressSize || w.status != 200 ||
+		h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends what has been written so far, compressing what is buffered if it
+// is worth it.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided && w.decide() != nil {
+		return
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Finishes the response.
+func (w *gzipResponseWriter) Close() error {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
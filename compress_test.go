@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A ResponseWriter that throws the response away, so benchmarks measure
+// the handler and not the recording.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func BenchmarkCompressResponses(b *testing.B) {
+	for _, size := range []int{512, 16 << 10, 256 << 10} {
+		body := []byte(`[` + strings.Repeat(
+			`{"ChargeDeviceName":"Manchester Piccadilly Station"},`,
+			size/53) + `{}]`)
+		h := compressResponses(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(body)
+			}))
+		for _, encoding := range []string{"gzip", "identity"} {
+			name := fmt.Sprintf("size=%d/%s", size, encoding)
+			b.Run(name, func(b *testing.B) {
+				req := httptest.NewRequest("GET", "/api/ChargePoints", nil)
+				req.Header.Set("Accept-Encoding", encoding)
+				w := &discardWriter{header: http.Header{}}
+				b.SetBytes(int64(len(body)))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					clear(w.header)
+					h.ServeHTTP(w, req)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"chargepoints/alerts"
+	"chargepoints/analytics"
+	"chargepoints/apikeys"
+	"chargepoints/attachments"
+	"chargepoints/bus"
+	"chargepoints/config"
+	"chargepoints/geocode"
+	"chargepoints/idempotency"
+	"chargepoints/jobs"
+	"chargepoints/leader"
+	"chargepoints/merge"
+	"chargepoints/migrations"
+	"chargepoints/quality"
+	"chargepoints/reports"
+	"chargepoints/router"
+	"chargepoints/snapshots"
+	"chargepoints/suggest"
+	"chargepoints/webhooks"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// The YAML file settings are read from after the environment, set with
+// CONFIG_FILE. See package config.
+var configFile string
+
+var currentConfig atomic.Pointer[config.Config]
+
+// Returns the settings in effect. They are replaced as a whole when the
+// config is reloaded, so a request should read them once if it needs
+// several to agree.
+func conf() *config.Config {
+	return currentConfig.Load()
+}
+
+// Reads the settings from the environment and configFile, keeping those in
+// effect if they are invalid.
+func loadConfig() (*config.Config, error) {
+	c, err := config.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	currentConfig.Store(c)
+	apiKeyLimiter.SetDefault(c.Limits.RateLimit)
+	lastGood.SetMaxEntries(c.Fallback.MaxEntries)
+	loadTransforms(c.Transforms)
+	return c, nil
+}
+
+// Reloads the config whenever the process is sent SIGHUP.
+func reloadOnHangup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if _, err := loadConfig(); err != nil {
+			log.Printf("Unable to reload config: %s", err)
+		} else {
+			log.Println("Reloaded config.")
+		}
+	}
+}
+
+// Sets Access-Control-Allow-Origin so that the pages allowed by the CORS
+// config can read the response.
+func allowOrigin(ctx *Context) {
+	origin := ctx.Request.Header.Get("Origin")
+	for _, allowed := range conf().CORS.AllowedOrigins {
+		if allowed == "*" {
+			ctx.SetHeader("Access-Control-Allow-Origin", "*", true)
+			return
+		} else if origin != "" && strings.EqualFold(allowed, origin) {
+			ctx.SetHeader("Access-Control-Allow-Origin", origin, true)
+			ctx.SetHeader("Vary", "Origin", false)
+			return
+		}
+	}
+}
+
+// The collections the app keeps its own state in, which are not served
+// whatever the config says: they hold API keys, webhook secrets and the
+// like.
+var internalCollections = map[string]bool{
+	alerts.Collection:       true,
+	analytics.Collection:    true,
+	analytics.Rollups:       true,
+	analytics.Views:         true,
+	apikeys.Keys:            true,
+	attachments.Collection:  true,
+	bus.State:               true,
+	geocode.CacheCollection: true,
+	idempotency.Collection:  true,
+	jobs.Collection:         true,
+	leader.Collection:       true,
+	merge.Bases:             true,
+	merge.Conflicts:         true,
+	migrations.State:        true,
+	quality.Reports:         true,
+	reports.Collection:      true,
+	reports.Sequences:       true,
+	snapshots.Collection:    true,
+	suggest.Collection:      true,
+	webhooks.DeadLetters:    true,
+	webhooks.Secrets:        true,
+	webhooks.State:          true,
+	webhooks.Webhooks:       true,
+}
+
+// Returns whether the API serves a collection.
+func served(collection string) bool {
+	if internalCollections[collection] {
+		return false
+	}
+	for _, c := range conf().Collections {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps a handler whose pattern has a {collection} so that it 404s for
+// collections that are not served. The search endpoint may be given several
+// collections separated by commas.
+func servedCollections(h handlerFunc) handlerFunc {
+	return func(ctx *Context) {
+		for _, c := range strings.Split(ctx.Request.PathValue("collection"),
+			",") {
+			if !served(c) {
+				ctx.Abort(404, fmt.Sprintf("Unknown collection %s.", c))
+				return
+			}
+		}
+		h(ctx)
+	}
+}
+
+// Returns the settings in effect.
+func getConfig(ctx *Context) {
+	writeJSON(ctx, conf().Values(), nil)
+}
+
+// Reloads the config and returns the settings now in effect, or a 400 with
+// the reason the config is invalid, in which case the settings in effect
+// are kept.
+func reloadConfig(ctx *Context) {
+	c, err := loadConfig()
+	if err != nil {
+		ctx.Abort(400, err.Error())
+		return
+	}
+	log.Println("Reloaded config.")
+	writeJSON(ctx, c.Values(), nil)
+}
+
+func configRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/config", timeout: lookupTimeout,
+		handler: getConfig, role: apikeys.Admin,
+		summary:  "Returns the settings in effect.",
+		response: map[string]interface{}{},
+	}, route{
+		method: "POST", pattern: "/api/config/reload", timeout: lookupTimeout,
+		handler: reloadConfig, role: apikeys.Admin,
+		summary:  "Reloads the config and returns the settings now in effect.",
+		response: map[string]interface{}{},
+	})
+}
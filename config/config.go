@@ -0,0 +1,444 @@
+// Package config holds the settings of the web app that operators may want
+// to tune while it runs: the collections it serves, cache lifetimes, limits,
+// CORS, the languages text is returned in, which endpoints fall back to
+// stale data, how documents are transformed and how often background jobs
+// run. Settings are read from the
+// environment and then from an optional YAML file, which is read last so
+// that editing it and reloading changes settings without a redeploy.
+//
+// A file setting everything to its default looks like:
+//
+//	collections: [ChargePoints, Operators, Networks, Tariffs, ConnectorTypes]
+//	cache:
+//	  status_ttl: 30m
+//	  tile_max_age: 3600
+//	  idempotency_ttl: 24h
+//	  catalog_ttl: 1h
+//	limits:
+//	  rate_limit: 60
+//	  bbox_max_results: 500
+//	  bbox_max_clusters: 64
+//	  max_body_bytes: 65536
+//	  max_graphql_bytes: 1048576
+//	  max_attachment_bytes: 10485760
+//	  max_json_depth: 20
+//	cors:
+//	  allowed_origins: ["*"]
+//	locale:
+//	  languages: [en, cy]
+//	  fields: [description]
+//	fallback:
+//	  endpoints: [search, bbox, tiles, near, near-postcode]
+//	  max_age: 24h
+//	  max_entries: 1000
+//	backups:
+//	  keep_daily: 7
+//	  keep_weekly: 4
+//	  full_every: 6
+//	schedules:
+//	  publish: 24h
+//	  snapshots: 24h
+//	  backups: 24h
+//	  webhooks: 30s
+//	  bus: 10s
+//	  alerts: 1h
+//	  fallback: 5m
+//	transforms:
+//
+// The transforms of a collection are given under its name, as a list of the
+// steps described in package transform:
+//
+//	transforms:
+//	  ChargePoints:
+//	    - convert Connector.RatedOutputkW kW W
+//	    - compute is_rapid = Connector.RatedOutputkW >= 43000
+package config
+
+import (
+	"chargepoints/apikeys"
+	"chargepoints/attachments"
+	"chargepoints/lastgood"
+	"chargepoints/model"
+	"chargepoints/transform"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The settings. Each has a name in the YAML file, given by the yaml tags of
+// the fields leading to it joined with dots, and most can be set with the
+// environment variable in its env tag. Lists are given in the environment
+// separated by commas. Settings with a min tag can not be set lower.
+type Config struct {
+	// The collections the API serves, the public datasets by default. The
+	// collections the app keeps its own state in are never served.
+	Collections []string `yaml:"collections" env:"COLLECTIONS"`
+
+	Cache     Cache     `yaml:"cache"`
+	Limits    Limits    `yaml:"limits"`
+	CORS      CORS      `yaml:"cors"`
+	Locale    Locale    `yaml:"locale"`
+	Fallback  Fallback  `yaml:"fallback"`
+	Backups   Backups   `yaml:"backups"`
+	Schedules Schedules `yaml:"schedules"`
+
+	// The transforms applied to the documents of each collection before they
+	// are returned, which can only be set in the YAML file.
+	Transforms map[string][]string `yaml:"transforms"`
+}
+
+// How long responses and records are kept or trusted for.
+type Cache struct {
+	// How long a chargepoint status is trusted for after it was reported.
+	StatusTTL time.Duration `yaml:"status_ttl" env:"STATUS_TTL" min:"1"`
+
+	// How many seconds map tiles may be cached for.
+	TileMaxAge int `yaml:"tile_max_age" env:"TILE_MAX_AGE" min:"0"`
+
+	// How long the responses to writes made with an Idempotency-Key are
+	// kept.
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL" min:"1"`
+
+	// How long the statistics the sitemap and dataset metadata are built
+	// from are kept before the chargepoints are read again.
+	CatalogTTL time.Duration `yaml:"catalog_ttl" env:"CATALOG_TTL" min:"0"`
+}
+
+// Limits on what requests may ask for.
+type Limits struct {
+	// The requests a minute API keys without a rate limit of their own may
+	// make.
+	RateLimit int `yaml:"rate_limit" env:"RATE_LIMIT" min:"1"`
+
+	// The most chargepoints a bounding box search returns before clustering
+	// them, and the most clusters it returns.
+	BBoxMaxResults  int `yaml:"bbox_max_results" env:"BBOX_MAX_RESULTS" min:"0"`
+	BBoxMaxClusters int `yaml:"bbox_max_clusters" env:"BBOX_MAX_CLUSTERS" min:"1"`
+
+	// The largest request bodies accepted, in bytes: JSON bodies of the
+	// write endpoints, GraphQL queries and attachment uploads, which can be
+	// at most attachments.MaxSize.
+	MaxBodyBytes       int64 `yaml:"max_body_bytes" env:"MAX_BODY_BYTES" min:"1"`
+	MaxGraphQLBytes    int64 `yaml:"max_graphql_bytes" env:"MAX_GRAPHQL_BYTES" min:"1"`
+	MaxAttachmentBytes int64 `yaml:"max_attachment_bytes" env:"MAX_ATTACHMENT_BYTES" min:"1"`
+
+	// How deeply arrays and objects may be nested in JSON bodies.
+	MaxJSONDepth int `yaml:"max_json_depth" env:"MAX_JSON_DEPTH" min:"1"`
+}
+
+// Which web pages may call the API from a browser.
+type CORS struct {
+	// The origins sent in Access-Control-Allow-Origin, such as
+	// "https://example.com", or "*" for any.
+	AllowedOrigins []string `yaml:"allowed_origins" env:"CORS_ORIGINS"`
+}
+
+// The languages text fields are stored in, and so can be asked for with
+// Accept-Language.
+type Locale struct {
+	// The languages, of which the first is used when a field has no text in
+	// the language asked for.
+	Languages []string `yaml:"languages" env:"LANGUAGES"`
+
+	// The dotted paths of the fields that hold an object of texts by
+	// language, such as {"en": "...", "cy": "..."}.
+	Fields []string `yaml:"fields" env:"LOCALIZED_FIELDS"`
+}
+
+// Which endpoints answer with the last response they gave to the same
+// request while Orchestrate's circuit breaker is open, rather than failing.
+type Fallback struct {
+	// The endpoints, of search, bbox, tiles, near and near-postcode.
+	Endpoints []string `yaml:"endpoints" env:"FALLBACK_ENDPOINTS"`
+
+	// The oldest response served, or any if 0.
+	MaxAge time.Duration `yaml:"max_age" env:"FALLBACK_MAX_AGE" min:"0"`
+
+	// How many responses are kept, the least recently used are dropped.
+	MaxEntries int `yaml:"max_entries" env:"FALLBACK_MAX_ENTRIES" min:"1"`
+}
+
+// How the chargepoints are backed up, and which of the backups are kept.
+type Backups struct {
+	// The latest backup of each of the last KeepDaily days and KeepWeekly
+	// weeks is kept, and every backup is kept if both are 0.
+	KeepDaily  int `yaml:"keep_daily" env:"BACKUP_KEEP_DAILY" min:"0"`
+	KeepWeekly int `yaml:"keep_weekly" env:"BACKUP_KEEP_WEEKLY" min:"0"`
+
+	// Backups hold only the chargepoints changed since the backup before,
+	// but for every FullEvery+1th, which holds them all. Every backup holds
+	// them all if 0.
+	FullEvery int `yaml:"full_every" env:"BACKUP_FULL_EVERY" min:"0"`
+}
+
+// How often background jobs run. Changes take effect after the run that
+// is waiting.
+type Schedules struct {
+	// Publishing the chargepoints as a dataset.
+	Publish time.Duration `yaml:"publish" env:"PUBLISH_INTERVAL" min:"1"`
+
+	// Snapshotting the chargepoints, which is not done if 0.
+	Snapshots time.Duration `yaml:"snapshots" env:"SNAPSHOT_INTERVAL" min:"0"`
+
+	// Backing up the chargepoints to the store set with BACKUP_DIR,
+	// BACKUP_S3_BUCKET or BACKUP_GCS_BUCKET, which is not done if 0.
+	Backups time.Duration `yaml:"backups" env:"BACKUP_INTERVAL" min:"0"`
+
+	// Delivering changes to webhooks.
+	Webhooks time.Duration `yaml:"webhooks" env:"WEBHOOK_INTERVAL" min:"1"`
+
+	// Publishing changes to the message bus set with BUS_URL.
+	Bus time.Duration `yaml:"bus" env:"BUS_INTERVAL" min:"1"`
+
+	// Running saved searches.
+	Alerts time.Duration `yaml:"alerts" env:"ALERT_INTERVAL" min:"1"`
+
+	// Saving the responses kept for the fallback to FALLBACK_FILE.
+	Fallback time.Duration `yaml:"fallback" env:"FALLBACK_SAVE_INTERVAL" min:"1"`
+}
+
+// Returns the default settings.
+func Default() *Config {
+	return &Config{
+		Collections: []string{
+			model.ChargePoints, model.Operators, model.Networks,
+			model.Tariffs, model.ConnectorTypes,
+		},
+		Cache: Cache{
+			StatusTTL:      30 * time.Minute,
+			TileMaxAge:     3600,
+			IdempotencyTTL: 24 * time.Hour,
+			CatalogTTL:     time.Hour,
+		},
+		Limits: Limits{
+			RateLimit:          apikeys.DefaultRateLimit,
+			BBoxMaxResults:     500,
+			BBoxMaxClusters:    64,
+			MaxBodyBytes:       64 << 10,
+			MaxGraphQLBytes:    1 << 20,
+			MaxAttachmentBytes: attachments.MaxSize,
+			MaxJSONDepth:       20,
+		},
+		CORS: CORS{AllowedOrigins: []string{"*"}},
+		Locale: Locale{
+			Languages: []string{"en", "cy"},
+			Fields:    []string{"description"},
+		},
+		Fallback: Fallback{
+			Endpoints: []string{
+				"search", "bbox", "tiles", "near", "near-postcode",
+			},
+			MaxAge:     24 * time.Hour,
+			MaxEntries: lastgood.DefaultMaxEntries,
+		},
+		Backups: Backups{KeepDaily: 7, KeepWeekly: 4, FullEvery: 6},
+		Schedules: Schedules{
+			Publish:   24 * time.Hour,
+			Snapshots: 24 * time.Hour,
+			Backups:   24 * time.Hour,
+			Webhooks:  30 * time.Second,
+			Bus:       10 * time.Second,
+			Alerts:    time.Hour,
+			Fallback:  5 * time.Minute,
+		},
+	}
+}
+
+// Returns the default settings overridden by those in the environment and
+// then those in the YAML file at path, if path is not "".
+func Load(path string) (*Config, error) {
+	c := Default()
+	var err error
+	c.each(func(name, env string, field reflect.Value, min string) {
+		if v := os.Getenv(env); v != "" && err == nil {
+			if !set(field, v, min) {
+				err = fmt.Errorf("Invalid %s %q.", env, v)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		values, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %s", path, err)
+		}
+		if err := c.apply(values); err != nil {
+			return nil, fmt.Errorf("Unable to load %s: %s", path, err)
+		}
+	}
+
+	for collection, steps := range c.Transforms {
+		if _, err := transform.Parse(steps); err != nil {
+			return nil, fmt.Errorf("Invalid transforms.%s: %s", collection,
+				err)
+		}
+	}
+	if len(c.Locale.Fields) > 0 && len(c.Locale.Languages) == 0 {
+		return nil, fmt.Errorf("Localized fields need at least one language.")
+	}
+	if c.Limits.MaxAttachmentBytes > attachments.MaxSize {
+		return nil, fmt.Errorf("Attachments can be at most %d bytes.",
+			attachments.MaxSize)
+	}
+	return c, nil
+}
+
+// Sets the settings given in a parsed YAML file.
+func (c *Config) apply(values map[string]interface{}) error {
+	flat := make(map[string]interface{})
+	flatten("", values, flat)
+
+	var err error
+	c.each(func(name, env string, field reflect.Value, min string) {
+		if field.Kind() == reflect.Map {
+			// Each entry of a map is a setting of its own.
+			entries := make(map[string]interface{})
+			for k, v := range flat {
+				if key, ok := strings.CutPrefix(k, name+"."); ok {
+					entries[key] = v
+					delete(flat, k)
+				}
+			}
+			if v, ok := flat[name]; ok && v == "" {
+				delete(flat, name)
+			}
+			if !setMap(field, entries) && err == nil {
+				err = fmt.Errorf("Invalid %s.", name)
+			}
+			return
+		}
+		v, ok := flat[name]
+		if !ok || err != nil {
+			return
+		}
+		delete(flat, name)
+		if !set(field, v, min) {
+			err = fmt.Errorf("Invalid %s %v.", name, v)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for name := range flat {
+		return fmt.Errorf("Unknown setting %s.", name)
+	}
+	return nil
+}
+
+// Adds the values of nested mappings to flat under their dotted names.
+func flatten(prefix string, values map[string]interface{},
+	flat map[string]interface{}) {
+	for k, v := range values {
+		if m, ok := v.(map[string]interface{}); ok {
+			flatten(prefix+k+".", m, flat)
+		} else {
+			flat[prefix+k] = v
+		}
+	}
+}
+
+// Calls fn with each setting: its name in the YAML file, its environment
+// variable, the field holding it and its min tag.
+func (c *Config) each(fn func(name, env string, field reflect.Value,
+	min string)) {
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			name := prefix + f.Tag.Get("yaml")
+			if f.Type.Kind() == reflect.Struct {
+				walk(name+".", v.Field(i))
+			} else {
+				fn(name, f.Tag.Get("env"), v.Field(i), f.Tag.Get("min"))
+			}
+		}
+	}
+	walk("", reflect.ValueOf(c).Elem())
+}
+
+// Sets a field to a value from the environment or a YAML file, returning
+// false if it is invalid or below min.
+func set(field reflect.Value, value interface{}, min string) bool {
+	if field.Kind() == reflect.Slice {
+		var items []string
+		switch v := value.(type) {
+		case []string:
+			items = v
+		case string:
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return true
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	var n int64
+	var err error
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		var d time.Duration
+		d, err = time.ParseDuration(s)
+		n = int64(d)
+	} else {
+		n, err = strconv.ParseInt(s, 10, 64)
+	}
+	if m, _ := strconv.ParseInt(min, 10, 64); err != nil || n < m {
+		return false
+	}
+	field.SetInt(n)
+	return true
+}
+
+// Sets a map of lists to the entries of a mapping in a YAML file, returning
+// false if an entry is not a list. Entries given as "key:" are empty.
+func setMap(field reflect.Value, entries map[string]interface{}) bool {
+	m := make(map[string][]string)
+	for k, v := range entries {
+		if strings.Contains(k, ".") {
+			return false
+		}
+		switch v := v.(type) {
+		case []string:
+			m[k] = v
+		case string:
+			if v != "" {
+				return false
+			}
+			m[k] = nil
+		default:
+			return false
+		}
+	}
+	field.Set(reflect.ValueOf(m))
+	return true
+}
+
+// Returns the settings by their names in the YAML file, with durations
+// written as they would be there.
+func (c *Config) Values() map[string]interface{} {
+	values := make(map[string]interface{})
+	c.each(func(name, env string, field reflect.Value, min string) {
+		if d, ok := field.Interface().(time.Duration); ok {
+			values[name] = d.String()
+		} else {
+			values[name] = field.Interface()
+		}
+	})
+	return values
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A line of a YAML file with its comment and indentation removed.
+type yamlLine struct {
+	n, indent int
+	text      string
+}
+
+// Parses the subset of YAML config files are written in: mappings nested
+// by indentation whose values are scalars, or lists written as "- item"
+// lines or as [a, b]. Scalars may be quoted, and are returned as strings,
+// lists as []string and mappings as map[string]interface{}. Comments and
+// blank lines are ignored.
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	var lines []yamlLine
+	for i, line := range strings.Split(string(data), "\n") {
+		line = stripComment(strings.TrimRight(line, " \r"))
+		text := strings.TrimLeft(line, " ")
+		if text == "" || text == "---" {
+			continue
+		} else if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("Line %d is indented with a tab.", i+1)
+		}
+		lines = append(lines, yamlLine{i + 1, len(line) - len(text), text})
+	}
+
+	p := &yamlParser{lines: lines}
+	m, err := p.mapping(0)
+	if err == nil && p.pos < len(lines) {
+		err = fmt.Errorf("Line %d is not indented as expected.",
+			lines[p.pos].n)
+	}
+	return m, err
+}
+
+// Returns a line without the comment at its end, if it has one.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return strings.TrimRight(line[:i], " ")
+		}
+	}
+	return line
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// Parses the mapping starting at the current line, whose keys are indented
+// by indent.
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		} else if line.indent > indent {
+			return nil, fmt.Errorf("Line %d is not indented as expected.",
+				line.n)
+		}
+		key, value, ok := strings.Cut(line.text, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || (value != "" && value[0] != ' ') {
+			return nil, fmt.Errorf("Line %d is not a key: value pair.", line.n)
+		} else if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("Line %d repeats %s.", line.n, key)
+		}
+		p.pos++
+
+		var err error
+		if value = strings.TrimSpace(value); value != "" {
+			m[key], err = parseValue(value)
+		} else if p.pos == len(p.lines) {
+			m[key] = ""
+		} else if next := p.lines[p.pos]; isListItem(next.text) &&
+			next.indent >= indent {
+			// Lists may be indented as far as the key they belong to.
+			m[key], err = p.list(next.indent)
+		} else if next.indent > indent {
+			m[key], err = p.mapping(next.indent)
+		} else {
+			m[key] = ""
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line.n, err)
+		}
+	}
+	return m, nil
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// Parses the "- item" lines starting at the current line, indented by
+// indent.
+func (p *yamlParser) list(indent int) ([]string, error) {
+	items := []string{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !isListItem(line.text) {
+			break
+		}
+		item, err := parseScalar(strings.TrimSpace(line.text[1:]))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		p.pos++
+	}
+	return items, nil
+}
+
+// Parses a value given on the same line as its key, a scalar or a list
+// written as [a, b].
+func parseValue(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "[") {
+		return parseScalar(s)
+	} else if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("List %s is not closed.", s)
+	}
+	items := []string{}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	if s == "" {
+		return items, nil
+	}
+	for _, item := range splitFlow(s) {
+		item, err := parseScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Splits the items of a list written as [a, b] at the commas that are not
+// quoted.
+func splitFlow(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// Parses a plain, single quoted or double quoted scalar. Null is returned
+// as "".
+func parseScalar(s string) (string, error) {
+	switch {
+	case s == "~" || s == "null":
+		return "", nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("Invalid quoted string %s.", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("Invalid quoted string %s.", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsAny(s[:1], "[]{}&*!|>%@`"):
+		return "", fmt.Errorf("Unsupported value %s.", s)
+	}
+	return s, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"chargepoints/model"
+	"chargepoints/webhooks"
+	"testing"
+)
+
+func TestInternalCollectionsNotServed(t *testing.T) {
+	c := *conf()
+	c.Collections = []string{model.ChargePoints, webhooks.Secrets}
+	for name := range internalCollections {
+		c.Collections = append(c.Collections, name)
+	}
+	previous := currentConfig.Swap(&c)
+	defer currentConfig.Store(previous)
+
+	if !served(model.ChargePoints) {
+		t.Errorf("%s is not served", model.ChargePoints)
+	}
+	if served(webhooks.Secrets) {
+		t.Errorf("%s is served", webhooks.Secrets)
+	}
+	for name := range internalCollections {
+		if served(name) {
+			t.Errorf("%s is served", name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package cursor makes the opaque tokens clients page through results with.
+// A token holds the link of the page it leads to, the path of a request and
+// its query parameters, which include the filters of the results and
+// whatever says where the page starts, and is signed so that clients can
+// not make their own or change the filters of one they were given. Clients
+// only follow the links they are given, so they can not ask for deep pages
+// that were never offered, and how pages are found can change without
+// breaking them.
+package cursor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The number of bytes of the signature kept in a token.
+const signatureSize = 16
+
+// Makes and reads tokens signed with a secret. Every instance serving the
+// same API must use the same secret for tokens to be accepted by all of
+// them.
+type Signer struct {
+	secret []byte
+}
+
+// Returns a Signer signing tokens with the secret.
+func NewSigner(secret string) *Signer {
+	return &Signer{secret: []byte(secret)}
+}
+
+func (s *Signer) sign(link string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(link))
+	return mac.Sum(nil)[:signatureSize]
+}
+
+// Returns a token holding the link of a page, the path and parameters of a
+// request for it.
+func (s *Signer) Encode(path string, params url.Values) string {
+	link := path + "?" + params.Encode()
+	return base64.RawURLEncoding.EncodeToString([]byte(link)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.sign(link))
+}
+
+// Returns the path and parameters held by a token, or an error if it was
+// not made by a Signer with the same secret.
+func (s *Signer) Decode(token string) (string, url.Values, error) {
+	encoded, signature, _ := strings.Cut(token, ".")
+	link, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid cursor.")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.sign(string(link))) {
+		return "", nil, fmt.Errorf("Invalid cursor.")
+	}
+	path, query, _ := strings.Cut(string(link), "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid cursor.")
+	}
+	return path, params, nil
+}
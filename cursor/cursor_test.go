@@ -0,0 +1,41 @@
+package cursor
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	s := NewSigner("secret")
+	f.Add(s.Encode("/v1/chargepoints", url.Values{"offset": {"10"}}), "", "")
+	f.Add(s.Encode("/v1/search", url.Values{"q": {"a b&c"}}), "/p", "x")
+	f.Add("", "/v1/chargepoints", "limit")
+	f.Add(".", "/", "")
+	f.Add("L3YxP2E9JQ.AAAAAAAAAAAAAAAAAAAAAA", "?", "%")
+	f.Add("!!!.!!!", "/v1/a?b", "c")
+	f.Fuzz(func(t *testing.T, token, path, value string) {
+		// Made up tokens are refused, or are ones a Signer could have made.
+		if p, params, err := s.Decode(token); err == nil {
+			again, _, err := s.Decode(s.Encode(p, params))
+			if err != nil || again != p {
+				t.Fatalf("%q decoded as %q, which does not round trip",
+					token, p)
+			}
+		}
+
+		if strings.Contains(path, "?") {
+			return
+		}
+		params := url.Values{"q": {value}}
+		p, got, err := s.Decode(s.Encode(path, params))
+		if err != nil || p != path || !reflect.DeepEqual(got, params) {
+			t.Fatalf("%q %v decoded as %q %v, %v", path, params, p, got, err)
+		}
+		if _, _, err := NewSigner("other").Decode(
+			s.Encode(path, params)); err == nil {
+			t.Fatalf("%q was accepted with another secret", path)
+		}
+	})
+}
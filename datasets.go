@@ -0,0 +1,113 @@
+package main
+
+import (
+	"chargepoints/model"
+	"chargepoints/publish"
+	"chargepoints/router"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Where the bulk dataset is published, or nil if publishing is disabled. Set
+// with PUBLISH_DIR for a local directory, PUBLISH_S3_BUCKET and
+// PUBLISH_S3_REGION for S3 with PUBLISH_S3_ENDPOINT for other S3 compatible
+// services, or PUBLISH_GCS_BUCKET for Google Cloud Storage.
+var datasetStore publish.Store
+
+// Prepended to file names to give their URLs in the manifest. Defaults to
+// the files endpoint of this app, set PUBLISH_BASE_URL to point consumers
+// at the store directly.
+var publishBaseURL = "/api/Datasets/"
+
+// Publishes the chargepoints when called and then every
+// schedules.publish, if this replica leads the scheduler.
+func publishDatasets() {
+	for {
+		if scheduler.IsLeader() {
+			publishDataset()
+		}
+		time.Sleep(conf().Schedules.Publish)
+	}
+}
+
+func publishDataset() {
+	manifest, err := publish.Publish(orc.Collection(model.ChargePoints),
+		datasetStore, &publish.Options{BaseURL: publishBaseURL})
+	if err != nil {
+		log.Printf("Unable to publish dataset: %s", err)
+	} else {
+		log.Printf("Published dataset version %s with %d chargepoints.",
+			manifest.Version, manifest.Count)
+	}
+}
+
+// The versions and file names of published datasets, as written by
+// publish.Publish().
+var (
+	datasetVersion = regexp.MustCompile(`^[0-9TZ]+$`)
+	datasetName    = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+)
+
+// Returns the manifest of the latest published dataset.
+func datasetManifest(ctx *Context) {
+	if datasetStore == nil {
+		ctx.Abort(404, "Datasets are not published.")
+		return
+	}
+	manifest, err := publish.Latest(datasetStore)
+	if err == publish.ErrNotFound {
+		ctx.Abort(404, "No dataset has been published yet.")
+		return
+	}
+	writeJSON(ctx, manifest, err)
+}
+
+// Returns a file of a published dataset.
+func datasetFile(ctx *Context) {
+	version := ctx.Request.PathValue("version")
+	name := ctx.Request.PathValue("name")
+	if !datasetVersion.MatchString(version) || !datasetName.MatchString(name) {
+		ctx.Abort(404, "Not found.")
+		return
+	} else if datasetStore == nil {
+		ctx.Abort(404, "Datasets are not published.")
+		return
+	}
+	data, err := datasetStore.Get(version + "/" + name)
+	if err == publish.ErrNotFound {
+		ctx.Abort(404, "Not found.")
+		return
+	} else if err != nil {
+		log.Println(err)
+		ctx.Abort(502, "Unable to read dataset.")
+		return
+	}
+
+	allowOrigin(ctx)
+	if strings.HasSuffix(name, ".gz") {
+		ctx.ContentType("application/gzip")
+		ctx.SetHeader("Content-Disposition", "attachment; filename="+name,
+			true)
+	} else {
+		ctx.ContentType("json")
+	}
+	ctx.Write(data)
+}
+
+// Registers the dataset endpoints. These must be registered before the
+// search endpoint.
+func datasetRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/Datasets/" + publish.ManifestName,
+		timeout: lookupTimeout, handler: datasetManifest,
+		summary:  "Returns the manifest of the latest published dataset.",
+		response: publish.Manifest{},
+	}, route{
+		method: "GET", pattern: "/api/Datasets/{version}/{name}",
+		timeout: downloadTimeout, handler: datasetFile,
+		summary:      "Returns a file of a published dataset.",
+		responseType: "application/gzip",
+	})
+}
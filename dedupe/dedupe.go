@@ -0,0 +1,264 @@
+// Package dedupe finds chargepoint records that are likely to describe the
+// same device and merges them.
+package dedupe
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/model"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The event type recorded on the kept chargepoint when a duplicate is
+// merged into it.
+const MergeEventType = "merge"
+
+// Options for Find.
+type Options struct {
+	// The furthest apart two chargepoints can be and still be duplicates.
+	// Defaults to 25 meters.
+	MaxDistance float64
+
+	// The lowest name similarity, between 0 and 1, for two chargepoints to
+	// be duplicates. Defaults to 0.5.
+	MinSimilarity float64
+}
+
+// A proposed merge of Duplicate into Keep.
+type Candidate struct {
+	Keep      string `json:"keep"`
+	Duplicate string `json:"duplicate"`
+
+	// How far apart the two are in meters and how similar their names are.
+	Distance   float64 `json:"distance"`
+	Similarity float64 `json:"similarity"`
+}
+
+// The fields of a chargepoint used to find duplicates.
+type chargepoint struct {
+	key    string
+	fields int
+
+	ChargeDeviceName     string
+	ChargeDeviceLocation struct {
+		Latitude  *float64
+		Longitude *float64
+	}
+}
+
+// Returns proposed merges for the likely duplicates in a collection: pairs
+// of chargepoints within MaxDistance of each other whose names are at least
+// MinSimilarity alike. The record with the most fields is kept, or the
+// lowest key if they have the same number. A record is only ever proposed
+// as the duplicate in one merge. If opts is nil the defaults are used.
+func Find(collection *gorc2.Collection, opts *Options) ([]Candidate, error) {
+	maxDistance := 25.0
+	minSimilarity := 0.5
+	if opts != nil {
+		if opts.MaxDistance > 0 {
+			maxDistance = opts.MaxDistance
+		}
+		if opts.MinSimilarity > 0 {
+			minSimilarity = opts.MinSimilarity
+		}
+	}
+
+	// Bucket the chargepoints into a grid with cells larger than the
+	// distance, so only neighbouring cells need to be compared.
+	cellSize := maxDistance / 1000 / gorc2.EarthRadius * 180 / math.Pi
+	type cell struct{ lat, lon int }
+	grid := make(map[cell][]*chargepoint)
+
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		cp := &chargepoint{key: raw.Key}
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw.Value, cp) != nil ||
+			json.Unmarshal(raw.Value, &fields) != nil {
+			continue
+		}
+		loc := cp.ChargeDeviceLocation
+		if loc.Latitude == nil || loc.Longitude == nil {
+			continue
+		}
+		cp.fields = len(fields)
+		// Longitude cells are widened so they are never narrower than the
+		// distance, even far from the equator.
+		lonSize := cellSize / math.Max(math.Cos(*loc.Latitude*math.Pi/180),
+			0.01)
+		c := cell{
+			int(math.Floor(*loc.Latitude / cellSize)),
+			int(math.Floor(*loc.Longitude / lonSize)),
+		}
+		grid[c] = append(grid[c], cp)
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+
+	var candidates []Candidate
+	for c, cps := range grid {
+		for dLat := -1; dLat <= 1; dLat++ {
+			for dLon := -1; dLon <= 1; dLon++ {
+				others := grid[cell{c.lat + dLat, c.lon + dLon}]
+				for _, a := range cps {
+					for _, b := range others {
+						// Each pair is seen twice, only handle it once.
+						if a.key >= b.key {
+							continue
+						}
+						distance := 1000 * gorc2.Distance(
+							*a.ChargeDeviceLocation.Latitude,
+							*a.ChargeDeviceLocation.Longitude,
+							*b.ChargeDeviceLocation.Latitude,
+							*b.ChargeDeviceLocation.Longitude)
+						if distance > maxDistance {
+							continue
+						}
+						similarity := nameSimilarity(a.ChargeDeviceName,
+							b.ChargeDeviceName)
+						if similarity < minSimilarity {
+							continue
+						}
+						keep, dup := a, b
+						if b.fields > a.fields {
+							keep, dup = b, a
+						}
+						candidates = append(candidates, Candidate{
+							Keep:       keep.key,
+							Duplicate:  dup.key,
+							Distance:   math.Round(distance*10) / 10,
+							Similarity: math.Round(similarity*100) / 100,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	// Prefer the closest matches, and drop proposals that would merge a
+	// record that is already being merged away.
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Similarity != b.Similarity {
+			return a.Similarity > b.Similarity
+		} else if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		return a.Duplicate < b.Duplicate
+	})
+	merged := make(map[string]bool)
+	proposals := []Candidate{}
+	for _, c := range candidates {
+		if merged[c.Duplicate] || merged[c.Keep] {
+			continue
+		}
+		merged[c.Duplicate] = true
+		proposals = append(proposals, c)
+	}
+	return proposals, nil
+}
+
+// Merges the Duplicate of a candidate into Keep, both of which must be in
+// the ChargePoints collection. Fields only the duplicate has are copied to
+// the kept record and Connector entries are combined. The duplicate's
+// operator, network and tariff relations are moved to the kept record, a
+// merge event holding the duplicate's value is added to the kept record,
+// and the duplicate is deleted.
+func Merge(client *gorc2.Client, c Candidate) error {
+	collection := client.Collection(model.ChargePoints)
+	var keepValue, dupValue map[string]interface{}
+	item, err := collection.Get(c.Keep, &keepValue)
+	if err != nil {
+		return err
+	}
+	dup, err := collection.Get(c.Duplicate, &dupValue)
+	if err != nil {
+		return err
+	} else if keepValue == nil || dupValue == nil {
+		return fmt.Errorf("Chargepoints must be JSON objects to be merged.")
+	}
+
+	for name, value := range dupValue {
+		if _, ok := keepValue[name]; !ok {
+			keepValue[name] = value
+		}
+	}
+	if connectors, ok := dupValue["Connector"].([]interface{}); ok {
+		keepValue["Connector"] = mergeConnectors(keepValue["Connector"],
+			connectors)
+	}
+	if _, err := item.Update(keepValue); err != nil {
+		return err
+	}
+
+	if err := model.NewStore(client).MoveLinks(c.Duplicate, c.Keep); err != nil {
+		return err
+	}
+	_, err = collection.AddEvent(c.Keep, MergeEventType, map[string]interface{}{
+		"duplicate": c.Duplicate,
+		"ref":       dup.Ref,
+		"value":     dup.Value,
+		"merged":    time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return collection.Delete(c.Duplicate)
+}
+
+// Returns the Connector entries of both records without repeats.
+func mergeConnectors(keep interface{}, dupList []interface{}) []interface{} {
+	keepList, _ := keep.([]interface{})
+	seen := make(map[string]bool)
+	var merged []interface{}
+	for _, c := range append(keepList, dupList...) {
+		data, _ := json.Marshal(c)
+		if !seen[string(data)] {
+			seen[string(data)] = true
+			merged = append(merged, c)
+		}
+	}
+	return merged
+}
+
+// Returns how alike two names are, as the share of their words they have in
+// common. A name that is wholly contained in the other scores 1.
+func nameSimilarity(a, b string) float64 {
+	wordsA, wordsB := words(a), words(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+	joinedA, joinedB := strings.Join(wordsA, " "), strings.Join(wordsB, " ")
+	if strings.Contains(joinedA, joinedB) || strings.Contains(joinedB, joinedA) {
+		return 1
+	}
+
+	set := make(map[string]bool, len(wordsA))
+	for _, w := range wordsA {
+		set[w] = true
+	}
+	shared, union := 0, len(set)
+	for _, w := range wordsB {
+		if set[w] {
+			shared++
+			delete(set, w)
+		} else {
+			union++
+		}
+	}
+	return float64(shared) / float64(union)
+}
+
+// Returns the lower cased words of a name.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,147 @@
+// Package devdata holds a small sample of UK chargepoints for local
+// development, demos and tests, so a fresh checkout running against the
+// in-memory backend has something to search.
+package devdata
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/model"
+	_ "embed"
+	"encoding/json"
+)
+
+// The sample records, in the same shape as the National Chargepoint
+// Registry data stored in Orchestrate.
+//
+//go:embed chargepoints.json
+var chargepointsJSON []byte
+
+// Returns the sample chargepoints as raw JSON values.
+func Chargepoints() ([]json.RawMessage, error) {
+	var records []json.RawMessage
+	if err := json.Unmarshal(chargepointsJSON, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Writes the sample chargepoints into the collection keyed by their
+// ChargeDeviceId, overwriting any existing values, and returns how many were
+// written. Connector types are normalized with the default mapping table.
+func LoadSeed(collection *gorc2.Collection) (int, error) {
+	records, err := Chargepoints()
+	if err != nil {
+		return 0, err
+	}
+
+	normalizer := model.NewConnectorNormalizer(model.DefaultConnectorMappings)
+	bulk := make([]gorc2.BulkRecord, len(records))
+	for i, raw := range records {
+		if raw, _, err = normalizer.Normalize(raw); err != nil {
+			return 0, err
+		}
+		var id struct{ ChargeDeviceId string }
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return 0, err
+		}
+		bulk[i] = gorc2.BulkRecord{Key: id.ChargeDeviceId, Value: raw}
+	}
+	return collection.BulkUpdate(bulk, nil)
+}
+
+// Writes an operator for each DeviceOwner in the sample chargepoints and
+// links it to the chargepoints it owns, returning the number of operators.
+// The chargepoints should be loaded with LoadSeed first.
+func LoadOperators(store *model.Store) (int, error) {
+	records, err := Chargepoints()
+	if err != nil {
+		return 0, err
+	}
+
+	operators := make(map[string]bool)
+	for _, raw := range records {
+		var cp struct {
+			ChargeDeviceId string
+			DeviceOwner    struct{ OrganisationName string }
+		}
+		if err := json.Unmarshal(raw, &cp); err != nil {
+			return 0, err
+		}
+		operator := &model.Operator{Name: cp.DeviceOwner.OrganisationName}
+		if operator.Name == "" {
+			continue
+		}
+		if !operators[operator.Name] {
+			if err := store.PutOperator(operator); err != nil {
+				return 0, err
+			}
+			operators[operator.Name] = true
+		}
+		err := store.LinkOperator(model.Slug(operator.Name), cp.ChargeDeviceId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(operators), nil
+}
+
+// The sample tariffs written by LoadTariffs.
+var (
+	freeTariff = &model.Tariff{
+		Name:        "Free",
+		Description: "No charge for charging, parking charges may apply.",
+	}
+	standardTariff = &model.Tariff{
+		Name:        "Standard",
+		Description: "Pay as you go on AC chargers up to 22kW.",
+		PricePerkWh: 0.35,
+	}
+	rapidTariff = &model.Tariff{
+		Name:          "Rapid",
+		Description:   "Pay as you go on rapid chargers over 22kW.",
+		PricePerkWh:   0.65,
+		ConnectionFee: 1,
+	}
+)
+
+// Writes sample tariffs and links each of the sample chargepoints to one of
+// them based on whether payment is required and the power of its fastest
+// connector, returning the number of chargepoints linked. The chargepoints
+// should be loaded with LoadSeed first.
+func LoadTariffs(store *model.Store) (int, error) {
+	records, err := Chargepoints()
+	if err != nil {
+		return 0, err
+	}
+	for _, tariff := range []*model.Tariff{
+		freeTariff, standardTariff, rapidTariff,
+	} {
+		if err := store.PutTariff(tariff); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, raw := range records {
+		var cp struct {
+			ChargeDeviceId      string
+			PaymentRequiredFlag bool
+			Connector           []struct{ RatedOutputkW float64 }
+		}
+		if err := json.Unmarshal(raw, &cp); err != nil {
+			return 0, err
+		}
+		tariff := freeTariff
+		if cp.PaymentRequiredFlag {
+			tariff = standardTariff
+			for _, c := range cp.Connector {
+				if c.RatedOutputkW > 22 {
+					tariff = rapidTariff
+				}
+			}
+		}
+		if err := store.LinkTariff(tariff.ID, cp.ChargeDeviceId); err != nil {
+			return 0, err
+		}
+	}
+	return len(records), nil
+}
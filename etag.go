@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Returns a strong ETag for a response listing the given results. It is a
+// hash of the collection, key and ref of each result, which change whenever
+// a result is written, along with the query string and the format asked
+// for, the transforms in effect, the language asked for and the version of
+// the response format, since those decide how the results are shown.
+func resultsETag(ctx *Context, results []Result) string {
+	version, _ := requestVersion(ctx.Request)
+	h := sha256.New()
+	h.Write([]byte(ctx.Request.URL.RawQuery))
+	fmt.Fprint(h, conf().Transforms, requestLanguage(ctx), version)
+	if wantsJSONAPI(ctx) {
+		h.Write([]byte("\x00jsonapi"))
+	}
+	for _, r := range results {
+		h.Write([]byte("\x00" + r.Collection + "/" + r.Key + "/" + r.Ref))
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// Sets the ETag header of the response. Returns true, after writing a 304,
+// if the client sent the ETag in If-None-Match, in which case nothing else
+// should be written.
+func notModified(ctx *Context, etag string) bool {
+	ctx.SetHeader("ETag", etag, true)
+	match := ctx.Request.Header.Get("If-None-Match")
+	if match == "" {
+		return false
+	}
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			ctx.NotModified()
+			return true
+		}
+	}
+	return false
+}
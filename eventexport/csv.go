@@ -0,0 +1,37 @@
+package eventexport
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+type csvFormat struct{}
+
+func (csvFormat) Extension() string {
+	return "csv"
+}
+
+func (csvFormat) ContentType() string {
+	return "text/csv"
+}
+
+func (csvFormat) NewWriter(w io.Writer, columns []string) (Writer, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return nil, err
+	}
+	return &csvWriter{cw}, nil
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(row []string) error {
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,241 @@
+// Package eventexport writes the events of a collection to files for
+// analytics pipelines. Events are read key by key and type by type, and
+// written to a file per type and day, named in the Hive style pipelines
+// discover partitions by:
+//
+//	status/day=2024-03-31/ChargePoints.csv
+//
+// Each file has a column per field of the events, with nested objects
+// flattened into dotted column names as package publish does. Files are
+// written as CSV unless another Format, such as Parquet, is given.
+package eventexport
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/publish"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// The layout of the days events are partitioned by, in UTC.
+const DayLayout = "2006-01-02"
+
+// The layout of the timestamps of events, in UTC. Events are timestamped to
+// the millisecond, and the timestamps sort in the order of the times.
+const TimeLayout = "2006-01-02T15:04:05.000Z"
+
+// The columns every file starts with. The fields of the values of events
+// follow, prefixed with "value.".
+var baseColumns = []string{"key", "type", "timestamp", "ordinal", "ref"}
+
+// Writes the rows of one file.
+type Writer interface {
+	// Writes a row, which has a value for every column.
+	Write(row []string) error
+
+	// Finishes the file.
+	Close() error
+}
+
+// A file format events are written in.
+type Format interface {
+	// The extension of file names, such as "csv", and the content type of
+	// the files.
+	Extension() string
+	ContentType() string
+
+	// Returns a Writer of a file with the given columns. Values are given
+	// as text, with numbers as written in the JSON of the events and other
+	// JSON values that are not objects, such as arrays, as JSON.
+	NewWriter(w io.Writer, columns []string) (Writer, error)
+}
+
+// Writes files as CSV with a header row.
+var CSV Format = csvFormat{}
+
+// Options for Export.
+type Options struct {
+	// The event types to export. Required, since events are listed by
+	// type.
+	Types []string
+
+	// The keys whose events are exported, or every key in the collection
+	// if empty.
+	Keys []string
+
+	// Only events at or after Since and before Until are exported, unless
+	// they are zero.
+	Since, Until time.Time
+
+	// Defaults to CSV.
+	Format Format
+
+	// Prepended to the name of each file, such as "events/".
+	Prefix string
+}
+
+// What Export wrote.
+type Result struct {
+	Events int      `json:"events"`
+	Files  []string `json:"files"`
+}
+
+// An exported event, flattened into columns.
+type row map[string]string
+
+// The events of one file.
+type partition struct {
+	typ, day string
+	rows     []row
+	columns  map[string]bool
+}
+
+// Exports the events of a collection to the store, replacing files that
+// were written before. The rows of each file are kept in memory until the
+// events have all been read, so exports of long periods should be made a
+// period at a time.
+func Export(
+	collection *gorc2.Collection, store publish.Store, opts *Options,
+) (*Result, error) {
+	if opts == nil || len(opts.Types) == 0 {
+		return nil, fmt.Errorf("No event types to export.")
+	}
+	format := opts.Format
+	if format == nil {
+		format = CSV
+	}
+
+	keys := opts.Keys
+	if len(keys) == 0 {
+		it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+		for it.Next() {
+			keys = append(keys, it.Raw().Key)
+		}
+		if it.Error != nil {
+			return nil, it.Error
+		}
+	}
+
+	result := &Result{Files: []string{}}
+	partitions := make(map[[2]string]*partition)
+	for _, key := range keys {
+		for _, typ := range opts.Types {
+			query := &gorc2.ListEventsQuery{Limit: 100}
+			if !opts.Since.IsZero() {
+				query.Start = opts.Since
+			}
+			if !opts.Until.IsZero() {
+				query.Before = opts.Until
+			}
+			it := collection.ListEvents(key, typ, query)
+			for it.Next() {
+				event, err := it.GetEvent(nil)
+				if err != nil {
+					return nil, err
+				}
+				r, err := flatten(key, typ, event)
+				if err != nil {
+					return nil, fmt.Errorf("Event %s of %s: %s", event.Ref,
+						key, err)
+				}
+				day := event.Timestamp.UTC().Format(DayLayout)
+				p := partitions[[2]string{typ, day}]
+				if p == nil {
+					p = &partition{typ: typ, day: day,
+						columns: make(map[string]bool)}
+					partitions[[2]string{typ, day}] = p
+				}
+				p.rows = append(p.rows, r)
+				for column := range r {
+					p.columns[column] = true
+				}
+				result.Events++
+			}
+			if it.Error != nil {
+				return nil, it.Error
+			}
+		}
+	}
+
+	for _, p := range partitions {
+		name := fmt.Sprintf("%s%s/day=%s/%s.%s", opts.Prefix, p.typ, p.day,
+			collection.Name, format.Extension())
+		data, err := p.encode(format)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Put(name, data, format.ContentType()); err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, name)
+	}
+	sort.Strings(result.Files)
+	return result, nil
+}
+
+// Returns the columns of an event.
+func flatten(key, typ string, e *gorc2.Event) (row, error) {
+	r := row{
+		"key":       key,
+		"type":      typ,
+		"timestamp": e.Timestamp.UTC().Format(TimeLayout),
+		"ordinal":   e.OrdinalStr,
+		"ref":       e.Ref,
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(e.Value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	publish.Flatten("value", value, r)
+	return r, nil
+}
+
+// Returns the file of a partition, its rows ordered by time.
+func (p *partition) encode(format Format) ([]byte, error) {
+	columns := append([]string{}, baseColumns...)
+	var fields []string
+	for column := range p.columns {
+		if !isBase(column) {
+			fields = append(fields, column)
+		}
+	}
+	sort.Strings(fields)
+	columns = append(columns, fields...)
+
+	sort.SliceStable(p.rows, func(i, j int) bool {
+		return p.rows[i]["timestamp"] < p.rows[j]["timestamp"]
+	})
+	buf := new(bytes.Buffer)
+	w, err := format.NewWriter(buf, columns)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(columns))
+	for _, r := range p.rows {
+		for i, column := range columns {
+			values[i] = r[column]
+		}
+		if err := w.Write(values); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func isBase(column string) bool {
+	for _, c := range baseColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
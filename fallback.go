@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"chargepoints/lastgood"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The last successful responses of the endpoints in the fallback config,
+// served while Orchestrate's circuit breaker is open.
+var lastGood = &lastgood.Cache{}
+
+// The file lastGood is saved to every schedules.fallback and on shutdown,
+// and read from on start, set with FALLBACK_FILE. It is not saved if empty.
+var lastGoodFile string
+
+// Returns the key a response to a request is kept under. Responses differ
+// by endpoint, path, query parameters other than the API key, whether a
+// JSON:API document was asked for and the language asked for.
+func lastGoodKey(endpoint string, ctx *Context) string {
+	req := ctx.Request
+	query := req.URL.Query()
+	query.Del("api_key")
+	key := endpoint + " " + req.URL.Path + "?" + query.Encode()
+	if strings.Contains(req.Header.Get("Accept"), jsonAPIMediaType) {
+		key += " " + jsonAPIMediaType
+	}
+	if lang := requestLanguage(ctx); lang != "" {
+		key += " " + lang
+	}
+	return key
+}
+
+// Wraps the handler of an endpoint so that its successful responses are
+// kept, and while the circuit breaker is failing requests and the endpoint
+// is in the fallback config the last one kept for the same request is
+// served, with an Age and a Warning header, instead of a 502. Requests are handled as
+// usual if nothing is kept for them.
+func fallsBack(endpoint string, h handlerFunc) handlerFunc {
+	return func(ctx *Context) {
+		fallback := conf().Fallback
+		enabled := false
+		for _, e := range fallback.Endpoints {
+			enabled = enabled || e == endpoint
+		}
+		if !enabled {
+			h(ctx)
+			return
+		}
+
+		key := lastGoodKey(endpoint, ctx)
+		if !orc.Breaker.Allows() {
+			if r, ok := lastGood.Get(key, fallback.MaxAge); ok {
+				serveLastGood(ctx, r)
+				return
+			}
+		}
+
+		rec := &responseRecorder{
+			statusWriter: statusWriter{ResponseWriter: ctx.ResponseWriter},
+		}
+		ctx.ResponseWriter = rec
+		h(ctx)
+		if rec.status == 200 && !rec.tooLarge {
+			header := http.Header{}
+			for _, name := range []string{"Content-Type", "Content-Language"} {
+				if values := rec.Header().Values(name); len(values) > 0 {
+					header[name] = values
+				}
+			}
+			lastGood.Put(&lastgood.Response{
+				Key:    key,
+				Stored: time.Now().UTC(),
+				Header: header,
+				Body:   bytes.Clone(rec.body.Bytes()),
+			})
+		}
+	}
+}
+
+// Writes a kept response, marked as stale so that clients can tell and
+// caches do not keep it.
+func serveLastGood(ctx *Context, r *lastgood.Response) {
+	for name, values := range r.Header {
+		ctx.Header()[name] = values
+	}
+	allowOrigin(ctx)
+	ctx.SetHeader("Age",
+		strconv.Itoa(int(time.Since(r.Stored).Seconds())), true)
+	ctx.SetHeader("Warning", `110 - "Response is Stale"`, true)
+	ctx.SetHeader("Cache-Control", "no-store", true)
+	ctx.Write(r.Body)
+}
+
+// Saves lastGood to lastGoodFile every schedules.fallback.
+func saveLastGood() {
+	for {
+		time.Sleep(conf().Schedules.Fallback)
+		if err := lastGood.Save(lastGoodFile); err != nil {
+			log.Printf("Unable to save fallback responses: %s", err)
+		}
+	}
+}
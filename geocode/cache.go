@@ -0,0 +1,111 @@
+package geocode
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The collection Cache stores lookups in by default.
+const CacheCollection = "Geocodes"
+
+// Wraps a Geocoder to make at most perSecond lookups a second, waiting for
+// a turn, or until the context is done, when called more often.
+func RateLimit(g Geocoder, perSecond float64) Geocoder {
+	return &rateLimited{
+		geocoder: g,
+		interval: time.Duration(float64(time.Second) / perSecond),
+	}
+}
+
+type rateLimited struct {
+	geocoder Geocoder
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (r *rateLimited) Reverse(
+	ctx context.Context, lat, lon float64,
+) (*Place, error) {
+	r.mu.Lock()
+	at := time.Now()
+	if r.next.After(at) {
+		at = r.next
+	}
+	r.next = at.Add(r.interval)
+	r.mu.Unlock()
+
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return r.geocoder.Reverse(ctx, lat, lon)
+}
+
+// Wraps a Geocoder to keep the results of lookups in a collection, keyed by
+// the location rounded to 4 decimal places, about 10 meters. Locations
+// with no place are kept too, so they are not looked up again.
+type Cache struct {
+	Geocoder Geocoder
+	Client   *gorc2.Client
+
+	// Defaults to CacheCollection.
+	Collection string
+}
+
+// A lookup as stored in the cache.
+type cached struct {
+	Place   *Place    `json:"place"`
+	Updated time.Time `json:"updated"`
+}
+
+// Returns the key a location is cached under.
+func cacheKey(lat, lon float64) string {
+	return keys.Build(keys.Geocode, fmt.Sprintf("%.4f", lat),
+		fmt.Sprintf("%.4f", lon))
+}
+
+func (c *Cache) Reverse(
+	ctx context.Context, lat, lon float64,
+) (*Place, error) {
+	name := c.Collection
+	if name == "" {
+		name = CacheCollection
+	}
+	collection := c.Client.Collection(name).WithContext(ctx)
+	key := cacheKey(lat, lon)
+
+	var hit cached
+	_, err := collection.Get(key, &hit)
+	if err == nil {
+		if hit.Place == nil {
+			return nil, ErrNoPlace
+		}
+		return hit.Place, nil
+	} else if _, ok := err.(gorc2.NotFoundError); !ok {
+		return nil, err
+	}
+
+	place, err := c.Geocoder.Reverse(ctx, lat, lon)
+	if err != nil && err != ErrNoPlace {
+		return nil, err
+	}
+	entry := &cached{Place: place, Updated: time.Now().UTC()}
+	if _, err := collection.Update(key, entry); err != nil {
+		return nil, err
+	}
+	if place == nil {
+		return nil, ErrNoPlace
+	}
+	return place, nil
+}
@@ -0,0 +1,177 @@
+package geocode
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// Options for Enrich.
+type Options struct {
+	// Report what would be filled in without writing anything.
+	DryRun bool
+
+	// Cancels the run. Defaults to context.Background().
+	Context context.Context
+}
+
+// What Enrich did.
+type Report struct {
+	// The number of chargepoints read, and of those missing address fields
+	// that have coordinates to look up.
+	Scanned int `json:"scanned"`
+	Missing int `json:"missing"`
+
+	// The keys of the chargepoints that had fields filled in.
+	Enriched []string `json:"enriched"`
+
+	// The keys of those whose coordinates have no known place.
+	NoPlace []string `json:"no_place"`
+
+	// The keys of those that could not be looked up or written, with the
+	// error.
+	Failed map[string]string `json:"failed"`
+}
+
+// The address fields of a chargepoint filled in and the Place field each
+// comes from.
+var addressFields = []struct {
+	name  string
+	value func(*Place) string
+}{
+	{"PostCode", func(p *Place) string { return p.PostCode }},
+	{"PostTown", func(p *Place) string { return p.PostTown }},
+	{"County", func(p *Place) string { return p.County }},
+}
+
+// The fields of a chargepoint read to find those to enrich.
+type chargepoint struct {
+	ChargeDeviceLocation struct {
+		Latitude  *float64
+		Longitude *float64
+		Address   map[string]interface{}
+	}
+}
+
+// Returns true if an address is missing any of the fields that are filled
+// in.
+func missingFields(address map[string]interface{}) bool {
+	for _, f := range addressFields {
+		if s, _ := address[f.name].(string); s == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Reverse geocodes the chargepoints in a collection that have coordinates
+// but are missing a postcode, post town or county, and fills in the
+// missing fields. Fields that are set are never changed. Each chargepoint is
+// written only if it has not changed since it was read, so concurrent
+// edits are not lost. A failure to look up or write one chargepoint is
+// recorded in the report rather than stopping the run. If opts is nil the
+// defaults are used.
+func Enrich(
+	collection *gorc2.Collection, g Geocoder, opts *Options,
+) (*Report, error) {
+	ctx := context.Background()
+	dryRun := false
+	if opts != nil {
+		if opts.Context != nil {
+			ctx = opts.Context
+		}
+		dryRun = opts.DryRun
+	}
+
+	report := &Report{
+		Enriched: []string{},
+		NoPlace:  []string{},
+		Failed:   map[string]string{},
+	}
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		raw := it.Raw()
+		report.Scanned++
+
+		var cp chargepoint
+		if json.Unmarshal(raw.Value, &cp) != nil {
+			continue
+		}
+		lat, lon := cp.ChargeDeviceLocation.Latitude,
+			cp.ChargeDeviceLocation.Longitude
+		if lat == nil || lon == nil || (*lat == 0 && *lon == 0) ||
+			!missingFields(cp.ChargeDeviceLocation.Address) {
+			continue
+		}
+		report.Missing++
+
+		place, err := g.Reverse(ctx, *lat, *lon)
+		if err == ErrNoPlace {
+			report.NoPlace = append(report.NoPlace, raw.Key)
+			continue
+		} else if err != nil {
+			report.Failed[raw.Key] = err.Error()
+			continue
+		}
+
+		value, changed, err := fill(raw.Value, place)
+		if err != nil {
+			report.Failed[raw.Key] = err.Error()
+			continue
+		} else if !changed {
+			continue
+		}
+		if !dryRun {
+			item := &gorc2.Item{Collection: collection, Key: raw.Key,
+				Ref: raw.Ref}
+			if _, err := item.Update(value); err != nil {
+				log.Printf("Unable to enrich %s: %s", raw.Key, err)
+				report.Failed[raw.Key] = err.Error()
+				continue
+			}
+		}
+		report.Enriched = append(report.Enriched, raw.Key)
+	}
+	return report, it.Error
+}
+
+// Returns a chargepoint with the empty address fields that a place knows
+// filled in, and whether any were.
+func fill(value json.RawMessage, place *Place) (json.RawMessage, bool, error) {
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, false, err
+	}
+	location, _ := object["ChargeDeviceLocation"].(map[string]interface{})
+	if location == nil {
+		return value, false, nil
+	}
+	address, _ := location["Address"].(map[string]interface{})
+	if address == nil {
+		address = map[string]interface{}{}
+	}
+
+	changed := false
+	for _, f := range addressFields {
+		if s, _ := address[f.name].(string); s != "" {
+			continue
+		}
+		if v := f.value(place); v != "" {
+			address[f.name] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return value, false, nil
+	}
+	location["Address"] = address
+	data, err := json.Marshal(object)
+	return data, true, err
+}
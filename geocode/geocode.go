@@ -0,0 +1,112 @@
+// Package geocode fills in the missing address fields of chargepoints by
+// reverse geocoding their coordinates. Geocoders are pluggable, with
+// postcodes.io provided, and can be wrapped to limit the rate of lookups
+// and to cache their results in a collection so that reruns are cheap.
+package geocode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned by geocoders when nothing is known about a location.
+var ErrNoPlace = fmt.Errorf("No place found at the location.")
+
+// The address of a location. Fields that are unknown are empty.
+type Place struct {
+	PostCode string `json:"postcode,omitempty"`
+	PostTown string `json:"post_town,omitempty"`
+	County   string `json:"county,omitempty"`
+}
+
+// Looks up the address of a location.
+type Geocoder interface {
+	Reverse(ctx context.Context, lat, lon float64) (*Place, error)
+}
+
+// The postcodes.io API used by PostcodesIO by default.
+const DefaultPostcodesURL = "https://api.postcodes.io"
+
+// Reverse geocodes with postcodes.io, giving the nearest postcode within
+// Radius of a location and the district and county it is in. Only
+// locations in the UK are known.
+type PostcodesIO struct {
+	// Defaults to DefaultPostcodesURL.
+	URL string
+
+	// Defaults to a client with a 10 second timeout.
+	Client *http.Client
+
+	// How far from a location in meters, up to 2000, the nearest postcode
+	// may be. Defaults to 100.
+	Radius int
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// The parts of a postcodes.io reverse geocoding response that are used.
+type reverseResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+	Result []struct {
+		Postcode      string `json:"postcode"`
+		AdminDistrict string `json:"admin_district"`
+		AdminCounty   string `json:"admin_county"`
+	} `json:"result"`
+}
+
+func (p *PostcodesIO) Reverse(
+	ctx context.Context, lat, lon float64,
+) (*Place, error) {
+	base, client, radius := DefaultPostcodesURL, defaultClient, 100
+	if p.URL != "" {
+		base = strings.TrimSuffix(p.URL, "/")
+	}
+	if p.Client != nil {
+		client = p.Client
+	}
+	if p.Radius > 0 {
+		radius = p.Radius
+	}
+
+	query := url.Values{
+		"lat":    {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon":    {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"radius": {strconv.Itoa(radius)},
+		"limit":  {"1"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		base+"/postcodes?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body reverseResponse
+	if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&body)
+		return nil, fmt.Errorf("Reverse geocoding failed with status %d: %s",
+			resp.StatusCode, body.Error)
+	} else if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if len(body.Result) == 0 {
+		return nil, ErrNoPlace
+	}
+	r := body.Result[0]
+	return &Place{
+		PostCode: r.Postcode,
+		PostTown: r.AdminDistrict,
+		County:   r.AdminCounty,
+	}, nil
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/graphql"
+	"chargepoints/model"
+	"chargepoints/openapi"
+	"chargepoints/router"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default and largest number of results in a page of a connection.
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// A chargepoint as resolved by the GraphQL schema.
+type gqlChargepoint struct {
+	key, ref string
+	value    json.RawMessage
+
+	// Set when results are ordered by distance.
+	distance *float64
+
+	// The value decoded, see doc().
+	decoded map[string]interface{}
+}
+
+// Returns the decoded value of the chargepoint.
+func (c *gqlChargepoint) doc() map[string]interface{} {
+	if c.decoded == nil {
+		json.Unmarshal(c.value, &c.decoded)
+		if c.decoded == nil {
+			c.decoded = map[string]interface{}{}
+		}
+	}
+	return c.decoded
+}
+
+// Returns the value at a dotted path of the chargepoint, or nil if there
+// is none.
+func (c *gqlChargepoint) path(path string) interface{} {
+	var value interface{} = c.doc()
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+// A page of chargepoints.
+type gqlConnection struct {
+	Nodes       []*gqlChargepoint
+	HasNextPage bool
+	EndCursor   string
+}
+
+// An event as resolved by the GraphQL schema.
+type gqlEvent struct {
+	Type      string
+	Timestamp time.Time
+	Ordinal   string
+	Value     json.RawMessage
+}
+
+// Returns a field whose value is computed from a source of type T.
+func resolver[T any](f func(source *T) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Resolve: func(p graphql.Params) (interface{}, error) {
+			return f(p.Source.(*T)), nil
+		},
+	}
+}
+
+// Returns a field holding the value at a dotted path of a chargepoint.
+func chargepointPath(path string) *graphql.Field {
+	return resolver(func(c *gqlChargepoint) interface{} {
+		return c.path(path)
+	})
+}
+
+// Returns a field holding the value of a key of a JSON object.
+func jsonField(name string) *graphql.Field {
+	return &graphql.Field{
+		Resolve: func(p graphql.Params) (interface{}, error) {
+			m, _ := p.Source.(map[string]interface{})
+			return m[name], nil
+		},
+	}
+}
+
+// Returns a field holding a part of the Address of a location.
+func addressField(name string) *graphql.Field {
+	return &graphql.Field{
+		Resolve: func(p graphql.Params) (interface{}, error) {
+			location, _ := p.Source.(map[string]interface{})
+			address, _ := location["Address"].(map[string]interface{})
+			return address[name], nil
+		},
+	}
+}
+
+// Cursors are opaque to clients, they hold the offset of the next result
+// signed like the cursors of page links, so that they can not be made up.
+func encodeCursor(offset int) string {
+	return cursors.Encode("graphql",
+		url.Values{"offset": {strconv.Itoa(offset)}})
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	path, params, err := cursors.Decode(cursor)
+	if err == nil && path == "graphql" {
+		if n, err := strconv.Atoi(params.Get("offset")); err == nil && n >= 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid cursor %q.", cursor)
+}
+
+// Returns the page size and offset given by the first and after arguments.
+func pageArgs(p graphql.Params) (first, offset int, err error) {
+	first, ok := p.Int("first")
+	if !ok || first < 1 || first > maxPageSize {
+		return 0, 0, fmt.Errorf("first must be between 1 and %d.",
+			maxPageSize)
+	}
+	offset, err = decodeCursor(p.String("after"))
+	return first, offset, err
+}
+
+// Reads a page of chargepoints from an Iterator, skipping the first skip
+// results. Results further than radius kilometers away end the page when
+// radius is above zero, which needs the Iterator to be ordered by distance.
+func readPage(
+	it *gorc2.Iterator, skip, first, offset int, radius float64,
+	byDistance bool,
+) (*gqlConnection, error) {
+	page := &gqlConnection{Nodes: []*gqlChargepoint{}}
+	for n := 0; it.Next(); n++ {
+		raw := it.Raw()
+		if radius > 0 && float64(raw.Distance) > radius {
+			break
+		} else if n < skip {
+			continue
+		} else if len(page.Nodes) == first {
+			page.HasNextPage = true
+			break
+		}
+		c := &gqlChargepoint{key: raw.Key, ref: raw.Ref, value: raw.Value}
+		if byDistance {
+			distance := float64(raw.Distance)
+			c.distance = &distance
+		}
+		page.Nodes = append(page.Nodes, c)
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	if len(page.Nodes) > 0 {
+		page.EndCursor = encodeCursor(offset + len(page.Nodes))
+	}
+	return page, nil
+}
+
+// Returns an ordered page of the chargepoints linked to a key.
+func linkedChargepoints(
+	p graphql.Params, it func(id string) *gorc2.Iterator, id string,
+) (interface{}, error) {
+	first, offset, err := pageArgs(p)
+	if err != nil {
+		return nil, err
+	}
+	return readPage(it(id), offset, first, offset, 0, false)
+}
+
+// Searches the chargepoints, see the chargepoints field of the query type.
+func searchChargepoints(p graphql.Params) (interface{}, error) {
+	first, offset, err := pageArgs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	q := gorc2.NewQuery()
+	if query := p.String("query"); query != "" {
+		q.Raw("(" + query + ")")
+	}
+	if connector := p.String("connector"); connector != "" {
+		q.Term("value.Connector."+model.ConnectorStandardField, connector)
+	}
+	if status := p.String("status"); status != "" {
+		q.Term("value."+statusField+".status", status)
+	}
+	if max, ok := p.Float("maxPricePerkWh"); ok {
+		q.AtMost("value."+model.MinPriceField, max)
+	}
+
+	lat, latOK := p.Float("lat")
+	lon, lonOK := p.Float("lon")
+	radius, radiusOK := p.Float("radius")
+	if latOK != lonOK {
+		return nil, fmt.Errorf("lat and lon must be given together.")
+	} else if radiusOK && !latOK {
+		return nil, fmt.Errorf("radius needs lat and lon.")
+	} else if radiusOK && (radius <= 0 || radius > maxNearRadius) {
+		return nil, fmt.Errorf("radius must be a number of kilometers up "+
+			"to %g.", maxNearRadius)
+	}
+	if radiusOK {
+		// Search the box around the circle as the nearby endpoints do.
+		dLat := radius / 111.32
+		dLon := radius / (111.32 * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+		q.Raw(fmt.Sprintf("value.%s:IN:{north:%g south:%g east:%g west:%g}",
+			locationField, lat+dLat, lat-dLat, lon+dLon, lon-dLon))
+	}
+
+	query := q.String()
+	if query == "" {
+		query = "*"
+	}
+	collection := orc.Collection(model.ChargePoints).WithContext(p.Context)
+	sort := p.String("sort")
+	if latOK && sort == "" {
+		// Ordering by distance reads every match, so the offset is skipped
+		// afterwards.
+		it := collection.Search(query, &gorc2.SearchQuery{Limit: 100}).
+			SortByDistanceFrom(locationField, lat, lon)
+		return readPage(it, offset, first, offset, radius, true)
+	}
+	it := collection.Search(query, &gorc2.SearchQuery{
+		Limit:  first + 1,
+		Offset: int64(offset),
+		Sort:   sort,
+	})
+	return readPage(it, 0, first, offset, 0, false)
+}
+
+// Returns the GraphQL query type.
+func graphqlSchema() *graphql.Object {
+	pageInfoType := &graphql.Object{Name: "PageInfo", Fields: graphql.Fields{
+		"hasNextPage": resolver(func(c *gqlConnection) interface{} {
+			return c.HasNextPage
+		}),
+		"endCursor": resolver(func(c *gqlConnection) interface{} {
+			if c.EndCursor == "" {
+				return nil
+			}
+			return c.EndCursor
+		}),
+	}}
+	chargepointType := &graphql.Object{Name: "Chargepoint"}
+	connectionType := &graphql.Object{
+		Name: "ChargepointConnection",
+		Fields: graphql.Fields{
+			"nodes": {
+				Type: chargepointType,
+				Resolve: func(p graphql.Params) (interface{}, error) {
+					return p.Source.(*gqlConnection).Nodes, nil
+				},
+			},
+			"pageInfo": {
+				Type: pageInfoType,
+				Resolve: func(p graphql.Params) (interface{}, error) {
+					return p.Source, nil
+				},
+			},
+		},
+	}
+	pagingArgs := map[string]interface{}{"first": defaultPageSize, "after": nil}
+
+	operatorType := &graphql.Object{Name: "Operator", Fields: graphql.Fields{
+		"id": resolver(func(o *model.Operator) interface{} {
+			return o.ID
+		}),
+		"name": resolver(func(o *model.Operator) interface{} {
+			return o.Name
+		}),
+		"website": resolver(func(o *model.Operator) interface{} {
+			return o.Website
+		}),
+		"phone": resolver(func(o *model.Operator) interface{} {
+			return o.Phone
+		}),
+		"chargepoints": {
+			Type: connectionType,
+			Args: pagingArgs,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return linkedChargepoints(p, store.OperatorChargepoints,
+					p.Source.(*model.Operator).ID)
+			},
+		},
+	}}
+	networkType := &graphql.Object{Name: "Network", Fields: graphql.Fields{
+		"id": resolver(func(n *model.Network) interface{} { return n.ID }),
+		"name": resolver(func(n *model.Network) interface{} {
+			return n.Name
+		}),
+		"website": resolver(func(n *model.Network) interface{} {
+			return n.Website
+		}),
+		"chargepoints": {
+			Type: connectionType,
+			Args: pagingArgs,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return linkedChargepoints(p, store.NetworkChargepoints,
+					p.Source.(*model.Network).ID)
+			},
+		},
+	}}
+	tariffType := &graphql.Object{Name: "Tariff", Fields: graphql.Fields{
+		"id": resolver(func(t *model.Tariff) interface{} {
+			return t.ID
+		}),
+		"name": resolver(func(t *model.Tariff) interface{} {
+			return t.Name
+		}),
+		"description": resolver(func(t *model.Tariff) interface{} {
+			return t.Description
+		}),
+		"currency": resolver(func(t *model.Tariff) interface{} {
+			return t.Currency
+		}),
+		"pricePerkWh": resolver(func(t *model.Tariff) interface{} {
+			return t.PricePerkWh
+		}),
+		"pricePerMinute": resolver(func(t *model.Tariff) interface{} {
+			return t.PricePerMinute
+		}),
+		"connectionFee": resolver(func(t *model.Tariff) interface{} {
+			return t.ConnectionFee
+		}),
+		"chargepoints": {
+			Type: connectionType,
+			Args: pagingArgs,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return linkedChargepoints(p, store.TariffChargepoints,
+					p.Source.(*model.Tariff).ID)
+			},
+		},
+	}}
+	eventType := &graphql.Object{Name: "Event", Fields: graphql.Fields{
+		"type": resolver(func(e *gqlEvent) interface{} { return e.Type }),
+		"timestamp": resolver(func(e *gqlEvent) interface{} {
+			return e.Timestamp
+		}),
+		"ordinal": resolver(func(e *gqlEvent) interface{} {
+			return e.Ordinal
+		}),
+		"value": resolver(func(e *gqlEvent) interface{} { return e.Value }),
+	}}
+	statusType := &graphql.Object{Name: "Status", Fields: graphql.Fields{
+		"status":  resolver(func(s *Status) interface{} { return s.Status }),
+		"updated": resolver(func(s *Status) interface{} { return s.Updated }),
+		"stale":   resolver(func(s *Status) interface{} { return s.Stale }),
+	}}
+	locationType := &graphql.Object{Name: "Location", Fields: graphql.Fields{
+		"latitude":  jsonField("Latitude"),
+		"longitude": jsonField("Longitude"),
+		"postTown":  addressField("PostTown"),
+		"postCode":  addressField("PostCode"),
+	}}
+	connectorType := &graphql.Object{Name: "Connector", Fields: graphql.Fields{
+		"id":            jsonField("ConnectorId"),
+		"type":          jsonField("ConnectorType"),
+		"standard":      jsonField(model.ConnectorStandardField),
+		"ratedOutputkW": jsonField("RatedOutputkW"),
+		"chargeMethod":  jsonField("ChargeMethod"),
+	}}
+
+	chargepointType.Fields = graphql.Fields{
+		"key": resolver(func(c *gqlChargepoint) interface{} {
+			return c.key
+		}),
+		"ref": resolver(func(c *gqlChargepoint) interface{} {
+			return c.ref
+		}),
+		"value": resolver(func(c *gqlChargepoint) interface{} {
+			return c.value
+		}),
+		"name":           chargepointPath("ChargeDeviceName"),
+		"minPricePerkWh": chargepointPath(model.MinPriceField),
+		"distance": resolver(func(c *gqlChargepoint) interface{} {
+			return c.distance
+		}),
+		"field": {
+			Args: map[string]interface{}{"path": nil},
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				if p.String("path") == "" {
+					return nil, fmt.Errorf("path is required.")
+				}
+				return p.Source.(*gqlChargepoint).path(p.String("path")), nil
+			},
+		},
+		"location": {
+			Type: locationType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				c := p.Source.(*gqlChargepoint)
+				m, ok := c.path(locationField).(map[string]interface{})
+				if !ok {
+					return nil, nil
+				}
+				return m, nil
+			},
+		},
+		"connectors": {
+			Type: connectorType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				c := p.Source.(*gqlChargepoint)
+				connectors, _ := c.path("Connector").([]interface{})
+				return connectors, nil
+			},
+		},
+		"status": {
+			Type: statusType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				var current Status
+				raw, _ := json.Marshal(p.Source.(*gqlChargepoint).path(statusField))
+				json.Unmarshal(raw, &current)
+				current = current.at(time.Now())
+				return &current, nil
+			},
+		},
+		"operator": {
+			Type: operatorType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return linked[model.Operator](p, model.OperatedByRelation)
+			},
+		},
+		"network": {
+			Type: networkType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return linked[model.Network](p, model.MemberOfRelation)
+			},
+		},
+		"tariffs": {
+			Type: tariffType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return store.ChargepointTariffs(p.Source.(*gqlChargepoint).key)
+			},
+		},
+		"events": {
+			Type: eventType,
+			Args: map[string]interface{}{"type": nil, "first": 10},
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				first, ok := p.Int("first")
+				if p.String("type") == "" {
+					return nil, fmt.Errorf("type is required.")
+				} else if !ok || first < 1 || first > maxPageSize {
+					return nil, fmt.Errorf("first must be between 1 and %d.",
+						maxPageSize)
+				}
+				it := orc.Collection(model.ChargePoints).WithContext(p.Context).
+					ListEvents(p.Source.(*gqlChargepoint).key, p.String("type"),
+						&gorc2.ListEventsQuery{Limit: first})
+				events := []*gqlEvent{}
+				for len(events) < first && it.Next() {
+					raw := it.Raw()
+					events = append(events, &gqlEvent{
+						Type:      raw.Type,
+						Timestamp: time.Unix(0, raw.Timestamp*int64(time.Millisecond)).UTC(),
+						Ordinal:   strconv.FormatInt(raw.Ordinal, 10),
+						Value:     raw.Value,
+					})
+				}
+				return events, it.Error
+			},
+		},
+	}
+
+	return &graphql.Object{Name: "Query", Fields: graphql.Fields{
+		"chargepoint": {
+			Type: chargepointType,
+			Args: map[string]interface{}{"key": nil},
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				var value json.RawMessage
+				item, err := orc.Collection(model.ChargePoints).
+					WithContext(p.Context).Get(p.String("key"), &value)
+				if _, ok := err.(gorc2.NotFoundError); ok {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+				return &gqlChargepoint{key: item.Key, ref: item.Ref,
+					value: value}, nil
+			},
+		},
+		"chargepoints": {
+			Type: connectionType,
+			Args: map[string]interface{}{
+				"query":          nil,
+				"connector":      nil,
+				"status":         nil,
+				"maxPricePerkWh": nil,
+				"lat":            nil,
+				"lon":            nil,
+				"radius":         nil,
+				"sort":           nil,
+				"first":          defaultPageSize,
+				"after":          nil,
+			},
+			Resolve: searchChargepoints,
+		},
+		"operator": {
+			Type: operatorType,
+			Args: map[string]interface{}{"id": nil},
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return orNull(store.Operator(p.String("id")))
+			},
+		},
+		"operators": {
+			Type: operatorType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return store.Operators()
+			},
+		},
+		"network": {
+			Type: networkType,
+			Args: map[string]interface{}{"id": nil},
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return orNull(store.Network(p.String("id")))
+			},
+		},
+		"networks": {
+			Type: networkType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return store.Networks()
+			},
+		},
+		"tariff": {
+			Type: tariffType,
+			Args: map[string]interface{}{"id": nil},
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return orNull(store.Tariff(p.String("id")))
+			},
+		},
+		"tariffs": {
+			Type: tariffType,
+			Resolve: func(p graphql.Params) (interface{}, error) {
+				return store.Tariffs()
+			},
+		},
+	}}
+}
+
+// Returns the first record of type T linked to a chargepoint by the given
+// relation, or nil if there is none.
+func linked[T any](p graphql.Params, kind string) (interface{}, error) {
+	it := orc.Collection(model.ChargePoints).WithContext(p.Context).
+		GetLinks(p.Source.(*gqlChargepoint).key, &gorc2.GetLinksQuery{Limit: 1},
+			kind)
+	if !it.Next() {
+		return nil, it.Error
+	}
+	value := new(T)
+	if _, err := it.Get(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Turns a NotFoundError into a null value, as GraphQL reports missing
+// records.
+func orNull[T any](value *T, err error) (interface{}, error) {
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+var graphqlQuery = graphqlSchema()
+
+// Handles GraphQL requests, either a POST with a JSON body of query,
+// variables and operationName, a POST of a bare query with the
+// application/graphql content type, or a GET with them as parameters.
+func graphqlHandler(ctx *Context) {
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+
+	req := &graphql.Request{}
+	if ctx.Request.Method == "POST" {
+		body, ok := readBody(ctx, conf().Limits.MaxGraphQLBytes,
+			"application/json", "application/graphql")
+		if !ok {
+			return
+		}
+		if strings.HasPrefix(ctx.Request.Header.Get("Content-Type"),
+			"application/graphql") {
+			req.Query = string(body)
+		} else if !decodeJSON(ctx, body, req) {
+			return
+		}
+	} else {
+		req.Query = ctx.Params["query"]
+		req.OperationName = ctx.Params["operationName"]
+		if v := ctx.Params["variables"]; v != "" &&
+			json.Unmarshal([]byte(v), &req.Variables) != nil {
+			ctx.Abort(400, "variables must be a JSON object.")
+			return
+		}
+	}
+	if req.Query == "" {
+		ctx.Abort(400, "A query is required.")
+		return
+	}
+
+	resp := graphql.Execute(traceContext(ctx.Request), graphqlQuery, req)
+	data, _ := json.Marshal(resp)
+	if resp.Data == nil {
+		ctx.WriteHeader(400)
+	}
+	ctx.Write(data)
+}
+
+// Registers the GraphQL endpoint.
+func graphqlRoutes(r router.Router) {
+	params := []openapi.Param{
+		{Name: "query", Description: "The GraphQL query.", Required: true},
+		{Name: "variables", Description: "The variables, as JSON."},
+		{Name: "operationName", Description: "The operation to run."},
+	}
+	handleRoutes(r, route{
+		method: "GET", pattern: "/graphql", timeout: searchTimeout,
+		handler: graphqlHandler,
+		summary: "Runs a GraphQL query given as parameters.",
+		params:  params, response: graphql.Response{},
+	}, route{
+		method: "POST", pattern: "/graphql", timeout: searchTimeout,
+		handler: graphqlHandler,
+		summary: "Runs a GraphQL query given as a JSON body.",
+		body:    graphql.Request{}, response: graphql.Response{},
+	})
+}
@@ -0,0 +1,376 @@
+// Package graphql executes GraphQL queries against a schema of resolver
+// functions. It covers the query language (fields, arguments, aliases,
+// variables, fragments and the @skip and @include directives) but not
+// mutations, subscriptions or introspection, and argument types are left
+// for resolvers to check.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// An object type.
+type Object struct {
+	Name   string
+	Fields Fields
+}
+
+// The fields of an object type by name.
+type Fields map[string]*Field
+
+// A field of an object type.
+type Field struct {
+	// The object type of the value returned, or nil for scalars. Values of
+	// object fields must be selected from and may be slices, in which case
+	// each element is an object of the type.
+	Type *Object
+
+	// The arguments the field accepts along with their default values. A
+	// nil default means the argument is optional.
+	Args map[string]interface{}
+
+	// Returns the value of the field. Scalars must encode to JSON. If nil
+	// the value is taken from Source when it is a map[string]interface{}.
+	Resolve func(p Params) (interface{}, error)
+}
+
+// The input to a Resolve function.
+type Params struct {
+	Context context.Context
+
+	// The value of the object the field belongs to, nil for the query type.
+	Source interface{}
+
+	// The arguments to the field, with defaults filled in and variables
+	// replaced by their values.
+	Args map[string]interface{}
+}
+
+// Returns a string argument, or "" if it is not a string.
+func (p Params) String(name string) string {
+	s, _ := p.Args[name].(string)
+	return s
+}
+
+// Returns a numeric argument as an int, and whether it was one.
+func (p Params) Int(name string) (int, bool) {
+	switch n := p.Args[name].(type) {
+	case int:
+		return n, true
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), true
+		}
+	}
+	return 0, false
+}
+
+// Returns a numeric argument as a float64, and whether it was one.
+func (p Params) Float(name string) (float64, bool) {
+	switch n := p.Args[name].(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// A request as sent by GraphQL clients.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// The result of a request.
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// An error running a request. Errors raised while resolving a field have
+// the path of the field, and the field is null in Data.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Runs a request against the given query type.
+func Execute(ctx context.Context, query *Object, req *Request) *Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+
+	var op *operation
+	for _, o := range doc.operations {
+		if req.OperationName == "" || o.name == req.OperationName {
+			if op != nil {
+				return errorResponse("An operationName is required when " +
+					"there is more than one operation.")
+			}
+			op = o
+		}
+	}
+	if op == nil {
+		return errorResponse("Unknown operation %q.", req.OperationName)
+	} else if op.kind != "query" {
+		return errorResponse("Only queries are supported.")
+	}
+
+	variables := make(map[string]interface{})
+	for _, v := range op.variables {
+		value, ok := req.Variables[v.name]
+		if !ok && v.hasDefault {
+			value, ok = v.def, true
+		}
+		if v.nonNull && value == nil {
+			return errorResponse("Variable $%s is required.", v.name)
+		}
+		if ok {
+			variables[v.name] = value
+		}
+	}
+
+	e := &executor{
+		ctx:       ctx,
+		fragments: doc.fragments,
+		variables: variables,
+	}
+	data := e.object(query, nil, op.selections, nil)
+	return &Response{Data: data, Errors: e.errors}
+}
+
+func errorResponse(format string, args ...interface{}) *Response {
+	return &Response{Errors: []*Error{{Message: fmt.Sprintf(format, args...)}}}
+}
+
+// Holds the state of one request.
+type executor struct {
+	ctx       context.Context
+	fragments map[string]*fragment
+	variables map[string]interface{}
+	errors    []*Error
+}
+
+func (e *executor) fail(
+	path []interface{}, format string, args ...interface{},
+) {
+	e.errors = append(e.errors, &Error{
+		Message: fmt.Sprintf(format, args...),
+		Path:    append([]interface{}{}, path...),
+	})
+}
+
+// Returns the selected fields of an object.
+func (e *executor) object(
+	t *Object, source interface{}, selections []*selection, path []interface{},
+) *orderedMap {
+	result := &orderedMap{values: make(map[string]interface{})}
+	fields, order := e.collect(t, selections, nil, nil, make(map[string]bool))
+	for _, key := range order {
+		path := append(path, key)
+		result.set(key, e.field(t, source, fields[key], path))
+	}
+	return result
+}
+
+// Groups the fields selected from an object by their response keys,
+// expanding fragments and dropping skipped fields.
+func (e *executor) collect(
+	t *Object, selections []*selection, fields map[string][]*selection,
+	order []string, visited map[string]bool,
+) (map[string][]*selection, []string) {
+	if fields == nil {
+		fields = make(map[string][]*selection)
+	}
+	for _, s := range selections {
+		if !e.included(s) {
+			continue
+		}
+		switch {
+		case s.name != "":
+			if _, ok := fields[s.alias]; !ok {
+				order = append(order, s.alias)
+			}
+			fields[s.alias] = append(fields[s.alias], s)
+		case s.spread != "":
+			f := e.fragments[s.spread]
+			if visited[s.spread] || f == nil || f.on != t.Name {
+				continue
+			}
+			visited[s.spread] = true
+			fields, order = e.collect(t, f.selections, fields, order, visited)
+		case s.on == "" || s.on == t.Name:
+			fields, order = e.collect(t, s.selections, fields, order, visited)
+		}
+	}
+	return fields, order
+}
+
+// Returns false if a selection has a @skip or @include directive excluding
+// it.
+func (e *executor) included(s *selection) bool {
+	for _, d := range s.directives {
+		value, _ := e.resolve(d.args["if"]).(bool)
+		if (d.name == "skip" && value) || (d.name == "include" && !value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the value of a field, which may have been selected more than
+// once with the same response key.
+func (e *executor) field(
+	t *Object, source interface{}, selections []*selection, path []interface{},
+) interface{} {
+	s := selections[0]
+	if s.name == "__typename" {
+		return t.Name
+	}
+	field := t.Fields[s.name]
+	if field == nil {
+		e.fail(path, "Unknown field %q on type %s.", s.name, t.Name)
+		return nil
+	}
+
+	args := make(map[string]interface{})
+	for name, value := range s.args {
+		if _, ok := field.Args[name]; !ok {
+			e.fail(path, "Unknown argument %q on field %s.%s.", name, t.Name,
+				s.name)
+			return nil
+		}
+		// Arguments given unset variables are left out, as if they had not
+		// been given at all.
+		if v, ok := value.(variable); ok {
+			if _, ok := e.variables[string(v)]; !ok {
+				continue
+			}
+		}
+		args[name] = e.resolve(value)
+	}
+	for name, def := range field.Args {
+		if _, ok := args[name]; !ok && def != nil {
+			args[name] = def
+		}
+	}
+
+	var value interface{}
+	var err error
+	if field.Resolve != nil {
+		value, err = field.Resolve(Params{
+			Context: e.ctx,
+			Source:  source,
+			Args:    args,
+		})
+	} else if m, ok := source.(map[string]interface{}); ok {
+		value = m[s.name]
+	}
+	if err != nil {
+		e.fail(path, "%s", err)
+		return nil
+	}
+
+	var sub []*selection
+	for _, s := range selections {
+		sub = append(sub, s.selections...)
+	}
+	if field.Type == nil {
+		if len(sub) > 0 {
+			e.fail(path, "Field %s.%s has no fields to select.", t.Name,
+				s.name)
+			return nil
+		}
+		return value
+	} else if len(sub) == 0 {
+		e.fail(path, "Field %s.%s of type %s must have a selection.",
+			t.Name, s.name, field.Type.Name)
+		return nil
+	}
+	return e.complete(field.Type, value, sub, path)
+}
+
+// Selects the fields of an object value, or of each object in a slice.
+func (e *executor) complete(
+	t *Object, value interface{}, selections []*selection, path []interface{},
+) interface{} {
+	if value == nil {
+		return nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	} else if v.Kind() != reflect.Slice {
+		return e.object(t, value, selections, path)
+	}
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = e.complete(t, v.Index(i).Interface(), selections,
+			append(path, i))
+	}
+	return list
+}
+
+// Replaces variables in a value with their values, and enum values with
+// their names.
+func (e *executor) resolve(value interface{}) interface{} {
+	switch v := value.(type) {
+	case variable:
+		return e.variables[string(v)]
+	case enumValue:
+		return string(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.resolve(item)
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			object[name] = e.resolve(item)
+		}
+		return object
+	}
+	return value
+}
+
+// A JSON object that keeps its keys in the order they were selected.
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *orderedMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,523 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A parsed request document.
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+// A query, mutation or subscription in a document.
+type operation struct {
+	kind       string
+	name       string
+	variables  []variableDefinition
+	selections []*selection
+}
+
+// A variable declared by an operation.
+type variableDefinition struct {
+	name       string
+	def        interface{}
+	hasDefault bool
+	nonNull    bool
+}
+
+// A named fragment.
+type fragment struct {
+	name       string
+	on         string
+	selections []*selection
+}
+
+// A field when name is set, otherwise a fragment spread when spread is set
+// or else an inline fragment.
+type selection struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*selection
+	spread     string
+	on         string
+	directives []directive
+}
+
+// A directive such as @skip(if: true).
+type directive struct {
+	name string
+	args map[string]interface{}
+}
+
+// Argument values in a document are decoded to the types encoding/json
+// uses, except that integers are int and these two types stand for
+// variables and enum values.
+type (
+	variable  string
+	enumValue string
+)
+
+// The kinds of token.
+const (
+	tokenEOF = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  int
+	value string
+	pos   int
+}
+
+// A recursive descent parser over a document's tokens.
+type parser struct {
+	src   string
+	pos   int
+	token token
+}
+
+// Parses a request document.
+func parse(src string) (doc *document, err error) {
+	p := &parser{src: src}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(syntaxError); ok {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	p.next()
+	doc = &document{fragments: make(map[string]*fragment)}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunct, "{"):
+			doc.operations = append(doc.operations, &operation{
+				kind:       "query",
+				selections: p.selectionSet(),
+			})
+		case p.peek(tokenName, "fragment"):
+			p.next()
+			f := &fragment{name: p.name()}
+			p.keyword("on")
+			f.on = p.name()
+			p.directives()
+			f.selections = p.selectionSet()
+			doc.fragments[f.name] = f
+		case p.peek(tokenName, "query") || p.peek(tokenName, "mutation") ||
+			p.peek(tokenName, "subscription"):
+			op := &operation{kind: p.token.value}
+			p.next()
+			if p.token.kind == tokenName {
+				op.name = p.name()
+			}
+			if p.skip("(") {
+				for !p.skip(")") {
+					op.variables = append(op.variables, p.variableDefinition())
+				}
+			}
+			p.directives()
+			op.selections = p.selectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("Unexpected %s.", p.describe())
+		}
+	}
+	return doc, nil
+}
+
+// A syntax error, raised as a panic while parsing.
+type syntaxError struct {
+	message string
+}
+
+func (e syntaxError) Error() string {
+	return e.message
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	line := 1 + strings.Count(p.src[:p.token.pos], "\n")
+	column := p.token.pos - strings.LastIndex(p.src[:p.token.pos], "\n")
+	panic(syntaxError{fmt.Sprintf("Syntax error at line %d column %d: %s",
+		line, column, fmt.Sprintf(format, args...))})
+}
+
+func (p *parser) describe() string {
+	if p.token.kind == tokenEOF {
+		return "end of document"
+	}
+	return fmt.Sprintf("%q", p.token.value)
+}
+
+func (p *parser) peek(kind int, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+// Consumes the given punctuator if it is next, returning whether it was.
+func (p *parser) skip(punct string) bool {
+	if p.peek(tokenPunct, punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) {
+	if !p.skip(punct) {
+		p.fail("Expected %q but found %s.", punct, p.describe())
+	}
+}
+
+func (p *parser) keyword(name string) {
+	if !p.peek(tokenName, name) {
+		p.fail("Expected %q but found %s.", name, p.describe())
+	}
+	p.next()
+}
+
+func (p *parser) name() string {
+	if p.token.kind != tokenName {
+		p.fail("Expected a name but found %s.", p.describe())
+	}
+	name := p.token.value
+	p.next()
+	return name
+}
+
+func (p *parser) variableDefinition() variableDefinition {
+	p.expect("$")
+	v := variableDefinition{name: p.name()}
+	p.expect(":")
+
+	// Types are only checked for being non null, the resolvers check the
+	// rest.
+	depth := 0
+	for {
+		if p.skip("[") {
+			depth++
+			continue
+		}
+		p.name()
+		for depth > 0 {
+			p.skip("!")
+			p.expect("]")
+			depth--
+		}
+		break
+	}
+	v.nonNull = p.skip("!")
+
+	if p.skip("=") {
+		v.def = p.value(true)
+		v.hasDefault = true
+	}
+	p.directives()
+	return v
+}
+
+func (p *parser) selectionSet() []*selection {
+	p.expect("{")
+	var selections []*selection
+	for !p.skip("}") {
+		s := &selection{}
+		if p.skip("...") {
+			if p.peek(tokenName, "on") {
+				p.next()
+				s.on = p.name()
+			} else if p.token.kind == tokenName {
+				s.spread = p.name()
+				s.directives = p.directives()
+				selections = append(selections, s)
+				continue
+			}
+			s.directives = p.directives()
+			s.selections = p.selectionSet()
+			selections = append(selections, s)
+			continue
+		}
+
+		s.name = p.name()
+		if p.skip(":") {
+			s.alias, s.name = s.name, p.name()
+		} else {
+			s.alias = s.name
+		}
+		s.args = p.arguments(false)
+		s.directives = p.directives()
+		if p.peek(tokenPunct, "{") {
+			s.selections = p.selectionSet()
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		p.fail("Selection sets can not be empty.")
+	}
+	return selections
+}
+
+func (p *parser) arguments(constant bool) map[string]interface{} {
+	args := make(map[string]interface{})
+	if p.skip("(") {
+		for !p.skip(")") {
+			name := p.name()
+			p.expect(":")
+			args[name] = p.value(constant)
+		}
+	}
+	return args
+}
+
+func (p *parser) directives() []directive {
+	var directives []directive
+	for p.skip("@") {
+		d := directive{name: p.name()}
+		d.args = p.arguments(false)
+		directives = append(directives, d)
+	}
+	return directives
+}
+
+// Parses a value. Variables are not allowed in constant values such as
+// variable defaults.
+func (p *parser) value(constant bool) interface{} {
+	t := p.token
+	switch {
+	case t.kind == tokenPunct && t.value == "$" && !constant:
+		p.next()
+		return variable(p.name())
+	case t.kind == tokenPunct && t.value == "[":
+		p.next()
+		list := []interface{}{}
+		for !p.skip("]") {
+			list = append(list, p.value(constant))
+		}
+		return list
+	case t.kind == tokenPunct && t.value == "{":
+		p.next()
+		object := make(map[string]interface{})
+		for !p.skip("}") {
+			name := p.name()
+			p.expect(":")
+			object[name] = p.value(constant)
+		}
+		return object
+	case t.kind == tokenInt:
+		p.next()
+		n, err := strconv.Atoi(t.value)
+		if err != nil {
+			p.fail("Integer %s is out of range.", t.value)
+		}
+		return n
+	case t.kind == tokenFloat:
+		p.next()
+		f, _ := strconv.ParseFloat(t.value, 64)
+		return f
+	case t.kind == tokenString:
+		p.next()
+		return t.value
+	case t.kind == tokenName:
+		p.next()
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return enumValue(t.value)
+	}
+	p.fail("Expected a value but found %s.", p.describe())
+	return nil
+}
+
+// Reads the next token into p.token, skipping white space, commas and
+// comments.
+func (p *parser) next() {
+	src := p.src
+	for p.pos < len(src) {
+		c := src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(src) && src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == 0xEF && strings.HasPrefix(src[p.pos:], "\ufeff") {
+			p.pos += 3
+		} else {
+			break
+		}
+	}
+
+	start := p.pos
+	p.token = token{pos: start}
+	if p.pos >= len(src) {
+		p.token.kind = tokenEOF
+		return
+	}
+
+	c := src[p.pos]
+	switch {
+	case strings.HasPrefix(src[p.pos:], "..."):
+		p.pos += 3
+		p.token.kind, p.token.value = tokenPunct, "..."
+	case strings.IndexByte("!$()/:=@[]{|}&", c) >= 0:
+		p.pos++
+		p.token.kind, p.token.value = tokenPunct, string(c)
+	case c == '_' || isLetter(c):
+		for p.pos < len(src) && (src[p.pos] == '_' || isLetter(src[p.pos]) ||
+			isDigit(src[p.pos])) {
+			p.pos++
+		}
+		p.token.kind, p.token.value = tokenName, src[start:p.pos]
+	case c == '-' || isDigit(c):
+		p.number()
+	case strings.HasPrefix(src[p.pos:], `"""`):
+		p.blockString()
+	case c == '"':
+		p.string()
+	default:
+		p.fail("Unexpected character %q.", c)
+	}
+}
+
+func (p *parser) number() {
+	src, start := p.src, p.pos
+	digits := func() {
+		if p.pos >= len(src) || !isDigit(src[p.pos]) {
+			p.token.pos = p.pos
+			p.fail("Malformed number.")
+		}
+		for p.pos < len(src) && isDigit(src[p.pos]) {
+			p.pos++
+		}
+	}
+
+	p.token.kind = tokenInt
+	if src[p.pos] == '-' {
+		p.pos++
+	}
+	digits()
+	if p.pos < len(src) && src[p.pos] == '.' {
+		p.pos++
+		digits()
+		p.token.kind = tokenFloat
+	}
+	if p.pos < len(src) && (src[p.pos] == 'e' || src[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(src) && (src[p.pos] == '+' || src[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+		p.token.kind = tokenFloat
+	}
+	p.token.value = src[start:p.pos]
+}
+
+func (p *parser) string() {
+	src := p.src
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(src) || src[p.pos] == '\n' {
+			p.fail("Unterminated string.")
+		}
+		c := src[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		} else if c != '\\' {
+			r, size := utf8.DecodeRuneInString(src[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+			continue
+		}
+
+		p.pos++
+		if p.pos >= len(src) {
+			p.fail("Unterminated string.")
+		}
+		escape := src[p.pos]
+		p.pos++
+		switch escape {
+		case '"', '\\', '/':
+			b.WriteByte(escape)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(src) {
+				p.fail("Invalid unicode escape.")
+			}
+			n, err := strconv.ParseUint(src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				p.fail("Invalid unicode escape.")
+			}
+			b.WriteRune(rune(n))
+			p.pos += 4
+		default:
+			p.fail("Invalid escape \\%c.", escape)
+		}
+	}
+	p.token.kind, p.token.value = tokenString, b.String()
+}
+
+// Reads a """ string. The common indentation of its lines and any blank
+// first and last lines are removed.
+func (p *parser) blockString() {
+	p.pos += 3
+	end := strings.Index(p.src[p.pos:], `"""`)
+	if end < 0 {
+		p.fail("Unterminated string.")
+	}
+	raw := strings.ReplaceAll(p.src[p.pos:p.pos+end], `\"""`, `"""`)
+	p.pos += end + 3
+
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	p.token.kind, p.token.value = tokenString, strings.Join(lines, "\n")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"chargepoints/apikeys"
+	"chargepoints/openapi"
+	"chargepoints/router"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The request being handled and its response, passed to each handler.
+type Context struct {
+	http.ResponseWriter
+	Request *http.Request
+
+	// The query parameters, along with the form values of form POSTs. Only
+	// the first value of each is kept.
+	Params map[string]string
+}
+
+// Writes an error response with the given status and plain text body.
+func (ctx *Context) Abort(status int, body string) {
+	ctx.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	ctx.WriteHeader(status)
+	ctx.Write([]byte(body))
+}
+
+// Sets the Content-Type of the response to a type given in full, or by a
+// file extension such as "json".
+func (ctx *Context) ContentType(val string) {
+	if !strings.ContainsRune(val, '/') {
+		val = mime.TypeByExtension("." + strings.TrimPrefix(val, "."))
+	}
+	if val != "" {
+		ctx.Header().Set("Content-Type", val)
+	}
+}
+
+// Sets a response header, replacing any earlier values if unique is true
+// and otherwise adding to them.
+func (ctx *Context) SetHeader(hdr, val string, unique bool) {
+	if unique {
+		ctx.Header().Set(hdr, val)
+	} else {
+		ctx.Header().Add(hdr, val)
+	}
+}
+
+// Writes a 304 Not Modified response.
+func (ctx *Context) NotModified() {
+	ctx.WriteHeader(304)
+}
+
+// A handler taking a Context. The values matched by the route's pattern
+// are read with ctx.Request.PathValue().
+type handlerFunc func(ctx *Context)
+
+func (h handlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]string)
+	// Errors are ignored, a malformed query just leaves out parameters.
+	r.ParseForm()
+	for k, v := range r.Form {
+		params[k] = v[0]
+	}
+	ctx := &Context{ResponseWriter: w, Request: r, Params: params}
+	if followCursor(ctx) {
+		h(ctx)
+	}
+}
+
+// How long requests may take before the queries they make are given up on.
+// Lookups of a single record should be quick, searches may read several
+// pages of results, and downloads stream whole datasets.
+const (
+	lookupTimeout   = 10 * time.Second
+	searchTimeout   = 30 * time.Second
+	downloadTimeout = 10 * time.Minute
+)
+
+// A route of the API: the handler of a method and path pattern, and what
+// /openapi.json says about it.
+type route struct {
+	method  string
+	pattern string
+
+	// The request is given up on after timeout.
+	timeout time.Duration
+	handler handlerFunc
+
+	// If set the handler is only called for requests with this role.
+	role apikeys.Role
+
+	// What the route does, starting "Returns" as handler comments do, and
+	// the group /openapi.json lists it in if not the one its path implies.
+	summary string
+	tag     string
+
+	// The query parameters the handler reads. Path parameters are taken
+	// from the pattern.
+	params []openapi.Param
+
+	// Values of the types of the JSON body the handler reads and of the JSON
+	// it writes on success, or nil. responseType is the media type written
+	// if it is not JSON, and status the status written if not 200.
+	body         interface{}
+	response     interface{}
+	responseType string
+	status       int
+}
+
+// Every route registered, in order.
+var routeTable []route
+
+// Registers routes. Handlers of a {collection} are only called for the
+// collections served. Routes under /api/ are also served under /v1/, see
+// versioned().
+func handleRoutes(r router.Router, routes ...route) {
+	for _, rt := range routes {
+		routeTable = append(routeTable, rt)
+		h := rt.handler
+		if rt.role != "" {
+			h = requireRole(rt.role, h)
+		}
+		if strings.Contains(rt.pattern, "{collection}") {
+			h = servedCollections(h)
+		}
+		rest, ok := strings.CutPrefix(rt.pattern, "/api/")
+		if ok {
+			h = versioned(h)
+			r.Handle(rt.method, "/v1/"+rest, router.Timeout(rt.timeout)(h))
+		}
+		r.Handle(rt.method, rt.pattern, router.Timeout(rt.timeout)(h))
+	}
+}
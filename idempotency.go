@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"chargepoints/idempotency"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Returns the store remembering the responses to writes made with an
+// Idempotency-Key header, which keeps them for cache.idempotency_ttl.
+func idempotencyStore() *idempotency.Store {
+	return &idempotency.Store{Client: orc, TTL: conf().Cache.IdempotencyTTL}
+}
+
+// The response headers kept and sent again with a replayed response. The
+// others are set afresh for each request, such as rate limits.
+var replayedHeaders = []string{
+	"Access-Control-Allow-Origin", "Cache-Control", "Content-Type", "ETag",
+	"Location",
+}
+
+// Responses larger than this are not kept, so retrying the request makes
+// it again, and they are not served by the fallback.
+const maxReplayBytes = 1 << 20
+
+// Records a response as it is written so that it can be kept.
+type responseRecorder struct {
+	statusWriter
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if !w.tooLarge && w.body.Len()+len(p) > maxReplayBytes {
+		w.tooLarge = true
+		w.body.Reset()
+	} else if !w.tooLarge {
+		w.body.Write(p)
+	}
+	return w.statusWriter.Write(p)
+}
+
+// Returns who made a request, so idempotency keys of different clients do
+// not clash.
+func idempotencyScope(req *http.Request) string {
+	if hasAdminToken(req) {
+		return "admin"
+	} else if key := requestKey(req); key != nil {
+		return "key-" + key.ID
+	}
+	return "public"
+}
+
+// Returns true if the responses to writes to a path may hold credentials
+// or other secrets: those of the admin endpoints, such as issued API keys
+// and webhook secrets, and of saved searches.
+func returnsSecrets(path string) bool {
+	return isAdminPath(path) || strings.HasSuffix(legacyPath(path),
+		"/searches")
+}
+
+// Wraps the API so that POST and PUT requests with an Idempotency-Key
+// header are only handled once. Retries of a request with the same key get
+// the original response with an Idempotent-Replayed header and the SHA-256
+// of its body in an Idempotent-Digest header. A retry made while the
+// original is still being handled gets a 409, and using the key for a
+// different request gets a 422. Responses with a 5xx status or larger than
+// maxReplayBytes are not kept, so those requests can be retried. Writes
+// whose responses may hold secrets are not made idempotent.
+func idempotentWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" || (req.Method != "POST" && req.Method != "PUT") ||
+			!strings.HasPrefix(legacyPath(req.URL.Path), "/api/") ||
+			returnsSecrets(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		} else if len(key) > idempotency.MaxKeyLength {
+			http.Error(w, "Idempotency-Key is too long.", 400)
+			return
+		}
+
+		body, err := io.ReadAll(req.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body is too large.", 413)
+			return
+		} else if err != nil {
+			http.Error(w, "Unable to read body.", 400)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		store, scope := idempotencyStore(), idempotencyScope(req)
+		record, err := store.Begin(scope, key,
+			idempotency.Fingerprint(req.Method, req.URL.RequestURI(), body))
+		switch err {
+		case nil:
+		case idempotency.ErrMismatch:
+			http.Error(w, err.Error(), 422)
+			return
+		case idempotency.ErrInProgress:
+			http.Error(w, err.Error(), 409)
+			return
+		default:
+			log.Println(err)
+			http.Error(w, "Unable to check Idempotency-Key.", 502)
+			return
+		}
+		if record.Completed != nil {
+			for name, values := range record.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.Header().Set("Idempotent-Digest", "sha-256="+record.Digest)
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+			return
+		}
+
+		rec := &responseRecorder{statusWriter: statusWriter{ResponseWriter: w}}
+		kept := false
+		defer func() {
+			if !kept {
+				if err := store.Abandon(scope, key); err != nil {
+					log.Printf("Unable to release Idempotency-Key: %s", err)
+				}
+			}
+		}()
+		next.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = 200
+		}
+		if rec.status >= 500 || rec.tooLarge {
+			return
+		}
+		header := http.Header{}
+		for _, name := range replayedHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		err = store.Complete(scope, key, record, rec.status, header,
+			rec.body.Bytes())
+		if err != nil {
+			log.Printf("Unable to keep response for Idempotency-Key: %s", err)
+			return
+		}
+		kept = true
+	})
+}
+
+// Deletes expired idempotency records every hour.
+func sweepIdempotencyKeys() {
+	for {
+		time.Sleep(time.Hour)
+		if n, err := idempotencyStore().Sweep(); err != nil {
+			log.Printf("Unable to delete expired idempotency keys: %s", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d expired idempotency keys.", n)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package idempotency remembers the responses to requests made with an
+// idempotency key, so that a client retrying a write it did not see the
+// response to gets the original response instead of making the write
+// again. Callers must not keep the responses of requests whose bodies may
+// hold credentials, such as new API keys. Records are kept in a collection
+// until they expire.
+package idempotency
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The collection records are kept in.
+const Collection = "IdempotencyKeys"
+
+// How long records are kept if Store.TTL is not set.
+const DefaultTTL = 24 * time.Hour
+
+// How long a request may take before it is given up on and the key can be
+// used again, in case the server handling it stopped.
+const Lease = 10 * time.Minute
+
+// The longest idempotency key accepted.
+const MaxKeyLength = 255
+
+// Returned by Begin().
+var (
+	// The key was used for a different request.
+	ErrMismatch = fmt.Errorf("Idempotency key was used for another request.")
+
+	// The request the key was first used for has not finished.
+	ErrInProgress = fmt.Errorf("A request with this idempotency key is in " +
+		"progress.")
+)
+
+// A request made with an idempotency key, and its response once it has
+// completed.
+type Record struct {
+	// Identifies the request, see Fingerprint().
+	Fingerprint string `json:"fingerprint"`
+
+	Started   time.Time  `json:"started"`
+	Completed *time.Time `json:"completed,omitempty"`
+	Expires   time.Time  `json:"expires"`
+
+	// The response, and the hex SHA-256 of its body.
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	Digest string      `json:"digest,omitempty"`
+}
+
+// Returns a fingerprint of a request, so a key reused for a different
+// request can be told apart from a retry.
+func Fingerprint(method, uri string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, uri)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Keeps records in Collection.
+type Store struct {
+	Client *gorc2.Client
+
+	// How long the records of completed requests are kept. Defaults to
+	// DefaultTTL.
+	TTL time.Duration
+}
+
+func (s *Store) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return DefaultTTL
+}
+
+// Returns the key of the record of an idempotency key used by a client,
+// identified by scope.
+func recordKey(scope, key string) string {
+	return keys.Build(keys.Idempotency, scope, key)
+}
+
+// Starts a request with an idempotency key. If the key was used for the
+// same request before and it completed, returns its record, whose response
+// should be sent again. Otherwise returns a new record without Completed
+// set, and the request should be handled and then passed to Complete() or
+// Abandon(). Returns ErrMismatch or ErrInProgress if the key was used for
+// another request or one that has not completed.
+func (s *Store) Begin(scope, key, fingerprint string) (*Record, error) {
+	c := s.Client.Collection(Collection)
+	k := recordKey(scope, key)
+	for attempt := 0; ; attempt++ {
+		now := s.Client.Now().UTC()
+		r := &Record{
+			Fingerprint: fingerprint,
+			Started:     now,
+			Expires:     now.Add(Lease),
+		}
+		var existing Record
+		item, err := c.Get(k, &existing)
+		if _, ok := err.(gorc2.NotFoundError); ok {
+			if _, err = c.Create(k, r); err == nil {
+				return r, nil
+			}
+		} else if err == nil && now.After(existing.Expires) {
+			if _, err = item.Update(r); err == nil {
+				return r, nil
+			}
+		} else if err == nil && existing.Fingerprint != fingerprint {
+			return nil, ErrMismatch
+		} else if err == nil && existing.Completed == nil {
+			return nil, ErrInProgress
+		} else if err == nil {
+			return &existing, nil
+		}
+
+		// Another request with the key got there first.
+		switch err.(type) {
+		case gorc2.AlreadyExistsError, gorc2.NotMostRecentError:
+			if attempt < 3 {
+				continue
+			}
+		}
+		return nil, err
+	}
+}
+
+// Records the response to a request started with Begin(), given the record
+// it returned. The body is kept along with its digest.
+func (s *Store) Complete(
+	scope, key string, r *Record, status int, header http.Header,
+	body []byte,
+) error {
+	now := s.Client.Now().UTC()
+	r.Completed = &now
+	r.Expires = now.Add(s.ttl())
+	digest := sha256.Sum256(body)
+	r.Status, r.Header, r.Body = status, header, body
+	r.Digest = hex.EncodeToString(digest[:])
+	_, err := s.Client.Collection(Collection).Update(recordKey(scope, key),
+		r)
+	return err
+}
+
+// Forgets a request started with Begin() that failed, so that it can be
+// retried with the same key.
+func (s *Store) Abandon(scope, key string) error {
+	return s.Client.Collection(Collection).Delete(recordKey(scope, key))
+}
+
+// Deletes expired records, returning how many were deleted.
+func (s *Store) Sweep() (int, error) {
+	c := s.Client.Collection(Collection)
+	now := s.Client.Now()
+	var expired []string
+	it := c.List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		var r Record
+		if _, err := it.Get(&r); err == nil && now.After(r.Expires) {
+			expired = append(expired, it.Raw().Key)
+		}
+	}
+	if it.Error != nil {
+		return 0, it.Error
+	}
+	for i, key := range expired {
+		if err := c.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
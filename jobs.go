@@ -0,0 +1,78 @@
+package main
+
+import (
+	"chargepoints/apikeys"
+	"chargepoints/jobs"
+	"chargepoints/merge"
+	"chargepoints/openapi"
+	"chargepoints/reports"
+	"chargepoints/router"
+	"chargepoints/suggest"
+	"chargepoints/webhooks"
+	"fmt"
+)
+
+// The number of jobs this instance runs at once, set with JOB_WORKERS. Jobs
+// are still queued by an instance that runs none, for others to run.
+var jobWorkers = 4
+
+// Runs the jobs queued by imports, the webhook watcher and report
+// moderation.
+func runJobs() {
+	reindex := func(collection string) error {
+		_, err := suggest.Build(orc, collection)
+		return err
+	}
+	watcher := &webhooks.Watcher{Client: orc}
+	pool := &jobs.Pool{
+		Client:  orc,
+		Workers: jobWorkers,
+		Handlers: map[string]jobs.Handler{
+			merge.JobType:    merge.JobHandler(orc, reindex),
+			reports.JobType:  reports.JobHandler(orc),
+			webhooks.JobType: watcher.HandleJob,
+		},
+	}
+	pool.Run(nil)
+}
+
+// Lists the jobs with the status given by the status parameter, or every
+// job if it has none. Their payloads, which can hold every record of an
+// import, are left out.
+func listJobs(ctx *Context) {
+	status := ctx.Params["status"]
+	switch status {
+	case "", jobs.Queued, jobs.Running, jobs.Succeeded, jobs.Failed:
+	default:
+		ctx.Abort(400, fmt.Sprintf("Unknown job status %q.", status))
+		return
+	}
+	list, err := jobs.List(orc, status)
+	for _, j := range list {
+		j.Payload = nil
+	}
+	writeJSON(ctx, list, err)
+}
+
+func getJob(ctx *Context) {
+	j, err := jobs.Get(orc, ctx.Request.PathValue("id"))
+	writeJSON(ctx, j, err)
+}
+
+// Registers the job admin endpoints. These must be registered before the
+// search endpoint.
+func jobRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/jobs", timeout: lookupTimeout,
+		handler: listJobs, role: apikeys.Admin,
+		summary: "Lists the background jobs.",
+		params: []openapi.Param{{Name: "status", Description: "queued, " +
+			"running, succeeded or failed. Lists every job if not given."}},
+		response: []*jobs.Job{},
+	}, route{
+		method: "GET", pattern: "/api/jobs/{id}", timeout: lookupTimeout,
+		handler: getJob, role: apikeys.Admin,
+		summary:  "Returns a background job, including its payload.",
+		response: jobs.Job{},
+	})
+}
@@ -0,0 +1,342 @@
+// Package jobs is a queue of background work kept in a collection, so that
+// work outlives the instance that queued it and is shared by every instance
+// running a Pool. A worker takes a job by writing a lease on it, and renews
+// the lease with heartbeats while the job runs. A job whose lease runs out,
+// because its worker stopped, is taken by another worker. Jobs that fail are
+// retried after a backoff until they have been attempted MaxAttempts times,
+// after which they are left failed for an operator to look at.
+package jobs
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The collection jobs are kept in, keyed by generated IDs that sort in the
+// order jobs were queued.
+const Collection = "Jobs"
+
+// The states of a job.
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// The attempts made at a job that does not set MaxAttempts.
+const DefaultMaxAttempts = 5
+
+// A unit of background work.
+type Job struct {
+	ID string `json:"id,omitempty" orc:"key"`
+
+	// Says which Handler runs the job, which is given the payload.
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	Created     time.Time `json:"created"`
+
+	// The job is not run before this time, which is put back after an
+	// attempt fails.
+	RunAt time.Time `json:"run_at"`
+
+	// While the job runs, the worker running it and when its lease runs out
+	// unless renewed, and when it last was.
+	Worker    string     `json:"worker,omitempty"`
+	Lease     *time.Time `json:"lease,omitempty"`
+	Heartbeat *time.Time `json:"heartbeat,omitempty"`
+
+	// The error of the last failed attempt, and what the handler returned
+	// once the job succeeded.
+	Error    string          `json:"error,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Finished *time.Time      `json:"finished,omitempty"`
+}
+
+// Runs a job, returning a value describing what it did, kept as the job's
+// Result, or an error if the job should be retried. The context is
+// cancelled if the worker loses the job's lease or its Pool stops.
+type Handler func(ctx context.Context, job *Job) (interface{}, error)
+
+// Returns the queue, filling in job IDs when reading.
+func queue(client *gorc2.Client) *gorc2.Collection {
+	c := client.Collection(Collection)
+	c.InjectMetadata = true
+	return c
+}
+
+// Queues a job of the given type with the payload encoded as JSON, to be
+// attempted at most maxAttempts times, or DefaultMaxAttempts if 0.
+func Enqueue(
+	client *gorc2.Client, typ string, payload interface{}, maxAttempts int,
+) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	now := client.Now().UTC()
+	j := &Job{Type: typ, Payload: data, Status: Queued, Created: now,
+		RunAt: now, MaxAttempts: maxAttempts}
+	item, err := queue(client).CreateAuto(j)
+	if err != nil {
+		return nil, err
+	}
+	j.ID = item.Key
+	return j, nil
+}
+
+// Returns a job.
+func Get(client *gorc2.Client, id string) (*Job, error) {
+	j := &Job{}
+	if _, err := queue(client).Get(id, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Returns the jobs with the given status, or every job if it is "", oldest
+// first.
+func List(client *gorc2.Client, status string) ([]*Job, error) {
+	jobs := []*Job{}
+	it := queue(client).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		j := &Job{}
+		if _, err := it.Get(j); err != nil {
+			return nil, err
+		}
+		if status == "" || j.Status == status {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].ID < jobs[k].ID
+	})
+	return jobs, it.Error
+}
+
+// Runs queued jobs with a fixed number of workers.
+type Pool struct {
+	Client *gorc2.Client
+
+	// The handlers of the types of jobs the pool runs. Jobs of other types
+	// are left for other pools.
+	Handlers map[string]Handler
+
+	// The number of jobs run at once. Defaults to 4.
+	Workers int
+
+	// How long a worker holds a job without a heartbeat, renewed every
+	// third of it. Defaults to a minute.
+	LeaseTime time.Duration
+
+	// How often the queue is checked while workers are idle. Defaults to 5
+	// seconds.
+	PollInterval time.Duration
+
+	// The wait before a failed job is retried, doubling with each attempt.
+	// Defaults to 30 seconds.
+	Backoff time.Duration
+
+	// Names the pool in the leases of the jobs it runs. Defaults to the
+	// host name followed by a random suffix.
+	Name string
+}
+
+func (p *Pool) defaults() {
+	if p.Workers <= 0 {
+		p.Workers = 4
+	}
+	if p.LeaseTime <= 0 {
+		p.LeaseTime = time.Minute
+	}
+	if p.PollInterval <= 0 {
+		p.PollInterval = 5 * time.Second
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = 30 * time.Second
+	}
+	if p.Name == "" {
+		host, _ := os.Hostname()
+		buf := make([]byte, 4)
+		rand.Read(buf)
+		p.Name = host + "-" + hex.EncodeToString(buf)
+	}
+}
+
+// Takes and runs jobs until stop is closed, then waits for the jobs that
+// are running to return.
+func (p *Pool) Run(stop <-chan struct{}) {
+	p.defaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	idle := make(chan struct{}, p.Workers)
+	for n := 0; n < p.Workers; n++ {
+		idle <- struct{}{}
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		// Take as many jobs as there are idle workers, and wait before
+		// looking again if there were none to take.
+		took := false
+		for len(idle) > 0 {
+			item, job, err := p.take()
+			if err != nil {
+				log.Printf("Unable to take a job: %s", err)
+				break
+			} else if job == nil {
+				break
+			}
+			<-idle
+			took = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.run(ctx, item, job)
+				idle <- struct{}{}
+			}()
+		}
+		wait := p.PollInterval
+		if took && len(idle) > 0 {
+			wait = 0
+		}
+		select {
+		case <-p.Client.After(wait):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Returns true if a job can be taken at the given time.
+func (p *Pool) ready(j *Job, now time.Time) bool {
+	if p.Handlers[j.Type] == nil {
+		return false
+	}
+	switch j.Status {
+	case Queued:
+		return !now.Before(j.RunAt)
+	case Running:
+		return j.Lease == nil || now.After(*j.Lease)
+	}
+	return false
+}
+
+// Takes the oldest job that is ready by writing a lease on it, returning it
+// along with its Item, or nil if none is ready. Jobs taken by another worker
+// in the meantime are skipped.
+func (p *Pool) take() (*gorc2.Item, *Job, error) {
+	now := p.Client.Now().UTC()
+	it := queue(p.Client).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		j := &Job{}
+		item, err := it.Get(j)
+		if err != nil {
+			return nil, nil, err
+		} else if !p.ready(j, now) {
+			continue
+		}
+		lease := now.Add(p.LeaseTime)
+		j.Status, j.Worker, j.Lease, j.Heartbeat = Running, p.Name, &lease, &now
+		j.Attempts++
+		item, err = item.Update(j)
+		if _, ok := err.(gorc2.NotMostRecentError); ok {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return item, j, nil
+	}
+	return nil, nil, it.Error
+}
+
+// Runs a job, renewing its lease until it returns, and records the outcome.
+func (p *Pool) run(ctx context.Context, item *gorc2.Item, j *Job) {
+	ctx, cancel := context.WithCancel(ctx)
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-p.Client.After(p.LeaseTime / 3):
+			case <-done:
+				return
+			}
+			mu.Lock()
+			now := p.Client.Now().UTC()
+			lease := now.Add(p.LeaseTime)
+			j.Lease, j.Heartbeat = &lease, &now
+			renewed, err := item.Update(j)
+			if err == nil {
+				item = renewed
+			}
+			mu.Unlock()
+			if _, ok := err.(gorc2.NotMostRecentError); ok {
+				// Another worker took the job, so stop running it.
+				log.Printf("Lost the lease of job %s.", j.ID)
+				cancel()
+				return
+			} else if err != nil {
+				log.Printf("Unable to renew the lease of job %s: %s", j.ID,
+					err)
+			}
+		}
+	}()
+
+	result, err := p.call(ctx, j)
+	close(done)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	now := p.Client.Now().UTC()
+	j.Worker, j.Lease, j.Heartbeat = "", nil, nil
+	switch {
+	case err == nil:
+		j.Status, j.Finished, j.Error = Succeeded, &now, ""
+		j.Result, _ = json.Marshal(result)
+	case j.Attempts >= j.MaxAttempts:
+		j.Status, j.Finished, j.Error = Failed, &now, err.Error()
+		log.Printf("Job %s of type %s failed after %d attempts: %s", j.ID,
+			j.Type, j.Attempts, err)
+	default:
+		j.Status, j.Error = Queued, err.Error()
+		j.RunAt = now.Add(p.Backoff << (j.Attempts - 1))
+	}
+	if _, err := item.Update(j); err != nil {
+		log.Printf("Unable to record the outcome of job %s: %s", j.ID, err)
+	}
+}
+
+// Calls the handler of a job, turning a panic into an error.
+func (p *Pool) call(ctx context.Context, j *Job) (result interface{},
+	err error,
+) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Job panicked: %v", r)
+		}
+	}()
+	return p.Handlers[j.Type](ctx, j)
+}
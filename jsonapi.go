@@ -0,0 +1,362 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/cursor"
+	"chargepoints/model"
+	"chargepoints/openapi"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The media type of JSON:API documents. Clients get them instead of the
+// usual responses by sending it in the Accept header, or with the format
+// parameter set to jsonapi.
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// The page size of JSON:API lists when page[limit] is not given, and the
+// largest allowed.
+const (
+	defaultAPIPageLimit = 100
+	maxAPIPageLimit     = 500
+)
+
+// The query parameters of endpoints that can answer with JSON:API. Those
+// that do not page take only the first.
+var jsonAPIParams = []openapi.Param{
+	{Name: "format", Description: "jsonapi for a JSON:API document."},
+	{Name: "page[limit]", Type: "integer"},
+	{Name: "page[cursor]",
+		Description: "Where the page starts, from a prev or next link."},
+}
+
+// Signs the cursors of page links, set with CURSOR_SECRET. Instances must
+// share it for cursors to be followed across them. Defaults to a random
+// secret.
+var cursors = cursor.NewSigner(randomHex(32))
+
+// A JSON:API resource object.
+type apiResource struct {
+	Type          string                     `json:"type"`
+	ID            string                     `json:"id"`
+	Attributes    map[string]interface{}     `json:"attributes"`
+	Relationships map[string]apiRelationship `json:"relationships,omitempty"`
+	Links         map[string]string          `json:"links,omitempty"`
+}
+
+// A relationship of a resource, given as a link to the related resources.
+type apiRelationship struct {
+	Links map[string]string `json:"links"`
+}
+
+// A JSON:API document holding primary data.
+type apiDocument struct {
+	Data  interface{}            `json:"data"`
+	Links map[string]*string     `json:"links,omitempty"`
+	Meta  map[string]interface{} `json:"meta,omitempty"`
+}
+
+// A JSON:API error object.
+type apiError struct {
+	Status string `json:"status"`
+	Title  string `json:"title"`
+}
+
+// Returns true if the client asked for JSON:API documents.
+func wantsJSONAPI(ctx *Context) bool {
+	return ctx.Params["format"] == "jsonapi" ||
+		strings.Contains(ctx.Request.Header.Get("Accept"), jsonAPIMediaType)
+}
+
+// Writes a JSON:API document with the given status.
+func writeAPIDocument(ctx *Context, status int, doc interface{}) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		log.Println(err)
+		status = 500
+		data = []byte(`{"errors":[{"status":"500",` +
+			`"title":"Unable to encode response."}]}`)
+	}
+	ctx.SetHeader("Content-Type", jsonAPIMediaType, true)
+	allowOrigin(ctx)
+	ctx.WriteHeader(status)
+	ctx.Write(data)
+}
+
+// Writes a JSON:API error document.
+func writeAPIError(ctx *Context, status int, title string) {
+	writeAPIDocument(ctx, status, map[string][]apiError{
+		"errors": {{Status: strconv.Itoa(status), Title: title}},
+	})
+}
+
+// Writes an error from Orchestrate as a JSON:API error document, a 404 for
+// missing records and a 502 for anything else.
+func writeAPIBackendError(ctx *Context, err error) {
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		writeAPIError(ctx, 404, "Not found.")
+		return
+	}
+	log.Println(err)
+	writeAPIError(ctx, 502, "Unable to read from Orchestrate.")
+}
+
+// Returns the resource type of the records in a collection.
+func apiType(collection string) string {
+	return strings.ToLower(collection)
+}
+
+// Returns a resource for a chargepoint from the given collection, unless the
+// result says which collection it is from. Chargepoints in the ChargePoints
+// collection link to their tariffs.
+func chargepointResource(collection string, r Result) apiResource {
+	if r.Collection != "" {
+		collection = r.Collection
+	}
+	resource := apiResource{
+		Type:       apiType(collection),
+		ID:         r.Key,
+		Attributes: map[string]interface{}{},
+	}
+	json.Unmarshal(r.Value, &resource.Attributes)
+	if collection == model.ChargePoints {
+		resource.Relationships = map[string]apiRelationship{
+			"tariffs": {Links: map[string]string{
+				"related": "/api/" + collection + "/" +
+					url.PathEscape(r.Key) + "/tariffs",
+			}},
+		}
+	}
+	return resource
+}
+
+// Returns a resource for each element of a slice, or a single resource for
+// anything else, from the operator, network and tariff types of the model.
+// Their id field becomes the resource id, the rest are attributes.
+func modelResources(typ string, value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	resource := func(attributes map[string]interface{}) apiResource {
+		id, _ := attributes["id"].(string)
+		delete(attributes, "id")
+		self := "/api/" + typ + "/" + url.PathEscape(id)
+		return apiResource{
+			Type:       typ,
+			ID:         id,
+			Attributes: attributes,
+			Relationships: map[string]apiRelationship{
+				"chargepoints": {Links: map[string]string{
+					"related": self + "/chargepoints",
+				}},
+			},
+			Links: map[string]string{"self": self},
+		}
+	}
+
+	if strings.HasPrefix(string(data), "[") {
+		var list []map[string]interface{}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		resources := make([]apiResource, len(list))
+		for i, attributes := range list {
+			resources[i] = resource(attributes)
+		}
+		return resources, nil
+	}
+	var attributes map[string]interface{}
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return nil, err
+	}
+	return resource(attributes), nil
+}
+
+// Writes operators, networks or tariffs, as a JSON:API document if one was
+// asked for and otherwise as writeJSON does.
+func writeResources(
+	ctx *Context, typ string, value interface{}, err error,
+) {
+	if !wantsJSONAPI(ctx) {
+		writeJSON(ctx, value, err)
+		return
+	} else if err != nil {
+		writeAPIBackendError(ctx, err)
+		return
+	}
+	data, err := modelResources(typ, value)
+	if err != nil {
+		log.Println(err)
+		writeAPIError(ctx, 500, "Unable to encode response.")
+		return
+	}
+	writeAPIDocument(ctx, 200, apiDocument{Data: data})
+}
+
+// Returns the page[offset] and page[limit] parameters. page[offset] is only
+// set by followCursor().
+func apiPage(ctx *Context) (offset, limit int, err error) {
+	limit = defaultAPIPageLimit
+	if v := ctx.Params["page[offset]"]; v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid page[offset].")
+		}
+	}
+	if v := ctx.Params["page[limit]"]; v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 ||
+			limit > maxAPIPageLimit {
+			return 0, 0, fmt.Errorf("page[limit] must be between 1 and %d.",
+				maxAPIPageLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+// Returns the URL of the request with the page parameters set. Pages after
+// the first are linked to by a cursor holding the parameters, and the
+// api_key parameter is kept out of it.
+func apiPageLink(ctx *Context, offset, limit int) *string {
+	query := ctx.Request.URL.Query()
+	apiKey := query.Get("api_key")
+	query.Del("api_key")
+	query.Del("page[offset]")
+	query.Set("page[limit]", strconv.Itoa(limit))
+	if offset > 0 {
+		query.Set("page[offset]", strconv.Itoa(offset))
+		query = url.Values{"page[cursor]": {
+			cursors.Encode(ctx.Request.URL.Path, query)}}
+	}
+	if apiKey != "" {
+		query.Set("api_key", apiKey)
+	}
+	link := ctx.Request.URL.Path + "?" + query.Encode()
+	return &link
+}
+
+// Handles a request with a page[cursor] parameter as a request for the page
+// the cursor links to, replacing its query with the one the cursor holds.
+// Returns false, after writing an error, if the cursor is invalid or of
+// another path, or if page[offset] is given other than by a cursor.
+func followCursor(ctx *Context) bool {
+	token, ok := ctx.Params["page[cursor]"]
+	if !ok {
+		if _, ok := ctx.Params["page[offset]"]; ok {
+			writeAPIError(ctx, 400, "page[offset] is not supported, follow "+
+				"the next link of a page instead.")
+			return false
+		}
+		return true
+	}
+	path, query, err := cursors.Decode(token)
+	if err != nil || path != ctx.Request.URL.Path {
+		writeAPIError(ctx, 400, "Invalid page[cursor].")
+		return false
+	}
+	if apiKey := ctx.Params["api_key"]; apiKey != "" {
+		query.Set("api_key", apiKey)
+	}
+	ctx.Request.URL.RawQuery = query.Encode()
+	ctx.Params = make(map[string]string)
+	for k, v := range query {
+		ctx.Params[k] = v[0]
+	}
+	return true
+}
+
+// Returns a page of items along with the self, first, prev, next and last
+// links of the page. Links to pages that do not exist are null.
+func apiPaginate(
+	ctx *Context, total, offset, limit int,
+) (start, end int, links map[string]*string) {
+	start, end = offset, offset+limit
+	if start > total {
+		start = total
+	}
+	if end > total {
+		end = total
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+	links = map[string]*string{
+		"self":  apiPageLink(ctx, offset, limit),
+		"first": apiPageLink(ctx, 0, limit),
+		"last":  apiPageLink(ctx, last, limit),
+		"prev":  nil,
+		"next":  nil,
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links["prev"] = apiPageLink(ctx, prev, limit)
+	}
+	if end < total {
+		links["next"] = apiPageLink(ctx, end, limit)
+	}
+	return start, end, links
+}
+
+// Writes a page of chargepoints as a JSON:API document. The count in meta
+// is the number of chargepoints on every page.
+func writeAPIChargepoints(
+	ctx *Context, collection string, results []Result, err error,
+) {
+	if err != nil {
+		writeAPIBackendError(ctx, err)
+		return
+	}
+	offset, limit, err := apiPage(ctx)
+	if err != nil {
+		writeAPIError(ctx, 400, err.Error())
+		return
+	}
+
+	start, end, links := apiPaginate(ctx, len(results), offset, limit)
+	data := make([]apiResource, 0, end-start)
+	for _, r := range results[start:end] {
+		data = append(data, chargepointResource(collection, r))
+	}
+	writeAPIDocument(ctx, 200, apiDocument{
+		Data:  data,
+		Links: links,
+		Meta:  map[string]interface{}{"count": len(results)},
+	})
+}
+
+// Writes the clusters of the bbox endpoint as a JSON:API document, with the
+// number of chargepoints they hold as the count in meta. Clusters are not
+// paginated since there are at most limits.bbox_max_clusters of them.
+func writeAPIClusters(ctx *Context, clusters []Cluster, count int) {
+	data := make([]apiResource, len(clusters))
+	for i, c := range clusters {
+		id := c.Geohash
+		if c.Tile != "" {
+			id = c.Tile
+		}
+		data[i] = apiResource{
+			Type: "clusters",
+			ID:   id,
+			Attributes: map[string]interface{}{
+				"north":     c.North,
+				"south":     c.South,
+				"east":      c.East,
+				"west":      c.West,
+				"count":     c.Count,
+				"latitude":  c.Latitude,
+				"longitude": c.Longitude,
+			},
+		}
+	}
+	writeAPIDocument(ctx, 200, apiDocument{
+		Data: data,
+		Meta: map[string]interface{}{"count": count},
+	})
+}
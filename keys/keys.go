@@ -0,0 +1,147 @@
+// Package keys builds and parses the composite keys of items that are
+// identified by more than one value, such as the import base of a record,
+// which is keyed by its collection and its key. Keys are a kind followed by
+// the parts, separated by colons:
+//
+//	base:ChargePoints:17e4c292676061e60a4c6866f7e5d733
+//
+// Anything in a part other than letters, digits and "-._~" is percent
+// encoded, so parts may hold colons without two sets of parts giving the
+// same key, and keys are safe to use in Orchestrate URL paths.
+package keys
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Separates the kind and parts of a key.
+const Separator = ":"
+
+// The kinds of composite keys used by the app.
+const (
+	// Import bases and conflicts, keyed by collection and record key. See
+	// package merge.
+	ImportBase     = "base"
+	ImportConflict = "conflict"
+
+	// Suggestion index buckets, keyed by collection and prefix, and the
+	// index manifest keyed by collection. See package suggest.
+	SuggestBucket   = "suggest"
+	SuggestManifest = "suggestindex"
+
+	// Snapshots, keyed by collection and time. See package snapshots.
+	Snapshot = "snapshot"
+
+	// Cached reverse geocoding lookups, keyed by rounded coordinates. See
+	// package geocode.
+	Geocode = "geo"
+
+	// Webhook watcher checkpoints keyed by collection, and dead lettered
+	// deliveries keyed by webhook and change. See package webhooks.
+	WebhookCheckpoint = "checkpoint"
+	WebhookDelivery   = "delivery"
+
+	// Idempotent requests, keyed by who made them and the idempotency key
+	// they gave. See package idempotency.
+	Idempotency = "idempotency"
+
+	// View counters, keyed by collection and record key. See package
+	// analytics.
+	Views = "views"
+
+	// Change forwarding checkpoints, keyed by collection. See package bus.
+	BusCheckpoint = "bus"
+
+	// Migration state, keyed by collection. See package migrations.
+	Migration = "migration"
+)
+
+// Returns true if a byte is left as it is in parts.
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+		'0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// Percent encodes the bytes of a part that are not unreserved.
+func escape(part string) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		if c := part[i]; unreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Returns an error unless a kind is made of lower case letters and digits,
+// starting with a letter.
+func checkKind(kind string) error {
+	for i := 0; i < len(kind); i++ {
+		c := kind[i]
+		if !('a' <= c && c <= 'z' || i > 0 && '0' <= c && c <= '9') {
+			return fmt.Errorf("Invalid key kind %q.", kind)
+		}
+	}
+	if kind == "" {
+		return fmt.Errorf("Key kind is empty.")
+	}
+	return nil
+}
+
+// Returns the key of a kind and parts. Panics if the kind is invalid, since
+// kinds are constants.
+func Build(kind string, parts ...string) string {
+	if err := checkKind(kind); err != nil {
+		panic(err)
+	}
+	var b strings.Builder
+	b.WriteString(kind)
+	for _, part := range parts {
+		b.WriteString(Separator)
+		b.WriteString(escape(part))
+	}
+	return b.String()
+}
+
+// Returns the kind and parts of a key.
+func Parse(key string) (string, []string, error) {
+	fields := strings.Split(key, Separator)
+	if err := checkKind(fields[0]); err != nil {
+		return "", nil, err
+	}
+	parts := make([]string, len(fields)-1)
+	for i, field := range fields[1:] {
+		part, err := url.PathUnescape(field)
+		if err != nil || escape(part) != field {
+			return "", nil, fmt.Errorf("Invalid key %q.", key)
+		}
+		parts[i] = part
+	}
+	return fields[0], parts, nil
+}
+
+// Returns the parts of a key of the given kind with the given number of
+// parts.
+func ParseKind(key, kind string, n int) ([]string, error) {
+	k, parts, err := Parse(key)
+	if err != nil {
+		return nil, err
+	} else if k != kind || len(parts) != n {
+		return nil, fmt.Errorf("Key %q is not a %s key with %d parts.", key,
+			kind, n)
+	}
+	return parts, nil
+}
+
+// Returns the range of keys that start with the given kind and parts and
+// have more parts after them, as the StartKey and BeforeKey of a
+// gorc2.ListQuery.
+func Range(kind string, parts ...string) (start, before string) {
+	prefix := Build(kind, parts...)
+	// ";" sorts straight after the separator.
+	return prefix + Separator, prefix + ";"
+}
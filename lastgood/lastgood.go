@@ -0,0 +1,153 @@
+// Package lastgood keeps the last successful response to each request in
+// memory, so that while Orchestrate is unreachable the app can answer with
+// what it last knew instead of failing. The least recently used responses
+// are dropped once the cache is full, and the cache can be written to a
+// local file and read back so that it survives restarts.
+package lastgood
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How many responses are kept if Cache.MaxEntries is not set.
+const DefaultMaxEntries = 1000
+
+// A response as it was sent.
+type Response struct {
+	Key    string      `json:"key"`
+	Stored time.Time   `json:"stored"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body"`
+}
+
+// Keeps responses by key. The zero value is ready to use.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   list.List
+	max     int
+}
+
+// Sets how many responses are kept, dropping the least recently used if
+// there are more. DefaultMaxEntries is used if max is not positive.
+func (c *Cache) SetMaxEntries(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max
+	c.trim()
+}
+
+// Drops the least recently used responses until there are at most the
+// maximum. Must be called with mu held.
+func (c *Cache) trim() {
+	max := c.max
+	if max <= 0 {
+		max = DefaultMaxEntries
+	}
+	for c.order.Len() > max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*Response).Key)
+	}
+}
+
+// Keeps a response, replacing any kept under the same key.
+func (c *Cache) Put(r *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if e, ok := c.entries[r.Key]; ok {
+		e.Value = r
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[r.Key] = c.order.PushFront(r)
+	c.trim()
+}
+
+// Returns the response kept under a key if it was stored at most maxAge
+// ago, or at any time if maxAge is 0.
+func (c *Cache) Get(key string, maxAge time.Duration) (*Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	r := e.Value.(*Response)
+	if maxAge > 0 && time.Since(r.Stored) > maxAge {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return r, true
+}
+
+// Returns how many responses are kept.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Writes the responses to a file, most recently used first, replacing it
+// only once they have all been written.
+func (c *Cache) Save(path string) error {
+	c.mu.Lock()
+	responses := make([]*Response, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		responses = append(responses, e.Value.(*Response))
+	}
+	c.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".lastgood-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(responses); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Reads the responses written by Save(), keeping those not already in the
+// cache. It is not an error for the file not to exist.
+func (c *Cache) Load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var responses []*Response
+	if err := json.Unmarshal(data, &responses); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	n := 0
+	for _, r := range responses {
+		if _, ok := c.entries[r.Key]; !ok && r.Key != "" {
+			c.entries[r.Key] = c.order.PushBack(r)
+			n++
+		}
+	}
+	c.trim()
+	return n, nil
+}
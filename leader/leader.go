@@ -0,0 +1,108 @@
+// Package leader elects one of the replicas of an app to do work that must
+// be done once however many replicas are deployed, such as taking
+// scheduled snapshots. The leader holds a gorc2.Lock named after the
+// election, which it renews with heartbeats, so two replicas can not both
+// lead. A leader that stops renewing its lock, because it stopped or can
+// not reach Orchestrate, loses it once it expires and another replica
+// takes over.
+package leader
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"log"
+	"sync"
+	"time"
+)
+
+// The collection the locks of elections are kept in, keyed by the name of
+// their election.
+const Collection = "Leases"
+
+// Campaigns for the lock of an election on behalf of this replica.
+type Elector struct {
+	Client *gorc2.Client
+
+	// Names the election, so that different work can be led by different
+	// replicas.
+	Name string
+
+	// How long the lock lasts unless renewed, which is done every third of
+	// it. Defaults to 30 seconds.
+	TTL time.Duration
+
+	mu   sync.Mutex
+	lock *gorc2.Lock
+}
+
+// Returns true if this replica leads. A leader stops leading a third of the
+// TTL before its lock expires if it has not renewed it, so that the clocks
+// of the replicas may differ by that much.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lock != nil &&
+		e.Client.Now().Before(e.lock.Expires().Add(-e.TTL/3))
+}
+
+// Takes the lock if it is free or has expired, or renews it if this
+// replica holds it, and returns whether this replica leads.
+func (e *Elector) Campaign() (bool, error) {
+	e.mu.Lock()
+	if e.TTL <= 0 {
+		e.TTL = 30 * time.Second
+	}
+	lock := e.lock
+	e.mu.Unlock()
+
+	var err error
+	if lock != nil {
+		err = lock.Renew()
+	} else {
+		lock, err = e.Client.Collection(Collection).AcquireLock(e.Name,
+			e.TTL)
+		if err == nil {
+			log.Printf("Leading %s.", e.Name)
+		}
+	}
+	if _, ok := err.(gorc2.LockedError); ok {
+		// Another replica leads.
+		lock, err = nil, nil
+	} else if err != nil {
+		// Leads until the lock it holds runs out, in case the next renewal
+		// succeeds.
+		return e.IsLeader(), err
+	}
+	e.mu.Lock()
+	e.lock = lock
+	e.mu.Unlock()
+	return lock != nil, nil
+}
+
+// Campaigns when called and then every third of the TTL until stop is
+// closed, logging failures, and then gives up the lock if this replica
+// holds it so that another can take over without waiting for it to expire.
+func (e *Elector) Run(stop <-chan struct{}) {
+	for {
+		if _, err := e.Campaign(); err != nil {
+			log.Printf("Unable to campaign for %s: %s", e.Name, err)
+		}
+		select {
+		case <-e.Client.After(e.TTL / 3):
+		case <-stop:
+			e.Resign()
+			return
+		}
+	}
+}
+
+// Gives up the lock if this replica holds it.
+func (e *Elector) Resign() error {
+	e.mu.Lock()
+	lock := e.lock
+	e.lock = nil
+	e.mu.Unlock()
+	if lock == nil {
+		return nil
+	}
+	return lock.Release()
+}
@@ -0,0 +1,131 @@
+// Package locale picks the language to answer a request in from its
+// Accept-Language header, and reduces text fields stored in several
+// languages, such as:
+//
+//	"description": {"en": "Level 2 of the car park", "cy": "Lefel 2 y maes parcio"}
+//
+// to the text in that language.
+package locale
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returns the language of those supported that an Accept-Language header
+// prefers, or "" if the header is empty or accepts none of them. Languages
+// are matched by their primary subtag, so "cy-GB" picks "cy", and "*"
+// picks the first supported language.
+func Negotiate(header string, supported []string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].q > choices[j].q
+	})
+
+	for _, c := range choices {
+		if c.tag == "*" && len(supported) > 0 {
+			return supported[0]
+		}
+		primary, _, _ := strings.Cut(c.tag, "-")
+		for _, lang := range supported {
+			if strings.EqualFold(lang, c.tag) ||
+				strings.EqualFold(lang, primary) {
+				return lang
+			}
+		}
+	}
+	return ""
+}
+
+// Returns a document with each of the given fields that holds an object of
+// texts by language replaced by the text in lang, or in fallback if there
+// is none in lang, or else in the first language there is one in. Fields
+// are named by dotted paths, and a path through an array names that field
+// of every element. Documents that are not JSON objects, and fields that
+// are not objects of strings, are left as they are.
+func Localize(
+	value json.RawMessage, fields []string, lang, fallback string,
+) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil || doc == nil {
+		return value, nil
+	}
+	changed := false
+	for _, field := range fields {
+		path := strings.Split(strings.TrimPrefix(field, "value."), ".")
+		changed = localize(doc, path, lang, fallback) || changed
+	}
+	if !changed {
+		return value, nil
+	}
+	return json.Marshal(doc)
+}
+
+// Localizes the field at path within value, returning true if it was
+// changed.
+func localize(value interface{}, path []string, lang, fallback string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) > 1 {
+			return localize(v[path[0]], path[1:], lang, fallback)
+		}
+		texts, ok := v[path[0]].(map[string]interface{})
+		if !ok || len(texts) == 0 {
+			return false
+		}
+		for _, text := range texts {
+			if _, ok := text.(string); !ok {
+				return false
+			}
+		}
+		v[path[0]] = pick(texts, lang, fallback)
+		return true
+	case []interface{}:
+		changed := false
+		for _, element := range v {
+			changed = localize(element, path, lang, fallback) || changed
+		}
+		return changed
+	}
+	return false
+}
+
+// Returns the text in lang, in fallback, or in the first language there is
+// one in, in the order of their tags.
+func pick(texts map[string]interface{}, lang, fallback string) interface{} {
+	for _, want := range []string{lang, fallback} {
+		for tag, text := range texts {
+			if strings.EqualFold(tag, want) {
+				return text
+			}
+		}
+	}
+	tags := make([]string, 0, len(texts))
+	for tag := range texts {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return texts[tags[0]]
+}
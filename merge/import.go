@@ -0,0 +1,317 @@
+package merge
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"chargepoints/migrations"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The collections the bases of imported records, and the conflicts found
+// importing them, are kept in. Keyed by keys.ImportBase and
+// keys.ImportConflict keys of the collection name and the key of the record.
+const (
+	Bases     = "ImportBases"
+	Conflicts = "ImportConflicts"
+)
+
+// How many times a record is merged again when it is written to while
+// being merged.
+const maxAttempts = 3
+
+// Options for Import.
+type Options struct {
+	// Defaults to FieldLevel.
+	Policy Policy
+
+	// With FieldLevel, the dotted paths of fields the import wins for when
+	// they have been edited by hand too, such as fields the import is the
+	// only source of truth for.
+	ImportFields []string
+
+	// Options for the writes, see gorc2.BulkOptions.
+	Concurrency int
+	DeadLetter  gorc2.DeadLetter
+}
+
+// What Import did.
+type Result struct {
+	// Records written, and records left as they were because nothing
+	// changed or their edits won.
+	Written   int `json:"written"`
+	Unchanged int `json:"unchanged"`
+
+	// Records edited by hand that the import changed too.
+	Conflicts int `json:"conflicts"`
+}
+
+// A record that was edited by hand since the last import and that the
+// import changed too, as stored in Conflicts for review.
+type Conflict struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Policy     Policy `json:"policy"`
+
+	// The ref the last import wrote and the ref that was found instead.
+	BaseRef    string `json:"base_ref"`
+	CurrentRef string `json:"current_ref"`
+
+	// The fields both changed, with FieldLevel.
+	Fields []FieldConflict `json:"fields,omitempty"`
+
+	// The values the import and the edit gave the record, and the value
+	// that was kept.
+	Imported json.RawMessage `json:"imported"`
+	Current  json.RawMessage `json:"current"`
+	Kept     json.RawMessage `json:"kept"`
+
+	Time time.Time `json:"time"`
+}
+
+// The last value imported for a record and the ref it was written as.
+type base struct {
+	Ref   string          `json:"ref"`
+	Value json.RawMessage `json:"value"`
+
+	// Set if edits were merged into the value written, so that the record
+	// at Ref is not the value imported.
+	Merged bool `json:"merged,omitempty"`
+}
+
+// Writes records to a collection, merging them with edits made since the
+// last import as the policy says instead of overwriting them. A record is
+// known to be unedited if its ref is the one the last import wrote, and
+// otherwise its fields are compared with what the last import wrote. The
+// first import of a record that already exists treats it as unedited.
+// Writes are conditional on the ref read, so an edit made while a record
+// is merged is merged too. Failed records are handled as by BulkUpdate().
+func Import(
+	client *gorc2.Client, collection string, records []gorc2.BulkRecord,
+	opts *Options,
+) (*Result, error) {
+	i := &importer{
+		client:     client,
+		collection: client.Collection(collection),
+		policy:     FieldLevel,
+		result:     &Result{},
+	}
+	bulk := &gorc2.BulkOptions{}
+	if opts != nil {
+		if opts.Policy != "" {
+			i.policy = opts.Policy
+		}
+		i.importFields = opts.ImportFields
+		bulk.Concurrency = opts.Concurrency
+		bulk.DeadLetter = opts.DeadLetter
+	}
+	op := func(r gorc2.BulkRecord) error {
+		value, err := json.Marshal(r.Value)
+		if err != nil {
+			return err
+		}
+		// Records are written in the shape of the latest migration.
+		value, err = migrations.Upgrade(collection, value)
+		if err != nil {
+			return err
+		}
+		for attempt := 1; ; attempt++ {
+			err := i.importRecord(r.Key, value)
+			if !retryable(err) || attempt == maxAttempts {
+				return err
+			}
+		}
+	}
+	_, err := i.collection.BulkApply(records, bulk, op)
+	return i.result, err
+}
+
+// Returns true if a record was written to while it was being merged.
+func retryable(err error) bool {
+	switch err.(type) {
+	case gorc2.NotMostRecentError, gorc2.AlreadyExistsError:
+		return true
+	}
+	return false
+}
+
+type importer struct {
+	client       *gorc2.Client
+	collection   *gorc2.Collection
+	policy       Policy
+	importFields []string
+
+	mu     sync.Mutex
+	result *Result
+}
+
+func (i *importer) count(written, unchanged, conflicts int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.result.Written += written
+	i.result.Unchanged += unchanged
+	i.result.Conflicts += conflicts
+}
+
+// Imports a single record.
+func (i *importer) importRecord(key string, imported json.RawMessage) error {
+	bases := i.client.Collection(Bases)
+	var b base
+	_, err := bases.Get(keys.Build(keys.ImportBase, i.collection.Name, key),
+		&b)
+	hasBase := err == nil
+	if _, ok := err.(gorc2.NotFoundError); err != nil && !ok {
+		return err
+	}
+	current, err := i.collection.Get(key, nil)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+
+	// New records, and those unedited since the last import, are written
+	// as imported.
+	if current == nil || !hasBase || (current.Ref == b.Ref && !b.Merged) {
+		return i.write(key, current, imported, imported)
+	}
+
+	// Bases kept before a migration are migrated too, so that they compare
+	// equal to the records the migration wrote.
+	upgraded, err := migrations.Upgrade(i.collection.Name, b.Value)
+	if err != nil {
+		return err
+	}
+	baseValue, err := decode(upgraded)
+	if err != nil {
+		return err
+	}
+	importedValue, err := decode(imported)
+	if err != nil {
+		return err
+	}
+	currentValue, err := decode(current.Value)
+	if err != nil {
+		return err
+	}
+	switch {
+	case reflect.DeepEqual(currentValue, baseValue):
+		// Written again without being changed.
+		return i.write(key, current, imported, imported)
+	case reflect.DeepEqual(importedValue, baseValue),
+		reflect.DeepEqual(importedValue, currentValue):
+		// Edited, but the import has nothing new.
+		i.count(0, 1, 0)
+		return nil
+	}
+
+	conflict := &Conflict{
+		Collection: i.collection.Name,
+		Key:        key,
+		Policy:     i.policy,
+		BaseRef:    b.Ref,
+		CurrentRef: current.Ref,
+		Imported:   imported,
+		Current:    current.Value,
+		Time:       time.Now().UTC(),
+	}
+	switch i.policy {
+	case ImportWins:
+		conflict.Kept = imported
+	case ManualWins:
+		conflict.Kept = current.Value
+	case FieldLevel:
+		merged, fields := threeWay(baseValue, importedValue, currentValue,
+			i.importFields)
+		if conflict.Kept, err = json.Marshal(merged); err != nil {
+			return err
+		}
+		conflict.Fields = fields
+	default:
+		return fmt.Errorf("Unknown merge policy %q.", i.policy)
+	}
+	if i.policy == FieldLevel && len(conflict.Fields) == 0 {
+		// The edit and the import changed different fields.
+		return i.write(key, current, conflict.Kept, imported)
+	}
+
+	// The conflict is recorded before the write so that an edit is never
+	// lost without a record of it.
+	conflictKey := keys.Build(keys.ImportConflict, i.collection.Name, key)
+	_, err = i.client.Collection(Conflicts).Update(conflictKey, conflict)
+	if err != nil {
+		return err
+	}
+	if i.policy == ManualWins {
+		i.count(0, 1, 1)
+		return nil
+	}
+	if err := i.write(key, current, conflict.Kept, imported); err != nil {
+		return err
+	}
+	i.count(0, 0, 1)
+	return nil
+}
+
+// Writes a record if it has not changed since current was read, or creates
+// it if current is nil, and keeps the imported value as the base of the
+// next import.
+func (i *importer) write(
+	key string, current *gorc2.Item, value, imported json.RawMessage,
+) error {
+	var item *gorc2.Item
+	var err error
+	if current == nil {
+		item, err = i.collection.Create(key, value)
+	} else {
+		item, err = current.Update(value)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = i.client.Collection(Bases).Update(
+		keys.Build(keys.ImportBase, i.collection.Name, key), &base{
+			Ref:    item.Ref,
+			Value:  imported,
+			Merged: !bytes.Equal(value, imported),
+		})
+	if err == nil {
+		i.count(1, 0, 0)
+	}
+	return err
+}
+
+// Returns the conflicts recorded importing a collection, oldest first.
+func ListConflicts(
+	client *gorc2.Client, collection string,
+) ([]*Conflict, error) {
+	conflicts := []*Conflict{}
+	start, before := keys.Range(keys.ImportConflict, collection)
+	it := client.Collection(Conflicts).List(&gorc2.ListQuery{
+		Limit:     100,
+		StartKey:  start,
+		BeforeKey: before,
+	})
+	for it.Next() {
+		c := &Conflict{}
+		if _, err := it.Get(c); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(a, b int) bool {
+		return conflicts[a].Time.Before(conflicts[b].Time)
+	})
+	return conflicts, it.Error
+}
+
+// Removes a reviewed conflict.
+func ResolveConflict(client *gorc2.Client, collection, key string) error {
+	return client.Collection(Conflicts).Delete(
+		keys.Build(keys.ImportConflict, collection, key))
+}
@@ -0,0 +1,72 @@
+package merge
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/jobs"
+	"context"
+	"encoding/json"
+)
+
+// The type of the jobs importing records in the background, queued with
+// Enqueue.
+const JobType = "import"
+
+// An import to run in the background, the payload of a JobType job.
+type ImportJob struct {
+	Collection string   `json:"collection"`
+	Records    []Record `json:"records"`
+
+	// The Options of the import. Failed records can not be dead lettered,
+	// the job is retried instead.
+	Policy       Policy   `json:"policy,omitempty"`
+	ImportFields []string `json:"import_fields,omitempty"`
+	Concurrency  int      `json:"concurrency,omitempty"`
+
+	// Whether the indexes derived from the collection are rebuilt once the
+	// records are imported.
+	Reindex bool `json:"reindex,omitempty"`
+}
+
+// A record of an ImportJob, kept as the JSON it was given as.
+type Record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Queues an import, returning the job running it.
+func Enqueue(client *gorc2.Client, i *ImportJob) (*jobs.Job, error) {
+	return jobs.Enqueue(client, JobType, i, 0)
+}
+
+// Returns the handler of JobType jobs, which imports the records and then,
+// if the job asks for it, calls reindex with the collection. Imports are
+// retried as a whole, which leaves the records written by an earlier
+// attempt as they are.
+func JobHandler(
+	client *gorc2.Client, reindex func(collection string) error,
+) jobs.Handler {
+	return func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var i ImportJob
+		if err := json.Unmarshal(job.Payload, &i); err != nil {
+			return nil, err
+		}
+		records := make([]gorc2.BulkRecord, len(i.Records))
+		for n, r := range i.Records {
+			records[n] = gorc2.BulkRecord{Key: r.Key, Value: r.Value}
+		}
+		result, err := Import(client, i.Collection, records, &Options{
+			Policy:       i.Policy,
+			ImportFields: i.ImportFields,
+			Concurrency:  i.Concurrency,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if i.Reindex && reindex != nil {
+			if err := reindex(i.Collection); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,170 @@
+// Package merge imports records without losing manual edits. The value each
+// import writes is kept as the base of the next, so when a record has been
+// edited since, the edit is found by comparing it with the base and a
+// Policy decides what is kept. Records edited by hand that the import also
+// changes are conflicts, recorded for review.
+package merge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Decides what is kept when a record was edited since the last import and
+// the import changes it too.
+type Policy string
+
+const (
+	// The imported record replaces the edited one, as without merging.
+	ImportWins Policy = "import-wins"
+
+	// The edited record is kept and the import of it skipped.
+	ManualWins Policy = "manual-wins"
+
+	// Fields changed only by the import or only by hand take that change.
+	// Fields changed by both keep the edit unless they are listed in
+	// Options.ImportFields.
+	FieldLevel Policy = "field"
+)
+
+// Returns the Policy with the given name.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case ImportWins, ManualWins, FieldLevel:
+		return p, nil
+	}
+	return "", fmt.Errorf("Unknown merge policy %q, must be %s, %s or %s.",
+		name, ImportWins, ManualWins, FieldLevel)
+}
+
+// Which side a conflicting field was taken from.
+const (
+	FromImport = "import"
+	FromManual = "manual"
+)
+
+// A field that was changed both by hand and by the import.
+type FieldConflict struct {
+	// The dotted path of the field, such as "ChargeDeviceLocation.Address.
+	// PostCode". Arrays are compared whole.
+	Path string `json:"path"`
+
+	// FromImport or FromManual.
+	Kept string `json:"kept"`
+
+	// The values of the field. Missing fields are null.
+	Base     interface{} `json:"base"`
+	Imported interface{} `json:"imported"`
+	Current  interface{} `json:"current"`
+}
+
+// Decodes a JSON value keeping numbers as written.
+func decode(value []byte) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+// Returns true if a field path is one of the given fields or inside one.
+func within(path string, fields []string) bool {
+	for _, f := range fields {
+		if path == f || strings.HasPrefix(path, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// A field of a record, which may be missing.
+type field struct {
+	value   interface{}
+	present bool
+}
+
+func (f field) equal(g field) bool {
+	return f.present == g.present && reflect.DeepEqual(f.value, g.value)
+}
+
+// Returns the named field of an object, which is missing if f is not an
+// object.
+func (f field) get(name string) field {
+	object, _ := f.value.(map[string]interface{})
+	value, ok := object[name]
+	return field{value, ok}
+}
+
+// Three way merges records, see threeWay().
+type merger struct {
+	importFields []string
+	conflicts    []FieldConflict
+}
+
+// Returns the merge of a field, or of a record if path is "".
+func (m *merger) merge(path string, base, imported, current field) field {
+	baseObject, baseOK := base.value.(map[string]interface{})
+	importedObject, importedOK := imported.value.(map[string]interface{})
+	currentObject, currentOK := current.value.(map[string]interface{})
+	if importedOK && currentOK && (baseOK || !base.present) {
+		names := map[string]bool{}
+		for _, object := range []map[string]interface{}{
+			baseObject, importedObject, currentObject,
+		} {
+			for name := range object {
+				names[name] = true
+			}
+		}
+		merged := map[string]interface{}{}
+		for name := range names {
+			p := name
+			if path != "" {
+				p = path + "." + name
+			}
+			f := m.merge(p, base.get(name), imported.get(name),
+				current.get(name))
+			if f.present {
+				merged[name] = f.value
+			}
+		}
+		return field{merged, true}
+	}
+
+	switch {
+	case imported.equal(base), imported.equal(current):
+		return current
+	case current.equal(base):
+		return imported
+	}
+	conflict := FieldConflict{Path: path, Kept: FromManual,
+		Base: base.value, Imported: imported.value, Current: current.value}
+	if within(path, m.importFields) {
+		conflict.Kept = FromImport
+	}
+	m.conflicts = append(m.conflicts, conflict)
+	if conflict.Kept == FromImport {
+		return imported
+	}
+	return current
+}
+
+// Three way merges the imported and current values of a record against the
+// base written by the last import. Objects are merged field by field and
+// anything else is taken whole. Returns the merged value and the fields
+// that both sides changed, with importFields deciding which side those are
+// taken from.
+func threeWay(
+	base, imported, current interface{}, importFields []string,
+) (interface{}, []FieldConflict) {
+	m := &merger{importFields: importFields}
+	merged := m.merge("", field{base, true}, field{imported, true},
+		field{current, true})
+	sort.Slice(m.conflicts, func(i, j int) bool {
+		return m.conflicts[i].Path < m.conflicts[j].Path
+	})
+	return merged.value, m.conflicts
+}
@@ -0,0 +1,20 @@
+package migrations
+
+import (
+	"chargepoints/model"
+)
+
+// The migrations of chargepoints. Append new ones with the next version;
+// those that have run must not be changed.
+func init() {
+	Register(model.ChargePoints, &Migration{
+		Version: 1,
+		Name:    "baseline",
+		// Changes nothing but the version, so that later migrations can
+		// tell documents written in the shape the importers have always
+		// written from those that are not.
+		Transform: func(doc map[string]interface{}) error { return nil },
+		Rollback: "Nothing to undo, documents at version 1 are otherwise " +
+			"as they were.",
+	})
+}
@@ -0,0 +1,354 @@
+// Package migrations changes the shape of the documents already stored in a
+// collection, such as restructuring the Connector array of chargepoints, by
+// applying numbered transforms written in Go to every document.
+//
+// Each document records the version of the last migration applied to it in
+// its schema_version field, a document without one being at version 0, so
+// a migration is applied to a document once however often Run is called.
+// Run goes through the collection in key order and checkpoints the last key
+// it migrated, so an interrupted run resumes where it stopped. The versions
+// applied are recorded with their rollback notes, which say how to undo
+// them; migrations are not undone automatically, and the usual way back is
+// to restore the backup taken before running them.
+//
+// Imports migrate the records they write too, so documents written in the
+// shape of an older version are brought up to date as they arrive.
+package migrations
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The collection the state of the migrations of each collection is kept
+// in, keyed by keys.Migration keys of the collection name.
+const State = "MigrationState"
+
+// The field of a document holding the version it was migrated to.
+const VersionField = "schema_version"
+
+// How many documents are migrated between checkpoints.
+const checkpointEvery = 100
+
+// How many times a document is migrated again when it is written to while
+// being migrated.
+const maxAttempts = 3
+
+// A change to the documents of a collection.
+type Migration struct {
+	// Versions start at 1 and are applied in order. Once a migration has
+	// run its version must not be reused.
+	Version int
+	Name    string
+
+	// Changes a document in place. Numbers are json.Number, as written.
+	// Documents that are not JSON objects are skipped.
+	Transform func(doc map[string]interface{}) error
+
+	// How to undo the migration, for whoever has to.
+	Rollback string
+}
+
+// The migrations of each collection, sorted by version.
+var registry = struct {
+	sync.Mutex
+	m map[string][]*Migration
+}{m: make(map[string][]*Migration)}
+
+// Adds a migration of a collection. Panics if the version is not above 0
+// or is already taken.
+func Register(collection string, m *Migration) {
+	registry.Lock()
+	defer registry.Unlock()
+	if m.Version <= 0 {
+		panic(fmt.Sprintf("migrations: version %d of %s is not above 0",
+			m.Version, collection))
+	}
+	list := registry.m[collection]
+	for _, other := range list {
+		if other.Version == m.Version {
+			panic(fmt.Sprintf("migrations: version %d of %s registered "+
+				"twice", m.Version, collection))
+		}
+	}
+	list = append(list, m)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	registry.m[collection] = list
+}
+
+// Returns the migrations of a collection in order.
+func For(collection string) []*Migration {
+	registry.Lock()
+	defer registry.Unlock()
+	return append([]*Migration(nil), registry.m[collection]...)
+}
+
+// Returns the latest version of a collection, or 0 if it has no
+// migrations.
+func Latest(collection string) int {
+	list := For(collection)
+	if len(list) == 0 {
+		return 0
+	}
+	return list[len(list)-1].Version
+}
+
+// What has been done to a collection, as stored in State.
+type Status struct {
+	Collection string `json:"collection"`
+
+	// Every document has been migrated to this version.
+	Version int `json:"version"`
+
+	// The latest version registered, which Run migrates to by default.
+	Latest int `json:"latest"`
+
+	// The run in progress, or interrupted, and the last that finished.
+	Running  *Progress `json:"running,omitempty"`
+	Finished *Progress `json:"finished,omitempty"`
+
+	// The migrations applied, oldest first.
+	Applied []*Applied `json:"applied"`
+}
+
+// How far a run of the migrations of a collection has got.
+type Progress struct {
+	// The version documents are migrated to.
+	Target int `json:"target"`
+
+	// The last key migrated, which a resumed run starts after.
+	AfterKey string `json:"after_key,omitempty"`
+
+	Started time.Time `json:"started"`
+
+	// The number of documents read and of those changed so far.
+	Scanned  int `json:"scanned"`
+	Migrated int `json:"migrated"`
+}
+
+// A migration that has been applied to every document.
+type Applied struct {
+	Version  int       `json:"version"`
+	Name     string    `json:"name"`
+	Rollback string    `json:"rollback,omitempty"`
+	Finished time.Time `json:"finished"`
+}
+
+// Options for Run.
+type Options struct {
+	// The version to migrate to, which defaults to the latest. Documents
+	// at a later version are left as they are.
+	Target int
+
+	// Cancels the run, leaving its checkpoint to resume from. Defaults to
+	// context.Background().
+	Context context.Context
+}
+
+// Returns the status of the migrations of a collection.
+func GetStatus(client *gorc2.Client, collection string) (*Status, error) {
+	s, _, err := getStatus(client, collection)
+	return s, err
+}
+
+// Returns the status of a collection and the item it is stored as, which
+// is nil if nothing has been stored yet.
+func getStatus(client *gorc2.Client, collection string) (
+	*Status, *gorc2.Item, error,
+) {
+	s := &Status{Collection: collection, Applied: []*Applied{}}
+	item, err := client.Collection(State).Get(
+		keys.Build(keys.Migration, collection), s)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		item, err = nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	s.Latest = Latest(collection)
+	return s, item, nil
+}
+
+// Migrates every document of a collection to the target version, resuming
+// a run to the same version that was interrupted, and returns the status
+// once it is done. A transform that fails stops the run; the checkpoint is
+// left at the last document migrated so it resumes once the migration is
+// fixed. Writes are conditional on the ref read, so a document written
+// while it is migrated is read and migrated again.
+func Run(client *gorc2.Client, collection string, opts *Options) (
+	*Status, error,
+) {
+	ctx := context.Background()
+	target := Latest(collection)
+	if opts != nil {
+		if opts.Context != nil {
+			ctx = opts.Context
+		}
+		if opts.Target != 0 {
+			target = opts.Target
+		}
+	}
+	if target < 0 || target > Latest(collection) {
+		return nil, fmt.Errorf("%s has no migration %d.", collection, target)
+	}
+	var pending []*Migration
+	for _, m := range For(collection) {
+		if m.Version <= target {
+			pending = append(pending, m)
+		}
+	}
+
+	s, item, err := getStatus(client, collection)
+	if err != nil {
+		return nil, err
+	}
+	if s.Running == nil || s.Running.Target != target {
+		s.Running = &Progress{Target: target, Started: time.Now().UTC()}
+	}
+	save := func() error {
+		var err error
+		if item == nil {
+			item, err = client.Collection(State).Create(
+				keys.Build(keys.Migration, collection), s)
+		} else {
+			item, err = item.Update(s)
+		}
+		return err
+	}
+	if err := save(); err != nil {
+		return nil, err
+	}
+
+	c := client.Collection(collection)
+	it := c.List(&gorc2.ListQuery{Limit: 100, AfterKey: s.Running.AfterKey})
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			save()
+			return s, err
+		}
+		raw := it.Raw()
+		changed, err := migrate(c, raw, pending)
+		if err != nil {
+			// Keeps the progress made up to the failed document.
+			save()
+			return s, err
+		}
+		s.Running.AfterKey = raw.Key
+		s.Running.Scanned++
+		if changed {
+			s.Running.Migrated++
+		}
+		if s.Running.Scanned%checkpointEvery == 0 {
+			if err := save(); err != nil {
+				return s, err
+			}
+		}
+	}
+	if it.Error != nil {
+		save()
+		return s, it.Error
+	}
+
+	now := time.Now().UTC()
+	for _, m := range pending {
+		if m.Version > s.Version {
+			s.Applied = append(s.Applied, &Applied{
+				Version:  m.Version,
+				Name:     m.Name,
+				Rollback: m.Rollback,
+				Finished: now,
+			})
+		}
+	}
+	if target > s.Version {
+		s.Version = target
+	}
+	s.Running, s.Finished = nil, s.Running
+	return s, save()
+}
+
+// Applies the pending migrations to a document and writes it if that
+// changed it, returning whether it did.
+func migrate(
+	c *gorc2.Collection, raw gorc2.RawResult, pending []*Migration,
+) (bool, error) {
+	item := &gorc2.Item{Collection: c, Key: raw.Key, Ref: raw.Ref,
+		Value: raw.Value}
+	for attempt := 1; ; attempt++ {
+		value, changed, err := apply(item.Value, pending)
+		if err != nil {
+			return false, fmt.Errorf("Unable to migrate %s: %s", item.Key,
+				err)
+		} else if !changed {
+			return false, nil
+		}
+		_, err = item.Update(value)
+		if _, ok := err.(gorc2.NotMostRecentError); ok &&
+			attempt < maxAttempts {
+			if item, err = c.Get(raw.Key, nil); err != nil {
+				return false, err
+			}
+			continue
+		}
+		return err == nil, err
+	}
+}
+
+// Returns a document of a collection migrated to the latest version, or
+// unchanged if it is already at it or is not a JSON object.
+func Upgrade(collection string, value json.RawMessage) (
+	json.RawMessage, error,
+) {
+	value, _, err := apply(value, For(collection))
+	return value, err
+}
+
+// Applies the migrations above a document's version to it, returning it
+// and whether any were.
+func apply(value json.RawMessage, migrations []*Migration) (
+	json.RawMessage, bool, error,
+) {
+	if len(migrations) == 0 {
+		return value, false, nil
+	}
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if decoder.Decode(&doc) != nil || doc == nil {
+		return value, false, nil
+	}
+	version := 0
+	if n, ok := doc[VersionField].(json.Number); ok {
+		v, err := n.Int64()
+		if err != nil {
+			return nil, false, fmt.Errorf("Invalid %s %s.", VersionField, n)
+		}
+		version = int(v)
+	}
+
+	changed := false
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := m.Transform(doc); err != nil {
+			return nil, false, fmt.Errorf("Migration %d (%s) failed: %s",
+				m.Version, m.Name, err)
+		}
+		doc[VersionField] = m.Version
+		changed = true
+	}
+	if !changed {
+		return value, false, nil
+	}
+	migrated, err := json.Marshal(doc)
+	return migrated, true, err
+}
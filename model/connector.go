@@ -0,0 +1,201 @@
+package model
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The collection the connector mapping table is stored in, keyed by
+// pattern.
+const ConnectorTypes = "ConnectorTypes"
+
+// The field added to each entry of a chargepoint's Connector array holding
+// the canonical standard. The upstream ConnectorType is left as it is.
+const ConnectorStandardField = "ConnectorStandard"
+
+// The canonical connector standards.
+const (
+	ConnectorCCS      = "CCS"
+	ConnectorCHAdeMO  = "CHAdeMO"
+	ConnectorTesla    = "Tesla"
+	ConnectorType2    = "Type2"
+	ConnectorType1    = "Type1"
+	ConnectorCommando = "Commando"
+	ConnectorThreePin = "ThreePin"
+	ConnectorUnknown  = "Unknown"
+)
+
+// When a spelling matches patterns of several standards the first of them
+// in this list wins. Combined connectors come first since their names also
+// mention the AC connector they extend, as in "CCS Type 2 Combo".
+var connectorPrecedence = []string{
+	ConnectorCCS,
+	ConnectorCHAdeMO,
+	ConnectorTesla,
+	ConnectorType2,
+	ConnectorType1,
+	ConnectorCommando,
+	ConnectorThreePin,
+}
+
+// Maps upstream connector spellings containing Pattern to Standard. Both the
+// pattern and the spelling are compared lower cased with everything but
+// letters and digits removed, so "IEC 62196-2" is matched by "iec621962".
+type ConnectorMapping struct {
+	Pattern  string `json:"pattern"`
+	Standard string `json:"standard"`
+}
+
+// The mapping table used when none has been stored.
+var DefaultConnectorMappings = []ConnectorMapping{
+	{"ccs", ConnectorCCS},
+	{"combo", ConnectorCCS},
+	{"chademo", ConnectorCHAdeMO},
+	{"jevsg105", ConnectorCHAdeMO},
+	{"tesla", ConnectorTesla},
+	{"supercharger", ConnectorTesla},
+	{"type2", ConnectorType2},
+	{"mennekes", ConnectorType2},
+	{"iec621962", ConnectorType2},
+	{"iec62196", ConnectorType2},
+	{"type1", ConnectorType1},
+	{"j1772", ConnectorType1},
+	{"yazaki", ConnectorType1},
+	{"commando", ConnectorCommando},
+	{"iec60309", ConnectorCommando},
+	{"bs1363", ConnectorThreePin},
+	{"3pin", ConnectorThreePin},
+	{"typeg", ConnectorThreePin},
+}
+
+// Maps connector spellings to canonical standards.
+type ConnectorNormalizer struct {
+	mappings []ConnectorMapping
+}
+
+// Returns a ConnectorNormalizer using the given mapping table.
+func NewConnectorNormalizer(mappings []ConnectorMapping) *ConnectorNormalizer {
+	n := &ConnectorNormalizer{}
+	for _, m := range mappings {
+		if pattern := squash(m.Pattern); pattern != "" {
+			n.mappings = append(n.mappings, ConnectorMapping{
+				Pattern:  pattern,
+				Standard: m.Standard,
+			})
+		}
+	}
+	return n
+}
+
+// Returns the standard for an upstream connector spelling, or
+// ConnectorUnknown if no pattern matches.
+func (n *ConnectorNormalizer) Standard(spelling string) string {
+	s := squash(spelling)
+	matched := make(map[string]bool)
+	for _, m := range n.mappings {
+		if strings.Contains(s, m.Pattern) {
+			matched[m.Standard] = true
+		}
+	}
+	for _, standard := range connectorPrecedence {
+		if matched[standard] {
+			return standard
+		}
+	}
+
+	// Standards added to the stored table but missing from the precedence
+	// list are picked in name order so the result is stable.
+	var others []string
+	for standard := range matched {
+		others = append(others, standard)
+	}
+	if len(others) == 0 {
+		return ConnectorUnknown
+	}
+	sort.Strings(others)
+	return others[0]
+}
+
+// Sets the ConnectorStandardField of each entry in the Connector array of a
+// chargepoint and returns the updated value along with any spellings that
+// were not recognised. Values without a Connector array are returned as
+// they are.
+func (n *ConnectorNormalizer) Normalize(
+	raw json.RawMessage,
+) (json.RawMessage, []string, error) {
+	var value map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, nil, err
+	}
+	connectors, ok := value["Connector"].([]interface{})
+	if !ok {
+		return raw, nil, nil
+	}
+
+	var unknown []string
+	for _, c := range connectors {
+		connector, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		spelling, _ := connector["ConnectorType"].(string)
+		standard := n.Standard(spelling)
+		if standard == ConnectorUnknown {
+			unknown = append(unknown, spelling)
+		}
+		connector[ConnectorStandardField] = standard
+	}
+	data, err := json.Marshal(value)
+	return json.RawMessage(data), unknown, err
+}
+
+// Returns a ConnectorNormalizer using the mapping table stored in
+// ConnectorTypes, or DefaultConnectorMappings if none is stored.
+func (s *Store) ConnectorNormalizer() (*ConnectorNormalizer, error) {
+	mappings, err := list[ConnectorMapping](s, ConnectorTypes)
+	if err != nil {
+		return nil, err
+	} else if len(mappings) == 0 {
+		return NewConnectorNormalizer(DefaultConnectorMappings), nil
+	}
+	table := make([]ConnectorMapping, len(mappings))
+	for i, m := range mappings {
+		table[i] = *m
+	}
+	return NewConnectorNormalizer(table), nil
+}
+
+// Adds or replaces an entry in the stored mapping table. Once any entry is
+// stored the defaults are no longer used, so SeedConnectorMappings should be
+// called first.
+func (s *Store) PutConnectorMapping(m ConnectorMapping) error {
+	m.Pattern = squash(m.Pattern)
+	_, err := s.client.Collection(ConnectorTypes).Update(m.Pattern, &m)
+	return err
+}
+
+// Writes DefaultConnectorMappings to the stored mapping table.
+func (s *Store) SeedConnectorMappings() error {
+	records := make([]gorc2.BulkRecord, len(DefaultConnectorMappings))
+	for i, m := range DefaultConnectorMappings {
+		records[i] = gorc2.BulkRecord{Key: m.Pattern, Value: m}
+	}
+	_, err := s.client.Collection(ConnectorTypes).BulkUpdate(records, nil)
+	return err
+}
+
+// Lower cases a string and drops everything but letters and digits.
+func squash(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
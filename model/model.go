@@ -0,0 +1,120 @@
+// Package model holds the typed reference data stored alongside the
+// chargepoints, such as operators and networks, and the graph relations
+// between them and the chargepoints.
+package model
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"strings"
+	"unicode"
+)
+
+// The collections the models are stored in.
+const (
+	ChargePoints = "ChargePoints"
+	Operators    = "Operators"
+	Networks     = "Networks"
+)
+
+// Reads and writes models in Orchestrate.
+type Store struct {
+	client *gorc2.Client
+}
+
+// Returns a Store using the given client.
+func NewStore(client *gorc2.Client) *Store {
+	return &Store{client: client}
+}
+
+// Returns an ID for a name made of its lower cased letters and digits, with
+// runs of anything else replaced by a single dash, so "Source London" becomes
+// "source-london".
+func Slug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// Creates relations of the given kinds in both directions between two
+// items.
+func (s *Store) link(
+	collection, key, kind, toCollection, toKey, reverseKind string,
+) error {
+	err := s.client.Collection(collection).Link(key, kind, toCollection, toKey)
+	if err != nil {
+		return err
+	}
+	return s.client.Collection(toCollection).Link(toKey, reverseKind,
+		collection, key)
+}
+
+// Removes relations created by link().
+func (s *Store) unlink(
+	collection, key, kind, toCollection, toKey, reverseKind string,
+) error {
+	err := s.client.Collection(collection).Unlink(key, kind, toCollection,
+		toKey)
+	if err != nil {
+		return err
+	}
+	return s.client.Collection(toCollection).Unlink(toKey, reverseKind,
+		collection, key)
+}
+
+// Returns every value in a collection.
+func list[T any](s *Store, collection string) ([]*T, error) {
+	values := []*T{}
+	it := s.client.Collection(collection).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		value := new(T)
+		if _, err := it.Get(value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, it.Error
+}
+
+// Moves every operator, network and tariff relation of one chargepoint to
+// another, for example when merging duplicate records.
+func (s *Store) MoveLinks(fromID, toID string) error {
+	moves := []struct {
+		kind         string
+		link, unlink func(id, chargepointID string) error
+	}{
+		{OperatedByRelation, s.LinkOperator, s.UnlinkOperator},
+		{MemberOfRelation, s.LinkNetwork, s.UnlinkNetwork},
+		{PricedByRelation, s.LinkTariff, s.UnlinkTariff},
+	}
+	for _, move := range moves {
+		var ids []string
+		it := s.client.Collection(ChargePoints).GetLinks(fromID,
+			&gorc2.GetLinksQuery{Limit: 100}, move.kind)
+		for it.Next() {
+			ids = append(ids, it.Raw().Key)
+		}
+		if it.Error != nil {
+			return it.Error
+		}
+		for _, id := range ids {
+			if err := move.link(id, toID); err != nil {
+				return err
+			}
+			if err := move.unlink(id, fromID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
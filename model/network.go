@@ -0,0 +1,70 @@
+package model
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"fmt"
+)
+
+// The relation kinds between a network and its member chargepoints.
+const (
+	MemberRelation   = "member"
+	MemberOfRelation = "member_of"
+)
+
+// A charging network or scheme, such as Source London, that chargepoints
+// from one or more operators belong to.
+type Network struct {
+	// The key of the network, see Slug().
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Website string `json:"website,omitempty"`
+}
+
+// Returns the network with the given ID.
+func (s *Store) Network(id string) (*Network, error) {
+	network := &Network{}
+	if _, err := s.client.Collection(Networks).Get(id, network); err != nil {
+		return nil, err
+	}
+	return network, nil
+}
+
+// Returns every network ordered by ID.
+func (s *Store) Networks() ([]*Network, error) {
+	return list[Network](s, Networks)
+}
+
+// Writes a network, setting its ID from its name if it is empty.
+func (s *Store) PutNetwork(network *Network) error {
+	if network.ID == "" {
+		network.ID = Slug(network.Name)
+	}
+	if network.ID == "" {
+		return fmt.Errorf("Network has no ID or name.")
+	}
+	_, err := s.client.Collection(Networks).Update(network.ID, network)
+	return err
+}
+
+// Deletes a network. Relations to its chargepoints are not removed.
+func (s *Store) DeleteNetwork(id string) error {
+	return s.client.Collection(Networks).Delete(id)
+}
+
+// Records that a chargepoint is a member of a network.
+func (s *Store) LinkNetwork(networkID, chargepointID string) error {
+	return s.link(Networks, networkID, MemberRelation, ChargePoints,
+		chargepointID, MemberOfRelation)
+}
+
+// Removes a chargepoint from a network.
+func (s *Store) UnlinkNetwork(networkID, chargepointID string) error {
+	return s.unlink(Networks, networkID, MemberRelation, ChargePoints,
+		chargepointID, MemberOfRelation)
+}
+
+// Returns an Iterator over the member chargepoints of a network.
+func (s *Store) NetworkChargepoints(networkID string) *gorc2.Iterator {
+	return s.client.Collection(Networks).GetLinks(networkID,
+		&gorc2.GetLinksQuery{Limit: 100}, MemberRelation)
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"fmt"
+)
+
+// The relation kinds between an operator and the chargepoints it runs.
+const (
+	OperatesRelation   = "operates"
+	OperatedByRelation = "operated_by"
+)
+
+// A company or council that owns and runs chargepoints, the DeviceOwner of
+// a chargepoint.
+type Operator struct {
+	// The key of the operator, see Slug().
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Website string `json:"website,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+}
+
+// Returns the operator with the given ID.
+func (s *Store) Operator(id string) (*Operator, error) {
+	operator := &Operator{}
+	if _, err := s.client.Collection(Operators).Get(id, operator); err != nil {
+		return nil, err
+	}
+	return operator, nil
+}
+
+// Returns every operator ordered by ID.
+func (s *Store) Operators() ([]*Operator, error) {
+	return list[Operator](s, Operators)
+}
+
+// Writes an operator, setting its ID from its name if it is empty.
+func (s *Store) PutOperator(operator *Operator) error {
+	if operator.ID == "" {
+		operator.ID = Slug(operator.Name)
+	}
+	if operator.ID == "" {
+		return fmt.Errorf("Operator has no ID or name.")
+	}
+	_, err := s.client.Collection(Operators).Update(operator.ID, operator)
+	return err
+}
+
+// Deletes an operator. Relations to its chargepoints are not removed.
+func (s *Store) DeleteOperator(id string) error {
+	return s.client.Collection(Operators).Delete(id)
+}
+
+// Records that an operator runs a chargepoint.
+func (s *Store) LinkOperator(operatorID, chargepointID string) error {
+	return s.link(Operators, operatorID, OperatesRelation, ChargePoints,
+		chargepointID, OperatedByRelation)
+}
+
+// Removes the record that an operator runs a chargepoint.
+func (s *Store) UnlinkOperator(operatorID, chargepointID string) error {
+	return s.unlink(Operators, operatorID, OperatesRelation, ChargePoints,
+		chargepointID, OperatedByRelation)
+}
+
+// Returns an Iterator over the chargepoints an operator runs.
+func (s *Store) OperatorChargepoints(operatorID string) *gorc2.Iterator {
+	return s.client.Collection(Operators).GetLinks(operatorID,
+		&gorc2.GetLinksQuery{Limit: 100}, OperatesRelation)
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"fmt"
+)
+
+// The collection tariffs are stored in.
+const Tariffs = "Tariffs"
+
+// The relation kinds between a chargepoint and the tariffs it charges.
+const (
+	PricedByRelation  = "priced_by"
+	AppliesToRelation = "applies_to"
+)
+
+// The field of a chargepoint holding the lowest PricePerkWh of its tariffs,
+// so chargepoints can be searched by price. Chargepoints without a tariff do
+// not have the field.
+const MinPriceField = "MinPricePerkWh"
+
+// The price of charging at a chargepoint. All prices are in Currency
+// including VAT.
+type Tariff struct {
+	// The key of the tariff, see Slug().
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Currency    string `json:"currency"`
+
+	// The price per kWh delivered, per minute connected and per session.
+	PricePerkWh    float64 `json:"price_per_kwh"`
+	PricePerMinute float64 `json:"price_per_minute,omitempty"`
+	ConnectionFee  float64 `json:"connection_fee,omitempty"`
+}
+
+// Returns the tariff with the given ID.
+func (s *Store) Tariff(id string) (*Tariff, error) {
+	tariff := &Tariff{}
+	if _, err := s.client.Collection(Tariffs).Get(id, tariff); err != nil {
+		return nil, err
+	}
+	return tariff, nil
+}
+
+// Returns every tariff ordered by ID.
+func (s *Store) Tariffs() ([]*Tariff, error) {
+	return list[Tariff](s, Tariffs)
+}
+
+// Writes a tariff, setting its ID from its name if it is empty and its
+// currency to GBP if that is empty. The MinPriceField of every chargepoint
+// it applies to is updated to match.
+func (s *Store) PutTariff(tariff *Tariff) error {
+	if tariff.ID == "" {
+		tariff.ID = Slug(tariff.Name)
+	}
+	if tariff.ID == "" {
+		return fmt.Errorf("Tariff has no ID or name.")
+	} else if tariff.PricePerkWh < 0 || tariff.PricePerMinute < 0 ||
+		tariff.ConnectionFee < 0 {
+		return fmt.Errorf("Tariff %s has a negative price.", tariff.ID)
+	}
+	if tariff.Currency == "" {
+		tariff.Currency = "GBP"
+	}
+	if _, err := s.client.Collection(Tariffs).Update(tariff.ID, tariff); err != nil {
+		return err
+	}
+
+	it := s.TariffChargepoints(tariff.ID)
+	for it.Next() {
+		if err := s.refreshPrice(it.Raw().Key); err != nil {
+			return err
+		}
+	}
+	return it.Error
+}
+
+// Deletes a tariff. Relations to its chargepoints are not removed.
+func (s *Store) DeleteTariff(id string) error {
+	return s.client.Collection(Tariffs).Delete(id)
+}
+
+// Records that a chargepoint charges a tariff and updates its price.
+func (s *Store) LinkTariff(tariffID, chargepointID string) error {
+	err := s.link(ChargePoints, chargepointID, PricedByRelation, Tariffs,
+		tariffID, AppliesToRelation)
+	if err != nil {
+		return err
+	}
+	return s.refreshPrice(chargepointID)
+}
+
+// Removes a tariff from a chargepoint and updates its price.
+func (s *Store) UnlinkTariff(tariffID, chargepointID string) error {
+	err := s.unlink(ChargePoints, chargepointID, PricedByRelation, Tariffs,
+		tariffID, AppliesToRelation)
+	if err != nil {
+		return err
+	}
+	return s.refreshPrice(chargepointID)
+}
+
+// Returns an Iterator over the chargepoints a tariff applies to.
+func (s *Store) TariffChargepoints(tariffID string) *gorc2.Iterator {
+	return s.client.Collection(Tariffs).GetLinks(tariffID,
+		&gorc2.GetLinksQuery{Limit: 100}, AppliesToRelation)
+}
+
+// Returns the tariffs a chargepoint charges.
+func (s *Store) ChargepointTariffs(chargepointID string) ([]*Tariff, error) {
+	tariffs := []*Tariff{}
+	it := s.client.Collection(ChargePoints).GetLinks(chargepointID,
+		&gorc2.GetLinksQuery{Limit: 100}, PricedByRelation)
+	for it.Next() {
+		tariff := &Tariff{}
+		if _, err := it.Get(tariff); err != nil {
+			return nil, err
+		}
+		tariffs = append(tariffs, tariff)
+	}
+	return tariffs, it.Error
+}
+
+// Sets the MinPriceField of a chargepoint from its tariffs, removing it if
+// it has none.
+func (s *Store) refreshPrice(chargepointID string) error {
+	tariffs, err := s.ChargepointTariffs(chargepointID)
+	if err != nil {
+		return err
+	}
+
+	collection := s.client.Collection(ChargePoints)
+	for attempt := 0; ; attempt++ {
+		var doc map[string]interface{}
+		item, err := collection.Get(chargepointID, &doc)
+		if err != nil {
+			return err
+		} else if doc == nil {
+			return fmt.Errorf("Chargepoint %s is not an object.",
+				chargepointID)
+		}
+
+		delete(doc, MinPriceField)
+		for _, tariff := range tariffs {
+			if min, ok := doc[MinPriceField].(float64); !ok ||
+				tariff.PricePerkWh < min {
+				doc[MinPriceField] = tariff.PricePerkWh
+			}
+		}
+
+		_, err = item.Update(doc)
+		if _, ok := err.(gorc2.NotMostRecentError); ok && attempt < 5 {
+			continue
+		}
+		return err
+	}
+}
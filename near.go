@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// The search radius in kilometers used by the nearby endpoints when none is
+// given, and the largest radius allowed.
+const (
+	defaultNearRadius = 5.0
+	maxNearRadius     = 50.0
+)
+
+// Returns the chargepoints within the radius parameter of the lat and lon
+// parameters, nearest first.
+func near(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	lat, latErr := strconv.ParseFloat(ctx.Params["lat"], 64)
+	lon, lonErr := strconv.ParseFloat(ctx.Params["lon"], 64)
+	if latErr != nil || lonErr != nil {
+		ctx.Abort(400, "Missing or invalid lat and lon.")
+		return
+	}
+	nearby(ctx, "near", collection, lat, lon, time.Now())
+}
+
+// Returns the chargepoints within the radius parameter of the postcode in
+// the code parameter, nearest first.
+func nearPostcode(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	start := time.Now()
+	lat, lon, err := lookupPostcode(ctx.Request.Context(), ctx.Params["code"])
+	if _, ok := err.(unknownPostcodeError); ok {
+		ctx.Abort(404, err.Error())
+		return
+	} else if err != nil {
+		log.Println(err)
+		ctx.Abort(502, "Unable to look up postcode.")
+		return
+	}
+	nearby(ctx, "near-postcode", collection, lat, lon, start)
+}
+
+// Writes the chargepoints within the radius parameter of a point, nearest
+// first. Only chargepoints also matching the query parameter, if given, are
+// included. The search is for the box around the circle since that works
+// with every backend, and the corners are then dropped. The search is
+// recorded as made through the given endpoint at start.
+func nearby(
+	ctx *Context, endpoint, collection string, lat, lon float64,
+	start time.Time,
+) {
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+
+	radius := defaultNearRadius
+	if r := ctx.Params["radius"]; r != "" {
+		var err error
+		radius, err = strconv.ParseFloat(r, 64)
+		if err != nil || radius <= 0 || radius > maxNearRadius {
+			ctx.Abort(400, fmt.Sprintf("Radius must be a number of "+
+				"kilometers up to %g.", maxNearRadius))
+			return
+		}
+	}
+
+	// One degree of latitude is 111km, degrees of longitude shrink towards
+	// the poles.
+	dLat := radius / 111.32
+	dLon := radius / (111.32 * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+	query := fmt.Sprintf("value.%s:IN:{north:%g south:%g east:%g west:%g}",
+		locationField, lat+dLat, lat-dLat, lon+dLon, lon-dLon)
+	if extra := ctx.Params["query"]; extra != "" {
+		query += " AND (" + extra + ")"
+	}
+	it := orc.Collection(collection).WithContext(traceContext(ctx.Request)).
+		Search(query, &gorc2.SearchQuery{Limit: 100}).
+		SortByDistanceFrom(locationField, lat, lon)
+
+	results := Results{}
+	for it.Next() {
+		raw := it.Raw()
+		if float64(raw.Distance) > radius {
+			break
+		}
+		results.Results = append(results.Results,
+			Result{Key: raw.Key, Ref: raw.Ref, Value: raw.Value})
+	}
+	results.Count = len(results.Results)
+	if it.Error == nil {
+		recordSearch(ctx, endpoint, collection, results.Count, start)
+		if notModified(ctx, resultsETag(ctx, results.Results)) {
+			return
+		}
+	}
+	transformResults(ctx, collection, results.Results)
+	if wantsJSONAPI(ctx) {
+		writeAPIChargepoints(ctx, collection, results.Results, it.Error)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+
+	if it.Error != nil {
+		ctx.WriteHeader(502)
+		encoder.Encode(it.Error)
+		log.Println(it.Error)
+	} else {
+		encoder.Encode(&results)
+	}
+
+	ctx.Write(buf.Bytes())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"chargepoints/openapi"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// Query parameters several endpoints share.
+var (
+	queryParam = openapi.Param{Name: "query",
+		Description: "A Lucene query the records must also match."}
+	radiusParam = openapi.Param{Name: "radius", Type: "number",
+		Description: "In kilometers."}
+)
+
+const apiDescription = "Search the chargepoints of the UK. Every /api/ " +
+	"route is also served under /v1/, which wraps JSON responses in an " +
+	"envelope of data, meta, links and errors."
+
+var openAPI struct {
+	once sync.Once
+	data []byte
+}
+
+// Returns the OpenAPI document describing every route registered, so that
+// partners can generate clients of the API. The routes do not change once
+// the server starts, so it is only built once.
+func openAPIDocument(ctx *Context) {
+	openAPI.once.Do(func() {
+		var ops []openapi.Operation
+		for _, rt := range routeTable {
+			ops = append(ops, openapi.Operation{
+				Method:       rt.method,
+				Path:         rt.pattern,
+				Summary:      rt.summary,
+				Tag:          rt.tag,
+				Query:        rt.params,
+				Body:         rt.body,
+				Response:     rt.response,
+				ResponseType: rt.responseType,
+				Status:       rt.status,
+				Security:     routeSecurity(rt),
+			})
+		}
+		openAPI.data, _ = json.MarshalIndent(openapi.Build(&openapi.Info{
+			Title:       "UK Chargepoints",
+			Description: apiDescription,
+			Version:     appVersion,
+			SecuritySchemes: map[string]interface{}{
+				"adminToken": map[string]interface{}{
+					"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]interface{}{
+					"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		}, ops), "", "  ")
+	})
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+	ctx.Write(openAPI.data)
+}
+
+// Returns the security schemes that authorize requests of a route, none if
+// anyone may make them.
+func routeSecurity(rt route) []string {
+	switch {
+	case isAdminPath(rt.pattern):
+		return []string{"adminToken", "apiKey"}
+	case rt.role != "", apiKeysRequired &&
+		(strings.HasPrefix(rt.pattern, "/api/") || rt.pattern == "/graphql"):
+		return []string{"apiKey"}
+	}
+	return nil
+}
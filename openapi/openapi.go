@@ -0,0 +1,345 @@
+// Package openapi builds an OpenAPI 3 document describing an HTTP API from
+// a list of its operations, so that clients can be generated for it. The
+// schemas of request and response bodies are derived from Go values by
+// reflection, following the rules of encoding/json, and named types are
+// put in the components of the document and referred to.
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The version of OpenAPI documents are written in.
+const Version = "3.0.3"
+
+// A query parameter of an Operation.
+type Param struct {
+	Name        string
+	Description string
+	Required    bool
+
+	// The JSON schema type of the parameter: "string", "integer", "number"
+	// or "boolean". Defaults to "string".
+	Type string
+}
+
+// A method and path of the API.
+type Operation struct {
+	// The path is given as a pattern of package router, whose {name} and
+	// {name...} segments become path parameters.
+	Method string
+	Path   string
+
+	Summary string
+
+	// Groups operations in the document, the first segment of the path
+	// after /api/ that is not a parameter if not set.
+	Tag string
+
+	Query []Param
+
+	// Values of the types of the JSON body the operation takes and of the
+	// response it returns on success, or nil if it takes no body or its
+	// response is not described.
+	Body     interface{}
+	Response interface{}
+
+	// The media type of the response if it is not JSON, and its status if
+	// not 200.
+	ResponseType string
+	Status       int
+
+	// The names of the security schemes of the Document, any of which
+	// authorizes a request, or none if the operation is public.
+	Security []string
+}
+
+// The parts of a document not derived from the operations.
+type Info struct {
+	Title       string
+	Description string
+	Version     string
+
+	// The security schemes operations may name, such as
+	// {"type": "apiKey", "in": "header", "name": "X-API-Key"}, by name.
+	SecuritySchemes map[string]interface{}
+}
+
+// Returns an OpenAPI document for the operations, ready to be encoded as
+// JSON.
+func Build(info *Info, operations []Operation) map[string]interface{} {
+	b := &builder{schemas: make(map[string]interface{}),
+		names: make(map[reflect.Type]string)}
+	paths := make(map[string]map[string]interface{})
+	for _, op := range operations {
+		path, params := pathParams(op.Path)
+		for _, p := range op.Query {
+			params = append(params, b.param(p, "query"))
+		}
+
+		operation := map[string]interface{}{
+			"summary":   op.Summary,
+			"tags":      []string{tag(op)},
+			"responses": b.responses(op),
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": b.schema(reflect.TypeOf(op.Body)),
+					},
+				},
+			}
+		}
+		if len(op.Security) > 0 {
+			var security []interface{}
+			for _, name := range op.Security {
+				security = append(security,
+					map[string]interface{}{name: []string{}})
+			}
+			operation["security"] = security
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	components := map[string]interface{}{"schemas": b.schemas}
+	if len(info.SecuritySchemes) > 0 {
+		components["securitySchemes"] = info.SecuritySchemes
+	}
+	return map[string]interface{}{
+		"openapi": Version,
+		"info": map[string]interface{}{
+			"title":       info.Title,
+			"description": info.Description,
+			"version":     info.Version,
+		},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// Returns the path in OpenAPI form along with its parameters.
+func pathParams(pattern string) (string, []interface{}) {
+	var params []interface{}
+	segments := strings.Split(pattern, "/")
+	for i, s := range segments {
+		if !strings.HasPrefix(s, "{") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.Trim(s, "{}"), "...")
+		segments[i] = "{" + name + "}"
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func tag(op Operation) string {
+	if op.Tag != "" {
+		return op.Tag
+	}
+	for _, s := range strings.Split(strings.TrimPrefix(op.Path, "/api/"), "/") {
+		if s != "" && !strings.HasPrefix(s, "{") {
+			return s
+		}
+	}
+	return "api"
+}
+
+// Builds the schemas of a document, keeping those of named types.
+type builder struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+func (b *builder) param(p Param, in string) map[string]interface{} {
+	typ := p.Type
+	if typ == "" {
+		typ = "string"
+	}
+	param := map[string]interface{}{
+		"name":   p.Name,
+		"in":     in,
+		"schema": map[string]interface{}{"type": typ},
+	}
+	if p.Description != "" {
+		param["description"] = p.Description
+	}
+	if p.Required {
+		param["required"] = true
+	}
+	return param
+}
+
+func (b *builder) responses(op Operation) map[string]interface{} {
+	ok := map[string]interface{}{"description": "Success."}
+	switch {
+	case op.ResponseType != "":
+		ok["content"] = map[string]interface{}{
+			op.ResponseType: map[string]interface{}{},
+		}
+	case op.Response != nil:
+		ok["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": b.schema(reflect.TypeOf(op.Response)),
+			},
+		}
+	}
+	status := "200"
+	if op.Status != 0 {
+		status = strconv.Itoa(op.Status)
+	}
+	return map[string]interface{}{
+		status: ok,
+		"default": map[string]interface{}{
+			"description": "An error, described in plain text.",
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawType     = reflect.TypeOf(json.RawMessage{})
+	marshalType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// Returns the schema of the JSON encoding of a type. Named structs are
+// added to the components and referred to.
+func (b *builder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType, t.Implements(marshalType),
+		reflect.PointerTo(t).Implements(marshalType):
+		// Encodes itself, so it could be anything.
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{
+			"type":  "array",
+			"items": b.schema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": b.schema(t.Elem()),
+		}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name, ok := b.names[t]
+		if !ok {
+			// Take the name before describing the fields, which may refer
+			// back to the type.
+			name = b.name(t)
+			b.names[t] = name
+			b.schemas[name] = map[string]interface{}{}
+			b.schemas[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// Returns a name for the schema of a type that no other type has, the name
+// of the type qualified by its package if another package has one alike.
+func (b *builder) name(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.IndexByte(name, '['); i >= 0 {
+		name = name[:i]
+	}
+	if _, taken := b.schemas[name]; !taken {
+		return name
+	}
+	pkg := t.PkgPath()
+	pkg = pkg[strings.LastIndexByte(pkg, '/')+1:]
+	return strings.ToUpper(pkg[:1]) + pkg[1:] + name
+}
+
+// Returns the schema of a struct, whose exported fields are its properties
+// and whose embedded structs' properties are its own.
+func (b *builder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				add(ft)
+				continue
+			} else if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = b.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") &&
+				f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The postcodes.io API used to geocode postcodes. Set with POSTCODES_URL.
+var postcodesURL = "https://api.postcodes.io"
+
+// The client used for postcode lookups. Lookups sit in front of a search so
+// they are given a short timeout.
+var postcodesClient = &http.Client{Timeout: 5 * time.Second}
+
+// Returned by lookupPostcode if postcodes.io does not know the postcode.
+type unknownPostcodeError string
+
+func (u unknownPostcodeError) Error() string {
+	return fmt.Sprintf("Unknown postcode %s.", string(u))
+}
+
+// The parts of a postcodes.io lookup response that are used.
+type postcodeResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+	Result struct {
+		Postcode  string   `json:"postcode"`
+		Latitude  *float64 `json:"latitude"`
+		Longitude *float64 `json:"longitude"`
+	} `json:"result"`
+}
+
+// Returns the coordinates of the centre of a UK postcode. Spacing and case
+// in the postcode do not matter.
+func lookupPostcode(ctx context.Context, code string) (float64, float64, error) {
+	code = strings.ToUpper(strings.Join(strings.Fields(code), ""))
+	if code == "" {
+		return 0, 0, unknownPostcodeError(code)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		postcodesURL+"/postcodes/"+url.PathEscape(code), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := postcodesClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	var body postcodeResponse
+	if resp.StatusCode == 404 {
+		return 0, 0, unknownPostcodeError(code)
+	} else if resp.StatusCode != 200 {
+		json.NewDecoder(resp.Body).Decode(&body)
+		return 0, 0, fmt.Errorf("Postcode lookup failed with status %d: %s",
+			resp.StatusCode, body.Error)
+	} else if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, 0, err
+	}
+
+	// Some valid postcodes, such as those of PO boxes, have no location.
+	if body.Result.Latitude == nil || body.Result.Longitude == nil {
+		return 0, 0, unknownPostcodeError(code)
+	}
+	return *body.Result.Latitude, *body.Result.Longitude, nil
+}
@@ -0,0 +1,293 @@
+package publish
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scope of the access tokens GCS requests are made with.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Where instances on Google Cloud get access tokens for their service
+// account.
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/" +
+	"v1/instance/service-accounts/default/token"
+
+// A Store that keeps files in a Google Cloud Storage bucket, using its JSON
+// API. Requests are made with access tokens for a service account, got with
+// its key or, without one, from the metadata server of the instance the app
+// runs on.
+type GCS struct {
+	// The base URL of the API. Defaults to https://storage.googleapis.com.
+	Endpoint string
+	Bucket   string
+
+	// The service account key, as downloaded from Google Cloud, or nil to
+	// use the metadata server.
+	Key *ServiceAccountKey
+
+	// Sends requests without an access token, as emulators such as
+	// fake-gcs-server accept.
+	Anonymous bool
+
+	// Defaults to http.DefaultClient.
+	Client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// The fields of a service account key file that are used.
+type ServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// Returns a GCS store for a bucket, using the service account key in the
+// file named by GOOGLE_APPLICATION_CREDENTIALS if it is set.
+func NewGCS(bucket string) (*GCS, error) {
+	g := &GCS{Endpoint: "https://storage.googleapis.com", Bucket: bucket}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		g.Key = &ServiceAccountKey{}
+		if err := json.Unmarshal(data, g.Key); err != nil ||
+			g.Key.ClientEmail == "" || g.Key.PrivateKey == "" {
+			return nil, fmt.Errorf("%s is not a service account key.", path)
+		}
+	}
+	return g, nil
+}
+
+// Uploads a file.
+func (g *GCS) Put(name string, data []byte, contentType string) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	_, err := g.do("POST", "/upload/storage/v1/b/"+url.PathEscape(g.Bucket)+
+		"/o?uploadType=media&name="+url.QueryEscape(name), data, contentType)
+	return err
+}
+
+// Downloads a file.
+func (g *GCS) Get(name string) ([]byte, error) {
+	return g.do("GET", g.objectPath(name)+"?alt=media", nil, "")
+}
+
+// Deletes a file. Deleting a file that does not exist is not an error.
+func (g *GCS) Delete(name string) error {
+	_, err := g.do("DELETE", g.objectPath(name), nil, "")
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Returns the names of the files that start with prefix, in order.
+func (g *GCS) List(prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"prefix": {prefix},
+			"fields": {"items(name),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		data, err := g.do("GET", "/storage/v1/b/"+url.PathEscape(g.Bucket)+
+			"/o?"+query.Encode(), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("Unexpected listing of bucket %s: %s",
+				g.Bucket, err)
+		}
+		for _, item := range result.Items {
+			names = append(names, item.Name)
+		}
+		if result.NextPageToken == "" {
+			break
+		}
+		token = result.NextPageToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Returns the path of the metadata of a file in the API.
+func (g *GCS) objectPath(name string) string {
+	return "/storage/v1/b/" + url.PathEscape(g.Bucket) + "/o/" +
+		url.PathEscape(name)
+}
+
+func (g *GCS) client() *http.Client {
+	if g.Client == nil {
+		return http.DefaultClient
+	}
+	return g.Client
+}
+
+func (g *GCS) do(
+	method, path string, body []byte, contentType string,
+) ([]byte, error) {
+	req, err := http.NewRequest(method,
+		strings.TrimSuffix(g.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if !g.Anonymous {
+		token, err := g.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := g.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if resp.StatusCode == 404 {
+		return nil, ErrNotFound
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s of %s returned %s.", method, path,
+			resp.Status)
+	}
+	return data, err
+}
+
+// The response of a token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Returns an access token, getting a new one when the last is about to
+// expire.
+func (g *GCS) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if g.Key != nil {
+		req, err = g.Key.tokenRequest(time.Now())
+	} else {
+		req, err = http.NewRequest("GET", metadataTokenURL, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := g.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token tokenResponse
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("Access token request returned %s.",
+			resp.Status)
+	} else if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	} else if token.AccessToken == "" {
+		return "", fmt.Errorf("Access token response has no token.")
+	}
+	// Renewed a minute early so requests do not race its expiry.
+	g.token = token.AccessToken
+	g.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second -
+		time.Minute)
+	return g.token, nil
+}
+
+// Returns a request exchanging a JWT signed with the key for an access
+// token, as OAuth 2.0 for service accounts describes.
+func (k *ServiceAccountKey) tokenRequest(now time.Time) (*http.Request,
+	error,
+) {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("Service account private key is not PEM.")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("Service account private key is not an RSA " +
+			"key.")
+	}
+
+	tokenURI := k.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256",
+		"typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": gcsScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." +
+		encoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256,
+		sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + encoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequest("POST", tokenURI,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,230 @@
+// Package publish exports a whole collection as gzipped JSON and CSV files
+// along with a manifest describing them, for consumers who would rather
+// download the data in bulk than page through the API.
+package publish
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The name of the manifest of the latest version. Each version also has a
+// copy of its own manifest inside its directory.
+const ManifestName = "manifest.json"
+
+// A published file.
+type File struct {
+	// The path of the file in the Store, "VERSION/COLLECTION.json.gz" for
+	// example.
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// Where the file can be downloaded from, if Options.BaseURL was set.
+	URL string `json:"url,omitempty"`
+}
+
+// Describes one published version of a collection.
+type Manifest struct {
+	// The time the version was generated, as YYYYMMDDThhmmssZ. Versions
+	// sort in the order they were published.
+	Version    string    `json:"version"`
+	Generated  time.Time `json:"generated"`
+	Collection string    `json:"collection"`
+	Count      int       `json:"count"`
+	Files      []File    `json:"files"`
+}
+
+// Options for Publish.
+type Options struct {
+	// Prepended to the name of each file to give its URL in the manifest.
+	BaseURL string
+
+	// The time the version is published at. Defaults to now.
+	Now time.Time
+}
+
+// A record of the JSON file, the same form orcctl export uses.
+type record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Reads every record in a collection and writes a new version of it to the
+// store: a gzipped JSON array of {"key", "value"} objects, and a gzipped CSV
+// file with a column per field where nested objects are flattened into
+// dotted column names and arrays are written as JSON. The manifest of the
+// version is written last so consumers never see an incomplete version. If
+// opts is nil the defaults are used.
+func Publish(
+	collection *gorc2.Collection, store Store, opts *Options,
+) (*Manifest, error) {
+	now := time.Now()
+	baseURL := ""
+	if opts != nil {
+		if !opts.Now.IsZero() {
+			now = opts.Now
+		}
+		baseURL = opts.BaseURL
+	}
+	manifest := &Manifest{
+		Version:    now.UTC().Format("20060102T150405Z"),
+		Generated:  now.UTC(),
+		Collection: collection.Name,
+	}
+
+	records := []record{}
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		records = append(records, record{Key: raw.Key, Value: raw.Value})
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	manifest.Count = len(records)
+
+	jsonData, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	csvData, err := toCSV(records)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range []struct {
+		format string
+		data   []byte
+	}{
+		{"json", jsonData},
+		{"csv", csvData},
+	} {
+		compressed := new(bytes.Buffer)
+		w := gzip.NewWriter(compressed)
+		w.Write(f.data)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		name := manifest.Version + "/" + collection.Name + "." + f.format +
+			".gz"
+		err := store.Put(name, compressed.Bytes(), "application/gzip")
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(compressed.Bytes())
+		file := File{
+			Name:   name,
+			Format: f.format,
+			Size:   compressed.Len(),
+			SHA256: hex.EncodeToString(sum[:]),
+		}
+		if baseURL != "" {
+			file.URL = baseURL + name
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{manifest.Version + "/" + ManifestName, ManifestName}
+	for _, name := range names {
+		if err := store.Put(name, data, "application/json"); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// Returns the manifest of the latest version, or ErrNotFound if nothing has
+// been published.
+func Latest(store Store) (*Manifest, error) {
+	data, err := store.Get(ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	return manifest, json.Unmarshal(data, manifest)
+}
+
+// Returns the records as CSV with a key column followed by a column for
+// every field found in any record, in name order.
+func toCSV(records []record) ([]byte, error) {
+	rows := make([]map[string]string, len(records))
+	columns := make(map[string]bool)
+	for i, r := range records {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(r.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		rows[i] = make(map[string]string)
+		Flatten("", value, rows[i])
+		for column := range rows[i] {
+			columns[column] = true
+		}
+	}
+
+	header := []string{"key"}
+	for column := range columns {
+		header = append(header, column)
+	}
+	sort.Strings(header[1:])
+
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write(header)
+	for i, row := range rows {
+		line := []string{records[i].Key}
+		for _, column := range header[1:] {
+			line = append(line, row[column])
+		}
+		w.Write(line)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Adds the fields of a decoded JSON value to row, joining the names of
+// nested objects with dots after prefix. Arrays are stored as JSON. A value
+// that is not an object is stored under the prefix, or "value" if it is "".
+// Numbers should be decoded as json.Number to be kept as written.
+func Flatten(prefix string, value interface{}, row map[string]string) {
+	name := prefix
+	if name == "" {
+		name = "value"
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, child := range v {
+			if prefix != "" {
+				field = prefix + "." + field
+			}
+			Flatten(field, child, row)
+		}
+	case string:
+		row[name] = v
+	case json.Number:
+		row[name] = v.String()
+	case bool:
+		row[name] = strconv.FormatBool(v)
+	case nil:
+		row[name] = ""
+	default:
+		data, _ := json.Marshal(v)
+		row[name] = string(data)
+	}
+}
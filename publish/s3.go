@@ -0,0 +1,228 @@
+package publish
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Store that keeps files in a bucket of an S3 compatible service.
+// Requests are signed with AWS signature version 4 and use path style URLs
+// so services other than AWS work too.
+type S3 struct {
+	// The base URL of the service, such as https://s3.eu-west-2.amazonaws.com.
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	AccessKey string
+	SecretKey string
+
+	// Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Returns an S3 store for a bucket in the given AWS region, us-east-1 if it
+// is empty, using the credentials in AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY. Set Endpoint to use another service.
+func NewS3(bucket, region string) *S3 {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		Endpoint:  "https://s3." + region + ".amazonaws.com",
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+}
+
+// Uploads a file.
+func (s *S3) Put(name string, data []byte, contentType string) error {
+	_, err := s.do("PUT", name, nil, data, contentType)
+	return err
+}
+
+// Downloads a file.
+func (s *S3) Get(name string) ([]byte, error) {
+	return s.do("GET", name, nil, nil, "")
+}
+
+// Deletes a file. Deleting a file that does not exist is not an error.
+func (s *S3) Delete(name string) error {
+	_, err := s.do("DELETE", name, nil, nil, "")
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// The parts of a ListObjectsV2 response that are used.
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Returns the names of the files that start with prefix, in order.
+func (s *S3) List(prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			query["continuation-token"] = token
+		}
+		data, err := s.do("GET", "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("Unexpected listing of bucket %s: %s",
+				s.Bucket, err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Makes a request of a file, or of the bucket if name is "", with the given
+// query parameters.
+func (s *S3) do(
+	method, name string, query map[string]string, body []byte,
+	contentType string,
+) ([]byte, error) {
+	u := strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket
+	if name != "" {
+		u += "/" + name
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if resp.StatusCode == 404 {
+		return nil, ErrNotFound
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s of %s returned %s.", method, name,
+			resp.Status)
+	}
+	return data, err
+}
+
+// Adds the AWS signature version 4 Authorization header to a request.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	date := now.Format("20060102")
+	payloadHash := hexSHA256(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders,
+		hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// Returns query parameters encoded as signature version 4 requires, sorted
+// by name with spaces encoded as %20.
+func canonicalQuery(query map[string]string) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, escapeQuery(name)+"="+escapeQuery(query[name]))
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapeQuery(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,117 @@
+package publish
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Returned by Store.Get when there is no file with the given name.
+var ErrNotFound = fmt.Errorf("File not found.")
+
+// Somewhere published files are written to and read back from. Names are
+// slash separated paths relative to the root of the store.
+type Store interface {
+	Put(name string, data []byte, contentType string) error
+	Get(name string) ([]byte, error)
+}
+
+// A Store that can also list and delete files, as is needed to prune old
+// backups.
+type BlobStore interface {
+	Store
+
+	// Returns the names of the files that start with prefix, in order.
+	List(prefix string) ([]string, error)
+
+	// Deletes a file. Deleting a file that does not exist is not an error.
+	Delete(name string) error
+}
+
+// A Store that keeps files under a local directory.
+type Dir string
+
+// Writes a file, replacing any existing file of the same name in one step
+// so readers never see it half written.
+func (d Dir) Put(name string, data []byte, contentType string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns the contents of a file.
+func (d Dir) Get(name string) ([]byte, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Returns the local path of a file, refusing names that would escape the
+// directory.
+func (d Dir) path(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid file name %q.", name)
+		}
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+// Returns the names of the files under the directory that start with
+// prefix, in order.
+func (d Dir) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(string(d), func(path string, entry fs.DirEntry,
+		err error,
+	) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == string(d) {
+				return filepath.SkipDir
+			}
+			return err
+		} else if entry.IsDir() || strings.HasSuffix(path, ".tmp") {
+			// Files being written by Put are left out.
+			return nil
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// Deletes a file.
+func (d Dir) Delete(name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
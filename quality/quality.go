@@ -0,0 +1,175 @@
+// Package quality checks the chargepoint records for common data problems
+// and stores the findings as a report document.
+package quality
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// The collection reports are stored in, and the key of the data quality
+// report. Each run overwrites the report, earlier runs are kept as refs.
+const (
+	Reports   = "Reports"
+	ReportKey = "quality"
+)
+
+// The area a chargepoint must be inside to count as in the UK, the same box
+// the map is limited to.
+var ukBounds = struct{ North, South, East, West float64 }{
+	North: 60.854691,
+	South: 49.162090,
+	East:  1.768960,
+	West:  -13.413930,
+}
+
+// Options for Scan.
+type Options struct {
+	// The field holding the date a record was last verified, as an RFC3339
+	// timestamp, "YYYY-MM-DD hh:mm:ss" as used by the registry, or a plain
+	// date. Defaults to "DateUpdated". Records without the
+	// field are not reported as stale.
+	VerifiedField string
+
+	// Records last verified longer ago than this are reported as stale.
+	// Defaults to a year.
+	MaxAge time.Duration
+
+	// The time staleness is measured from. Defaults to now.
+	Now time.Time
+}
+
+// The findings of a scan. Each list holds the keys of the records with that
+// problem, in key order.
+type Report struct {
+	Generated  time.Time `json:"generated"`
+	Collection string    `json:"collection"`
+	Scanned    int       `json:"scanned"`
+
+	// Records with no latitude or longitude, or both set to zero.
+	MissingCoordinates []string `json:"missing_coordinates"`
+
+	// Records whose location is outside of the UK.
+	OutsideUK []string `json:"outside_uk"`
+
+	// Registry IDs (ChargeDeviceId) used by more than one record, with the
+	// keys of those records.
+	DuplicateIDs map[string][]string `json:"duplicate_ids"`
+
+	// Records last verified longer ago than MaxAge.
+	Stale []string `json:"stale"`
+}
+
+// The fields of a chargepoint that are checked.
+type record struct {
+	ChargeDeviceId       string
+	ChargeDeviceLocation struct {
+		Latitude  *float64
+		Longitude *float64
+	}
+}
+
+// Reads every record in the collection and returns a report of the problems
+// found. If opts is nil the defaults are used.
+func Scan(collection *gorc2.Collection, opts *Options) (*Report, error) {
+	verifiedField := "DateUpdated"
+	maxAge := 365 * 24 * time.Hour
+	now := time.Now()
+	if opts != nil {
+		if opts.VerifiedField != "" {
+			verifiedField = opts.VerifiedField
+		}
+		if opts.MaxAge > 0 {
+			maxAge = opts.MaxAge
+		}
+		if !opts.Now.IsZero() {
+			now = opts.Now
+		}
+	}
+
+	report := &Report{
+		Generated:          now.UTC(),
+		Collection:         collection.Name,
+		MissingCoordinates: []string{},
+		OutsideUK:          []string{},
+		DuplicateIDs:       map[string][]string{},
+		Stale:              []string{},
+	}
+	keysByID := make(map[string][]string)
+
+	it := collection.Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		report.Scanned++
+
+		var r record
+		var fields map[string]interface{}
+		if json.Unmarshal(raw.Value, &r) != nil ||
+			json.Unmarshal(raw.Value, &fields) != nil {
+			report.MissingCoordinates = append(report.MissingCoordinates,
+				raw.Key)
+			continue
+		}
+
+		lat, lon := r.ChargeDeviceLocation.Latitude,
+			r.ChargeDeviceLocation.Longitude
+		switch {
+		case lat == nil || lon == nil || (*lat == 0 && *lon == 0):
+			report.MissingCoordinates = append(report.MissingCoordinates,
+				raw.Key)
+		case *lat < ukBounds.South || *lat > ukBounds.North ||
+			*lon < ukBounds.West || *lon > ukBounds.East:
+			report.OutsideUK = append(report.OutsideUK, raw.Key)
+		}
+
+		if r.ChargeDeviceId != "" {
+			keysByID[r.ChargeDeviceId] = append(keysByID[r.ChargeDeviceId],
+				raw.Key)
+		}
+
+		if s, ok := fields[verifiedField].(string); ok {
+			if verified, ok := parseDate(s); ok && now.Sub(verified) > maxAge {
+				report.Stale = append(report.Stale, raw.Key)
+			}
+		}
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+
+	for id, keys := range keysByID {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			report.DuplicateIDs[id] = keys
+		}
+	}
+	return report, nil
+}
+
+// Writes the report to the Reports collection.
+func Save(client *gorc2.Client, report *Report) error {
+	_, err := client.Collection(Reports).Update(ReportKey, report)
+	return err
+}
+
+// Returns the most recently saved report.
+func Latest(client *gorc2.Client) (*Report, error) {
+	report := &Report{}
+	if _, err := client.Collection(Reports).Get(ReportKey, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Parses an RFC3339 timestamp, a registry timestamp or a plain date.
+func parseDate(s string) (time.Time, bool) {
+	layouts := []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
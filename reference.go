@@ -0,0 +1,206 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/model"
+	"chargepoints/quality"
+	"chargepoints/router"
+	"encoding/json"
+	"log"
+)
+
+// Reads operators and networks.
+var store *model.Store
+
+// Writes a value as the JSON response, or an error status if err is set.
+func writeJSON(ctx *Context, value interface{}, err error) {
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		ctx.Abort(404, "Not found.")
+		return
+	} else if err != nil {
+		log.Println(err)
+		ctx.Abort(502, "Unable to read from Orchestrate.")
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Println(err)
+		ctx.Abort(500, "Unable to encode response.")
+		return
+	}
+	ctx.Write(data)
+}
+
+// Writes the chargepoints an Iterator returns in the same form as a search.
+func writeChargepoints(ctx *Context, it *gorc2.Iterator) {
+	results := Results{}
+	for it.Next() {
+		raw := it.Raw()
+		results.Results = append(results.Results,
+			Result{Key: raw.Key, Ref: raw.Ref, Value: raw.Value})
+	}
+	results.Count = len(results.Results)
+	if it.Error == nil && notModified(ctx, resultsETag(ctx, results.Results)) {
+		return
+	}
+	transformResults(ctx, model.ChargePoints, results.Results)
+	if wantsJSONAPI(ctx) {
+		writeAPIChargepoints(ctx, model.ChargePoints, results.Results,
+			it.Error)
+		return
+	}
+	writeJSON(ctx, &results, it.Error)
+}
+
+func listOperators(ctx *Context) {
+	operators, err := store.Operators()
+	writeResources(ctx, "operators", operators, err)
+}
+
+func getOperator(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	operator, err := store.Operator(id)
+	writeResources(ctx, "operators", operator, err)
+}
+
+func operatorChargepoints(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	if _, err := store.Operator(id); err != nil {
+		writeResources(ctx, "", nil, err)
+		return
+	}
+	writeChargepoints(ctx, store.OperatorChargepoints(id))
+}
+
+func listNetworks(ctx *Context) {
+	networks, err := store.Networks()
+	writeResources(ctx, "networks", networks, err)
+}
+
+func getNetwork(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	network, err := store.Network(id)
+	writeResources(ctx, "networks", network, err)
+}
+
+func networkChargepoints(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	if _, err := store.Network(id); err != nil {
+		writeResources(ctx, "", nil, err)
+		return
+	}
+	writeChargepoints(ctx, store.NetworkChargepoints(id))
+}
+
+func listTariffs(ctx *Context) {
+	tariffs, err := store.Tariffs()
+	writeResources(ctx, "tariffs", tariffs, err)
+}
+
+func getTariff(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	tariff, err := store.Tariff(id)
+	writeResources(ctx, "tariffs", tariff, err)
+}
+
+func tariffChargepoints(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	if _, err := store.Tariff(id); err != nil {
+		writeResources(ctx, "", nil, err)
+		return
+	}
+	writeChargepoints(ctx, store.TariffChargepoints(id))
+}
+
+// Returns a chargepoint, the page the sitemap links to.
+func getChargepoint(ctx *Context) {
+	key := ctx.Request.PathValue("key")
+	item, err := orc.Collection(model.ChargePoints).
+		WithContext(traceContext(ctx.Request)).Get(key, nil)
+	if err != nil {
+		writeJSON(ctx, nil, err)
+		return
+	}
+	viewCounter.Record(model.ChargePoints, key)
+	results := []Result{{Collection: model.ChargePoints, Key: key,
+		Ref: item.Ref, Value: item.Value}}
+	if notModified(ctx, resultsETag(ctx, results)) {
+		return
+	}
+	transformResults(ctx, model.ChargePoints, results)
+	writeJSON(ctx, &results[0], nil)
+}
+
+// Returns the tariffs of a chargepoint.
+func chargepointTariffs(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	if _, err := orc.Collection(model.ChargePoints).Get(id, nil); err != nil {
+		writeResources(ctx, "", nil, err)
+		return
+	}
+	tariffs, err := store.ChargepointTariffs(id)
+	writeResources(ctx, "tariffs", tariffs, err)
+}
+
+// Returns the latest data quality report, as saved by orcctl report.
+func qualityReport(ctx *Context) {
+	report, err := quality.Latest(orc)
+	writeJSON(ctx, report, err)
+}
+
+// Registers the operator, network and tariff endpoints along with the data
+// quality report. These must be registered
+// before the search endpoint, which would otherwise match them.
+func referenceRoutes(r router.Router) {
+	for _, ref := range []struct {
+		path                    string
+		list, get, chargepoints handlerFunc
+
+		// What list and get write.
+		listResponse, getResponse interface{}
+	}{
+		{"operators", listOperators, getOperator, operatorChargepoints,
+			[]model.Operator{}, model.Operator{}},
+		{"networks", listNetworks, getNetwork, networkChargepoints,
+			[]model.Network{}, model.Network{}},
+		{"tariffs", listTariffs, getTariff, tariffChargepoints,
+			[]model.Tariff{}, model.Tariff{}},
+	} {
+		handleRoutes(r, route{
+			method: "GET", pattern: "/api/" + ref.path,
+			timeout: lookupTimeout, handler: ref.list,
+			summary:  "Lists the " + ref.path + ".",
+			params:   jsonAPIParams[:1],
+			response: ref.listResponse,
+		}, route{
+			method: "GET", pattern: "/api/" + ref.path + "/{id}/chargepoints",
+			timeout: searchTimeout, handler: ref.chargepoints,
+			summary: "Returns the chargepoints of one of the " +
+				ref.path + ".",
+			params:   jsonAPIParams,
+			response: Results{},
+		}, route{
+			method: "GET", pattern: "/api/" + ref.path + "/{id}",
+			timeout: lookupTimeout, handler: ref.get,
+			summary:  "Returns one of the " + ref.path + ".",
+			params:   jsonAPIParams[:1],
+			response: ref.getResponse,
+		})
+	}
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/" + model.ChargePoints + "/{id}/tariffs",
+		timeout: lookupTimeout, handler: chargepointTariffs,
+		summary:  "Returns the tariffs of a chargepoint.",
+		params:   jsonAPIParams[:1],
+		response: []model.Tariff{},
+	}, route{
+		method:  "GET",
+		pattern: "/api/" + quality.Reports + "/" + quality.ReportKey,
+		timeout: lookupTimeout, handler: qualityReport,
+		summary:  "Returns the latest data quality report.",
+		response: quality.Report{},
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/apikeys"
+	"chargepoints/openapi"
+	"chargepoints/reports"
+	"chargepoints/router"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Reports a problem with a chargepoint from a body such as {"kind":
+// "broken", "message": "Screen is blank and it won't start."}. Kinds are
+// broken, wrong_data and other. A report of wrong data can suggest the
+// fix as a JSON merge patch, such as {"kind": "wrong_data", "suggested":
+// {"ChargeDeviceLocation": {"Address": {"PostCode": "MK9 2EA"}}}}.
+func submitReport(ctx *Context) {
+	var r reports.Report
+	if !readJSON(ctx, &r) {
+		return
+	}
+	r.Collection = ctx.Request.PathValue("collection")
+	r.Key = ctx.Request.PathValue("key")
+	switch err := reports.Submit(orc, &r); err.(type) {
+	case nil:
+	case reports.InvalidError:
+		ctx.Abort(400, err.Error())
+		return
+	case gorc2.NotFoundError:
+		ctx.Abort(404, fmt.Sprintf("Unknown chargepoint %s.", r.Key))
+		return
+	default:
+		log.Println(err)
+		ctx.Abort(502, "Unable to record report.")
+		return
+	}
+	data, _ := json.Marshal(&r)
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+	ctx.WriteHeader(201)
+	ctx.Write(data)
+}
+
+// Lists the reports with the status given by the status parameter, open
+// by default, or every report with status=all.
+func listReports(ctx *Context) {
+	status := ctx.Params["status"]
+	switch status {
+	case "":
+		status = reports.Open
+	case "all":
+		status = ""
+	case reports.Open, reports.Resolved, reports.Rejected:
+	default:
+		ctx.Abort(400, fmt.Sprintf("Unknown report status %q.", status))
+		return
+	}
+	list, err := reports.List(orc, status)
+	writeJSON(ctx, list, err)
+}
+
+func getReport(ctx *Context) {
+	r, err := reports.Get(orc, ctx.Request.PathValue("id"))
+	writeJSON(ctx, r, err)
+}
+
+// Resolves or rejects a report from a body such as {"status": "resolved",
+// "note": "Postcode corrected.", "update": {"ChargeDeviceLocation":
+// {"Address": {"PostCode": "MK9 2EA"}}}}. The update is a JSON merge patch
+// applied to the chargepoint.
+func resolveReport(ctx *Context) {
+	var res reports.Resolution
+	if !readJSON(ctx, &res) {
+		return
+	}
+	r, err := reports.Resolve(orc, ctx.Request.PathValue("id"), &res)
+	switch err.(type) {
+	case nil, gorc2.NotFoundError:
+		writeJSON(ctx, r, err)
+	case reports.InvalidError:
+		ctx.Abort(400, err.Error())
+	case gorc2.NotMostRecentError:
+		ctx.Abort(409, "Report was resolved by someone else.")
+	default:
+		log.Println(err)
+		ctx.Abort(502, "Unable to resolve report.")
+	}
+}
+
+// Registers the report endpoints. These must be registered before the
+// search endpoint.
+func reportRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/reports", timeout: lookupTimeout,
+		handler: listReports, role: apikeys.Admin,
+		summary: "Lists the reports of problems with chargepoints.",
+		params: []openapi.Param{{Name: "status",
+			Description: "open, resolved, rejected or all. Defaults to open."}},
+		response: []*reports.Report{},
+	}, route{
+		method: "GET", pattern: "/api/reports/{id}", timeout: lookupTimeout,
+		handler: getReport, role: apikeys.Admin,
+		summary:  "Returns a report by its ID or its reference.",
+		response: reports.Report{},
+	}, route{
+		method: "POST", pattern: "/api/reports/{id}/resolve",
+		timeout: lookupTimeout, handler: resolveReport, role: apikeys.Admin,
+		summary: "Resolves or rejects a report.",
+		body:    reports.Resolution{}, response: reports.Report{},
+	}, route{
+		method: "POST", pattern: "/api/{collection}/{key}/reports",
+		timeout: lookupTimeout, handler: submitReport,
+		summary: "Reports a problem with a chargepoint.",
+		body:    reports.Report{}, response: reports.Report{}, status: 201,
+	})
+}
@@ -0,0 +1,49 @@
+package reports
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/jobs"
+	"context"
+	"encoding/json"
+)
+
+// The type of the jobs adding reports and their resolutions to
+// chargepoints as events, so that moderation does not wait on, or fail
+// with, writes to the chargepoints.
+const JobType = "report_event"
+
+// The payload of a JobType job.
+type event struct {
+	Type   string  `json:"type"`
+	Report *Report `json:"report"`
+}
+
+// Queues a job adding a report to its chargepoint as an event of the type.
+func enqueueEvent(client *gorc2.Client, typ string, r *Report) error {
+	_, err := jobs.Enqueue(client, JobType, &event{Type: typ, Report: r}, 0)
+	return err
+}
+
+// Returns the handler of JobType jobs, which adds the report to its
+// chargepoint. The event is timestamped when the report was made or
+// resolved rather than when the job runs. The report is added again if the
+// job is retried after the event was written.
+func JobHandler(client *gorc2.Client) jobs.Handler {
+	return func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var e event
+		if err := json.Unmarshal(job.Payload, &e); err != nil {
+			return nil, err
+		}
+		r := e.Report
+		ts := r.Created
+		if e.Type == ResolvedEventType && r.Resolved != nil {
+			ts = *r.Resolved
+		}
+		added, err := client.Collection(r.Collection).AddEventWithTimestamp(
+			r.Key, e.Type, ts, r)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"report": r.ID, "ref": added.Ref}, nil
+	}
+}
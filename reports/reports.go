@@ -0,0 +1,324 @@
+// Package reports keeps the reports end users make about chargepoints, such
+// as a broken charger or a wrong address. Each report is added to the
+// chargepoint as an event, so its history shows what was reported, and to
+// a moderation queue until it is resolved, which can update the
+// chargepoint to fix what was reported.
+package reports
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The collection of the moderation queue, keyed by generated report IDs
+// that sort in the order reports were made. It is not quality.Reports,
+// which holds the data quality report.
+const Collection = "UserReports"
+
+// The collection and key of the sequence report numbers are taken from.
+const (
+	Sequences   = "Sequences"
+	SequenceKey = "reports"
+)
+
+// How many report numbers an instance reserves at a time.
+const sequenceBatch = 10
+
+// Report references are the report number after this prefix.
+const ReferencePrefix = "R-"
+
+// The event types reports, and their resolutions, are added to
+// chargepoints under.
+const (
+	EventType         = "report"
+	ResolvedEventType = "report_resolved"
+)
+
+// The longest message a report can have.
+const MaxMessage = 2000
+
+// What a report is about.
+const (
+	Broken    = "broken"
+	WrongData = "wrong_data"
+	Other     = "other"
+)
+
+var kinds = map[string]bool{Broken: true, WrongData: true, Other: true}
+
+// The states of a report.
+const (
+	Open     = "open"
+	Resolved = "resolved"
+	Rejected = "rejected"
+)
+
+// A report about a chargepoint.
+type Report struct {
+	ID string `json:"id,omitempty" orc:"key"`
+
+	// A short reference, such as "R-1042", for people to quote, made from
+	// a number taken from a sequence. Numbers are unique and increase, but
+	// have gaps and can be out of order across instances.
+	Reference string `json:"reference,omitempty"`
+
+	// The chargepoint reported.
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+
+	// Changes to the chargepoint suggested by the reporter, as a JSON merge
+	// patch, for a moderator to review.
+	Suggested json.RawMessage `json:"suggested,omitempty"`
+
+	// Open until a moderator resolves or rejects it.
+	Status   string     `json:"status"`
+	Created  time.Time  `json:"created"`
+	Resolved *time.Time `json:"resolved,omitempty"`
+
+	// The moderator's note, and whether the chargepoint was updated.
+	Note    string `json:"note,omitempty"`
+	Updated bool   `json:"updated,omitempty"`
+}
+
+// How a moderator resolves a report.
+type Resolution struct {
+	// Resolved or Rejected.
+	Status string `json:"status"`
+	Note   string `json:"note"`
+
+	// Changes to make to the chargepoint, as a JSON merge patch (RFC 7396):
+	// fields are set to the values given, objects are merged and null
+	// removes a field. Only allowed when resolving.
+	Update json.RawMessage `json:"update,omitempty"`
+}
+
+// Returned for reports and resolutions that are not valid, or resolutions
+// of reports that are no longer open.
+type InvalidError string
+
+func (e InvalidError) Error() string {
+	return string(e)
+}
+
+// The sequences of report numbers of each client, kept so that the numbers
+// reserved are not wasted.
+var sequences = struct {
+	sync.Mutex
+	m map[*gorc2.Client]*gorc2.Sequence
+}{m: make(map[*gorc2.Client]*gorc2.Sequence)}
+
+// Returns the next report reference.
+func nextReference(client *gorc2.Client) (string, error) {
+	sequences.Lock()
+	seq := sequences.m[client]
+	if seq == nil {
+		seq = client.Collection(Sequences).Sequence(SequenceKey,
+			sequenceBatch)
+		sequences.m[client] = seq
+	}
+	sequences.Unlock()
+	n, err := seq.Next()
+	if err != nil {
+		return "", err
+	}
+	return ReferencePrefix + strconv.FormatInt(n, 10), nil
+}
+
+// Returns the moderation queue, filling in report IDs when reading.
+func queue(client *gorc2.Client) *gorc2.Collection {
+	c := client.Collection(Collection)
+	c.InjectMetadata = true
+	return c
+}
+
+// Checks a report and records it in the moderation queue, filling in its ID,
+// reference, status and creation time, and queues a job adding it to the
+// chargepoint as an event. Returns an InvalidError if the report is not
+// valid and a gorc2.NotFoundError if the chargepoint does not exist.
+func Submit(client *gorc2.Client, r *Report) error {
+	r.Message = strings.TrimSpace(r.Message)
+	if !kinds[r.Kind] {
+		return InvalidError(fmt.Sprintf("Report kind must be %s, %s or %s.",
+			Broken, WrongData, Other))
+	} else if r.Message == "" && len(r.Suggested) == 0 {
+		return InvalidError("Report has no message.")
+	} else if len(r.Message) > MaxMessage {
+		return InvalidError(fmt.Sprintf(
+			"Report message is longer than %d bytes.", MaxMessage))
+	} else if len(r.Suggested) > 0 && !isObject(r.Suggested) {
+		return InvalidError("Suggested changes must be a JSON object.")
+	}
+	if _, err := client.Collection(r.Collection).Get(r.Key, nil); err != nil {
+		return err
+	}
+
+	reference, err := nextReference(client)
+	if err != nil {
+		return err
+	}
+	r.ID, r.Reference = "", reference
+	r.Status = Open
+	r.Created = time.Now().UTC()
+	r.Resolved, r.Note, r.Updated = nil, "", false
+	item, err := queue(client).CreateAuto(r)
+	if err != nil {
+		return err
+	}
+	r.ID = item.Key
+	return enqueueEvent(client, EventType, r)
+}
+
+// Returns a report given its ID or its reference.
+func Get(client *gorc2.Client, id string) (*Report, error) {
+	if strings.HasPrefix(id, ReferencePrefix) {
+		reports, err := List(client, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range reports {
+			if r.Reference == id {
+				return r, nil
+			}
+		}
+		return nil, gorc2.NotFoundError(fmt.Sprintf(
+			"404: No report has the reference %s.", id))
+	}
+	r := &Report{}
+	if _, err := queue(client).Get(id, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the reports with the given status, or every report if it is "",
+// oldest first.
+func List(client *gorc2.Client, status string) ([]*Report, error) {
+	reports := []*Report{}
+	it := queue(client).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		r := &Report{}
+		if _, err := it.Get(r); err != nil {
+			return nil, err
+		}
+		if status == "" || r.Status == status {
+			reports = append(reports, r)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ID < reports[j].ID
+	})
+	return reports, it.Error
+}
+
+// Resolves or rejects an open report, first applying the resolution's
+// update to the chargepoint if it has one. A job is queued adding the
+// resolution to the chargepoint as an event too. Returns an InvalidError if
+// the resolution is not valid or the report is not open, and a
+// gorc2.NotMostRecentError if the report was resolved while this was.
+func Resolve(client *gorc2.Client, id string, res *Resolution) (
+	*Report, error,
+) {
+	if res.Status != Resolved && res.Status != Rejected {
+		return nil, InvalidError(fmt.Sprintf(
+			"Resolution status must be %s or %s.", Resolved, Rejected))
+	} else if len(res.Update) > 0 && res.Status != Resolved {
+		return nil, InvalidError(
+			"Only resolved reports can update the chargepoint.")
+	} else if len(res.Update) > 0 && !isObject(res.Update) {
+		return nil, InvalidError("Update must be a JSON object.")
+	}
+
+	r := &Report{}
+	item, err := queue(client).Get(id, r)
+	if err != nil {
+		return nil, err
+	} else if r.Status != Open {
+		return nil, InvalidError(fmt.Sprintf("Report %s is already %s.", id,
+			r.Status))
+	}
+
+	if len(res.Update) > 0 {
+		chargepoints := client.Collection(r.Collection)
+		if err := update(chargepoints, r.Key, res.Update); err != nil {
+			return nil, err
+		}
+		r.Updated = true
+	}
+	now := time.Now().UTC()
+	r.Status = res.Status
+	r.Resolved = &now
+	r.Note = strings.TrimSpace(res.Note)
+	// Written only if the report has not changed since it was read, so two
+	// moderators can not both resolve it.
+	if _, err := item.Update(r); err != nil {
+		return nil, err
+	}
+	return r, enqueueEvent(client, ResolvedEventType, r)
+}
+
+// Returns true if a value is a JSON object.
+func isObject(value json.RawMessage) bool {
+	var object map[string]json.RawMessage
+	return json.Unmarshal(value, &object) == nil && object != nil
+}
+
+// Applies a JSON merge patch to a chargepoint, retrying if it is written to
+// in the meantime.
+func update(c *gorc2.Collection, key string, patch json.RawMessage) error {
+	var changes interface{}
+	if err := decode(patch, &changes); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		item, err := c.Get(key, nil)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		if err := decode(item.Value, &doc); err != nil {
+			return err
+		}
+		_, err = item.Update(mergePatch(doc, changes))
+		if _, ok := err.(gorc2.NotMostRecentError); ok && attempt < 5 {
+			continue
+		}
+		return err
+	}
+}
+
+// Decodes a JSON value keeping numbers as written.
+func decode(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// Returns target with a JSON merge patch applied, as RFC 7396 describes.
+func mergePatch(target, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = mergePatch(object[name], value)
+		}
+	}
+	return object
+}
@@ -0,0 +1,186 @@
+// Package router routes HTTP requests to handlers by method and path
+// pattern, and chains middleware around them.
+//
+// Patterns are made of slash separated segments, each either literal text,
+// {name} to match any one segment, or a final {name...} to match the rest
+// of the path. The matched values are set as path values of the request, so
+// handlers read them with Request.PathValue() whichever Router is used.
+package router
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Routes requests to the handlers registered for them.
+type Router interface {
+	http.Handler
+
+	// Registers the handler for requests of the method to paths matching
+	// the pattern.
+	Handle(method, pattern string, h http.Handler)
+}
+
+// Wraps a handler with extra behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Returns the handler wrapped in the middleware, the first outermost.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Returns middleware that cancels the context of each request after d, so
+// that the queries and lookups handlers make with it are given up on.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Middleware that turns a panicking handler into a 500 rather than a
+// dropped connection, logging the panic.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Handler for %s %s panicked: %v\n%s", r.Method,
+					r.URL.Path, err, debug.Stack())
+				http.Error(w, "Internal server error.", 500)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// A Router that tries routes in the order they were registered, using the
+// first that matches. Unlike http.ServeMux, routes may overlap, with those
+// registered first taking precedence. A trailing slash on the path is
+// ignored. The zero value is ready to use.
+type Mux struct {
+	// Handles requests no route matches. Defaults to a 404.
+	NotFound http.Handler
+
+	routes []route
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+// Returns an empty Mux.
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Registers a route. Panics if the pattern is malformed.
+func (m *Mux) Handle(method, pattern string, h http.Handler) {
+	segments := split(pattern)
+	for i, s := range segments {
+		if strings.HasPrefix(s, "{") != strings.HasSuffix(s, "}") ||
+			(strings.HasSuffix(s, "...}") && i != len(segments)-1) {
+			panic("router: malformed pattern " + pattern)
+		}
+	}
+	m.routes = append(m.routes, route{method, segments, h})
+}
+
+// Calls the handler of the first route matching the request. Requests with
+// a path some route matches, but not for their method, get a 405.
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := split(r.URL.EscapedPath())
+	var allowed []string
+	for _, rt := range m.routes {
+		values, ok := rt.match(path)
+		if !ok {
+			continue
+		} else if rt.method != r.Method &&
+			!(rt.method == "GET" && r.Method == "HEAD") {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		for name, value := range values {
+			r.SetPathValue(name, value)
+		}
+		rt.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "Method not allowed.", 405)
+	} else if m.NotFound != nil {
+		m.NotFound.ServeHTTP(w, r)
+	} else {
+		http.Error(w, "Not found.", 404)
+	}
+}
+
+// Returns the path values if the escaped path segments match the route.
+func (rt *route) match(path []string) (map[string]string, bool) {
+	values := make(map[string]string)
+	for i, s := range rt.segments {
+		if name, ok := strings.CutSuffix(s, "...}"); ok {
+			rest := strings.Join(path[min(i, len(path)):], "/")
+			value, err := url.PathUnescape(rest)
+			if err != nil {
+				return nil, false
+			}
+			values[name[1:]] = value
+			return values, true
+		} else if i >= len(path) {
+			return nil, false
+		} else if strings.HasPrefix(s, "{") {
+			value, err := url.PathUnescape(path[i])
+			if err != nil || path[i] == "" {
+				return nil, false
+			}
+			values[s[1:len(s)-1]] = value
+		} else if s != path[i] {
+			return nil, false
+		}
+	}
+	return values, len(path) == len(rt.segments)
+}
+
+// Returns the segments of a path, ignoring a trailing slash.
+func split(path string) []string {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// A Router using http.ServeMux. Patterns must not overlap, as ServeMux
+// panics if two could match the same request and neither is more specific.
+type ServeMux struct {
+	*http.ServeMux
+}
+
+// Returns an empty ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{http.NewServeMux()}
+}
+
+func (m *ServeMux) Handle(method, pattern string, h http.Handler) {
+	m.ServeMux.Handle(method+" "+pattern, h)
+}
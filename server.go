@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long requests in flight are given to finish when shutting down.
+const shutdownTimeout = 20 * time.Second
+
+// Records the status of a response for logging.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Lets handlers stream responses through the writer.
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Middleware that logs each request with its status and how long it took.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = 200
+		}
+		log.Printf("%s %s %s %d %s", r.RemoteAddr, r.Method, r.URL.Path,
+			sw.status, time.Since(start))
+	})
+}
+
+// Runs the server until it is sent SIGINT or SIGTERM, then stops taking
+// new connections and waits for the requests in flight, and the searches
+// waiting to be recorded, before returning.
+func serve(server *http.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down.")
+		ctx, cancel := context.WithTimeout(context.Background(),
+			shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Unable to finish requests: %s", err)
+		}
+	}()
+
+	log.Printf("Serving on %s", server.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	if searchRecorder != nil {
+		searchRecorder.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"chargepoints/apikeys"
+	"chargepoints/model"
+	"chargepoints/openapi"
+	"chargepoints/router"
+	"chargepoints/snapshots"
+	"log"
+	"time"
+)
+
+// Snapshots the chargepoints when called and then every
+// schedules.snapshots, if this replica leads the scheduler. While that is 0
+// no snapshots are taken, and it is checked again every minute.
+func takeSnapshots() {
+	for {
+		interval := conf().Schedules.Snapshots
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+		if scheduler.IsLeader() {
+			s, err := snapshots.Take(orc, model.ChargePoints)
+			if err != nil {
+				log.Printf("Unable to snapshot %s: %s", model.ChargePoints,
+					err)
+			} else {
+				log.Printf("Took snapshot %s of %d chargepoints.", s.ID,
+					s.Count)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Parses a point in time given as RFC 3339, or as a date, YYYY-MM-DD,
+// which means the end of that day in UTC.
+func parseAsOf(s string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Add(24*time.Hour - time.Millisecond), true
+	}
+	return time.Time{}, false
+}
+
+// Returns an item as it was at the time given as the time parameter, such
+// as /api/ChargePoints/{key}/as-of?time=2024-03-31 for how a chargepoint
+// looked at the end of March 2024. The result has the ref that was current
+// then and when it was written.
+func getAsOf(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	key := ctx.Request.PathValue("key")
+	t, ok := parseAsOf(ctx.Params["time"])
+	if !ok {
+		ctx.Abort(400, "Time must be given as RFC 3339 or YYYY-MM-DD.")
+		return
+	}
+	item, err := orc.Collection(collection).
+		WithContext(traceContext(ctx.Request)).GetAsOf(key, t, nil)
+	if err != nil {
+		writeJSON(ctx, nil, err)
+		return
+	}
+	results := []Result{{Collection: collection, Key: key, Ref: item.Ref,
+		Value: item.Value}}
+	transformResults(ctx, collection, results)
+	writeJSON(ctx, &struct {
+		Result
+		Updated time.Time `json:"updated"`
+	}{results[0], item.Updated}, nil)
+}
+
+// Lists the snapshots of a collection, or returns the one that was current
+// at the time given as the time parameter along with the ref of every key.
+func listSnapshots(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	if at := ctx.Params["time"]; at != "" {
+		t, ok := parseAsOf(at)
+		if !ok {
+			ctx.Abort(400, "Time must be given as RFC 3339 or YYYY-MM-DD.")
+			return
+		}
+		s, err := snapshots.At(orc, collection, t)
+		writeJSON(ctx, s, err)
+		return
+	}
+	list, err := snapshots.List(orc, collection)
+	writeJSON(ctx, list, err)
+}
+
+// Returns a snapshot along with the ref of every key.
+func getSnapshot(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	s, err := snapshots.Get(orc, id)
+	if err == nil && s.Collection != ctx.Request.PathValue("collection") {
+		ctx.Abort(404, "Not found.")
+		return
+	}
+	writeJSON(ctx, s, err)
+}
+
+// Registers the point in time endpoints. These must be registered before
+// the search endpoint.
+func snapshotRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/snapshots/{collection}",
+		timeout: searchTimeout, handler: listSnapshots, role: apikeys.Admin,
+		summary: "Lists the snapshots of a collection, or returns the one " +
+			"current at a time.",
+		params: []openapi.Param{{Name: "time",
+			Description: "RFC 3339 or YYYY-MM-DD."}},
+		response: []*snapshots.Snapshot{},
+	}, route{
+		method: "GET", pattern: "/api/snapshots/{collection}/{id}",
+		timeout: lookupTimeout, handler: getSnapshot, role: apikeys.Admin,
+		summary:  "Returns a snapshot along with the ref of every key.",
+		response: snapshots.Snapshot{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}/{key}/as-of",
+		timeout: searchTimeout, handler: getAsOf,
+		summary: "Returns a record as it was at a time.",
+		params: []openapi.Param{{Name: "time", Required: true,
+			Description: "RFC 3339 or YYYY-MM-DD."}},
+		response: struct {
+			Result
+			Updated time.Time `json:"updated"`
+		}{},
+	})
+}
@@ -0,0 +1,123 @@
+// Package snapshots records manifests of collections, the ref of every key
+// at a point in time, so that a collection can be read as it was when a
+// snapshot was taken. Single items can be read as they were at any time
+// with gorc2's Collection.GetAsOf(); snapshots add which keys existed.
+package snapshots
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The collection snapshots are stored in.
+const Collection = "Snapshots"
+
+// The layout of the time in snapshot IDs.
+const idLayout = "20060102T150405Z"
+
+// The refs of every key of a collection at a point in time.
+type Snapshot struct {
+	// A keys.Snapshot key of the collection name and the time the snapshot
+	// was taken, as snapshot:COLLECTION:YYYYMMDDTHHMMSSZ.
+	ID         string    `json:"id"`
+	Collection string    `json:"collection"`
+	Taken      time.Time `json:"taken"`
+	Count      int       `json:"count"`
+
+	// The ref of each key. Left out of List() results.
+	Refs map[string]string `json:"refs,omitempty"`
+}
+
+// Returns the ID of the snapshot of a collection taken at a time.
+func snapshotID(collection string, t time.Time) string {
+	return keys.Build(keys.Snapshot, collection, t.UTC().Format(idLayout))
+}
+
+// Records the ref of every key of a collection and stores it as a new
+// snapshot. Writes made while the collection is read may or may not be
+// included.
+func Take(client *gorc2.Client, collection string) (*Snapshot, error) {
+	s := &Snapshot{
+		Collection: collection,
+		Taken:      time.Now().UTC().Truncate(time.Second),
+		Refs:       map[string]string{},
+	}
+	s.ID = snapshotID(collection, s.Taken)
+	it := client.Collection(collection).Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		raw := it.Raw()
+		s.Refs[raw.Key] = raw.Ref
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+	s.Count = len(s.Refs)
+	_, err := client.Collection(Collection).Update(s.ID, s)
+	return s, err
+}
+
+// Returns a snapshot.
+func Get(client *gorc2.Client, id string) (*Snapshot, error) {
+	s := &Snapshot{}
+	if _, err := client.Collection(Collection).Get(id, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the snapshots of a collection, oldest first, without their refs.
+func List(client *gorc2.Client, collection string) ([]*Snapshot, error) {
+	snapshots := []*Snapshot{}
+	start, before := keys.Range(keys.Snapshot, collection)
+	it := client.Collection(Collection).List(&gorc2.ListQuery{
+		Limit:     100,
+		StartKey:  start,
+		BeforeKey: before,
+	})
+	for it.Next() {
+		s := &Snapshot{}
+		if _, err := it.Get(s); err != nil {
+			return nil, err
+		}
+		s.Refs = nil
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Taken.Before(snapshots[j].Taken)
+	})
+	return snapshots, it.Error
+}
+
+// Returns the latest snapshot of a collection taken at or before a time.
+func At(
+	client *gorc2.Client, collection string, t time.Time,
+) (*Snapshot, error) {
+	snapshots, err := List(client, collection)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Taken.After(t) {
+			return Get(client, snapshots[i].ID)
+		}
+	}
+	return nil, gorc2.NotFoundError(fmt.Sprintf(
+		"404: No snapshot of %s was taken by %s.", collection,
+		t.UTC().Format(time.RFC3339)))
+}
+
+// Reads an item as it was when the snapshot was taken, decoding it into
+// value if it is non nil.
+func (s *Snapshot) Get(
+	client *gorc2.Client, key string, value interface{},
+) (*gorc2.Item, error) {
+	ref, ok := s.Refs[key]
+	if !ok {
+		return nil, gorc2.NotFoundError(fmt.Sprintf(
+			"404: %s is not in snapshot %s.", key, s.ID))
+	}
+	return client.Collection(s.Collection).GetRef(key, ref, value)
+}
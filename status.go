@@ -0,0 +1,128 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The event type availability updates are recorded under, and the field of
+// the chargepoint the latest status is copied to.
+const (
+	statusEventType = "status"
+	statusField     = "Status"
+)
+
+// The statuses a chargepoint can be given. A status older than
+// cache.status_ttl is reported as unknown.
+var statuses = map[string]bool{
+	"available":      true,
+	"occupied":       true,
+	"out-of-service": true,
+}
+
+// The availability of a chargepoint.
+type Status struct {
+	Status  string    `json:"status"`
+	Updated time.Time `json:"updated"`
+
+	// Set when the status has not been updated within cache.status_ttl, in
+	// which case Status is "unknown".
+	Stale bool `json:"stale,omitempty"`
+}
+
+// Returns the status as it should be reported at the given time.
+func (s Status) at(now time.Time) Status {
+	if s.Status == "" || now.Sub(s.Updated) > conf().Cache.StatusTTL {
+		return Status{Status: "unknown", Updated: s.Updated, Stale: true}
+	}
+	return s
+}
+
+// Handles GET and POST of /api/{collection}/{key}/status. GET returns the
+// current status of the chargepoint. POST takes a body such as
+// {"status": "occupied"}, records it as an event and copies it onto the
+// chargepoint, and needs the partner role.
+func status(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	key := ctx.Request.PathValue("key")
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+
+	c := orc.Collection(collection).WithContext(traceContext(ctx.Request))
+	var current struct {
+		Status *Status
+	}
+	if _, err := c.Get(key, &current); err != nil {
+		if _, ok := err.(gorc2.NotFoundError); ok {
+			ctx.Abort(404, fmt.Sprintf("Unknown chargepoint %s.", key))
+		} else {
+			log.Println(err)
+			ctx.Abort(502, "Unable to read chargepoint.")
+		}
+		return
+	}
+
+	var reply Status
+	if ctx.Request.Method == "POST" {
+		var update Status
+		if !readJSON(ctx, &update) {
+			return
+		} else if !statuses[update.Status] {
+			ctx.Abort(400, fmt.Sprintf("Unknown status %q.", update.Status))
+			return
+		}
+		updated, err := setStatus(c, key, update.Status)
+		if err != nil {
+			log.Println(err)
+			ctx.Abort(502, "Unable to update status.")
+			return
+		}
+		reply = updated
+	} else if current.Status != nil {
+		reply = *current.Status
+	}
+
+	data, _ := json.Marshal(reply.at(time.Now()))
+	ctx.Write(data)
+}
+
+// Records a status update as an event on the chargepoint and copies it to
+// the statusField of the chargepoint. Updates that arrive out of order do
+// not replace a newer status.
+func setStatus(c *gorc2.Collection, key, value string) (Status, error) {
+	event, err := c.AddEvent(key, statusEventType, map[string]string{
+		"status": value,
+	})
+	if err != nil {
+		return Status{}, err
+	}
+	update := Status{Status: value, Updated: event.Timestamp}
+
+	for attempt := 0; ; attempt++ {
+		var doc map[string]interface{}
+		item, err := c.Get(key, &doc)
+		if err != nil {
+			return Status{}, err
+		} else if doc == nil {
+			return Status{}, fmt.Errorf("Chargepoint %s is not an object.", key)
+		}
+
+		var current Status
+		if raw, err := json.Marshal(doc[statusField]); err == nil {
+			json.Unmarshal(raw, &current)
+		}
+		if current.Updated.After(update.Updated) {
+			return current, nil
+		}
+
+		doc[statusField] = update
+		_, err = item.Update(doc)
+		if _, ok := err.(gorc2.NotMostRecentError); ok && attempt < 5 {
+			continue
+		}
+		return update, err
+	}
+}
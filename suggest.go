@@ -0,0 +1,60 @@
+package main
+
+import (
+	"chargepoints/openapi"
+	"chargepoints/router"
+	"chargepoints/suggest"
+	"strconv"
+)
+
+// The most suggestions returned by default and at all.
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+)
+
+type Suggestions struct {
+	Suggestions []suggest.Suggestion `json:"suggestions"`
+	Count       int                  `json:"count"`
+}
+
+// Returns the town and operator names of a collection matching what has
+// been typed so far, given as q, for typeahead in a search box. Each word
+// typed must start a word of the name, so "lond" suggests "London" and
+// "keyn" suggests "Milton Keynes". The names come from an index rebuilt
+// when chargepoints are imported with orcctl.
+func suggestNames(ctx *Context) {
+	limit := defaultSuggestions
+	if l := ctx.Params["limit"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			ctx.Abort(400, "Invalid limit.")
+			return
+		}
+		limit = min(n, maxSuggestions)
+	}
+
+	suggestions, err := suggest.Suggest(orc, ctx.Request.PathValue("collection"),
+		ctx.Params["q"], limit)
+	if err == nil {
+		// Names only change on import, so suggestions can be cached a
+		// while to save a request per key pressed.
+		ctx.SetHeader("Cache-Control", "public, max-age=300", true)
+	}
+	writeJSON(ctx, &Suggestions{suggestions, len(suggestions)}, err)
+}
+
+func suggestRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/{collection}/suggest",
+		timeout: lookupTimeout, handler: suggestNames,
+		summary: "Returns the town and operator names matching what has " +
+			"been typed so far.",
+		params: []openapi.Param{
+			{Name: "q", Description: "What has been typed."},
+			{Name: "limit", Type: "integer",
+				Description: "The most suggestions returned, up to 50."},
+		},
+		response: Suggestions{},
+	})
+}
@@ -0,0 +1,231 @@
+// Package suggest keeps a prefix index of the town and operator names in a
+// collection of chargepoints, used to suggest names as they are typed.
+//
+// The index is built by scanning the collection, after each import, and is
+// split into buckets holding every name with a word starting with the same
+// PrefixLength letters, so suggestions for a query are found by reading a
+// single item.
+package suggest
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The collection the index is stored in.
+const Collection = "Suggestions"
+
+// The number of letters of each word that names are bucketed by. Queries
+// shorter than this get no suggestions.
+const PrefixLength = 2
+
+// The kinds of names suggested.
+const (
+	Town     = "town"
+	Operator = "operator"
+)
+
+// A name that can be searched for.
+type Suggestion struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+
+	// The number of chargepoints with this name.
+	Count int `json:"count"`
+}
+
+// The names with a word starting with the same prefix.
+type bucket struct {
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// Lists the prefixes of the buckets built for a collection, so that those
+// no longer needed can be deleted when it is rebuilt.
+type manifest struct {
+	Prefixes []string `json:"prefixes"`
+}
+
+// The fields of a chargepoint that names are taken from.
+type chargepoint struct {
+	ChargeDeviceLocation struct {
+		Address struct {
+			PostTown string
+		}
+	}
+	DeviceOwner struct {
+		OrganisationName string
+	}
+}
+
+// Returns the lower cased words of a name, split at anything other than a
+// letter or digit.
+func words(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Returns the bucket prefix of a word, or "" if it is too short to have one.
+func prefix(word string) string {
+	runes := []rune(word)
+	if len(runes) < PrefixLength {
+		return ""
+	}
+	return string(runes[:PrefixLength])
+}
+
+// Returns the key of a bucket of a collection's index.
+func bucketKey(collection, prefix string) string {
+	return keys.Build(keys.SuggestBucket, collection, prefix)
+}
+
+// Returns the key of the manifest of a collection's index.
+func manifestKey(collection string) string {
+	return keys.Build(keys.SuggestManifest, collection)
+}
+
+// Rebuilds the index of a collection's town and operator names, returning
+// the number of names indexed.
+func Build(client *gorc2.Client, collection string) (int, error) {
+	type name struct{ kind, name string }
+	counts := make(map[name]int)
+	it := client.Collection(collection).Scroll(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		var cp chargepoint
+		if err := json.Unmarshal(it.Raw().Value, &cp); err != nil {
+			continue
+		}
+		town := strings.TrimSpace(cp.ChargeDeviceLocation.Address.PostTown)
+		if town != "" {
+			counts[name{Town, town}]++
+		}
+		owner := strings.TrimSpace(cp.DeviceOwner.OrganisationName)
+		if owner != "" {
+			counts[name{Operator, owner}]++
+		}
+	}
+	if it.Error != nil {
+		return 0, it.Error
+	}
+
+	buckets := make(map[string]*bucket)
+	for n, count := range counts {
+		s := Suggestion{Name: n.name, Kind: n.kind, Count: count}
+		seen := make(map[string]bool)
+		for _, word := range words(n.name) {
+			p := prefix(word)
+			if p == "" || seen[p] {
+				continue
+			}
+			seen[p] = true
+			if buckets[p] == nil {
+				buckets[p] = &bucket{}
+			}
+			buckets[p].Suggestions = append(buckets[p].Suggestions, s)
+		}
+	}
+
+	c := client.Collection(Collection)
+	m := manifest{}
+	for p, b := range buckets {
+		rank(b.Suggestions)
+		if _, err := c.Update(bucketKey(collection, p), b); err != nil {
+			return 0, err
+		}
+		m.Prefixes = append(m.Prefixes, p)
+	}
+	sort.Strings(m.Prefixes)
+
+	// Remove the buckets of prefixes that no longer match any name.
+	var old manifest
+	_, err := c.Get(manifestKey(collection), &old)
+	if _, ok := err.(gorc2.NotFoundError); err != nil && !ok {
+		return 0, err
+	}
+	for _, p := range old.Prefixes {
+		if buckets[p] == nil {
+			if err := c.Delete(bucketKey(collection, p)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if _, err := c.Update(manifestKey(collection), &m); err != nil {
+		return 0, err
+	}
+	return len(counts), nil
+}
+
+// Sorts suggestions with the most chargepoints first, then by name.
+func rank(suggestions []Suggestion) {
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Kind < b.Kind
+	})
+}
+
+// Returns up to limit names in a collection's index matching a query as it
+// is typed: each word of the query must start a word of the name, with the
+// words in order. Names starting with the query come first, then those
+// with the most chargepoints.
+func Suggest(
+	client *gorc2.Client, collection, query string, limit int,
+) ([]Suggestion, error) {
+	terms := words(query)
+	if len(terms) == 0 || prefix(terms[0]) == "" {
+		return []Suggestion{}, nil
+	}
+
+	var b bucket
+	_, err := client.Collection(Collection).
+		Get(bucketKey(collection, prefix(terms[0])), &b)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		return []Suggestion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var leading, others []Suggestion
+	for _, s := range b.Suggestions {
+		if at := match(words(s.Name), terms); at == 0 {
+			leading = append(leading, s)
+		} else if at > 0 {
+			others = append(others, s)
+		}
+	}
+	suggestions := append(leading, others...)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	if suggestions == nil {
+		suggestions = []Suggestion{}
+	}
+	return suggestions, nil
+}
+
+// Returns the index of the first word of a name at which the terms start
+// consecutive words, or -1 if they match nowhere.
+func match(name, terms []string) int {
+	for i := 0; i+len(terms) <= len(name); i++ {
+		matched := true
+		for j, term := range terms {
+			if !strings.HasPrefix(name[i+j], term) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Below this zoom tiles hold clusters rather than chargepoints.
+const tileClusterZoom = 10
+
+// The deepest zoom tiles are served for.
+const maxTileZoom = 22
+
+// Clusters split a tile into a grid of 2^tileClusterDepth by
+// 2^tileClusterDepth cells, the tiles that many zoom levels deeper.
+const tileClusterDepth = 3
+
+type TileResults struct {
+	Results  []Result  `json:"results,omitempty"`
+	Clusters []Cluster `json:"clusters,omitempty"`
+	Count    int       `json:"count"`
+}
+
+// Returns the bounds of a slippy map tile.
+func tileBounds(z, x, y int) (north, south, east, west float64) {
+	n := math.Exp2(float64(z))
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+	return lat(y), lat(y + 1), float64(x+1)/n*360 - 180, float64(x)/n*360 - 180
+}
+
+// Returns the tile holding a point at a zoom.
+func tileOf(lat, lon float64, z int) (x, y int) {
+	n := math.Exp2(float64(z))
+	x = int(math.Floor((lon + 180) / 360 * n))
+	latRad := lat * math.Pi / 180
+	y = int(math.Floor((1 - math.Asinh(math.Tan(latRad))/math.Pi) / 2 * n))
+	clamp := func(v int) int { return max(0, min(v, int(n)-1)) }
+	return clamp(x), clamp(y)
+}
+
+// Groups results into clusters by the tiles tileClusterDepth zoom levels
+// below the one at z, so that clusters never span two tiles. Clusters are
+// returned largest first.
+func tileClusters(results []Result, z int) []Cluster {
+	zoom := z + tileClusterDepth
+	byTile := make(map[[2]int]*Cluster)
+	for _, r := range results {
+		var loc location
+		if err := json.Unmarshal(r.Value, &loc); err != nil {
+			continue
+		}
+		lat := loc.ChargeDeviceLocation.Latitude
+		lon := loc.ChargeDeviceLocation.Longitude
+		x, y := tileOf(lat, lon, zoom)
+		c, ok := byTile[[2]int{x, y}]
+		if !ok {
+			c = &Cluster{Tile: fmt.Sprintf("%d/%d/%d", zoom, x, y)}
+			c.North, c.South, c.East, c.West = tileBounds(zoom, x, y)
+			byTile[[2]int{x, y}] = c
+		}
+		c.Count++
+		c.Latitude += lat
+		c.Longitude += lon
+	}
+
+	clusters := make([]Cluster, 0, len(byTile))
+	for _, c := range byTile {
+		c.Latitude /= float64(c.Count)
+		c.Longitude /= float64(c.Count)
+		clusters = append(clusters, *c)
+	}
+	sortClusters(clusters)
+	return clusters
+}
+
+// Returns the chargepoints within a slippy map tile, as used by Leaflet and
+// other map libraries, so maps can load them a tile at a time. Tiles are
+// addressed as /api/{collection}/tiles/{z}/{x}/{y}.json. Tiles zoomed out
+// beyond tileClusterZoom, or holding more than limits.bbox_max_results
+// chargepoints, hold clusters instead. An optional query parameter narrows
+// the chargepoints further.
+//
+// Tiles may be cached for cache.tile_max_age and carry an ETag so that
+// clients can check whether they have changed after that.
+func tile(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	z, zErr := strconv.Atoi(ctx.Request.PathValue("z"))
+	x, xErr := strconv.Atoi(ctx.Request.PathValue("x"))
+	ys, ok := strings.CutSuffix(ctx.Request.PathValue("y"), ".json")
+	y, yErr := strconv.Atoi(ys)
+	if !ok || zErr != nil || xErr != nil || yErr != nil {
+		ctx.Abort(404, "Not found.")
+		return
+	}
+	if z < 0 || z > maxTileZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		ctx.Abort(404, fmt.Sprintf("No tile %d/%d/%d.", z, x, y))
+		return
+	}
+	ctx.ContentType("json")
+	allowOrigin(ctx)
+
+	north, south, east, west := tileBounds(z, x, y)
+	query := fmt.Sprintf("value.%s:IN:{north:%g south:%g east:%g west:%g}",
+		locationField, north, south, east, west)
+	if extra := ctx.Params["query"]; extra != "" {
+		query += " AND (" + extra + ")"
+	}
+	it := orc.Collection(collection).WithContext(traceContext(ctx.Request)).
+		Search(query, &gorc2.SearchQuery{Limit: 100})
+
+	// Chargepoints on the edge of a tile are matched by the tiles on both
+	// sides, so only those in this tile by tileOf() are kept.
+	results := TileResults{}
+	for it.Next() {
+		raw := it.Raw()
+		var loc location
+		if json.Unmarshal(raw.Value, &loc) == nil {
+			tx, ty := tileOf(loc.ChargeDeviceLocation.Latitude,
+				loc.ChargeDeviceLocation.Longitude, z)
+			if tx != x || ty != y {
+				continue
+			}
+		}
+		results.Results = append(results.Results,
+			Result{Key: raw.Key, Ref: raw.Ref, Value: raw.Value})
+	}
+	results.Count = len(results.Results)
+	if it.Error == nil {
+		ctx.SetHeader("Cache-Control",
+			fmt.Sprintf("public, max-age=%d", conf().Cache.TileMaxAge),
+			true)
+		if notModified(ctx, resultsETag(ctx, results.Results)) {
+			return
+		}
+	}
+	if z < tileClusterZoom ||
+		results.Count > conf().Limits.BBoxMaxResults {
+		results.Clusters = tileClusters(results.Results, z)
+		results.Results = nil
+	}
+	transformResults(ctx, collection, results.Results)
+
+	if wantsJSONAPI(ctx) {
+		if results.Clusters != nil && it.Error == nil {
+			writeAPIClusters(ctx, results.Clusters, results.Count)
+		} else {
+			writeAPIChargepoints(ctx, collection, results.Results, it.Error)
+		}
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+
+	if it.Error != nil {
+		ctx.WriteHeader(502)
+		encoder.Encode(it.Error)
+		log.Println(it.Error)
+	} else {
+		encoder.Encode(&results)
+	}
+
+	ctx.Write(buf.Bytes())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The context key that the trace of an incoming request is stored under.
+type traceKey struct{}
+
+// The W3C trace context of an incoming request.
+type traceParent struct {
+	// The ID of the trace, 32 hex digits.
+	TraceID string
+
+	// The ID of the browser's span the request was made in, 16 hex digits,
+	// or empty if the request did not come with a traceparent header.
+	ParentID string
+
+	// The trace flags, 2 hex digits, of which 01 is sampled.
+	Flags string
+}
+
+// Returns a context carrying the trace of the request. The trace is taken
+// from a W3C traceparent header if the browser sent a valid one, otherwise
+// a new one is started, so every query made to Orchestrate while handling
+// the request can be tied back to it.
+func traceContext(req *http.Request) context.Context {
+	trace, ok := parseTraceParent(req.Header.Get("traceparent"))
+	if !ok {
+		trace = traceParent{TraceID: randomHex(16), Flags: "01"}
+	}
+	return context.WithValue(req.Context(), traceKey{}, trace)
+}
+
+// Parses a traceparent header as given by the W3C Trace Context
+// recommendation, returning false if it is not valid. Versions after 00
+// may add fields, which are ignored.
+func parseTraceParent(header string) (traceParent, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || !isLowerHex(parts[0], 2) || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return traceParent{}, false
+	}
+	trace := traceParent{TraceID: parts[1], ParentID: parts[2],
+		Flags: parts[3]}
+	if !isLowerHex(trace.TraceID, 32) || isZero(trace.TraceID) ||
+		!isLowerHex(trace.ParentID, 16) || isZero(trace.ParentID) ||
+		!isLowerHex(trace.Flags, 2) {
+		return traceParent{}, false
+	}
+	return trace, true
+}
+
+// Returns true if s is n lowercase hex digits.
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if s is all zeros, which is an invalid trace or span ID.
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// Returns n random bytes as a hex string.
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// A gorc2.Tracer that forwards the trace to Orchestrate in a traceparent
+// header, as a child of the browser's span, and logs a line for every
+// request made. It stands in for an OpenTelemetry adapter, which would
+// start and export real spans in the same places; the IDs it logs and
+// sends are the ones such an adapter would use.
+type logTracer struct{}
+
+func (logTracer) StartRequest(
+	req *http.Request, span gorc2.SpanInfo,
+) (*http.Request, func(*http.Response, error)) {
+	trace, ok := req.Context().Value(traceKey{}).(traceParent)
+	if !ok {
+		trace = traceParent{TraceID: randomHex(16), Flags: "01"}
+	}
+	spanID := randomHex(8)
+	req.Header.Set("traceparent",
+		"00-"+trace.TraceID+"-"+spanID+"-"+trace.Flags)
+
+	start := time.Now()
+	return req, func(resp *http.Response, err error) {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		log.Printf("trace=%s span=%s parent=%s op=%s collection=%s "+
+			"status=%d duration=%s err=%v", trace.TraceID, spanID,
+			trace.ParentID, span.Operation, span.Collection, status,
+			time.Since(start), err)
+	}
+}
+
+// The query plan of a search as shown with debug=plan, see
+// gorc2.QueryPlan.
+type searchPlan struct {
+	Collection string              `json:"collection"`
+	Query      string              `json:"query"`
+	Params     map[string][]string `json:"params,omitempty"`
+	Pages      int                 `json:"pages"`
+	Fetched    int                 `json:"fetched"`
+	Filtered   int                 `json:"filtered"`
+	LatencyMs  float64             `json:"latency_ms"`
+	Sources    []*searchPlan       `json:"sources,omitempty"`
+}
+
+func newSearchPlan(p *gorc2.QueryPlan) *searchPlan {
+	plan := &searchPlan{
+		Collection: p.Collection,
+		Query:      p.Query,
+		Params:     p.Params,
+		Pages:      p.Pages,
+		Fetched:    p.Fetched,
+		Filtered:   p.Filtered,
+		LatencyMs:  float64(p.Latency.Microseconds()) / 1000,
+	}
+	for _, s := range p.Sources {
+		plan.Sources = append(plan.Sources, newSearchPlan(s))
+	}
+	return plan
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseTraceParent(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	for header, ok := range map[string]bool{
+		"00-" + traceID + "-" + parentID + "-01":                  true,
+		" 00-" + traceID + "-" + parentID + "-00 ":                true,
+		"01-" + traceID + "-" + parentID + "-01-extra":            true,
+		"00-" + traceID + "-" + parentID + "-01-extra":            false,
+		"ff-" + traceID + "-" + parentID + "-01":                  false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + parentID + "-01": false,
+		"00-" + traceID + "-" + parentID + "-1":                   false,
+		"00-" + traceID + "-00F067AA0BA902B7-01":                  false,
+		"00-00000000000000000000000000000000-" + parentID + "-01": false,
+		"00-" + traceID + "-0000000000000000-01":                  false,
+		"00-" + traceID + "-" + parentID[:15] + "g-01":            false,
+		"00-" + traceID + "-" + parentID:                          false,
+		"":                                                        false,
+	} {
+		trace, got := parseTraceParent(header)
+		if got != ok {
+			t.Errorf("%q parsed as %v, expected %v", header, got, ok)
+		} else if ok && (trace.TraceID != traceID ||
+			trace.ParentID != parentID) {
+			t.Errorf("%q parsed as %+v", header, trace)
+		}
+	}
+}
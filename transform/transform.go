@@ -0,0 +1,227 @@
+// Package transform rewrites the documents the API returns, so that fields
+// can be renamed, converted to other units or computed from others without
+// changing what the importers store. A chain of steps is given for each
+// collection, one step per string:
+//
+//	rename ChargeDeviceName name
+//	convert Connector.RatedOutputkW kW W
+//	rename Connector.RatedOutputkW RatedOutputW
+//	compute is_rapid = Connector.RatedOutputW >= 43000
+//	remove DeviceOwner.Website
+//
+// Fields are named by dotted paths. A path through an array names that field
+// of every element, or of a single element if the part after the array is
+// an index. rename gives the last field of the path a new name, leaving it
+// where it is. convert changes a number between units of power (W, kW, MW)
+// or of energy (Wh, kWh, MWh). compute sets a field, creating the objects
+// leading to it, to the value of a gorc2 filter expression evaluated against
+// the document as the earlier steps left it, in which key, ref, score and
+// distance are not set. remove deletes a field.
+package transform
+
+import (
+	"bytes"
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A step of a Chain, changing a decoded document in place.
+type step func(doc map[string]interface{}) error
+
+// The steps applied to the documents of a collection, in order. The zero
+// value leaves documents as they are.
+type Chain struct {
+	steps []step
+}
+
+// Parses the steps of a chain, see the package documentation.
+func Parse(steps []string) (*Chain, error) {
+	c := &Chain{}
+	for _, s := range steps {
+		st, err := parseStep(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid transform %q: %s", s, err)
+		}
+		c.steps = append(c.steps, st)
+	}
+	return c, nil
+}
+
+// Returns true if the chain has no steps.
+func (c *Chain) Empty() bool {
+	return c == nil || len(c.steps) == 0
+}
+
+// Returns a document with the steps applied. Documents that are not JSON
+// objects are returned unchanged.
+func (c *Chain) Apply(value json.RawMessage) (json.RawMessage, error) {
+	if c.Empty() {
+		return value, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil || doc == nil {
+		return value, nil
+	}
+	for _, st := range c.steps {
+		if err := st(doc); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func parseStep(s string) (step, error) {
+	op, rest, _ := strings.Cut(s, " ")
+	args := strings.Fields(rest)
+	switch op {
+	case "rename":
+		if len(args) != 2 || strings.Contains(args[1], ".") {
+			return nil, fmt.Errorf("expected rename <path> <name>")
+		}
+		return rename(split(args[0]), args[1]), nil
+	case "convert":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("expected convert <path> <unit> <unit>")
+		}
+		return convert(split(args[0]), args[1], args[2])
+	case "compute":
+		field, expr, ok := strings.Cut(rest, "=")
+		field = strings.TrimSpace(field)
+		if !ok || field == "" || strings.ContainsAny(field, " \t") {
+			return nil, fmt.Errorf("expected compute <path> = <expression>")
+		}
+		return compute(split(field), strings.TrimSpace(expr))
+	case "remove":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected remove <path>")
+		}
+		return remove(split(args[0])), nil
+	}
+	return nil, fmt.Errorf("unknown step %q", op)
+}
+
+// Splits a dotted path, dropping any "value." prefix.
+func split(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "value."), ".")
+}
+
+// Calls fn with each object holding the field a path names, along with the
+// name of the field. Objects without the field are included.
+func parents(
+	value interface{}, path []string,
+	fn func(parent map[string]interface{}, name string),
+) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			fn(v, path[0])
+		} else if next, ok := v[path[0]]; ok {
+			parents(next, path[1:], fn)
+		}
+	case []interface{}:
+		if n, err := strconv.Atoi(path[0]); err == nil {
+			if n >= 0 && n < len(v) && len(path) > 1 {
+				parents(v[n], path[1:], fn)
+			}
+			return
+		}
+		for _, element := range v {
+			parents(element, path, fn)
+		}
+	}
+}
+
+func rename(path []string, to string) step {
+	return func(doc map[string]interface{}) error {
+		parents(doc, path, func(parent map[string]interface{}, name string) {
+			if v, ok := parent[name]; ok && name != to {
+				parent[to] = v
+				delete(parent, name)
+			}
+		})
+		return nil
+	}
+}
+
+func remove(path []string) step {
+	return func(doc map[string]interface{}) error {
+		parents(doc, path, func(parent map[string]interface{}, name string) {
+			delete(parent, name)
+		})
+		return nil
+	}
+}
+
+// The units convert knows, by what they are a measure of and how many of
+// the base unit they are.
+var units = map[string]struct {
+	measure string
+	scale   float64
+}{
+	"W":   {"power", 1},
+	"kW":  {"power", 1e3},
+	"MW":  {"power", 1e6},
+	"Wh":  {"energy", 1},
+	"kWh": {"energy", 1e3},
+	"MWh": {"energy", 1e6},
+}
+
+// Fields that are not numbers are left as they are.
+func convert(path []string, from, to string) (step, error) {
+	f, ok := units[from]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %q", from)
+	}
+	t, ok := units[to]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %q", to)
+	} else if f.measure != t.measure {
+		return nil, fmt.Errorf("can not convert %s to %s", from, to)
+	}
+	factor := f.scale / t.scale
+	return func(doc map[string]interface{}) error {
+		parents(doc, path, func(parent map[string]interface{}, name string) {
+			switch v := parent[name].(type) {
+			case json.Number:
+				if f, err := v.Float64(); err == nil {
+					parent[name] = f * factor
+				}
+			case float64:
+				parent[name] = v * factor
+			}
+		})
+		return nil
+	}, nil
+}
+
+func compute(path []string, expr string) (step, error) {
+	f, err := gorc2.ParseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc map[string]interface{}) error {
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		value := f.Eval(&gorc2.Item{Value: raw})
+
+		// Create the objects leading to the field if they are missing.
+		parent := doc
+		for _, name := range path[:len(path)-1] {
+			next, ok := parent[name].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				parent[name] = next
+			}
+			parent = next
+		}
+		parent[path[len(path)-1]] = value
+		return nil
+	}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"chargepoints/locale"
+	"chargepoints/transform"
+	"log"
+	"sync/atomic"
+)
+
+// The transforms of each collection, parsed from the config when it is
+// loaded.
+var currentTransforms atomic.Pointer[map[string]*transform.Chain]
+
+// Parses the transforms of a config, which has been checked by config.Load.
+func loadTransforms(config map[string][]string) {
+	chains := make(map[string]*transform.Chain)
+	for collection, steps := range config {
+		chain, err := transform.Parse(steps)
+		if err != nil {
+			log.Printf("Unable to parse transforms.%s: %s", collection, err)
+			continue
+		}
+		chains[collection] = chain
+	}
+	currentTransforms.Store(&chains)
+}
+
+// Returns the language of the config's that the request asks for text to
+// be in, or "" if it does not ask for one.
+func requestLanguage(ctx *Context) string {
+	return locale.Negotiate(ctx.Request.Header.Get("Accept-Language"),
+		conf().Locale.Languages)
+}
+
+// Applies the transforms of its collection to the value of each result,
+// then reduces its localized fields to the language asked for, just before
+// they are written. Results of a search across collections name their own,
+// others are from the given collection. Values that can not be transformed
+// are returned as they are.
+func transformResults(ctx *Context, collection string, results []Result) {
+	chains := *currentTransforms.Load()
+	for i := range results {
+		name := results[i].Collection
+		if name == "" {
+			name = collection
+		}
+		chain := chains[name]
+		if chain.Empty() {
+			continue
+		}
+		value, err := chain.Apply(results[i].Value)
+		if err != nil {
+			log.Printf("Unable to transform %s/%s: %s", name,
+				results[i].Key, err)
+			continue
+		}
+		results[i].Value = value
+	}
+
+	// Without an Accept-Language every language is returned.
+	config := conf().Locale
+	if len(config.Fields) == 0 {
+		return
+	}
+	ctx.SetHeader("Vary", "Accept-Language", false)
+	lang := requestLanguage(ctx)
+	if lang == "" {
+		return
+	}
+	ctx.SetHeader("Content-Language", lang, true)
+	for i := range results {
+		value, err := locale.Localize(results[i].Value, config.Fields, lang,
+			config.Languages[0])
+		if err != nil {
+			log.Printf("Unable to localize %s: %s", results[i].Key, err)
+			continue
+		}
+		results[i].Value = value
+	}
+}
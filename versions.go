@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The versions of the format of API responses. Version 0 is that of the
+// /api/ routes, whose responses are whatever each endpoint writes. Version
+// 1, served by the same routes under /v1/, wraps every JSON response in an
+// envelope:
+//
+//	{"data": ..., "meta": {...}, "links": {"self": ...}, "errors": [...]}
+//
+// Requests of the /api/ routes can ask for another version with the
+// API-Version header, and every response says which version it is in with
+// the same header, so that the format can change without breaking clients
+// of the earlier ones.
+const (
+	legacyVersion = 0
+	latestVersion = 1
+)
+
+// The header versions are asked for and given in.
+const versionHeader = "API-Version"
+
+// Returns the version of the response format a request asks for: 1 for the
+// /v1/ routes, and for the others the version in the API-Version header,
+// or 0 if it has none.
+func requestVersion(req *http.Request) (int, error) {
+	if strings.HasPrefix(req.URL.Path, "/v1/") {
+		return 1, nil
+	}
+	v := req.Header.Get(versionHeader)
+	if v == "" {
+		return legacyVersion, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < legacyVersion || n > latestVersion {
+		return 0, fmt.Errorf("Unsupported %s %q, the versions supported "+
+			"are %d to %d.", versionHeader, v, legacyVersion, latestVersion)
+	}
+	return n, nil
+}
+
+// Returns the path of the /api/ route a path of a /v1/ route mirrors, or
+// the path itself.
+func legacyPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/v1/"); ok {
+		return "/api/" + rest
+	}
+	return path
+}
+
+// Wraps the handler of an /api/ route so that its responses are written in
+// the version of the response format asked for.
+func versioned(h handlerFunc) handlerFunc {
+	return func(ctx *Context) {
+		ctx.SetHeader("Vary", versionHeader, false)
+		version, err := requestVersion(ctx.Request)
+		if err != nil {
+			ctx.Abort(400, err.Error())
+			return
+		}
+		ctx.SetHeader(versionHeader, strconv.Itoa(version), true)
+		if version == legacyVersion {
+			h(ctx)
+			return
+		}
+		w := &envelopeWriter{ResponseWriter: ctx.ResponseWriter}
+		ctx.ResponseWriter = w
+		h(ctx)
+		w.finish(ctx.Request)
+	}
+}
+
+// The envelope of version 1 responses. JSON:API documents already have this
+// shape and are left as they are.
+type envelope struct {
+	Data   json.RawMessage            `json:"data,omitempty"`
+	Meta   map[string]json.RawMessage `json:"meta,omitempty"`
+	Links  map[string]string          `json:"links,omitempty"`
+	Errors []apiError                 `json:"errors,omitempty"`
+}
+
+// Keeps the JSON responses and plain text errors of a handler so that they
+// can be wrapped in an envelope. Other responses, such as downloads, are
+// passed through as they are written.
+type envelopeWriter struct {
+	http.ResponseWriter
+	status    int
+	decided   bool
+	buffering bool
+	body      bytes.Buffer
+}
+
+// Decides whether to keep the response from its Content-Type once its
+// status is known.
+func (w *envelopeWriter) decide(status int) {
+	if w.decided {
+		return
+	}
+	w.decided, w.status = true, status
+	contentType := w.Header().Get("Content-Type")
+	w.buffering = status != 304 &&
+		(strings.HasPrefix(contentType, "application/json") ||
+			(status >= 400 && strings.HasPrefix(contentType, "text/plain")))
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *envelopeWriter) WriteHeader(status int) {
+	w.decide(status)
+}
+
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	w.decide(200)
+	if w.buffering {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Lets handlers stream responses that are passed through.
+func (w *envelopeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.buffering {
+		f.Flush()
+	}
+}
+
+// Writes the kept response in its envelope. Errors become the errors of the
+// envelope. The results of lists become its data, and the other fields
+// written alongside them, such as the count, its meta. Other responses
+// become its data as they are.
+func (w *envelopeWriter) finish(req *http.Request) {
+	if !w.buffering {
+		return
+	}
+	env := envelope{Links: map[string]string{"self": req.URL.RequestURI()}}
+	body := bytes.TrimSpace(w.body.Bytes())
+	if w.status >= 400 {
+		title := http.StatusText(w.status)
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			title = string(body)
+		}
+		env.Errors = []apiError{{Status: strconv.Itoa(w.status), Title: title}}
+	} else {
+		env.Data = body
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(body, &fields) == nil {
+			if results, ok := fields["results"]; ok {
+				delete(fields, "results")
+				env.Data, env.Meta = results, fields
+			}
+		}
+	}
+	data, _ := json.Marshal(&env)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(data)
+}
@@ -2,79 +2,529 @@ package main
 
 import (
 	"bytes"
-	"chargepoints/Godeps/_workspace/src/github.com/hoisie/web"
 	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/analytics"
+	"chargepoints/apikeys"
+	"chargepoints/bus"
+	"chargepoints/cursor"
+	"chargepoints/devdata"
+	"chargepoints/leader"
+	"chargepoints/model"
+	"chargepoints/openapi"
+	"chargepoints/publish"
+	"chargepoints/router"
+	"chargepoints/suggest"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
-	orc  = gorc2.NewClient(os.Getenv("ORC_KEY"))
+	orc  *gorc2.Client
 	host = "api.orchestrate.io"
+
+	// The APP_VERSION of this deployment, "dev" if not set.
+	appVersion string
+
+	// Elects the replica that runs the scheduled jobs, such as snapshots
+	// and publishing, when several are deployed.
+	scheduler = &leader.Elector{Name: "scheduler"}
 )
 
+// The field of a chargepoint holding its location, used to order results
+// nearest first.
+const locationField = "ChargeDeviceLocation"
+
 type Result struct {
-	Value json.RawMessage `json:"value"`
+	// Only used by JSON:API documents, which give them as the type and id,
+	// and for ETags along with the ref.
+	Collection string          `json:"-"`
+	Key        string          `json:"-"`
+	Ref        string          `json:"-"`
+	Value      json.RawMessage `json:"value"`
 }
 
 type Results struct {
 	Results []Result `json:"results"`
 	Count   int      `json:"count"`
+
+	// True if nothing matched the query as given, so the results are those
+	// of a fuzzy retry. See the fuzzy parameter of search.
+	Relaxed bool `json:"relaxed,omitempty"`
+
+	// The plan of each query run, with debug=plan.
+	Plans []*searchPlan `json:"plans,omitempty"`
 }
 
 func main() {
-	web.Config.StaticDir = "static"
-	port := os.Getenv("PORT")
-	web.Get("/api/([^/]+/?)", search)
-	web.Run(":" + port)
+	// Without an Orchestrate key everything is kept in memory so the app can
+	// be run locally with no external dependencies.
+	if key := os.Getenv("ORC_KEY"); key != "" {
+		orc = gorc2.NewClient(key)
+		orc.APIHost = host
+	} else {
+		log.Println("ORC_KEY is not set, using an in-memory backend.")
+		orc = gorc2.NewLocalClient()
+		if err := loadSampleData(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Stop sending queries while Orchestrate is failing rather than letting
+	// them queue up.
+	orc.Breaker = &gorc2.CircuitBreaker{}
+
+	// A replica with READ_ONLY set, such as one serving only the public
+	// frontend, can not change data. It runs none of the scheduled jobs,
+	// job workers or analytics, which all write, and requests that write
+	// fail.
+	if readOnly := os.Getenv("READ_ONLY"); readOnly != "" {
+		b, err := strconv.ParseBool(readOnly)
+		if err != nil {
+			log.Fatalf("Invalid READ_ONLY %q.", readOnly)
+		}
+		orc.ReadOnly = b
+	}
+
+	// Identify this deployment to Orchestrate.
+	appVersion = os.Getenv("APP_VERSION")
+	if appVersion == "" {
+		appVersion = "dev"
+	}
+	orc.SetAppInfo("uk-chargepoints", appVersion)
+	store = model.NewStore(orc)
+
+	// Log every query made to Orchestrate along with the trace it belongs
+	// to if tracing is enabled.
+	if os.Getenv("TRACE") != "" {
+		orc.Tracer = logTracer{}
+	}
+
+	// Settings operators may tune while the app runs, reloaded on SIGHUP or
+	// by POST /api/config/reload.
+	configFile = os.Getenv("CONFIG_FILE")
+	if _, err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	go reloadOnHangup()
+
+	// Keep the responses served while Orchestrate is unreachable across
+	// restarts if FALLBACK_FILE is set.
+	if lastGoodFile = os.Getenv("FALLBACK_FILE"); lastGoodFile != "" {
+		n, err := lastGood.Load(lastGoodFile)
+		if err != nil {
+			log.Fatalf("Unable to read %s: %s", lastGoodFile, err)
+		}
+		log.Printf("Loaded %d fallback responses.", n)
+		go saveLastGood()
+	}
+
+	// Campaign before starting the scheduled jobs, so that a replica
+	// running alone does not skip their first run. Read only replicas never
+	// lead, so they skip them all.
+	scheduler.Client = orc
+	if !orc.ReadOnly {
+		if _, err := scheduler.Campaign(); err != nil {
+			log.Printf("Unable to campaign for %s: %s", scheduler.Name, err)
+		}
+		go scheduler.Run(nil)
+	}
+
+	publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+
+	if u := os.Getenv("POSTCODES_URL"); u != "" {
+		postcodesURL = strings.TrimSuffix(u, "/")
+	}
+
+	datasetStore = storeFromEnv("PUBLISH")
+	if u := os.Getenv("PUBLISH_BASE_URL"); u != "" {
+		publishBaseURL = strings.TrimSuffix(u, "/") + "/"
+	}
+	if datasetStore != nil {
+		go publishDatasets()
+	}
+
+	attachmentStore = storeFromEnv("ATTACHMENT")
+
+	go takeSnapshots()
+	if backupStore = storeFromEnv("BACKUP"); backupStore != nil {
+		go takeBackups()
+	}
+
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	go watchWebhooks()
+	go runSavedSearches()
+
+	if salt := os.Getenv("ANALYTICS_SALT"); salt != "" {
+		analyticsSalt = salt
+	}
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		cursors = cursor.NewSigner(secret)
+	}
+	recordAnalytics := !orc.ReadOnly
+	if enabled := os.Getenv("ANALYTICS"); enabled != "" {
+		b, err := strconv.ParseBool(enabled)
+		if err != nil {
+			log.Fatalf("Invalid ANALYTICS %q.", enabled)
+		}
+		recordAnalytics = b && !orc.ReadOnly
+	}
+	if recordAnalytics {
+		searchRecorder = analytics.NewRecorder(orc, 1000)
+		go rollupAnalytics()
+		viewCounter = analytics.NewViewCounter(orc)
+		go flushViews()
+	}
+
+	if required := os.Getenv("REQUIRE_API_KEY"); required != "" {
+		b, err := strconv.ParseBool(required)
+		if err != nil {
+			log.Fatalf("Invalid REQUIRE_API_KEY %q.", required)
+		}
+		apiKeysRequired = b
+	}
+	apiKeyCache.Client = orc
+	go sweepAPIKeyCache()
+
+	if !orc.ReadOnly {
+		go sweepIdempotencyKeys()
+	}
+
+	if workers := os.Getenv("JOB_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid JOB_WORKERS %q.", workers)
+		}
+		jobWorkers = n
+	}
+	if jobWorkers > 0 && !orc.ReadOnly {
+		go runJobs()
+	}
+
+	if u := os.Getenv("BUS_URL"); u != "" {
+		p, err := bus.Open(u)
+		if err != nil {
+			log.Fatal(err)
+		}
+		forwarder.Publisher = p
+		if types := os.Getenv("BUS_TYPES"); types != "" {
+			forwarder.Types = strings.Split(types, ",")
+		}
+		forwarder.Prefix = os.Getenv("BUS_PREFIX")
+		go forwardChanges()
+	}
+
+	serve(&http.Server{
+		Addr:              ":" + os.Getenv("PORT"),
+		Handler:           newHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	})
+	if viewCounter != nil {
+		if _, err := viewCounter.Flush(); err != nil {
+			log.Printf("Unable to count views: %s", err)
+		}
+	}
+	if lastGoodFile != "" {
+		if err := lastGood.Save(lastGoodFile); err != nil {
+			log.Printf("Unable to save fallback responses: %s", err)
+		}
+	}
 }
 
-func search(ctx *web.Context, collection string) {
-	if host != "" {
-		orc.APIHost = host
+// Loads the sample chargepoints, operators and tariffs into orc.
+func loadSampleData() error {
+	n, err := devdata.LoadSeed(orc.Collection(model.ChargePoints))
+	if err != nil {
+		return fmt.Errorf("Unable to load sample data: %s", err)
+	}
+	log.Printf("Loaded %d sample chargepoints.", n)
+	if n, err = devdata.LoadOperators(model.NewStore(orc)); err != nil {
+		return fmt.Errorf("Unable to load sample operators: %s", err)
+	}
+	log.Printf("Loaded %d sample operators.", n)
+	if n, err = devdata.LoadTariffs(model.NewStore(orc)); err != nil {
+		return fmt.Errorf("Unable to load sample tariffs: %s", err)
+	}
+	log.Printf("Priced %d sample chargepoints.", n)
+	if n, err = suggest.Build(orc, model.ChargePoints); err != nil {
+		return fmt.Errorf("Unable to index sample names: %s", err)
+	}
+	log.Printf("Indexed %d sample names.", n)
+	return nil
+}
+
+// Returns the handler of every route, wrapped in the middleware the API is
+// served with. It must only be called once, as the routes are added to
+// routeTable.
+func newHandler() http.Handler {
+	// Routes are matched in the order they are registered, so the search
+	// endpoint, which matches any collection, comes last. Anything else is
+	// looked for in the static directory.
+	routes := router.NewMux()
+	routes.NotFound = http.FileServer(http.Dir("static"))
+	referenceRoutes(routes)
+	datasetRoutes(routes)
+	graphqlRoutes(routes)
+	webhookRoutes(routes)
+	jobRoutes(routes)
+	apiKeyRoutes(routes)
+	analyticsRoutes(routes)
+	suggestRoutes(routes)
+	alertRoutes(routes)
+	snapshotRoutes(routes)
+	reportRoutes(routes)
+	attachmentRoutes(routes)
+	configRoutes(routes)
+	catalogRoutes(routes)
+	handleRoutes(routes, route{
+		method: "GET", pattern: "/api/{collection}/bbox",
+		timeout: searchTimeout, handler: fallsBack("bbox", bbox),
+		tag:     "search",
+		summary: "Returns the records within a bounding box.",
+		params: append([]openapi.Param{
+			{Name: "north", Type: "number", Required: true},
+			{Name: "south", Type: "number", Required: true},
+			{Name: "east", Type: "number", Required: true},
+			{Name: "west", Type: "number", Required: true},
+			queryParam,
+		}, jsonAPIParams...),
+		response: BBoxResults{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}/tiles/{z}/{x}/{y}",
+		timeout: searchTimeout, handler: fallsBack("tiles", tile),
+		tag:      "search",
+		summary:  "Returns the records within a map tile.",
+		params:   append([]openapi.Param{queryParam}, jsonAPIParams...),
+		response: TileResults{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}/near",
+		timeout: searchTimeout, handler: fallsBack("near", near),
+		tag:     "search",
+		summary: "Returns the records near a point, nearest first.",
+		params: append([]openapi.Param{
+			{Name: "lat", Type: "number", Required: true},
+			{Name: "lon", Type: "number", Required: true},
+			radiusParam, queryParam,
+		}, jsonAPIParams...),
+		response: Results{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}/near-postcode",
+		timeout: searchTimeout,
+		handler: fallsBack("near-postcode", nearPostcode),
+		tag:     "search",
+		summary: "Returns the records near a postcode, nearest first.",
+		params: append([]openapi.Param{
+			{Name: "code", Description: "A UK postcode.", Required: true},
+			radiusParam, queryParam,
+		}, jsonAPIParams...),
+		response: Results{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}/{key}/status",
+		timeout: lookupTimeout, handler: status,
+		summary:  "Returns the current status of a chargepoint.",
+		response: Status{},
+	}, route{
+		method: "POST", pattern: "/api/{collection}/{key}/status",
+		timeout: lookupTimeout, handler: status, role: apikeys.Partner,
+		summary: "Records the status of a chargepoint.",
+		body:    Status{}, response: Status{},
+	}, route{
+		method: "GET", pattern: "/api/" + model.ChargePoints + "/{key}",
+		timeout: lookupTimeout, handler: getChargepoint,
+		summary:  "Returns a chargepoint.",
+		response: Result{},
+	}, route{
+		method: "GET", pattern: "/api/{collection}",
+		timeout: searchTimeout, handler: fallsBack("search", search),
+		tag: "search",
+		summary: "Searches the records of a collection, or of several " +
+			"separated by commas.",
+		params: append([]openapi.Param{
+			{Name: "query", Description: "A Lucene query.", Required: true},
+			{Name: "fuzzy", Description: "true, retry or the number of " +
+				"edits misspelt terms are matched with."},
+			{Name: "sort", Description: "The fields to sort by."},
+			{Name: "lat", Type: "number",
+				Description: "Sorts by distance from lat and lon."},
+			{Name: "lon", Type: "number"},
+			{Name: "maxPricePerkWh", Type: "number"},
+			{Name: "debug", Description: "plan to include the query plan."},
+		}, jsonAPIParams...),
+		response: Results{},
+	}, route{
+		method: "GET", pattern: "/openapi.json", timeout: lookupTimeout,
+		handler: openAPIDocument, tag: "catalog",
+		summary:  "Returns this description of the API.",
+		response: map[string]interface{}{},
+	})
+
+	return router.Chain(routes, logRequests, router.Recover,
+		compressResponses, limitBodies, checkAPIKeys, idempotentWrites)
+}
+
+// Returns the store set by the environment variables starting with prefix,
+// or nil if none is set: PREFIX_DIR for a local directory, PREFIX_S3_BUCKET
+// and PREFIX_S3_REGION for S3, with PREFIX_S3_ENDPOINT for other S3
+// compatible services, or PREFIX_GCS_BUCKET for Google Cloud Storage.
+func storeFromEnv(prefix string) publish.BlobStore {
+	if dir := os.Getenv(prefix + "_DIR"); dir != "" {
+		return publish.Dir(dir)
+	} else if bucket := os.Getenv(prefix + "_S3_BUCKET"); bucket != "" {
+		s3 := publish.NewS3(bucket, os.Getenv(prefix+"_S3_REGION"))
+		if endpoint := os.Getenv(prefix + "_S3_ENDPOINT"); endpoint != "" {
+			s3.Endpoint = endpoint
+		}
+		return s3
+	} else if bucket := os.Getenv(prefix + "_GCS_BUCKET"); bucket != "" {
+		gcs, err := publish.NewGCS(bucket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return gcs
 	}
+	return nil
+}
 
+func search(ctx *Context) {
+	collection := ctx.Request.PathValue("collection")
+	start := time.Now()
 	ctx.ContentType("json")
-	ctx.SetHeader("Access-Control-Allow-Origin", "*", true)
+	allowOrigin(ctx)
 
 	query := ctx.Params["query"]
 
-	var err error
+	// Misspelt terms of the query are matched with fuzzy set to true, or to
+	// the number of edits allowed. Set to retry the query is first run as
+	// given and only made fuzzy if nothing matches.
+	fuzzy, retry, distance := false, false, 0
+	switch f := ctx.Params["fuzzy"]; f {
+	case "":
+	case "retry":
+		retry = true
+	default:
+		var err error
+		if fuzzy, err = strconv.ParseBool(f); err != nil {
+			distance, err = strconv.Atoi(f)
+			if err != nil || distance < 1 || distance > 2 {
+				ctx.Abort(400, "Fuzzy must be true, false, retry, 1 or 2.")
+				return
+			}
+			fuzzy = true
+		}
+	}
+	if fuzzy && query != "" {
+		query = gorc2.Fuzzify(query, distance)
+	}
 
-	c := orc.Collection(collection)
+	// Only return chargepoints with a tariff at or below the given price per
+	// kWh.
+	withFilters := func(query string) string { return query }
+	if p := ctx.Params["maxPricePerkWh"]; p != "" {
+		max, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			ctx.Abort(400, "Invalid maxPricePerkWh.")
+			return
+		}
+		withFilters = func(query string) string {
+			q := gorc2.NewQuery().AtMost("value."+model.MinPriceField, max)
+			if query != "" {
+				q.Raw("(" + query + ")")
+			}
+			return q.String()
+		}
+	}
 
 	searchParms := &gorc2.SearchQuery{
 		Limit: int(100),
 		Sort:  ctx.Params["sort"],
 	}
 
-	it := c.Search(query, searchParms)
+	// The queries run are added to the response with debug=plan, and logged
+	// if tracing is enabled, to help find out why a search is slow or
+	// matches nothing.
+	var plans []*searchPlan
+	debug := ctx.Params["debug"] == "plan"
 
-	results := Results{}
+	run := func(query string) ([]Result, error) {
+		// A comma separated list of collections searches all of them at
+		// once, merging the results by score.
+		var it *gorc2.Iterator
+		if names := strings.Split(strings.TrimSuffix(collection, "/"), ","); len(names) > 1 {
+			searchParms.Sort = ""
+			it = orc.MultiSearchContext(traceContext(ctx.Request), names,
+				query, searchParms)
+		} else {
+			it = orc.Collection(collection).
+				WithContext(traceContext(ctx.Request)).
+				Search(query, searchParms)
+		}
 
-	for i := 0; it.Next(); i++ {
-		if it.Error != nil {
-			err = it.Error
-			break
+		// Return the chargepoints nearest to the given point first unless
+		// some other order was asked for.
+		lat, latErr := strconv.ParseFloat(ctx.Params["lat"], 64)
+		lon, lonErr := strconv.ParseFloat(ctx.Params["lon"], 64)
+		if latErr == nil && lonErr == nil && searchParms.Sort == "" {
+			it = it.SortByDistanceFrom(locationField, lat, lon)
 		}
 
-		result := Result{}
+		defer func() {
+			plan := it.Plan()
+			if debug {
+				plans = append(plans, newSearchPlan(plan))
+			}
+			if orc.Tracer != nil {
+				log.Println(plan)
+			}
+		}()
 
-		if _, err := it.Get(&result.Value); err != nil {
-			log.Println(err)
-			break
+		var results []Result
+		for it.Next() {
+			raw := it.Raw()
+			results = append(results, Result{
+				Collection: raw.Collection,
+				Key:        raw.Key,
+				Ref:        raw.Ref,
+				Value:      raw.Value,
+			})
 		}
+		return results, it.Error
+	}
 
-		results.Results = append(results.Results, result)
+	results := Results{}
+	var err error
+	results.Results, err = run(withFilters(query))
+	if err == nil && retry && len(results.Results) == 0 && query != "" {
+		if relaxed := gorc2.Fuzzify(query, 0); relaxed != query {
+			results.Results, err = run(withFilters(relaxed))
+			results.Relaxed = true
+		}
 	}
 
 	results.Count = len(results.Results)
+	results.Plans = plans
+	if err == nil {
+		recordSearch(ctx, "search", collection, results.Count, start)
+		if notModified(ctx, resultsETag(ctx, results.Results)) {
+			return
+		}
+	}
+	transformResults(ctx, strings.TrimSuffix(collection, "/"), results.Results)
+	if wantsJSONAPI(ctx) {
+		writeAPIChargepoints(ctx, strings.TrimSuffix(collection, "/"),
+			results.Results, err)
+		return
+	}
 
 	buf := new(bytes.Buffer)
 	encoder := json.NewEncoder(buf)
 
 	if err != nil {
+		ctx.WriteHeader(502)
 		encoder.Encode(err)
 		log.Println(err)
 	} else {
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/model"
+	"chargepoints/quality"
+	"chargepoints/reports"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Serves the API against the in-memory backend loaded with the sample
+// data.
+var server *httptest.Server
+
+const (
+	// Sent as the admin token by requests that need one.
+	testAdminToken = "test-admin-token"
+
+	// A sample chargepoint at Manchester Piccadilly, and the operator of
+	// another.
+	piccadilly  = "07da860c55fa73de3fa5cb93aa1480ef"
+	canaryWharf = "canary-wharf-group"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	orc = gorc2.NewLocalClient()
+	if err := loadSampleData(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	store = model.NewStore(orc)
+	apiKeyCache.Client = orc
+	if _, err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	adminToken = testAdminToken
+
+	server = httptest.NewServer(newHandler())
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+// Makes a request of the server, with a JSON body if body is not empty,
+// and returns the response and its body.
+func request(
+	t *testing.T, method, path string, header map[string]string, body string,
+) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path,
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// Makes a request that should succeed with the given status and decodes
+// its JSON body into value.
+func requestJSON(
+	t *testing.T, method, path string, header map[string]string, body string,
+	status int, value interface{},
+) *http.Response {
+	t.Helper()
+	resp, data := request(t, method, path, header, body)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s returned %d, expected %d: %s", method, path,
+			resp.StatusCode, status, data)
+	}
+	if value != nil {
+		if err := json.Unmarshal(data, value); err != nil {
+			t.Fatalf("%s %s returned invalid JSON: %s", method, path, err)
+		}
+	}
+	return resp
+}
+
+// Returns the ChargeDeviceId of each result.
+func resultIDs(t *testing.T, results Results) []string {
+	t.Helper()
+	ids := make([]string, len(results.Results))
+	for i, r := range results.Results {
+		var value struct{ ChargeDeviceId string }
+		if err := json.Unmarshal(r.Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = value.ChargeDeviceId
+	}
+	return ids
+}
+
+// Returns the admin token as an Authorization header.
+func adminHeader() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + testAdminToken}
+}
+
+func TestSearch(t *testing.T) {
+	var results Results
+	requestJSON(t, "GET", "/api/ChargePoints?query=Piccadilly", nil, "", 200,
+		&results)
+	if ids := resultIDs(t, results); len(ids) != 1 || ids[0] != piccadilly {
+		t.Errorf("search returned %v, expected [%s]", ids, piccadilly)
+	}
+
+	var all Results
+	requestJSON(t, "GET", "/api/ChargePoints?query=*", nil, "", 200, &all)
+	if all.Count < 2 || all.Count != len(all.Results) {
+		t.Errorf("search of everything returned %d results, count %d",
+			len(all.Results), all.Count)
+	}
+}
+
+func TestNear(t *testing.T) {
+	var results Results
+	requestJSON(t, "GET",
+		"/api/ChargePoints/near?lat=53.47&lon=-2.23&radius=10", nil, "", 200,
+		&results)
+	if ids := resultIDs(t, results); len(ids) == 0 || ids[0] != piccadilly {
+		t.Errorf("near returned %v, expected %s first", ids, piccadilly)
+	}
+
+	resp, _ := request(t, "GET",
+		"/api/ChargePoints/near?lat=53.47&lon=-2.23&radius=500", nil, "")
+	if resp.StatusCode != 400 {
+		t.Errorf("too large a radius returned %d, expected 400",
+			resp.StatusCode)
+	}
+}
+
+func TestOperatorChargepoints(t *testing.T) {
+	var results Results
+	requestJSON(t, "GET", "/api/operators/"+canaryWharf+"/chargepoints",
+		nil, "", 200, &results)
+	if len(results.Results) == 0 {
+		t.Fatalf("%s has no chargepoints", canaryWharf)
+	}
+	for _, r := range results.Results {
+		var value struct {
+			DeviceOwner struct{ OrganisationName string }
+		}
+		json.Unmarshal(r.Value, &value)
+		if value.DeviceOwner.OrganisationName != "Canary Wharf Group" {
+			t.Errorf("%s has a chargepoint of %q", canaryWharf,
+				value.DeviceOwner.OrganisationName)
+		}
+	}
+
+	resp, _ := request(t, "GET", "/api/operators/nobody/chargepoints", nil,
+		"")
+	if resp.StatusCode != 404 {
+		t.Errorf("unknown operator returned %d, expected 404",
+			resp.StatusCode)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	var reply struct {
+		Data struct {
+			Chargepoint struct {
+				Key      string
+				Operator struct{ Name string }
+			}
+		}
+		Errors []interface{}
+	}
+	body, _ := json.Marshal(map[string]string{"query": `{ chargepoint(key: "` +
+		piccadilly + `") { key operator { name } } }`})
+	requestJSON(t, "POST", "/graphql", nil, string(body), 200, &reply)
+	if len(reply.Errors) > 0 {
+		t.Fatalf("query failed: %v", reply.Errors)
+	}
+	if cp := reply.Data.Chargepoint; cp.Key != piccadilly ||
+		cp.Operator.Name != "Transport for Greater Manchester" {
+		t.Errorf("query returned %+v", cp)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	path := "/api/ChargePoints/" + piccadilly
+	resp := requestJSON(t, "GET", path, nil, "", 200, nil)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("chargepoint has no ETag")
+	}
+	resp, data := request(t, "GET", path,
+		map[string]string{"If-None-Match": etag}, "")
+	if resp.StatusCode != 304 || len(data) != 0 {
+		t.Errorf("matching If-None-Match returned %d with %d bytes",
+			resp.StatusCode, len(data))
+	}
+	resp, _ = request(t, "GET", path,
+		map[string]string{"If-None-Match": `"other"`}, "")
+	if resp.StatusCode != 200 {
+		t.Errorf("other If-None-Match returned %d", resp.StatusCode)
+	}
+
+	search := "/api/ChargePoints?query=Piccadilly"
+	etag = requestJSON(t, "GET", search, nil, "", 200, nil).Header.Get("ETag")
+	resp, _ = request(t, "GET", search,
+		map[string]string{"If-None-Match": etag}, "")
+	if resp.StatusCode != 304 {
+		t.Errorf("search with its ETag returned %d", resp.StatusCode)
+	}
+}
+
+func TestJSONAPIEnvelope(t *testing.T) {
+	var doc struct {
+		Data []struct {
+			Type       string
+			ID         string
+			Attributes json.RawMessage
+		}
+	}
+	for _, header := range []map[string]string{
+		{"Accept": jsonAPIMediaType}, nil,
+	} {
+		path := "/api/ChargePoints?query=Piccadilly"
+		if header == nil {
+			path += "&format=jsonapi"
+		}
+		resp := requestJSON(t, "GET", path, header, "", 200, &doc)
+		if ct := resp.Header.Get("Content-Type"); ct != jsonAPIMediaType {
+			t.Errorf("%s returned %s", path, ct)
+		}
+		if len(doc.Data) != 1 || doc.Data[0].Type != "chargepoints" ||
+			doc.Data[0].ID != piccadilly ||
+			len(doc.Data[0].Attributes) == 0 {
+			t.Errorf("%s returned %+v", path, doc.Data)
+		}
+	}
+}
+
+func TestStatusEvents(t *testing.T) {
+	path := "/api/ChargePoints/" + piccadilly + "/status"
+	var got Status
+	requestJSON(t, "POST", path, adminHeader(), `{"status": "occupied"}`,
+		200, &got)
+	if got.Status != "occupied" {
+		t.Errorf("update returned %q", got.Status)
+	}
+	got = Status{}
+	requestJSON(t, "GET", path, nil, "", 200, &got)
+	if got.Status != "occupied" || got.Stale {
+		t.Errorf("status is %+v after update", got)
+	}
+
+	// The update is recorded as an event, read here through GraphQL.
+	var reply struct {
+		Data struct {
+			Chargepoint struct {
+				Events []struct {
+					Type  string
+					Value json.RawMessage
+				}
+			}
+		}
+		Errors []interface{}
+	}
+	query, _ := json.Marshal(map[string]string{"query": `{ chargepoint(key: "` +
+		piccadilly + `") { events(type: "status") { type value } } }`})
+	requestJSON(t, "POST", "/graphql", nil, string(query), 200, &reply)
+	events := reply.Data.Chargepoint.Events
+	if len(reply.Errors) > 0 || len(events) == 0 ||
+		events[0].Type != statusEventType ||
+		!strings.Contains(string(events[0].Value), "occupied") {
+		t.Errorf("events are %+v, errors %v", events, reply.Errors)
+	}
+
+	resp, _ := request(t, "POST", path, adminHeader(), `{"status": "gone"}`)
+	if resp.StatusCode != 400 {
+		t.Errorf("unknown status returned %d, expected 400",
+			resp.StatusCode)
+	}
+}
+
+func TestReportsBesideQualityReport(t *testing.T) {
+	err := quality.Save(orc, &quality.Report{Collection: model.ChargePoints,
+		Scanned: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var submitted reports.Report
+	requestJSON(t, "POST", "/api/ChargePoints/"+piccadilly+"/reports", nil,
+		`{"kind": "broken", "message": "Will not start."}`, 201, &submitted)
+
+	var listed []*reports.Report
+	requestJSON(t, "GET", "/api/reports?status=all", adminHeader(), "", 200,
+		&listed)
+	for _, r := range listed {
+		if r.Kind == "" || r.Reference == "" {
+			t.Errorf("listed %+v, which is not a user report", r)
+		}
+	}
+	if len(listed) == 0 || listed[len(listed)-1].ID != submitted.ID {
+		t.Errorf("listed %d reports, the last is not %s", len(listed),
+			submitted.ID)
+	}
+
+	var latest quality.Report
+	requestJSON(t, "GET", "/api/Reports/quality", nil, "", 200, &latest)
+	if latest.Scanned != 1 {
+		t.Errorf("quality report is %+v after a user report", latest)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	for _, path := range []string{"/api/keys", "/v1/keys", "/api/config"} {
+		if resp, _ := request(t, "GET", path, nil, ""); resp.StatusCode != 401 {
+			t.Errorf("%s without credentials returned %d", path,
+				resp.StatusCode)
+		}
+		requestJSON(t, "GET", path, adminHeader(), "", 200, nil)
+	}
+
+	// The collections the app keeps its state in are never served.
+	for _, c := range []string{"APIKeys", "IdempotencyKeys", "Webhooks",
+		"ChargePoints,APIKeys"} {
+		resp, _ := request(t, "GET", "/api/"+c+"?query=*", adminHeader(), "")
+		if resp.StatusCode != 404 {
+			t.Errorf("%s returned %d, expected 404", c, resp.StatusCode)
+		}
+	}
+
+	status := "/api/ChargePoints/" + piccadilly + "/status"
+	body := `{"status": "available"}`
+	resp, _ := request(t, "POST", status, nil, body)
+	if resp.StatusCode != 401 {
+		t.Errorf("anonymous status update returned %d", resp.StatusCode)
+	}
+
+	var issued struct {
+		ID  string
+		Key string
+	}
+	requestJSON(t, "POST", "/api/keys", adminHeader(),
+		`{"name": "Test partner", "role": "partner"}`, 201, &issued)
+	partner := map[string]string{"X-API-Key": issued.Key}
+	requestJSON(t, "POST", status, partner, body, 200, nil)
+	resp, _ = request(t, "GET", "/api/keys", partner, "")
+	if resp.StatusCode != 403 {
+		t.Errorf("partner key listing keys returned %d", resp.StatusCode)
+	}
+
+	// Keys are cached once used, so the key revoked is a new one.
+	requestJSON(t, "POST", "/api/keys", adminHeader(),
+		`{"name": "Revoked partner", "role": "partner"}`, 201, &issued)
+	requestJSON(t, "DELETE", "/api/keys/"+issued.ID, adminHeader(), "", 200,
+		nil)
+	revoked := map[string]string{"X-API-Key": issued.Key}
+	resp, _ = request(t, "POST", status, revoked, body)
+	if resp.StatusCode != 401 {
+		t.Errorf("revoked key returned %d", resp.StatusCode)
+	}
+
+	apiKeysRequired = true
+	defer func() { apiKeysRequired = false }()
+	resp, _ = request(t, "GET", "/api/ChargePoints?query=*", nil, "")
+	if resp.StatusCode != 401 {
+		t.Errorf("search without a required key returned %d",
+			resp.StatusCode)
+	}
+}
+
+func TestIdempotentWrites(t *testing.T) {
+	path := "/api/ChargePoints/" + piccadilly + "/status"
+	header := adminHeader()
+	header["Idempotency-Key"] = "test-idempotent-writes"
+	body := `{"status": "available"}`
+
+	resp, first := request(t, "POST", path, header, body)
+	if resp.StatusCode != 200 || len(first) == 0 ||
+		resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first request returned %d, replayed %q: %s",
+			resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), first)
+	}
+	resp, data := request(t, "POST", path, header, body)
+	if resp.StatusCode != 200 ||
+		resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry returned %d, replayed %q", resp.StatusCode,
+			resp.Header.Get("Idempotent-Replayed"))
+	}
+	if string(data) != string(first) || !strings.HasPrefix(
+		resp.Header.Get("Idempotent-Digest"), "sha-256=") {
+		t.Errorf("retry returned %q with digest %q, expected %q", data,
+			resp.Header.Get("Idempotent-Digest"), first)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct,
+		"application/json") {
+		t.Errorf("retry returned Content-Type %q", ct)
+	}
+
+	resp, _ = request(t, "POST", path, header, `{"status": "occupied"}`)
+	if resp.StatusCode != 422 {
+		t.Errorf("key reused for another request returned %d, expected 422",
+			resp.StatusCode)
+	}
+
+	// Responses holding credentials are not kept.
+	header["Idempotency-Key"] = "test-issue-key"
+	var issuedFirst, issuedSecond struct{ Key string }
+	requestJSON(t, "POST", "/api/keys", header, `{"name": "Twice"}`, 201,
+		&issuedFirst)
+	requestJSON(t, "POST", "/api/keys", header, `{"name": "Twice"}`, 201,
+		&issuedSecond)
+	if issuedFirst.Key == "" || issuedFirst.Key == issuedSecond.Key {
+		t.Errorf("issuing a key twice returned %q and %q", issuedFirst.Key,
+			issuedSecond.Key)
+	}
+}
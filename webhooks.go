@@ -0,0 +1,131 @@
+package main
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/apikeys"
+	"chargepoints/router"
+	"chargepoints/webhooks"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Lists the registered webhooks. Their secrets are left out.
+func listWebhooks(ctx *Context) {
+	hooks, err := webhooks.List(orc)
+	for _, hook := range hooks {
+		hook.Secret = ""
+	}
+	writeJSON(ctx, hooks, err)
+}
+
+// Registers a webhook from a body such as {"url": "https://example.com/",
+// "collection": "ChargePoints", "key_prefix": "", "types": ["update",
+// "status"]}. The secret deliveries are signed with is generated unless one is
+// given, and is included in the response but not shown again.
+func registerWebhook(ctx *Context) {
+	var hook webhooks.Webhook
+	if !readJSON(ctx, &hook) {
+		return
+	}
+	if err := webhooks.Register(orc, &hook); err != nil {
+		ctx.Abort(400, err.Error())
+		return
+	}
+	data, _ := json.Marshal(&hook)
+	ctx.ContentType("json")
+	ctx.WriteHeader(201)
+	ctx.Write(data)
+}
+
+func getWebhook(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	hook, err := webhooks.Get(orc, id)
+	if hook != nil {
+		hook.Secret = ""
+	}
+	writeJSON(ctx, hook, err)
+}
+
+func deleteWebhook(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	if _, err := webhooks.Get(orc, id); err != nil {
+		writeJSON(ctx, nil, err)
+		return
+	}
+	writeJSON(ctx, map[string]string{"deleted": id}, webhooks.Delete(orc, id))
+}
+
+// Lists the deliveries that failed every attempt.
+func listDeadLetters(ctx *Context) {
+	deliveries, err := webhooks.DeadLettered(orc)
+	writeJSON(ctx, deliveries, err)
+}
+
+// Sends a dead lettered delivery again.
+func redeliverWebhook(ctx *Context) {
+	id := ctx.Request.PathValue("id")
+	err := webhooks.Redeliver(orc, nil, id)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		ctx.Abort(404, "Not found.")
+		return
+	} else if err != nil {
+		log.Println(err)
+		ctx.Abort(502, "Redelivery failed: "+err.Error())
+		return
+	}
+	writeJSON(ctx, map[string]string{"redelivered": id}, nil)
+}
+
+// Queues the deliveries of changes to watched collections when called and
+// then every schedules.webhooks, for runJobs() to make, if this replica
+// leads the scheduler.
+func watchWebhooks() {
+	w := &webhooks.Watcher{Client: orc, Queue: true}
+	for {
+		if scheduler.IsLeader() {
+			if n, err := w.Poll(); err != nil {
+				log.Printf("Webhook watcher failed: %s", err)
+			} else if n > 0 {
+				log.Printf("Queued %d webhook notifications.", n)
+			}
+		}
+		time.Sleep(conf().Schedules.Webhooks)
+	}
+}
+
+// Registers the webhook admin endpoints. These must be registered before
+// the search endpoint.
+func webhookRoutes(r router.Router) {
+	handleRoutes(r, route{
+		method: "GET", pattern: "/api/webhooks/dead-letters",
+		timeout: lookupTimeout, handler: listDeadLetters, role: apikeys.Admin,
+		summary:  "Lists the deliveries that failed every attempt.",
+		response: []*webhooks.Delivery{},
+	}, route{
+		method: "POST", pattern: "/api/webhooks/dead-letters/{id}/redeliver",
+		timeout: searchTimeout, handler: redeliverWebhook, role: apikeys.Admin,
+		summary:  "Sends a dead lettered delivery again.",
+		response: map[string]string{},
+	}, route{
+		method: "GET", pattern: "/api/webhooks", timeout: lookupTimeout,
+		handler: listWebhooks, role: apikeys.Admin,
+		summary:  "Lists the registered webhooks.",
+		response: []*webhooks.Webhook{},
+	}, route{
+		method: "POST", pattern: "/api/webhooks", timeout: lookupTimeout,
+		handler: registerWebhook, role: apikeys.Admin,
+		summary: "Registers a webhook.",
+		body:    webhooks.Webhook{}, response: webhooks.Webhook{}, status: 201,
+	}, route{
+		method: "GET", pattern: "/api/webhooks/{id}", timeout: lookupTimeout,
+		handler: getWebhook, role: apikeys.Admin,
+		summary:  "Returns a webhook.",
+		response: webhooks.Webhook{},
+	}, route{
+		method: "DELETE", pattern: "/api/webhooks/{id}",
+		timeout: lookupTimeout, handler: deleteWebhook, role: apikeys.Admin,
+		summary:  "Deletes a webhook.",
+		response: map[string]string{},
+	})
+}
@@ -0,0 +1,103 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The headers sent with each delivery. The signature is
+// "sha256=" followed by the hex HMAC-SHA256, keyed with the webhook's
+// secret, of the timestamp header, a dot and the body. Receivers should
+// check it and reject old timestamps to stop replays.
+const (
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// Returns the signature of a delivery body sent at the given Unix time.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Posts changes to webhooks.
+type Sender struct {
+	// Defaults to a client with a 10 second timeout.
+	Client *http.Client
+
+	// The number of times a delivery is attempted before giving up.
+	// Defaults to 5.
+	MaxAttempts int
+
+	// The wait before the first retry, doubling after each. Defaults to a
+	// second.
+	Backoff time.Duration
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Posts a change to a webhook, retrying until it is accepted with a 2xx
+// status or MaxAttempts have been made. Returns the number of attempts made
+// and the error of the last one if none succeeded.
+func (s *Sender) Deliver(w *Webhook, c *Change) (int, error) {
+	client, maxAttempts, backoff := defaultClient, 5, time.Second
+	if s != nil {
+		if s.Client != nil {
+			client = s.Client
+		}
+		if s.MaxAttempts > 0 {
+			maxAttempts = s.MaxAttempts
+		}
+		if s.Backoff > 0 {
+			backoff = s.Backoff
+		}
+	}
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+	for attempt := 1; ; attempt++ {
+		err = post(client, w, deliveryID(w, c), body)
+		if err == nil || attempt == maxAttempts {
+			return attempt, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Makes a single delivery attempt.
+func post(client *http.Client, w *Webhook, id string, body []byte) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, id)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(w.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook %s returned %s.", w.ID, resp.Status)
+	}
+	return nil
+}
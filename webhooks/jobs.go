@@ -0,0 +1,67 @@
+package webhooks
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/jobs"
+	"context"
+	"encoding/json"
+)
+
+// The type of the jobs a Watcher queues with Queue set, each delivering
+// changes to one webhook.
+const JobType = "webhook_delivery"
+
+// The payload of a JobType job.
+type delivery struct {
+	Webhook string    `json:"webhook"`
+	Changes []*Change `json:"changes"`
+}
+
+// Queues a job for each webhook delivering the changes it matches, and
+// returns the number of deliveries queued.
+func (w *Watcher) enqueue(hooks []*Webhook, changes []*Change) (int, error) {
+	queued := 0
+	for _, hook := range hooks {
+		d := &delivery{Webhook: hook.ID}
+		for _, c := range changes {
+			if hook.matches(c) {
+				d.Changes = append(d.Changes, c)
+			}
+		}
+		if len(d.Changes) == 0 {
+			continue
+		}
+		if _, err := jobs.Enqueue(w.Client, JobType, d, 0); err != nil {
+			return queued, err
+		}
+		queued += len(d.Changes)
+	}
+	return queued, nil
+}
+
+// Runs a JobType job, making its deliveries in order and dead lettering
+// those that fail every attempt. The job is retried if a failure can not
+// be dead lettered, and receivers see a delivery made again with the same
+// delivery ID. Jobs for webhooks that have since been deleted do nothing.
+func (w *Watcher) HandleJob(ctx context.Context, job *jobs.Job) (
+	interface{}, error,
+) {
+	var d delivery
+	if err := json.Unmarshal(job.Payload, &d); err != nil {
+		return nil, err
+	}
+	hook, err := Get(w.Client, d.Webhook)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		return map[string]int{"delivered": 0}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	n, err := w.deliverTo(hook, d.Changes)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{
+		"delivered":     n,
+		"dead_lettered": len(d.Changes) - n,
+	}, nil
+}
@@ -0,0 +1,250 @@
+package webhooks
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Finds changes to the collections webhooks are registered for and
+// delivers them. Orchestrate has no change feed, so writes are found with
+// ListUpdatedSince() and the events of items that were written are then
+// listed for the event types webhooks want. Events are therefore only seen
+// when the item they are added to is also written, as this app does for
+// status and merge events. Changes only show up once they are indexed, and
+// items deleted outright are not seen.
+type Watcher struct {
+	Client *gorc2.Client
+
+	// Sends the deliveries. A nil Sender uses the defaults.
+	Sender *Sender
+
+	// If set, Poll() queues the deliveries to each webhook as a job of
+	// JobType instead of making them, for HandleJob() to make wherever a
+	// jobs.Pool runs.
+	Queue bool
+}
+
+// The checkpoint of a collection stored in State.
+type checkpoint struct {
+	RefTime int64 `json:"reftime"`
+}
+
+// Delivers the changes made since the last call to every webhook they
+// match, or queues them, and returns the number of deliveries made or
+// queued. Deliveries to a webhook
+// are made in order, with webhooks delivered to concurrently, and those
+// that fail every attempt are dead lettered. The first call for a
+// collection only records where to start from. Poll() must not be called
+// concurrently.
+func (w *Watcher) Poll() (int, error) {
+	webhooks, err := List(w.Client)
+	if err != nil {
+		return 0, err
+	}
+	byCollection := make(map[string][]*Webhook)
+	for _, hook := range webhooks {
+		byCollection[hook.Collection] = append(byCollection[hook.Collection],
+			hook)
+	}
+
+	delivered := 0
+	for collection, hooks := range byCollection {
+		n, err := w.poll(collection, hooks)
+		delivered += n
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// Calls Poll() every interval of the client's Clock until stop is closed,
+// logging failures.
+func (w *Watcher) Run(interval time.Duration, stop <-chan struct{}) {
+	for {
+		if n, err := w.Poll(); err != nil {
+			log.Printf("Webhook watcher failed: %s", err)
+		} else if n > 0 {
+			log.Printf("Delivered %d webhook notifications.", n)
+		}
+		select {
+		case <-w.Client.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Delivers the changes to one collection.
+func (w *Watcher) poll(collection string, hooks []*Webhook) (int, error) {
+	state := w.Client.Collection(State)
+	key := keys.Build(keys.WebhookCheckpoint, collection)
+	var cp checkpoint
+	_, err := state.Get(key, &cp)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		// Checkpoints were keyed "checkpoint_COLLECTION" before package
+		// keys, carry them over so no changes are skipped.
+		_, err = state.Get("checkpoint_"+collection, &cp)
+	}
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		cp.RefTime = w.Client.Now().UnixMilli()
+		_, err = state.Update(key, &cp)
+		return 0, err
+	} else if err != nil {
+		return 0, err
+	}
+
+	var eventTypes []string
+	seen := make(map[string]bool)
+	for _, hook := range hooks {
+		for _, typ := range hook.types() {
+			if typ != UpdateType && !seen[typ] {
+				seen[typ] = true
+				eventTypes = append(eventTypes, typ)
+			}
+		}
+	}
+
+	changes, latest, err := ListChanges(w.Client.Collection(collection),
+		time.UnixMilli(cp.RefTime), eventTypes)
+	if err != nil {
+		return 0, err
+	}
+	delivered, err := w.deliver(hooks, changes)
+	if err != nil || latest.UnixMilli() == cp.RefTime {
+		return delivered, err
+	}
+	cp.RefTime = latest.UnixMilli()
+	_, err = state.Update(key, &cp)
+	return delivered, err
+}
+
+// Returns the changes to a collection made after since: an UpdateType
+// change for each item written, followed by its events of the given types.
+// Also returns the time of the latest write, or since if there were none,
+// to pass as since the next time. See Watcher for which changes are found.
+func ListChanges(
+	c *gorc2.Collection, since time.Time, eventTypes []string,
+) ([]*Change, time.Time, error) {
+	latest := since.UnixMilli()
+	var changes []*Change
+	it := c.ListUpdatedSince(since)
+	for it.Next() {
+		raw := it.Raw()
+		if raw.RefTime > latest {
+			latest = raw.RefTime
+		}
+		changes = append(changes, &Change{
+			ID:         changeID(c.Name, raw.Key, raw.Ref),
+			Type:       UpdateType,
+			Collection: c.Name,
+			Key:        raw.Key,
+			Ref:        raw.Ref,
+			Timestamp:  time.UnixMilli(raw.RefTime).UTC(),
+			Value:      raw.Value,
+		})
+
+		for _, typ := range eventTypes {
+			events := c.ListEvents(raw.Key, typ, &gorc2.ListEventsQuery{
+				Limit: 100,
+				After: since,
+			})
+			for events.Next() {
+				event, err := events.GetEvent(nil)
+				if err != nil {
+					return nil, since, err
+				}
+				changes = append(changes,
+					EventChange(c.Name, raw.Key, typ, event))
+			}
+			if events.Error != nil {
+				return nil, since, events.Error
+			}
+		}
+	}
+	if it.Error != nil {
+		return nil, since, it.Error
+	}
+	return changes, time.UnixMilli(latest), nil
+}
+
+// Returns the change of an event of the given type added to an item.
+func EventChange(collection, key, typ string, e *gorc2.Event) *Change {
+	return &Change{
+		ID: changeID(collection, key, typ,
+			fmt.Sprint(e.Timestamp.UnixMilli()), e.OrdinalStr),
+		Type:       typ,
+		Collection: collection,
+		Key:        key,
+		Ref:        e.Ref,
+		Timestamp:  e.Timestamp.UTC(),
+		Value:      e.Value,
+	}
+}
+
+// Delivers each change to the webhooks it matches.
+func (w *Watcher) deliver(hooks []*Webhook, changes []*Change) (int, error) {
+	if w.Queue {
+		return w.enqueue(hooks, changes)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	delivered := 0
+	var firstErr error
+	for _, hook := range hooks {
+		wg.Add(1)
+		go func(hook *Webhook) {
+			defer wg.Done()
+			n, err := w.deliverTo(hook, changes)
+			mu.Lock()
+			delivered += n
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+		}(hook)
+	}
+	wg.Wait()
+	return delivered, firstErr
+}
+
+// Delivers the changes a webhook matches to it in order, dead lettering
+// those that fail every attempt. Returns the number delivered and the first
+// error dead lettering.
+func (w *Watcher) deliverTo(hook *Webhook, changes []*Change) (int, error) {
+	delivered := 0
+	var firstErr error
+	for _, c := range changes {
+		if !hook.matches(c) {
+			continue
+		}
+		attempts, err := w.Sender.Deliver(hook, c)
+		if err == nil {
+			delivered++
+			continue
+		}
+		log.Printf("Dead lettering delivery of %s to webhook %s: %s",
+			c.ID, hook.ID, err)
+		err = deadLetter(w.Client, hook, c, attempts, err)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return delivered, firstErr
+}
+
+// Returns an ID for a change that is safe to use in keys.
+func changeID(parts ...string) string {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:20]
+}
@@ -0,0 +1,269 @@
+// Package webhooks notifies registered URLs of changes to collections.
+// Changes are found by a Watcher polling the collections, and delivered as
+// signed POST requests by a Sender, which retries failed deliveries and
+// keeps those that never succeed in a dead letter collection so they can be
+// sent again later.
+package webhooks
+
+import (
+	"chargepoints/Godeps/_workspace/src/github.com/liquidgecka/gorc2"
+	"chargepoints/keys"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The collections webhooks keep their data in: the registered webhooks,
+// their secrets, the deliveries that failed every attempt, and the
+// checkpoints of the Watcher. Secrets are kept apart from the webhooks so
+// that they are only read to sign deliveries.
+const (
+	Webhooks    = "Webhooks"
+	Secrets     = "WebhookSecrets"
+	DeadLetters = "WebhookDeadLetters"
+	State       = "WebhookState"
+)
+
+// The change type of writes to an item. The other change types are the
+// types of the events added to items.
+const UpdateType = "update"
+
+// A registered URL and the changes it is sent.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	// The key deliveries are signed with, see Sign(). Generated when the
+	// webhook is registered if it is empty, and stored in Secrets.
+	Secret string `json:"secret,omitempty"`
+
+	// Only changes to items in Collection whose key starts with KeyPrefix
+	// are sent, and only those of the given change types. If Types is empty
+	// only UpdateType changes are sent.
+	Collection string   `json:"collection"`
+	KeyPrefix  string   `json:"key_prefix,omitempty"`
+	Types      []string `json:"types,omitempty"`
+
+	// Changes made before the webhook was registered are never sent.
+	Created time.Time `json:"created"`
+}
+
+// Returns the change types the webhook is sent.
+func (w *Webhook) types() []string {
+	if len(w.Types) == 0 {
+		return []string{UpdateType}
+	}
+	return w.Types
+}
+
+// Returns true if the webhook should be sent a change.
+func (w *Webhook) matches(c *Change) bool {
+	if c.Collection != w.Collection || !strings.HasPrefix(c.Key, w.KeyPrefix) ||
+		c.Timestamp.Before(w.Created) {
+		return false
+	}
+	for _, typ := range w.types() {
+		if typ == c.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// A change to an item, the body of a delivery.
+type Change struct {
+	// Identifies the change, the same for every webhook it is sent to.
+	ID string `json:"id"`
+
+	// UpdateType or the type of the event added.
+	Type       string `json:"type"`
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+
+	// The ref of the item for updates, or of the event.
+	Ref string `json:"ref"`
+
+	// When the item was written or the timestamp of the event.
+	Timestamp time.Time `json:"timestamp"`
+
+	// The value of the item or of the event.
+	Value json.RawMessage `json:"value"`
+}
+
+// A delivery that failed every attempt, as stored in DeadLetters.
+type Delivery struct {
+	ID        string    `json:"id"`
+	Webhook   string    `json:"webhook"`
+	Change    *Change   `json:"change"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	Failed    time.Time `json:"failed"`
+}
+
+// The secret of a webhook, as stored in Secrets under its ID.
+type secret struct {
+	Secret string `json:"secret"`
+}
+
+// Checks and stores a new webhook, filling in its ID, secret and creation
+// time.
+func Register(client *gorc2.Client, w *Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return fmt.Errorf("Webhook URL must be an absolute http or https " +
+			"URL.")
+	} else if w.Collection == "" {
+		return fmt.Errorf("Webhook has no collection.")
+	}
+	if w.Secret == "" {
+		w.Secret = randomHex(32)
+	}
+	w.ID = randomHex(8)
+	w.Created = time.Now().UTC()
+	_, err = client.Collection(Secrets).Create(w.ID, &secret{w.Secret})
+	if err != nil {
+		return err
+	}
+	stored := *w
+	stored.Secret = ""
+	_, err = client.Collection(Webhooks).Create(w.ID, &stored)
+	return err
+}
+
+// Returns a registered webhook with its secret.
+func Get(client *gorc2.Client, id string) (*Webhook, error) {
+	w := &Webhook{}
+	if _, err := client.Collection(Webhooks).Get(id, w); err != nil {
+		return nil, err
+	}
+	s := &secret{}
+	_, err := client.Collection(Secrets).Get(id, s)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		// Registered before secrets were kept apart.
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+	w.Secret = s.Secret
+	return w, nil
+}
+
+// Returns every registered webhook with its secret, ordered by ID.
+func List(client *gorc2.Client) ([]*Webhook, error) {
+	secrets := map[string]string{}
+	it := client.Collection(Secrets).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		s := &secret{}
+		item, err := it.Get(s)
+		if err != nil {
+			return nil, err
+		}
+		secrets[item.Key] = s.Secret
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+
+	webhooks := []*Webhook{}
+	it = client.Collection(Webhooks).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		w := &Webhook{}
+		if _, err := it.Get(w); err != nil {
+			return nil, err
+		}
+		if s, ok := secrets[w.ID]; ok {
+			w.Secret = s
+		}
+		webhooks = append(webhooks, w)
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks, it.Error
+}
+
+// Removes a webhook and its secret. Its dead letters are kept.
+func Delete(client *gorc2.Client, id string) error {
+	if err := client.Collection(Webhooks).Delete(id); err != nil {
+		return err
+	}
+	err := client.Collection(Secrets).Delete(id)
+	if _, ok := err.(gorc2.NotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// Returns the deliveries that failed every attempt, oldest first.
+func DeadLettered(client *gorc2.Client) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+	it := client.Collection(DeadLetters).List(&gorc2.ListQuery{Limit: 100})
+	for it.Next() {
+		d := &Delivery{}
+		if _, err := it.Get(d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Failed.Before(deliveries[j].Failed)
+	})
+	return deliveries, it.Error
+}
+
+// Sends a dead lettered delivery again, removing it from DeadLetters if it
+// succeeds and recording the new failure if not.
+func Redeliver(client *gorc2.Client, sender *Sender, id string) error {
+	d := &Delivery{}
+	if _, err := client.Collection(DeadLetters).Get(id, d); err != nil {
+		return err
+	}
+	w, err := Get(client, d.Webhook)
+	if err != nil {
+		return err
+	}
+	attempts, err := sender.Deliver(w, d.Change)
+	if err == nil {
+		return client.Collection(DeadLetters).Delete(id)
+	}
+	d.Attempts += attempts
+	d.LastError = err.Error()
+	d.Failed = time.Now().UTC()
+	if _, err := client.Collection(DeadLetters).Update(id, d); err != nil {
+		return err
+	}
+	return err
+}
+
+// Stores a delivery that failed every attempt.
+func deadLetter(
+	client *gorc2.Client, w *Webhook, c *Change, attempts int, err error,
+) error {
+	d := &Delivery{
+		ID:        deliveryID(w, c),
+		Webhook:   w.ID,
+		Change:    c,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		Failed:    time.Now().UTC(),
+	}
+	_, err = client.Collection(DeadLetters).Update(d.ID, d)
+	return err
+}
+
+// Returns the ID of the delivery of a change to a webhook.
+func deliveryID(w *Webhook, c *Change) string {
+	return keys.Build(keys.WebhookDelivery, w.ID, c.ID)
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}